@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+var billingCmd = Cmd{
+	Name:        "billing",
+	Usage:       "billing",
+	Description: "Show what is owed to each provider",
+	Run:         runBilling,
+}
+
+func runBilling(args []string) {
+	repo, err := openRepo()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer repo.Close()
+
+	bills, err := repo.Billing()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	totals := make(map[string]int64)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 5, 3, ' ', 0)
+	fmt.Fprintln(tw, "PROVIDER\tCURRENCY\tCONTRACTS\tSTORED\tMONTHLY\tSTORAGE\tEGRESS\tTOTAL")
+	for _, bill := range bills {
+		currency := bill.Currency
+		if len(currency) == 0 {
+			currency = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\n", bill.ProviderID, currency,
+			bill.Contracts, bill.StoredBytes, formatAmount(bill.Monthly), formatAmount(bill.Storage),
+			formatAmount(bill.Egress), formatAmount(bill.Total()))
+		if len(bill.Currency) > 0 {
+			totals[bill.Currency] += bill.Total()
+		}
+	}
+	tw.Flush()
+
+	var currencies []string
+	for currency := range totals {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	for _, currency := range currencies {
+		fmt.Printf("Total owed: %s %s\n", formatAmount(totals[currency]), currency)
+	}
+}
+
+// formatAmount formats an amount in millionths of a currency unit.
+func formatAmount(amount int64) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	return fmt.Sprintf("%s%d.%06d", sign, amount/1000000, amount%1000000)
+}
@@ -2,7 +2,10 @@ package cmd
 
 import (
 	"fmt"
+	"golang.org/x/net/context"
+	"log"
 	"os"
+	"os/signal"
 	"text/tabwriter"
 )
 
@@ -19,8 +22,38 @@ var Commands = []Cmd{
 	listCmd,
 	getCmd,
 	syncCmd,
+	repairCmd,
+	providersCmd,
+	billingCmd,
 	serverCmd,
+	daemonCmd,
 	infoCmd,
+	configCmd,
+	keysCmd,
+	webdavCmd,
+	migrateBlocksCmd,
+	migrateMetadataCmd,
+}
+
+// interruptContext returns a context that is canceled when the user presses
+// Ctrl-C, so the command can stop cleanly. A second Ctrl-C exits at once.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupts := make(chan os.Signal, 2)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		select {
+		case <-interrupts:
+			log.Println("interrupted; stopping (press Ctrl-C again to exit now)")
+			cancel()
+		case <-ctx.Done():
+			signal.Stop(interrupts)
+			return
+		}
+		<-interrupts
+		os.Exit(130)
+	}()
+	return ctx, cancel
 }
 
 func Usage() {
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	skybinrepo "skybin/repo"
+)
+
+const configUsage = "config show|get <key>|set <key> <value>|validate"
+
+var configCmd = Cmd{
+	Name:        "config",
+	Usage:       configUsage,
+	Description: "View, change, or check the repo's config",
+	Run:         runConfig,
+}
+
+func runConfig(args []string) {
+	if len(args) < 1 {
+		log.Fatal("usage: ", configUsage)
+	}
+
+	homedir, err := skybinrepo.FindHomeDir()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch args[0] {
+	case "show":
+		config, err := skybinrepo.LoadConfig(homedir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		data, err := json.MarshalIndent(config, "", "    ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(data))
+	case "get":
+		if len(args) < 2 {
+			log.Fatal("must provide config key")
+		}
+		config, err := skybinrepo.LoadConfig(homedir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		value, err := config.Get(args[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(value)
+	case "set":
+		if len(args) < 3 {
+			log.Fatal("must provide config key and value")
+		}
+		setConfig(args[1], args[2])
+	case "validate":
+		_, err := skybinrepo.LoadConfig(homedir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("config is valid")
+	default:
+		log.Fatal("usage: ", configUsage)
+	}
+}
+
+// setConfig changes a setting and saves the config if it is still valid. The
+// change goes through the daemon if one is running so it takes effect there.
+func setConfig(key string, value string) {
+	repo, err := openRepo()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer repo.Close()
+
+	current := repo.Info().Config
+	if current == nil {
+		log.Fatal("cannot read repo config")
+	}
+	config := *current
+	err = config.Set(key, value)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = repo.SaveConfig(&config)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
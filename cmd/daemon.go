@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"skybin/daemon"
+	skybinrepo "skybin/repo"
+	"syscall"
+)
+
+var daemonCmd = Cmd{
+	Name:        "daemon",
+	Usage:       "daemon",
+	Description: "Run a background daemon that serves the repo to other commands",
+	Run:         runDaemon,
+}
+
+func runDaemon(args []string) {
+	repo, err := skybinrepo.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer repo.Close()
+
+	logger := log.New(os.Stdout, "", log.Ldate|log.Ltime)
+	d := daemon.New(repo, logger)
+	err = d.Listen()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Remove the socket on exit so commands stop trying to use the daemon.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		logger.Println("shutting down")
+		d.Close()
+	}()
+
+	err = d.Serve()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// openRepo connects to the repo's daemon if one is running. Otherwise the
+// repo is opened directly.
+func openRepo() (skybinrepo.Repo, error) {
+	homedir, err := skybinrepo.FindHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	client, err := daemon.Dial(homedir)
+	if err == nil {
+		return client, nil
+	}
+	return skybinrepo.OpenAt(homedir)
+}
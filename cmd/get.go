@@ -1,30 +1,74 @@
 package cmd
 
 import (
+	"flag"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
-	skybinrepo "skybin/repo"
+	"path/filepath"
 )
 
 var getCmd = Cmd{
 	Name:        "get",
 	Description: "Download a file from the skybin network",
-	Usage:       "get <file> [destfile]",
+	Usage:       "get [-offset <bytes>] [-length <bytes>] <file> [destfile]",
 	Run:         runGet,
 }
 
 func runGet(args []string) {
+	flags := flag.NewFlagSet("", flag.ExitOnError)
+	offsetFlag := flags.Int64("offset", 0, "Offset of the first byte to download")
+	lengthFlag := flags.Int64("length", -1, "Number of bytes to download. Negative downloads to the end of the file.")
+	flags.Parse(args)
+	args = flags.Args()
+
 	if len(args) < 1 {
 		log.Fatal("must provide filename")
 	}
 
-	repo, err := skybinrepo.Open()
+	repo, err := openRepo()
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer repo.Close()
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+	if len(args) < 2 {
+		err = repo.GetRange(ctx, args[0], *offsetFlag, *lengthFlag, os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	err = repo.Get(args[0], os.Stdout)
+	err = writeFileAtomic(args[1], func(out io.Writer) error {
+		return repo.GetRange(ctx, args[0], *offsetFlag, *lengthFlag, out)
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
 }
+
+// writeFileAtomic creates filename with the data written by write. The data
+// is written to a temporary file that replaces filename only if write
+// succeeds, so a failed download never leaves a partial file behind.
+func writeFileAtomic(filename string, write func(out io.Writer) error) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = write(tmp)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
@@ -2,7 +2,6 @@ package cmd
 
 import (
 	"log"
-	skybinrepo "skybin/repo"
 )
 
 var infoCmd = Cmd{
@@ -14,12 +13,16 @@ var infoCmd = Cmd{
 
 func runInfo(args []string) {
 
-	repo, err := skybinrepo.Open()
+	repo, err := openRepo()
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer repo.Close()
 
 	info := repo.Info()
+	if info.Config == nil {
+		log.Fatal("cannot read repo config")
+	}
 
 	log.Println()
 	log.Println("Home Directory:", info.HomeDir)
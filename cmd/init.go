@@ -1,14 +1,19 @@
 package cmd
 
 import (
+	"bufio"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"os"
 	"skybin/repo"
+	"strings"
 )
 
 var initCmd = Cmd{
 	Name:        "init",
-	Usage:       "init",
+	Usage:       "init [-no-passphrase] [-mnemonic|-restore-from-mnemonic]",
 	Description: "Create a new repo",
 	Run:         runInit,
 }
@@ -16,17 +21,67 @@ var initCmd = Cmd{
 func runInit(args []string) {
 	flags := flag.NewFlagSet("", flag.ExitOnError)
 	homeFlag := flags.String("home", "", "Repo home directory")
+	noPassphraseFlag := flags.Bool("no-passphrase", false, "Store private keys unencrypted")
+	mnemonicFlag := flags.Bool("mnemonic", false, "Derive keys from a new recovery phrase")
+	restoreFlag := flags.Bool("restore-from-mnemonic", false, "Derive keys from an existing recovery phrase")
 	flags.Parse(args)
 
-	if len(*homeFlag) > 0 {
-		repo.Init(*homeFlag)
-		return
+	if *mnemonicFlag && *restoreFlag {
+		log.Fatal("cannot use both -mnemonic and -restore-from-mnemonic")
 	}
 
-	homedir, err := repo.DefaultHomeDir()
-	if err != nil {
-		log.Fatal("Could not find default home dir: ", err)
+	homedir := *homeFlag
+	if len(homedir) == 0 {
+		var err error
+		homedir, err = repo.DefaultHomeDir()
+		if err != nil {
+			log.Fatal("Could not find default home dir: ", err)
+		}
 	}
 
-	repo.Init(homedir)
+	var opts repo.InitOptions
+	if *mnemonicFlag {
+		mnemonic, err := repo.NewMnemonic()
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.Mnemonic = mnemonic
+	}
+	if *restoreFlag {
+		mnemonic, err := readMnemonic()
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.Mnemonic = mnemonic
+	}
+	if !*noPassphraseFlag {
+		passphrase, err := readNewPassphrase()
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.Passphrase = passphrase
+	}
+
+	repo.InitWithOptions(homedir, opts)
+
+	if *mnemonicFlag {
+		fmt.Println("Recovery phrase (write it down and keep it safe; anyone with it can")
+		fmt.Println("access your files, and it is needed to restore the repo):")
+		fmt.Println()
+		fmt.Println("\t" + opts.Mnemonic)
+	}
+}
+
+// readMnemonic reads a recovery phrase from $SKYBIN_MNEMONIC, or from a line
+// of standard input.
+func readMnemonic() (string, error) {
+	if mnemonic, ok := os.LookupEnv("SKYBIN_MNEMONIC"); ok {
+		return mnemonic, nil
+	}
+	fmt.Fprint(os.Stderr, "Recovery phrase: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && len(line) == 0 {
+		return "", errors.New("no recovery phrase given")
+	}
+	return strings.TrimSpace(line), nil
 }
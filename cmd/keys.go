@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/term"
+	"io"
+	"log"
+	"os"
+	skybinrepo "skybin/repo"
+)
+
+const keysUsage = "keys export <file>|import <file>|change-passphrase"
+
+var keysCmd = Cmd{
+	Name:        "keys",
+	Usage:       keysUsage,
+	Description: "Export, import, or re-encrypt the repo's private keys",
+	Run:         runKeys,
+}
+
+func runKeys(args []string) {
+	if len(args) < 1 {
+		log.Fatal("usage: ", keysUsage)
+	}
+
+	homedir, err := skybinrepo.FindHomeDir()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch args[0] {
+	case "export":
+		if len(args) < 2 {
+			log.Fatal("must provide file to export keys to")
+		}
+		exportKeys(homedir, args[1])
+	case "import":
+		if len(args) < 2 {
+			log.Fatal("must provide file to import keys from")
+		}
+		importKeys(homedir, args[1])
+	case "change-passphrase":
+		changePassphrase(homedir)
+	default:
+		log.Fatal("usage: ", keysUsage)
+	}
+}
+
+func exportKeys(homedir string, filename string) {
+	encrypted, err := skybinrepo.KeysEncrypted(homedir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !encrypted {
+		log.Fatal("keys must be protected by a passphrase to be exported; run keys change-passphrase first")
+	}
+	passphrase, err := readPassphrase("Passphrase: ")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = writeFileAtomic(filename, func(out io.Writer) error {
+		return skybinrepo.ExportKeys(homedir, passphrase, out)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func importKeys(homedir string, filename string) {
+	f, err := os.Open(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	passphrase, err := readPassphrase("Passphrase of exported keys: ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = skybinrepo.ImportKeys(homedir, f, passphrase)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("imported keys; restart any running daemon to use them")
+}
+
+func changePassphrase(homedir string) {
+	encrypted, err := skybinrepo.KeysEncrypted(homedir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var oldPassphrase []byte
+	if encrypted {
+		oldPassphrase, err = readPassphrase("Current passphrase: ")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	newPassphrase, err := readNewPassphrase()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = skybinrepo.ChangePassphrase(homedir, oldPassphrase, newPassphrase)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(newPassphrase) == 0 {
+		fmt.Println("keys are now stored unencrypted")
+	}
+}
+
+func init() {
+	// Renters sign contracts and stored blocks with the user's key.
+	skybinrepo.PassphraseFunc = func() ([]byte, error) {
+		return readPassphrase("Passphrase: ")
+	}
+}
+
+// readPassphrase reads a passphrase from $SKYBIN_PASSPHRASE, or prompts
+// for one if stdin is a terminal.
+func readPassphrase(prompt string) ([]byte, error) {
+	if passphrase, ok := os.LookupEnv("SKYBIN_PASSPHRASE"); ok {
+		return []byte(passphrase), nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, errors.New("no terminal to read passphrase from; set SKYBIN_PASSPHRASE")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return passphrase, err
+}
+
+// readNewPassphrase reads a new passphrase from $SKYBIN_NEW_PASSPHRASE, or
+// prompts for it twice if stdin is a terminal. An empty passphrase means
+// keys are stored unencrypted.
+func readNewPassphrase() ([]byte, error) {
+	if passphrase, ok := os.LookupEnv("SKYBIN_NEW_PASSPHRASE"); ok {
+		return []byte(passphrase), nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, errors.New("no terminal to read passphrase from; set SKYBIN_NEW_PASSPHRASE")
+	}
+	fmt.Fprint(os.Stderr, "New passphrase: ")
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+	repeated, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(passphrase, repeated) {
+		return nil, errors.New("passphrases do not match")
+	}
+	return passphrase, nil
+}
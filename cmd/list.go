@@ -3,7 +3,6 @@ package cmd
 import (
 	"fmt"
 	"log"
-	skybinrepo "skybin/repo"
 )
 
 var listCmd = Cmd{
@@ -15,10 +14,11 @@ var listCmd = Cmd{
 
 func runList(args []string) {
 
-	repo, err := skybinrepo.Open()
+	repo, err := openRepo()
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer repo.Close()
 
 	files, err := repo.ListFiles()
 	if err != nil {
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"log"
+	"path"
+	provider "skybin/provider/local"
+	skybinrepo "skybin/repo"
+)
+
+var migrateBlocksCmd = Cmd{
+	Name:        "migrate-blocks",
+	Description: "Move stored peer blocks to a different block store",
+	Usage:       "migrate-blocks <flat|sharded|bolt>",
+	Run:         runMigrateBlocks,
+}
+
+func runMigrateBlocks(args []string) {
+	if len(args) < 1 {
+		log.Fatal("must provide block store type")
+	}
+	storeType := args[0]
+
+	repo, err := skybinrepo.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	config := *repo.Info().Config
+	current := config.BlockStore
+	if len(current) == 0 {
+		current = provider.FlatStore
+	}
+	if storeType == current {
+		log.Fatal("blocks are already stored in a ", storeType, " block store")
+	}
+
+	// The server must not serve or store blocks while they are moved.
+	unlock, err := skybinrepo.LockProvider(repo.Info().HomeDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer unlock()
+
+	dir := path.Join(repo.Info().HomeDir, "peer")
+	src, err := provider.OpenBlockStore(config.BlockStore, dir)
+	if err != nil {
+		log.Fatal("cannot open block store: ", err)
+	}
+	defer src.Close()
+
+	dst, err := provider.OpenBlockStore(storeType, dir)
+	if err != nil {
+		log.Fatal("cannot open block store: ", err)
+	}
+	defer dst.Close()
+
+	report, err := provider.CopyBlocks(src, dst)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, id := range report.Quarantined {
+		log.Println("quarantined corrupt block", id)
+	}
+	for _, id := range report.Unverified {
+		log.Println("copied block", id, "without a checksum to verify")
+	}
+	for _, id := range report.Failed {
+		log.Println("cannot copy block", id)
+	}
+	if len(report.Failed) > 0 {
+		log.Fatalf("%d blocks could not be copied; the %s block store is still in use", len(report.Failed), current)
+	}
+
+	// Switch to the new store before removing blocks from the old one so an
+	// interrupted migration never loses data.
+	config.BlockStore = storeType
+	err = repo.SaveConfig(&config)
+	if err != nil {
+		log.Fatal("cannot save config: ", err)
+	}
+
+	for _, id := range report.Copied {
+		err := src.Delete(id)
+		if err != nil {
+			log.Printf("cannot remove block %s from old store: %s", id, err)
+		}
+	}
+
+	log.Printf("migrated %d blocks to %s block store, %d quarantined",
+		len(report.Copied), storeType, len(report.Quarantined))
+}
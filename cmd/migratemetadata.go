@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"log"
+	skybinrepo "skybin/repo"
+)
+
+var migrateMetadataCmd = Cmd{
+	Name:        "migrate-metadata",
+	Description: "Rewrite cached JSON metadata in the binary format",
+	Usage:       "migrate-metadata",
+	Run:         runMigrateMetadata,
+}
+
+func runMigrateMetadata(args []string) {
+	homedir, err := skybinrepo.FindHomeDir()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	n, err := skybinrepo.MigrateMetadata(homedir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Migrated", n, "metadata blocks")
+}
@@ -0,0 +1,189 @@
+package cmd
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"log"
+	"os"
+	core "skybin/core/proto"
+	provider "skybin/provider/remote"
+	skybinrepo "skybin/repo"
+	"text/tabwriter"
+	"time"
+)
+
+const providersUsage = "providers list|add <addr> [id]|add -relay <relay addr> <id>|remove <id>|ping [id]"
+
+// infoTimeout bounds how long to wait for a provider's info.
+const infoTimeout = 10 * time.Second
+
+var providersCmd = Cmd{
+	Name:        "providers",
+	Usage:       providersUsage,
+	Description: "Manage the storage providers known to the repo",
+	Run:         runProviders,
+}
+
+func runProviders(args []string) {
+	if len(args) < 1 {
+		log.Fatal("usage: ", providersUsage)
+	}
+
+	repo, err := openRepo()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer repo.Close()
+
+	switch args[0] {
+	case "list":
+		listProviders(repo)
+	case "add":
+		if len(args) > 1 && args[1] == "-relay" {
+			if len(args) < 4 {
+				log.Fatal("must provide relay address and provider ID")
+			}
+			addProvider(repo, core.PeerInfo{ID: args[3], Relay: args[2]})
+			break
+		}
+		if len(args) < 2 {
+			log.Fatal("must provide provider address")
+		}
+		id := ""
+		if len(args) > 2 {
+			id = args[2]
+		}
+		addProvider(repo, core.PeerInfo{ID: id, Addr: args[1]})
+	case "remove":
+		if len(args) < 2 {
+			log.Fatal("must provide provider ID")
+		}
+		err := repo.RemoveProvider(args[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "ping":
+		id := ""
+		if len(args) > 1 {
+			id = args[1]
+		}
+		pingProviders(repo, id)
+	default:
+		log.Fatal("usage: ", providersUsage)
+	}
+}
+
+func listProviders(repo skybinrepo.Repo) {
+	pvdrs, err := repo.ListProviders()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	contracts, err := repo.ListContracts()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ncontracts := make(map[string]int)
+	nbytes := make(map[string]int64)
+	for _, contract := range contracts {
+		ncontracts[contract.ProviderID]++
+		nbytes[contract.ProviderID] += contract.BlockSize
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 5, 3, ' ', 0)
+	fmt.Fprintln(tw, "ID\tADDRESS\tCONTRACTS\tBYTES")
+	for _, pvdr := range pvdrs {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\n", pvdr.ID, displayAddress(pvdr), ncontracts[pvdr.ID], nbytes[pvdr.ID])
+	}
+	tw.Flush()
+}
+
+// displayAddress describes where a provider is reached.
+func displayAddress(pinfo core.PeerInfo) string {
+	if len(pinfo.Relay) > 0 {
+		return "via " + pinfo.Relay
+	}
+	return pinfo.Addr
+}
+
+// addProvider adds a provider. If no ID is given, the provider's own ID is
+// fetched from it.
+func addProvider(repo skybinrepo.Repo, pinfo core.PeerInfo) {
+	addr := pinfo.Addr
+	if len(pinfo.Relay) > 0 {
+		addr = pinfo.Relay
+	}
+	err := skybinrepo.ValidateAddress(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(pinfo.ID) == 0 {
+		ctx, cancel := interruptContext()
+		info, _, err := fetchProviderInfo(ctx, pinfo)
+		cancel()
+		if err != nil {
+			log.Fatalf("cannot get provider info from %s: %s", addr, err)
+		}
+		pinfo.ID = info.ID
+	}
+
+	err = repo.AddProvider(pinfo)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("added provider", pinfo.ID)
+}
+
+// pingProviders fetches and prints the info of the provider with the given
+// ID, or of every provider if id is empty.
+func pingProviders(repo skybinrepo.Repo, id string) {
+	pvdrs, err := repo.ListProviders()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+	found := false
+	for _, pvdr := range pvdrs {
+		if len(id) > 0 && pvdr.ID != id {
+			continue
+		}
+		found = true
+		info, latency, err := fetchProviderInfo(ctx, pvdr)
+		if err != nil {
+			fmt.Printf("%s (%s): unreachable: %s\n", pvdr.ID, displayAddress(pvdr), err)
+			continue
+		}
+		fmt.Printf("%s (%s): ok in %s, max block size %d\n",
+			pvdr.ID, displayAddress(pvdr), latency.Round(time.Millisecond), info.MaxBlockSize)
+		if len(info.Currency) > 0 {
+			fmt.Printf("\tcharges %s %s per GB-month stored, %s per GB downloaded\n",
+				formatAmount(info.StorageRate), info.Currency, formatAmount(info.EgressRate))
+		}
+		if info.ID != pvdr.ID {
+			fmt.Printf("\twarning: provider reports ID %s\n", info.ID)
+		}
+	}
+	if len(id) > 0 && !found {
+		log.Fatalf("provider %s not found", id)
+	}
+}
+
+// fetchProviderInfo gets a provider's info, giving up after infoTimeout.
+func fetchProviderInfo(ctx context.Context, pinfo core.PeerInfo) (*core.ProviderInfo, time.Duration, error) {
+	pvdr, err := provider.DialPeer(pinfo)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer pvdr.Close()
+	ctx, cancel := context.WithTimeout(ctx, infoTimeout)
+	defer cancel()
+	start := time.Now()
+	info, err := pvdr.Info(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	return info, time.Since(start), nil
+}
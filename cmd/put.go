@@ -1,28 +1,62 @@
 package cmd
 
 import (
+	"flag"
 	"log"
-	skybinrepo "skybin/repo"
+	"os"
 )
 
 var storeCmd = Cmd{
 	Name:        "put",
 	Description: "Store a file in the skybin network",
-	Usage:       "put <path>",
+	Usage:       "put [-name <name>] [-compression none|gzip|zstd] <path>|-",
 	Run:         runPut,
 }
 
 func runPut(args []string) {
+	flags := flag.NewFlagSet("", flag.ExitOnError)
+	nameFlag := flags.String("name", "", "Name to store the file as. Required when reading from standard input.")
+	compressionFlag := flags.String("compression", "", "Compression to apply to the file's blocks. Defaults to the repo's config.")
+	flags.Parse(args)
+	args = flags.Args()
+
 	if len(args) < 1 {
 		log.Fatal("must provide path")
 	}
 
-	repo, err := skybinrepo.Open()
+	repo, err := openRepo()
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer repo.Close()
+
+	name := args[0]
+	if len(*nameFlag) > 0 {
+		name = *nameFlag
+	}
+	config := repo.Info().Config
+	if config == nil {
+		log.Fatal("cannot read repo config")
+	}
+	opts := config.DefaultStorageOpts(name)
+	if len(*compressionFlag) > 0 {
+		opts.Compression = *compressionFlag
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+	if args[0] == "-" {
+		if len(*nameFlag) == 0 {
+			log.Fatal("must provide -name when reading from standard input")
+		}
+		err = repo.PutReader(ctx, name, os.Stdin, opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	err = repo.Put(args[0], nil)
+	err = repo.Put(ctx, args[0], opts)
 	if err != nil {
 		log.Fatal(err)
 	}
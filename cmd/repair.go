@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"log"
+)
+
+var repairCmd = Cmd{
+	Name:        "repair",
+	Usage:       "repair",
+	Description: "Replace lost replicas of stored blocks and renew expiring contracts",
+	Run:         runRepair,
+}
+
+func runRepair(args []string) {
+
+	repo, err := openRepo()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer repo.Close()
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+	report, err := repo.Repair(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("Files checked:", report.Files)
+	log.Println("Blocks checked:", report.BlocksChecked)
+	log.Println("Blocks repaired:", report.BlocksRepaired)
+	log.Println("Replicas replaced:", report.ContractsReplaced)
+	log.Println("Contracts renewed:", report.ContractsRenewed)
+	for _, id := range report.BlocksLost {
+		log.Println("Lost block:", id)
+	}
+	if len(report.BlocksLost) > 0 {
+		log.Fatal("some blocks have no remaining replicas")
+	}
+}
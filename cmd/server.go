@@ -1,81 +1,78 @@
 package cmd
 
 import (
+	"flag"
 	"fmt"
-	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	core "skybin/core/proto"
+	"skybin/provider/chaos"
 	provider "skybin/provider/local"
+	"skybin/provider/relay"
+	providerserver "skybin/provider/server"
 	skybinrepo "skybin/repo"
+	"syscall"
 	"time"
 )
 
 var serverCmd = Cmd{
 	Name:        "server",
 	Description: "Run a provider server",
-	Usage:       "server",
+	Usage:       "server [-chaos <policy.json>] | server stats [renterID]",
 	Run:         runServer,
 }
 
-type server struct {
-	provider core.Provider
-	logger   *log.Logger
+func setServerBandwidth(server *providerserver.Server, limits skybinrepo.BandwidthLimits) {
+	server.SetUploadRates(limits.UploadRate, limits.PeerUploadRate)
+	server.SetDownloadRates(limits.DownloadRate, limits.PeerDownloadRate)
 }
 
-func (ps *server) Info(ctxt context.Context, req *core.InfoRequest) (*core.InfoResponse, error) {
-	ps.logger.Println("get provider info")
-	info, err := ps.provider.Info()
-	if err != nil {
-		return nil, err
-	}
-	return &core.InfoResponse{Info: info}, nil
+// rentersDBPath returns the path of the database recording the contracts a
+// provider server has signed with renters.
+func rentersDBPath(homedir string) string {
+	return path.Join(homedir, "renters.db")
 }
 
-func (ps *server) Negotiate(ctxt context.Context, req *core.NegotiateRequest) (*core.NegotiateResponse, error) {
-	ps.logger.Println("create contract")
-	contract, err := ps.provider.Negotiate(req.Contract)
-	if err != nil {
-		return nil, err
+func runServer(args []string) {
+	if len(args) > 0 && args[0] == "stats" {
+		runServerStats(args[1:])
+		return
 	}
-	return &core.NegotiateResponse{Contract: contract}, nil
-}
 
-func (ps *server) StoreBlock(ctxt context.Context, req *core.StoreBlockRequest) (*core.StoreBlockResponse, error) {
-	ps.logger.Println("store block id", req.BlockId)
-	err := ps.provider.StoreBlock(req.BlockId, req.Block.Data)
-	return &core.StoreBlockResponse{}, err
-}
+	flags := flag.NewFlagSet("", flag.ExitOnError)
+	chaosFlag := flags.String("chaos", "", "Inject faults into requests according to a policy file")
+	flags.Parse(args)
 
-func (ps *server) GetBlock(ctxt context.Context, req *core.GetBlockRequest) (*core.GetBlockResponse, error) {
-	ps.logger.Println("get block id:", req.BlockId)
-	bytes, err := ps.provider.GetBlock(req.BlockId)
+	repo, err := skybinrepo.Open()
 	if err != nil {
-		return &core.GetBlockResponse{}, err
+		log.Fatal(err)
 	}
-	return &core.GetBlockResponse{
-		Block: &core.Block{Data: bytes},
-	}, nil
-}
-
-func runServer(args []string) {
 
-	repo, err := skybinrepo.Open()
+	rinfo := repo.Info()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	rinfo := repo.Info()
+	unlock, err := skybinrepo.LockProvider(rinfo.HomeDir)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer unlock()
+
+	store, err := provider.OpenBlockStore(rinfo.Config.BlockStore, path.Join(rinfo.HomeDir, "peer"))
+	if err != nil {
+		log.Fatal("cannot open block store: ", err)
+	}
+	defer store.Close()
 
 	options := provider.Options{
 		ProviderInfo: rinfo.Config.ProviderInfo,
-		Dir:          path.Join(rinfo.HomeDir, "peer"),
+		Store:        store,
 	}
 
 	provider, err := provider.New(options)
@@ -83,6 +80,15 @@ func runServer(args []string) {
 		log.Fatal(err)
 	}
 
+	if len(*chaosFlag) > 0 {
+		policy, err := chaos.LoadPolicy(*chaosFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		provider = chaos.New(provider, policy)
+		log.Println("warning: injecting faults from", *chaosFlag)
+	}
+
 	logger := log.New(os.Stdout, "", log.Ldate|log.Ltime)
 	if len(rinfo.Config.LogFolder) > 0 {
 		err := os.MkdirAll(rinfo.Config.LogFolder, 0666)
@@ -98,17 +104,132 @@ func runServer(args []string) {
 		logger.SetOutput(f)
 	}
 
-	grpcServer := grpc.NewServer()
-	server := server{
-		provider: provider,
-		logger:   logger,
+	var serverOpts []grpc.ServerOption
+	if len(rinfo.Config.MetricsAddress) > 0 {
+		metrics := providerserver.NewMetrics(store)
+		serverOpts = append(serverOpts, grpc.UnaryInterceptor(metrics.Interceptor))
+		go func() {
+			logger.Println("Serving metrics at", rinfo.Config.MetricsAddress)
+			err := http.ListenAndServe(rinfo.Config.MetricsAddress, metrics.Handler())
+			logger.Println("metrics server error:", err)
+		}()
+	}
+
+	grpcServer := grpc.NewServer(serverOpts...)
+	go runScrubs(store, time.Duration(rinfo.Config.ScrubInterval)*time.Hour, logger)
+
+	accounts, err := providerserver.OpenAccounts(rentersDBPath(rinfo.HomeDir))
+	if err != nil {
+		log.Fatal("cannot open renter accounts: ", err)
 	}
-	core.RegisterProviderServer(grpcServer, &server)
+	defer accounts.Close()
+	go runExpiry(accounts, logger)
+
+	server := providerserver.New(provider, logger)
+	setServerBandwidth(server, rinfo.Config.ProviderBandwidth)
+	server.SetAccounts(accounts)
+	server.SetAdmission(rinfo.Config.ProviderAdmission)
+
+	// A relay serves requests for the providers connected to it and passes
+	// the rest on to this server.
+	var rly *relay.Relay
+	if rinfo.Config.RelayProviders {
+		rly = relay.New(server, logger)
+		core.RegisterProviderServer(grpcServer, rly)
+	} else {
+		core.RegisterProviderServer(grpcServer, server)
+	}
+
+	// Reload bandwidth limits and the admission policy from the repo config
+	// on SIGHUP.
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			repo, err := skybinrepo.OpenAt(rinfo.HomeDir)
+			if err != nil {
+				logger.Println("cannot reload config:", err)
+				continue
+			}
+			config := repo.Info().Config
+			setServerBandwidth(server, config.ProviderBandwidth)
+			server.SetAdmission(config.ProviderAdmission)
+			logger.Println("reloaded bandwidth limits and admission policy")
+		}
+	}()
+
+	// The admin service is served separately so it can be kept off the
+	// network renters use.
+	adminServer := grpc.NewServer()
+	core.RegisterAdminServer(adminServer, server)
+	adminListener, err := net.Listen("tcp", rinfo.Config.ApiAddress)
+	if err != nil {
+		log.Fatalf("cannot run admin server at address %s: %s", rinfo.Config.ApiAddress, err)
+	}
+	go func() {
+		logger.Println("Serving admin API at", adminListener.Addr())
+		err := adminServer.Serve(adminListener)
+		logger.Println("admin server error:", err)
+	}()
 
 	listener, err := net.Listen("tcp", rinfo.Config.ProviderAddress)
 	if err != nil {
 		log.Fatalf("cannot run API server at address %s: %s", listener.Addr(), err)
 	}
+	if rly != nil {
+		listener = rly.Listen(listener)
+		logger.Println("Relaying for providers at", listener.Addr())
+	}
+	// Relayed requests are held to this server's limits along with its own.
+	listener = server.Listen(listener)
+	if len(rinfo.Config.RelayAddress) > 0 {
+		nodeKey, err := skybinrepo.NodeKey(rinfo.HomeDir)
+		if err != nil {
+			log.Fatal("cannot load node key for the relay: ", err)
+		}
+		go relay.Serve(rinfo.Config.RelayAddress, rinfo.Config.ProviderInfo.ID, nodeKey, grpcServer, server.Listen, logger)
+	}
 	logger.Println("Starting provider server at", listener.Addr())
 	log.Fatal(grpcServer.Serve(listener))
 }
+
+// expiryInterval is how often the server removes expired contracts.
+const expiryInterval = time.Hour
+
+// runExpiry removes expired contracts from the renter accounts, releasing
+// their storage quota, immediately and then every expiryInterval.
+func runExpiry(accounts *providerserver.Accounts, logger *log.Logger) {
+	for {
+		n, err := accounts.Expire(time.Now())
+		if err != nil {
+			logger.Println("cannot expire contracts:", err)
+		} else if n > 0 {
+			logger.Printf("removed %d expired contracts", n)
+		}
+		time.Sleep(expiryInterval)
+	}
+}
+
+// runScrubs scrubs the block store immediately and then after every interval.
+func runScrubs(store provider.BlockStore, interval time.Duration, logger *log.Logger) {
+	for {
+		logger.Println("scrubbing stored blocks")
+		report, err := provider.Scrub(store)
+		if err != nil {
+			logger.Println("scrub error:", err)
+		} else {
+			for _, id := range report.Quarantined {
+				logger.Println("quarantined corrupt block", id)
+			}
+			for _, id := range report.Failed {
+				logger.Println("cannot scrub block", id)
+			}
+			logger.Printf("scrubbed %d blocks, %d quarantined, %d failed, %d without a checksum to verify",
+				report.Checked, len(report.Quarantined), len(report.Failed), len(report.Unverified))
+		}
+		if interval <= 0 {
+			return
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"log"
+	"os"
+	core "skybin/core/proto"
+	providerserver "skybin/provider/server"
+	skybinrepo "skybin/repo"
+	"text/tabwriter"
+	"time"
+)
+
+// runServerStats prints the usage of each renter of the provider server. It
+// asks the running server through its admin API, or reads the renter
+// accounts directly if no server is running.
+func runServerStats(args []string) {
+	renterID := ""
+	if len(args) > 0 {
+		renterID = args[0]
+	}
+
+	homedir, err := skybinrepo.FindHomeDir()
+	if err != nil {
+		log.Fatal(err)
+	}
+	config, err := skybinrepo.LoadConfig(homedir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	stats, err := fetchRenterStats(config.ApiAddress, renterID)
+	if err != nil {
+		accounts, openErr := providerserver.OpenAccounts(rentersDBPath(homedir))
+		if openErr != nil {
+			log.Fatalf("cannot reach server at %s: %s", config.ApiAddress, err)
+		}
+		defer accounts.Close()
+		stats, err = accounts.Stats(renterID)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(renterID) > 0 && len(stats.Renters) == 0 {
+		log.Fatalf("no usage recorded for renter %s", renterID)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 5, 3, ' ', 0)
+	fmt.Fprintln(tw, "RENTER\tCONTRACTS\tCONTRACTED\tBLOCKS\tSTORED\tSERVED")
+	for _, r := range stats.Renters {
+		id := r.RenterID
+		if len(id) == 0 {
+			id = "(no contract)"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\n", id,
+			r.Contracts, r.ContractedBytes, r.Blocks, r.StoredBytes, r.ServedBytes)
+	}
+	tw.Flush()
+}
+
+func fetchRenterStats(addr string, renterID string) (*core.RenterStatsResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, addr,
+		grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return core.NewAdminClient(conn).RenterStats(ctx, &core.RenterStatsRequest{RenterID: renterID})
+}
@@ -2,7 +2,6 @@ package cmd
 
 import (
 	"log"
-	skybinrepo "skybin/repo"
 )
 
 var syncCmd = Cmd{
@@ -14,12 +13,15 @@ var syncCmd = Cmd{
 
 func runSync(args []string) {
 
-	repo, err := skybinrepo.Open()
+	repo, err := openRepo()
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer repo.Close()
 
-	err = repo.Sync()
+	ctx, cancel := interruptContext()
+	defer cancel()
+	err = repo.Sync(ctx)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,361 @@
+package cmd
+
+import (
+	"errors"
+	"flag"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	skybinrepo "skybin/repo"
+	"strings"
+	"time"
+)
+
+var webdavCmd = Cmd{
+	Name:        "webdav",
+	Description: "Serve the repo's files over WebDAV",
+	Usage:       "webdav [-addr <host:port>]",
+	Run:         runWebdav,
+}
+
+func runWebdav(args []string) {
+	flags := flag.NewFlagSet("", flag.ExitOnError)
+	addrFlag := flags.String("addr", "127.0.0.1:8004", "Address to serve WebDAV on")
+	flags.Parse(args)
+
+	repo, err := skybinrepo.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("Serving WebDAV at", *addrFlag)
+	log.Fatal(http.ListenAndServe(*addrFlag, newDavHandler(repo)))
+}
+
+// newDavHandler returns a handler serving the repo's files over WebDAV.
+func newDavHandler(repo skybinrepo.Repo) *webdav.Handler {
+	return &webdav.Handler{
+		FileSystem: newDavFS(repo),
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(req *http.Request, err error) {
+			if err != nil {
+				log.Println(req.Method, req.URL.Path, "error:", err)
+			}
+		},
+	}
+}
+
+// davFS implements webdav.FileSystem for the flat namespace in the
+// user's root block. The namespace has no directories and a file's records
+// are named after it, so creating directories and renaming files are not
+// supported. The repo serializes its own operations, so uploads don't hold
+// up other requests.
+type davFS struct {
+	repo    skybinrepo.Repo
+	started time.Time // Modification time of the root and of files stored without one
+}
+
+func newDavFS(repo skybinrepo.Repo) *davFS {
+	return &davFS{
+		repo:    repo,
+		started: time.Now(),
+	}
+}
+
+func davName(name string) string {
+	return strings.Trim(name, "/")
+}
+
+func (fs *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if davName(name) == "" {
+		return os.ErrExist
+	}
+	return webdav.ErrNotImplemented
+}
+
+func (fs *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = davName(name)
+	if name == "" {
+		return &davDir{fs: fs}, nil
+	}
+
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		if flag&os.O_EXCL != 0 {
+			if _, err := fs.Stat(ctx, name); err == nil {
+				return nil, os.ErrExist
+			}
+		}
+		tmp, err := ioutil.TempFile("", "skybin-webdav")
+		if err != nil {
+			return nil, err
+		}
+		return &davWriter{ctx: ctx, fs: fs, name: name, tmp: tmp}, nil
+	}
+
+	info, err := fs.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &davReader{ctx: ctx, fs: fs, info: info.(*davFileInfo)}, nil
+}
+
+func (fs *davFS) RemoveAll(ctx context.Context, name string) error {
+	name = davName(name)
+	if name == "" {
+		return os.ErrPermission
+	}
+	if _, err := fs.Stat(ctx, name); err != nil {
+		return err
+	}
+	return fs.repo.Remove(name)
+}
+
+func (fs *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	return webdav.ErrNotImplemented
+}
+
+func (fs *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name = davName(name)
+	if name == "" {
+		return &davFileInfo{name: "/", isDir: true, modTime: fs.started}, nil
+	}
+
+	files, err := fs.repo.ListFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if file == name {
+			return fs.fileInfo(name)
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// fileInfo returns the info of a file listed in the root block.
+func (fs *davFS) fileInfo(name string) (*davFileInfo, error) {
+	finfo, err := fs.repo.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	modTime := finfo.ModTime
+	if modTime.IsZero() {
+		modTime = fs.started
+	}
+	return &davFileInfo{name: finfo.Name, size: finfo.Size, modTime: modTime}, nil
+}
+
+// davFileInfo implements os.FileInfo
+type davFileInfo struct {
+	name    string
+	size    int64
+	isDir   bool
+	modTime time.Time
+}
+
+func (fi *davFileInfo) Name() string       { return fi.name }
+func (fi *davFileInfo) Size() int64        { return fi.size }
+func (fi *davFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *davFileInfo) IsDir() bool        { return fi.isDir }
+func (fi *davFileInfo) Sys() interface{}   { return nil }
+
+func (fi *davFileInfo) Mode() os.FileMode {
+	if fi.isDir {
+		return os.ModeDir | 0700
+	}
+	return 0600
+}
+
+// davDir is the root directory.
+type davDir struct {
+	fs    *davFS
+	read  bool
+	infos []os.FileInfo // Files listed but not yet returned by Readdir
+}
+
+func (d *davDir) Close() error {
+	return nil
+}
+
+func (d *davDir) Read(p []byte) (int, error) {
+	return 0, errors.New("is a directory")
+}
+
+func (d *davDir) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+func (d *davDir) Write(p []byte) (int, error) {
+	return 0, errors.New("is a directory")
+}
+
+// Readdir lists the files in the root block, reading the listing on the
+// first call. As with os.File, a count greater than zero returns at most
+// count files and io.EOF once all have been returned.
+func (d *davDir) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.read {
+		files, err := d.fs.repo.ListFiles()
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			info, err := d.fs.fileInfo(file)
+			if err != nil {
+				return nil, err
+			}
+			d.infos = append(d.infos, info)
+		}
+		d.read = true
+	}
+
+	if count <= 0 {
+		infos := d.infos
+		d.infos = nil
+		return infos, nil
+	}
+	if len(d.infos) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.infos) {
+		count = len(d.infos)
+	}
+	infos := d.infos[:count]
+	d.infos = d.infos[count:]
+	return infos, nil
+}
+
+func (d *davDir) Stat() (os.FileInfo, error) {
+	return d.fs.Stat(context.Background(), "/")
+}
+
+// davReader streams a file from the network through Repo.GetRange. Seeking
+// restarts the download from the new offset.
+type davReader struct {
+	ctx    context.Context // Context of the request the file was opened for
+	fs     *davFS
+	info   *davFileInfo
+	offset int64 // Offset of the next read
+	pos    int64 // Offset of the download stream
+	stream *io.PipeReader
+	cancel context.CancelFunc // Stops the download stream
+}
+
+func (f *davReader) Read(p []byte) (int, error) {
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.stream == nil || f.pos != f.offset {
+		err := f.restart()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.stream.Read(p)
+	f.pos += int64(n)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *davReader) restart() error {
+	if f.stream != nil {
+		f.stream.Close()
+		f.cancel()
+	}
+	pr, pw := io.Pipe()
+	offset := f.offset
+	ctx, cancel := context.WithCancel(f.ctx)
+	go func() {
+		pw.CloseWithError(f.fs.repo.GetRange(ctx, f.info.name, offset, -1, pw))
+	}()
+	f.stream = pr
+	f.cancel = cancel
+	f.pos = offset
+	return nil
+}
+
+func (f *davReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *davReader) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (f *davReader) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (f *davReader) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *davReader) Close() error {
+	if f.stream != nil {
+		f.cancel()
+		return f.stream.Close()
+	}
+	return nil
+}
+
+// davWriter buffers a file in a temporary file and stores it with
+// Repo.Put when closed, replacing any existing file with the same name once
+// the upload succeeds.
+type davWriter struct {
+	ctx  context.Context // Context of the request the file was opened for
+	fs   *davFS
+	name string
+	tmp  *os.File
+}
+
+func (f *davWriter) Read(p []byte) (int, error) {
+	return f.tmp.Read(p)
+}
+
+func (f *davWriter) Seek(offset int64, whence int) (int64, error) {
+	return f.tmp.Seek(offset, whence)
+}
+
+func (f *davWriter) Write(p []byte) (int, error) {
+	return f.tmp.Write(p)
+}
+
+func (f *davWriter) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (f *davWriter) Stat() (os.FileInfo, error) {
+	finfo, err := f.tmp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &davFileInfo{name: f.name, size: finfo.Size(), modTime: finfo.ModTime()}, nil
+}
+
+func (f *davWriter) Close() error {
+	defer os.Remove(f.tmp.Name())
+	err := f.tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	opts := f.fs.repo.Info().Config.DefaultStorageOpts(f.name)
+	opts.Replace = true
+	return f.fs.repo.Put(f.ctx, f.tmp.Name(), opts)
+}
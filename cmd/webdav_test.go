@@ -0,0 +1,305 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	skybinrepo "skybin/repo"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memRepo keeps files in memory. It implements the parts of Repo used by
+// the WebDAV server.
+type memRepo struct {
+	skybinrepo.Repo
+	mu         sync.Mutex
+	files      map[string][]byte
+	times      map[string]time.Time
+	putErr     error         // Returned by Put if set
+	putStarted chan struct{} // Closed when Put is called, if set
+	putRelease chan struct{} // Put waits for it to be closed, if set
+	removed    []string
+}
+
+func newMemRepo() *memRepo {
+	return &memRepo{files: make(map[string][]byte), times: make(map[string]time.Time)}
+}
+
+func (r *memRepo) Info() skybinrepo.Info {
+	return skybinrepo.Info{Config: &skybinrepo.Config{Redundancy: 1, BlockSize: 1024}}
+}
+
+func (r *memRepo) Put(ctx context.Context, filename string, opts *skybinrepo.StorageOptions) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if r.putStarted != nil {
+		close(r.putStarted)
+		<-r.putRelease
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.putErr != nil {
+		return r.putErr
+	}
+	name := opts.FileName
+	if _, exists := r.files[name]; exists && !opts.Replace {
+		return fmt.Errorf("file %s exists", name)
+	}
+	r.files[name] = data
+	r.times[name] = time.Now()
+	return nil
+}
+
+func (r *memRepo) ListFiles() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var names []string
+	for name := range r.files {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (r *memRepo) Stat(filename string) (*skybinrepo.FileInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data, ok := r.files[filename]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return &skybinrepo.FileInfo{Name: filename, Size: int64(len(data)), ModTime: r.times[filename]}, nil
+}
+
+func (r *memRepo) GetRange(ctx context.Context, filename string, offset int64, length int64, out io.Writer) error {
+	r.mu.Lock()
+	data, ok := r.files[filename]
+	r.mu.Unlock()
+	if !ok {
+		return os.ErrNotExist
+	}
+	data = data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	_, err := out.Write(data)
+	return err
+}
+
+func (r *memRepo) Remove(filename string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.files, filename)
+	r.removed = append(r.removed, filename)
+	return nil
+}
+
+func davRequest(t *testing.T, server *httptest.Server, method string, name string, body string, header map[string]string) *http.Response {
+	req, err := http.NewRequest(method, server.URL+"/"+name, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestWebdavPutGet(t *testing.T) {
+	repo := newMemRepo()
+	server := httptest.NewServer(newDavHandler(repo))
+	defer server.Close()
+
+	resp := davRequest(t, server, "PUT", "hello.txt", "hello world", nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT returned %s", resp.Status)
+	}
+	resp = davRequest(t, server, "GET", "hello.txt", "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET returned %s", resp.Status)
+	}
+	if body := readBody(t, resp); body != "hello world" {
+		t.Fatalf("expected %q, got %q", "hello world", body)
+	}
+
+	resp = davRequest(t, server, "GET", "hello.txt", "", map[string]string{"Range": "bytes=6-"})
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("ranged GET returned %s", resp.Status)
+	}
+	if body := readBody(t, resp); body != "world" {
+		t.Fatalf("expected %q, got %q", "world", body)
+	}
+
+	resp = davRequest(t, server, "GET", "missing.txt", "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET of missing file returned %s", resp.Status)
+	}
+}
+
+func TestWebdavReplaceFile(t *testing.T) {
+	repo := newMemRepo()
+	server := httptest.NewServer(newDavHandler(repo))
+	defer server.Close()
+
+	davRequest(t, server, "PUT", "hello.txt", "old", nil)
+	resp := davRequest(t, server, "PUT", "hello.txt", "new", nil)
+	if resp.StatusCode >= 300 {
+		t.Fatalf("PUT returned %s", resp.Status)
+	}
+	if data := string(repo.files["hello.txt"]); data != "new" {
+		t.Fatalf("expected %q, got %q", "new", data)
+	}
+	if len(repo.removed) > 0 {
+		t.Fatalf("expected file to be replaced in place, but %v was removed", repo.removed)
+	}
+}
+
+func TestWebdavFailedPutKeepsFile(t *testing.T) {
+	repo := newMemRepo()
+	server := httptest.NewServer(newDavHandler(repo))
+	defer server.Close()
+
+	davRequest(t, server, "PUT", "hello.txt", "old", nil)
+	repo.putErr = errors.New("no providers")
+	resp := davRequest(t, server, "PUT", "hello.txt", "new", nil)
+	if resp.StatusCode < 300 {
+		t.Fatalf("expected failed upload to fail the request, got %s", resp.Status)
+	}
+	if data := string(repo.files["hello.txt"]); data != "old" {
+		t.Fatalf("expected existing file to be kept, got %q", data)
+	}
+}
+
+func TestWebdavServesDuringUpload(t *testing.T) {
+	repo := newMemRepo()
+	server := httptest.NewServer(newDavHandler(repo))
+	defer server.Close()
+
+	repo.files["a.txt"] = []byte("aaa")
+	repo.putStarted = make(chan struct{})
+	repo.putRelease = make(chan struct{})
+	uploaded := make(chan *http.Response)
+	go func() {
+		uploaded <- davRequest(t, server, "PUT", "b.txt", "b", nil)
+	}()
+	<-repo.putStarted
+
+	got := make(chan string)
+	go func() {
+		got <- readBody(t, davRequest(t, server, "GET", "a.txt", "", nil))
+	}()
+	select {
+	case body := <-got:
+		if body != "aaa" {
+			t.Fatalf("expected %q, got %q", "aaa", body)
+		}
+	case <-time.After(5 * time.Second):
+		close(repo.putRelease)
+		t.Fatal("GET waited for an upload of another file")
+	}
+
+	close(repo.putRelease)
+	if resp := <-uploaded; resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT returned %s", resp.Status)
+	}
+}
+
+func TestWebdavUnsupported(t *testing.T) {
+	repo := newMemRepo()
+	server := httptest.NewServer(newDavHandler(repo))
+	defer server.Close()
+
+	repo.files["a.txt"] = []byte("aaa")
+	resp := davRequest(t, server, "MKCOL", "dir", "", nil)
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("MKCOL returned %s", resp.Status)
+	}
+	resp = davRequest(t, server, "MOVE", "a.txt", "", map[string]string{"Destination": server.URL + "/b.txt"})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("MOVE returned %s", resp.Status)
+	}
+	if _, ok := repo.files["a.txt"]; !ok {
+		t.Fatal("file was removed by a failed MOVE")
+	}
+}
+
+func TestDavDirReaddirCount(t *testing.T) {
+	repo := newMemRepo()
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		repo.files[name] = []byte(name)
+	}
+	dir := &davDir{fs: newDavFS(repo)}
+
+	var names []string
+	for {
+		infos, err := dir.Readdir(2)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) == 0 || len(infos) > 2 {
+			t.Fatalf("Readdir(2) returned %d files", len(infos))
+		}
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+	}
+	if len(names) != 3 {
+		t.Fatalf("expected 3 files, got %v", names)
+	}
+
+	infos, err := dir.Readdir(0)
+	if err != nil || len(infos) != 0 {
+		t.Fatalf("Readdir(0) after the end returned %v, %v", infos, err)
+	}
+}
+
+func TestWebdavPropfind(t *testing.T) {
+	repo := newMemRepo()
+	server := httptest.NewServer(newDavHandler(repo))
+	defer server.Close()
+
+	repo.files["a.txt"] = []byte("aaa")
+	repo.times["a.txt"] = time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	repo.files["b.txt"] = []byte("b")
+	repo.times["b.txt"] = time.Date(2002, 2, 3, 4, 5, 6, 0, time.UTC)
+
+	resp := davRequest(t, server, "PROPFIND", "", "", map[string]string{"Depth": "1"})
+	if resp.StatusCode != http.StatusMultiStatus {
+		t.Fatalf("PROPFIND returned %s", resp.Status)
+	}
+	body := readBody(t, resp)
+	for _, want := range []string{
+		"/a.txt", "/b.txt",
+		"<D:getcontentlength>3</D:getcontentlength>",
+		"Sat, 03 Feb 2001 04:05:06 GMT", "Sun, 03 Feb 2002 04:05:06 GMT",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected PROPFIND response to contain %q, got %s", want, body)
+		}
+	}
+}
@@ -1,5 +1,12 @@
 package proto
 
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"golang.org/x/net/context"
+)
+
 //type EncryptionKey string
 //
 //type PeerInfo struct {
@@ -54,25 +61,44 @@ package proto
 //	ProviderSignature string
 //}
 
+// Provider is a storage provider. Each method gives up and returns an error
+// once its context is canceled or its deadline passes.
 type Provider interface {
-	Info() (*ProviderInfo, error)
+	Info(ctx context.Context) (*ProviderInfo, error)
 
 	// Negotiate attempts to negotiate a storage contract. If the provider
 	// agrees to the terms, the contract is  returned with the provider's
 	// signature. Otherwise, the signature field is left empty, and the contract
 	// is updated with the provider's requirements. If the provider is unwilling
 	// to store the block, an error is returned.
-	Negotiate(contract *Contract) (*Contract, error)
+	Negotiate(ctx context.Context, contract *Contract) (*Contract, error)
 
 	// StoreBlock stores the given block with the provider.
-	StoreBlock(id string, block []byte) error
+	StoreBlock(ctx context.Context, id string, block []byte) error
 
 	// GetBlock retrieves the given block from the provider.
-	GetBlock(id string) (block []byte, err error)
+	GetBlock(ctx context.Context, id string) (block []byte, err error)
 
 	// TODO: Audit storage
 }
 
+// ContentID returns the ID of a block named by the hash of its content, as
+// file blocks are.
+func ContentID(block []byte) string {
+	sum := sha1.Sum(block)
+	return base32.StdEncoding.EncodeToString(sum[:])
+}
+
+// BlockProof hashes a block with a nonce chosen by the renter. A provider
+// returns it to show that it still holds the block without sending the
+// block, and a fresh nonce keeps it from answering with a stored hash.
+func BlockProof(nonce []byte, block []byte) []byte {
+	h := sha256.New()
+	h.Write(nonce)
+	h.Write(block)
+	return h.Sum(nil)
+}
+
 //type ProviderInfo struct {
 //	MaxBlockSize int
 //	// Availability guarantees
@@ -0,0 +1,203 @@
+package proto
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	proto1 "github.com/golang/protobuf/proto"
+)
+
+// A user's or node's ID is derived from its public key, so a renter proves
+// its ID to providers by signing with the matching private key.
+
+// KeyID returns the ID derived from a public key.
+func KeyID(key *rsa.PublicKey) (string, error) {
+	der, err := asn1.Marshal(*key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum(der)
+	return base32.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+// EncodePublicKey encodes a public key for sending to peers.
+func EncodePublicKey(key *rsa.PublicKey) (string, error) {
+	der, err := asn1.Marshal(*key)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(der), nil
+}
+
+// DecodePublicKey decodes a key encoded with EncodePublicKey.
+func DecodePublicKey(s string) (*rsa.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var key rsa.PublicKey
+	rest, err := asn1.Unmarshal(der, &key)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("trailing data after public key")
+	}
+	return &key, nil
+}
+
+// contractDigest hashes the terms of a contract, leaving out the signatures.
+func contractDigest(c *Contract) ([]byte, error) {
+	terms := *c
+	terms.RenterSignature = ""
+	terms.ProviderSignature = ""
+	data, err := proto1.Marshal(&terms)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	return sum[:], nil
+}
+
+// SignContract sets the renter's key and signature on a contract offer.
+func SignContract(c *Contract, key *rsa.PrivateKey) error {
+	pub, err := EncodePublicKey(&key.PublicKey)
+	if err != nil {
+		return err
+	}
+	c.RenterKey = pub
+	digest, err := contractDigest(c)
+	if err != nil {
+		return err
+	}
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest)
+	if err != nil {
+		return err
+	}
+	c.RenterSignature = base64.StdEncoding.EncodeToString(sig)
+	return nil
+}
+
+// VerifyContract checks that a contract was signed by the renter it names,
+// and returns the renter's public key.
+func VerifyContract(c *Contract) (*rsa.PublicKey, error) {
+	if len(c.RenterKey) == 0 || len(c.RenterSignature) == 0 {
+		return nil, errors.New("contract is not signed by the renter")
+	}
+	key, err := verifiedKey(c.RenterKey, c.RenterID)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.StdEncoding.DecodeString(c.RenterSignature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid renter signature: %s", err)
+	}
+	digest, err := contractDigest(c)
+	if err != nil {
+		return nil, err
+	}
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, sig)
+	if err != nil {
+		return nil, errors.New("invalid renter signature")
+	}
+	return key, nil
+}
+
+// verifiedKey decodes a public key and checks that it belongs to id.
+func verifiedKey(encoded string, id string) (*rsa.PublicKey, error) {
+	key, err := DecodePublicKey(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %s", err)
+	}
+	keyID, err := KeyID(key)
+	if err != nil {
+		return nil, err
+	}
+	if keyID != id {
+		return nil, fmt.Errorf("public key does not belong to %s", id)
+	}
+	return key, nil
+}
+
+// storeBlockDigest hashes a request to store a block made at unix time t.
+func storeBlockDigest(blockID string, block []byte, t int64) []byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "StoreBlock\x00%s\x00%d\x00", blockID, t)
+	h.Write(block)
+	return h.Sum(nil)
+}
+
+// SignStoreBlock signs a request to store a block made at unix time t.
+func SignStoreBlock(key *rsa.PrivateKey, blockID string, block []byte, t int64) (string, error) {
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, storeBlockDigest(blockID, block, t))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// VerifyStoreBlock checks a signature made with SignStoreBlock by the owner
+// of the encoded public key, and returns the owner's ID.
+func VerifyStoreBlock(encodedKey string, signature string, blockID string, block []byte, t int64) (string, error) {
+	key, err := DecodePublicKey(encodedKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid public key: %s", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return "", fmt.Errorf("invalid signature: %s", err)
+	}
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, storeBlockDigest(blockID, block, t), sig)
+	if err != nil {
+		return "", errors.New("invalid signature")
+	}
+	return KeyID(key)
+}
+
+// tunnelDigest hashes a relay's challenge to the provider with the given ID.
+func tunnelDigest(id string, challenge []byte) []byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "Tunnel\x00%s\x00", id)
+	h.Write(challenge)
+	return h.Sum(nil)
+}
+
+// SignTunnel answers a relay's challenge, proving that the provider opening
+// a tunnel holds the key its ID is derived from. It returns the encoded
+// public key and the signature.
+func SignTunnel(key *rsa.PrivateKey, id string, challenge []byte) (string, string, error) {
+	pub, err := EncodePublicKey(&key.PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, tunnelDigest(id, challenge))
+	if err != nil {
+		return "", "", err
+	}
+	return pub, base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// VerifyTunnel checks an answer made with SignTunnel by the provider with
+// the given ID.
+func VerifyTunnel(encodedKey string, signature string, id string, challenge []byte) error {
+	key, err := verifiedKey(encodedKey, id)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %s", err)
+	}
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, tunnelDigest(id, challenge), sig)
+	if err != nil {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
@@ -5,9 +5,11 @@
 Package proto is a generated protocol buffer package.
 
 It is generated from these files:
+
 	skybin.proto
 
 It has these top-level messages:
+
 	PeerInfo
 	Block
 	BlockRef
@@ -24,6 +26,9 @@ It has these top-level messages:
 	InfoRequest
 	ProviderInfo
 	InfoResponse
+	RenterStats
+	RenterStatsRequest
+	RenterStatsResponse
 */
 package proto
 
@@ -48,8 +53,9 @@ var _ = math.Inf
 const _ = proto1.ProtoPackageIsVersion2 // please upgrade the proto package
 
 type PeerInfo struct {
-	ID   string `protobuf:"bytes,1,opt,name=ID" json:"ID,omitempty"`
-	Addr string `protobuf:"bytes,2,opt,name=Addr" json:"Addr,omitempty"`
+	ID    string `protobuf:"bytes,1,opt,name=ID" json:"ID,omitempty"`
+	Addr  string `protobuf:"bytes,2,opt,name=Addr" json:"Addr,omitempty"`
+	Relay string `protobuf:"bytes,3,opt,name=Relay" json:"Relay,omitempty"`
 }
 
 func (m *PeerInfo) Reset()                    { *m = PeerInfo{} }
@@ -71,6 +77,13 @@ func (m *PeerInfo) GetAddr() string {
 	return ""
 }
 
+func (m *PeerInfo) GetRelay() string {
+	if m != nil {
+		return m.Relay
+	}
+	return ""
+}
+
 type Block struct {
 	Data []byte `protobuf:"bytes,1,opt,name=Data,proto3" json:"Data,omitempty"`
 }
@@ -88,9 +101,11 @@ func (m *Block) GetData() []byte {
 }
 
 type BlockRef struct {
-	ID        string      `protobuf:"bytes,1,opt,name=ID" json:"ID,omitempty"`
-	Locations []string    `protobuf:"bytes,2,rep,name=Locations" json:"Locations,omitempty"`
-	Contracts []*Contract `protobuf:"bytes,3,rep,name=Contracts" json:"Contracts,omitempty"`
+	ID          string      `protobuf:"bytes,1,opt,name=ID" json:"ID,omitempty"`
+	Locations   []string    `protobuf:"bytes,2,rep,name=Locations" json:"Locations,omitempty"`
+	Contracts   []*Contract `protobuf:"bytes,3,rep,name=Contracts" json:"Contracts,omitempty"`
+	Compression string      `protobuf:"bytes,4,opt,name=Compression" json:"Compression,omitempty"`
+	Size        int64       `protobuf:"varint,5,opt,name=Size" json:"Size,omitempty"`
 }
 
 func (m *BlockRef) Reset()                    { *m = BlockRef{} }
@@ -119,6 +134,20 @@ func (m *BlockRef) GetContracts() []*Contract {
 	return nil
 }
 
+func (m *BlockRef) GetCompression() string {
+	if m != nil {
+		return m.Compression
+	}
+	return ""
+}
+
+func (m *BlockRef) GetSize() int64 {
+	if m != nil {
+		return m.Size
+	}
+	return 0
+}
+
 type NamedBlockRef struct {
 	ID        string      `protobuf:"bytes,1,opt,name=ID" json:"ID,omitempty"`
 	Name      string      `protobuf:"bytes,2,opt,name=Name" json:"Name,omitempty"`
@@ -214,6 +243,7 @@ type INodeBlock struct {
 	OwnerID   string      `protobuf:"bytes,4,opt,name=OwnerID" json:"OwnerID,omitempty"`
 	Blocks    []*BlockRef `protobuf:"bytes,5,rep,name=Blocks" json:"Blocks,omitempty"`
 	Size      int64       `protobuf:"varint,6,opt,name=Size" json:"Size,omitempty"`
+	ModTime   int64       `protobuf:"varint,7,opt,name=ModTime" json:"ModTime,omitempty"`
 }
 
 func (m *INodeBlock) Reset()                    { *m = INodeBlock{} }
@@ -263,6 +293,13 @@ func (m *INodeBlock) GetSize() int64 {
 	return 0
 }
 
+func (m *INodeBlock) GetModTime() int64 {
+	if m != nil {
+		return m.ModTime
+	}
+	return 0
+}
+
 type Contract struct {
 	BlockID           string `protobuf:"bytes,1,opt,name=blockID" json:"blockID,omitempty"`
 	BlockSize         int64  `protobuf:"varint,2,opt,name=blockSize" json:"blockSize,omitempty"`
@@ -270,6 +307,12 @@ type Contract struct {
 	ProviderID        string `protobuf:"bytes,4,opt,name=providerID" json:"providerID,omitempty"`
 	RenterSignature   string `protobuf:"bytes,5,opt,name=renterSignature" json:"renterSignature,omitempty"`
 	ProviderSignature string `protobuf:"bytes,6,opt,name=providerSignature" json:"providerSignature,omitempty"`
+	Currency          string `protobuf:"bytes,7,opt,name=currency" json:"currency,omitempty"`
+	StorageRate       int64  `protobuf:"varint,8,opt,name=storageRate" json:"storageRate,omitempty"`
+	EgressRate        int64  `protobuf:"varint,9,opt,name=egressRate" json:"egressRate,omitempty"`
+	StartTime         int64  `protobuf:"varint,10,opt,name=startTime" json:"startTime,omitempty"`
+	Duration          int64  `protobuf:"varint,11,opt,name=duration" json:"duration,omitempty"`
+	RenterKey         string `protobuf:"bytes,12,opt,name=renterKey" json:"renterKey,omitempty"`
 }
 
 func (m *Contract) Reset()                    { *m = Contract{} }
@@ -319,6 +362,48 @@ func (m *Contract) GetProviderSignature() string {
 	return ""
 }
 
+func (m *Contract) GetCurrency() string {
+	if m != nil {
+		return m.Currency
+	}
+	return ""
+}
+
+func (m *Contract) GetStorageRate() int64 {
+	if m != nil {
+		return m.StorageRate
+	}
+	return 0
+}
+
+func (m *Contract) GetEgressRate() int64 {
+	if m != nil {
+		return m.EgressRate
+	}
+	return 0
+}
+
+func (m *Contract) GetStartTime() int64 {
+	if m != nil {
+		return m.StartTime
+	}
+	return 0
+}
+
+func (m *Contract) GetDuration() int64 {
+	if m != nil {
+		return m.Duration
+	}
+	return 0
+}
+
+func (m *Contract) GetRenterKey() string {
+	if m != nil {
+		return m.RenterKey
+	}
+	return ""
+}
+
 type StoreBlockRequest struct {
 	BlockId string `protobuf:"bytes,1,opt,name=blockId" json:"blockId,omitempty"`
 	Block   *Block `protobuf:"bytes,2,opt,name=block" json:"block,omitempty"`
@@ -353,6 +438,7 @@ func (*StoreBlockResponse) Descriptor() ([]byte, []int) { return fileDescriptor0
 
 type GetBlockRequest struct {
 	BlockId string `protobuf:"bytes,1,opt,name=blockId" json:"blockId,omitempty"`
+	Nonce   []byte `protobuf:"bytes,2,opt,name=nonce,proto3" json:"nonce,omitempty"`
 }
 
 func (m *GetBlockRequest) Reset()                    { *m = GetBlockRequest{} }
@@ -367,8 +453,16 @@ func (m *GetBlockRequest) GetBlockId() string {
 	return ""
 }
 
+func (m *GetBlockRequest) GetNonce() []byte {
+	if m != nil {
+		return m.Nonce
+	}
+	return nil
+}
+
 type GetBlockResponse struct {
 	Block *Block `protobuf:"bytes,1,opt,name=block" json:"block,omitempty"`
+	Proof []byte `protobuf:"bytes,2,opt,name=proof,proto3" json:"proof,omitempty"`
 }
 
 func (m *GetBlockResponse) Reset()                    { *m = GetBlockResponse{} }
@@ -383,6 +477,13 @@ func (m *GetBlockResponse) GetBlock() *Block {
 	return nil
 }
 
+func (m *GetBlockResponse) GetProof() []byte {
+	if m != nil {
+		return m.Proof
+	}
+	return nil
+}
+
 type NegotiateRequest struct {
 	Contract *Contract `protobuf:"bytes,1,opt,name=contract" json:"contract,omitempty"`
 }
@@ -434,6 +535,10 @@ func (*InfoRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int
 type ProviderInfo struct {
 	ID           string `protobuf:"bytes,1,opt,name=ID" json:"ID,omitempty"`
 	MaxBlockSize int32  `protobuf:"varint,2,opt,name=maxBlockSize" json:"maxBlockSize,omitempty"`
+	Currency     string `protobuf:"bytes,3,opt,name=currency" json:"currency,omitempty"`
+	StorageRate  int64  `protobuf:"varint,4,opt,name=storageRate" json:"storageRate,omitempty"`
+	EgressRate   int64  `protobuf:"varint,5,opt,name=egressRate" json:"egressRate,omitempty"`
+	MinDuration  int64  `protobuf:"varint,6,opt,name=minDuration" json:"minDuration,omitempty"`
 }
 
 func (m *ProviderInfo) Reset()                    { *m = ProviderInfo{} }
@@ -455,6 +560,34 @@ func (m *ProviderInfo) GetMaxBlockSize() int32 {
 	return 0
 }
 
+func (m *ProviderInfo) GetCurrency() string {
+	if m != nil {
+		return m.Currency
+	}
+	return ""
+}
+
+func (m *ProviderInfo) GetStorageRate() int64 {
+	if m != nil {
+		return m.StorageRate
+	}
+	return 0
+}
+
+func (m *ProviderInfo) GetEgressRate() int64 {
+	if m != nil {
+		return m.EgressRate
+	}
+	return 0
+}
+
+func (m *ProviderInfo) GetMinDuration() int64 {
+	if m != nil {
+		return m.MinDuration
+	}
+	return 0
+}
+
 type InfoResponse struct {
 	Info *ProviderInfo `protobuf:"bytes,1,opt,name=info" json:"info,omitempty"`
 }
@@ -471,6 +604,94 @@ func (m *InfoResponse) GetInfo() *ProviderInfo {
 	return nil
 }
 
+type RenterStats struct {
+	RenterID        string `protobuf:"bytes,1,opt,name=renterID" json:"renterID,omitempty"`
+	Contracts       int64  `protobuf:"varint,2,opt,name=contracts" json:"contracts,omitempty"`
+	ContractedBytes int64  `protobuf:"varint,3,opt,name=contractedBytes" json:"contractedBytes,omitempty"`
+	Blocks          int64  `protobuf:"varint,4,opt,name=blocks" json:"blocks,omitempty"`
+	StoredBytes     int64  `protobuf:"varint,5,opt,name=storedBytes" json:"storedBytes,omitempty"`
+	ServedBytes     int64  `protobuf:"varint,6,opt,name=servedBytes" json:"servedBytes,omitempty"`
+}
+
+func (m *RenterStats) Reset()                    { *m = RenterStats{} }
+func (m *RenterStats) String() string            { return proto1.CompactTextString(m) }
+func (*RenterStats) ProtoMessage()               {}
+func (*RenterStats) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{16} }
+
+func (m *RenterStats) GetRenterID() string {
+	if m != nil {
+		return m.RenterID
+	}
+	return ""
+}
+
+func (m *RenterStats) GetContracts() int64 {
+	if m != nil {
+		return m.Contracts
+	}
+	return 0
+}
+
+func (m *RenterStats) GetContractedBytes() int64 {
+	if m != nil {
+		return m.ContractedBytes
+	}
+	return 0
+}
+
+func (m *RenterStats) GetBlocks() int64 {
+	if m != nil {
+		return m.Blocks
+	}
+	return 0
+}
+
+func (m *RenterStats) GetStoredBytes() int64 {
+	if m != nil {
+		return m.StoredBytes
+	}
+	return 0
+}
+
+func (m *RenterStats) GetServedBytes() int64 {
+	if m != nil {
+		return m.ServedBytes
+	}
+	return 0
+}
+
+type RenterStatsRequest struct {
+	RenterID string `protobuf:"bytes,1,opt,name=renterID" json:"renterID,omitempty"`
+}
+
+func (m *RenterStatsRequest) Reset()                    { *m = RenterStatsRequest{} }
+func (m *RenterStatsRequest) String() string            { return proto1.CompactTextString(m) }
+func (*RenterStatsRequest) ProtoMessage()               {}
+func (*RenterStatsRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{17} }
+
+func (m *RenterStatsRequest) GetRenterID() string {
+	if m != nil {
+		return m.RenterID
+	}
+	return ""
+}
+
+type RenterStatsResponse struct {
+	Renters []*RenterStats `protobuf:"bytes,1,rep,name=renters" json:"renters,omitempty"`
+}
+
+func (m *RenterStatsResponse) Reset()                    { *m = RenterStatsResponse{} }
+func (m *RenterStatsResponse) String() string            { return proto1.CompactTextString(m) }
+func (*RenterStatsResponse) ProtoMessage()               {}
+func (*RenterStatsResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{18} }
+
+func (m *RenterStatsResponse) GetRenters() []*RenterStats {
+	if m != nil {
+		return m.Renters
+	}
+	return nil
+}
+
 func init() {
 	proto1.RegisterType((*PeerInfo)(nil), "proto.PeerInfo")
 	proto1.RegisterType((*Block)(nil), "proto.Block")
@@ -488,6 +709,9 @@ func init() {
 	proto1.RegisterType((*InfoRequest)(nil), "proto.InfoRequest")
 	proto1.RegisterType((*ProviderInfo)(nil), "proto.ProviderInfo")
 	proto1.RegisterType((*InfoResponse)(nil), "proto.InfoResponse")
+	proto1.RegisterType((*RenterStats)(nil), "proto.RenterStats")
+	proto1.RegisterType((*RenterStatsRequest)(nil), "proto.RenterStatsRequest")
+	proto1.RegisterType((*RenterStatsResponse)(nil), "proto.RenterStatsResponse")
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -661,46 +885,129 @@ var _Provider_serviceDesc = grpc.ServiceDesc{
 	Metadata: "skybin.proto",
 }
 
+// Client API for Admin service
+
+type AdminClient interface {
+	RenterStats(ctx context.Context, in *RenterStatsRequest, opts ...grpc.CallOption) (*RenterStatsResponse, error)
+}
+
+type adminClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewAdminClient(cc *grpc.ClientConn) AdminClient {
+	return &adminClient{cc}
+}
+
+func (c *adminClient) RenterStats(ctx context.Context, in *RenterStatsRequest, opts ...grpc.CallOption) (*RenterStatsResponse, error) {
+	out := new(RenterStatsResponse)
+	err := grpc.Invoke(ctx, "/proto.Admin/RenterStats", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Server API for Admin service
+
+type AdminServer interface {
+	RenterStats(context.Context, *RenterStatsRequest) (*RenterStatsResponse, error)
+}
+
+func RegisterAdminServer(s *grpc.Server, srv AdminServer) {
+	s.RegisterService(&_Admin_serviceDesc, srv)
+}
+
+func _Admin_RenterStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RenterStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).RenterStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.Admin/RenterStats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).RenterStats(ctx, req.(*RenterStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _Admin_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "proto.Admin",
+	HandlerType: (*AdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "RenterStats",
+			Handler:    _Admin_RenterStats_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "skybin.proto",
+}
+
 func init() { proto1.RegisterFile("skybin.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 601 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xc4, 0x54, 0xdb, 0x6e, 0xd3, 0x40,
-	0x10, 0xc5, 0x49, 0x1c, 0x9c, 0xa9, 0x4b, 0x9b, 0x6d, 0x45, 0x4d, 0x40, 0x08, 0xed, 0x4b, 0x2b,
-	0x0a, 0x91, 0x08, 0x12, 0x3c, 0x21, 0x20, 0x8d, 0x40, 0x91, 0x50, 0x28, 0x0e, 0x1f, 0x80, 0x13,
-	0x6f, 0x23, 0x2b, 0xad, 0xb7, 0xd8, 0x5b, 0x6e, 0x4f, 0x48, 0x7c, 0x0a, 0xff, 0xc0, 0xa7, 0xf0,
-	0x3d, 0xec, 0x8e, 0x77, 0x7d, 0x89, 0x5b, 0x5a, 0x9e, 0x78, 0xca, 0x78, 0xe6, 0xcc, 0x99, 0x33,
-	0x97, 0x2c, 0xb8, 0xe9, 0xf2, 0xeb, 0x2c, 0x8a, 0xfb, 0xa7, 0x09, 0x17, 0x9c, 0xd8, 0xf8, 0x43,
-	0xfb, 0xe0, 0x1c, 0x32, 0x96, 0x8c, 0xe3, 0x23, 0x4e, 0x6e, 0x40, 0x63, 0x3c, 0xf2, 0xac, 0x7b,
-	0xd6, 0x5e, 0xc7, 0x97, 0x16, 0x21, 0xd0, 0x7a, 0x19, 0x86, 0x89, 0xd7, 0x40, 0x0f, 0xda, 0xf4,
-	0x36, 0xd8, 0xc3, 0x63, 0x3e, 0x5f, 0xaa, 0xe0, 0x28, 0x10, 0x01, 0xc2, 0x5d, 0x1f, 0x6d, 0xba,
-	0x00, 0x07, 0x83, 0x3e, 0x3b, 0xaa, 0x91, 0xdd, 0x81, 0xce, 0x1b, 0x3e, 0x0f, 0x44, 0xc4, 0xe3,
-	0x54, 0x32, 0x36, 0xa5, 0xbb, 0x70, 0x90, 0x87, 0xd0, 0x39, 0xe0, 0xb1, 0x48, 0x82, 0xb9, 0x48,
-	0xbd, 0xa6, 0x8c, 0xae, 0x0d, 0x36, 0x32, 0xa1, 0x7d, 0xe3, 0xf7, 0x0b, 0x04, 0xfd, 0x6e, 0xc1,
-	0xfa, 0x24, 0x38, 0x61, 0xe1, 0x85, 0xe5, 0xa4, 0x3c, 0x05, 0x30, 0xda, 0x95, 0x5d, 0x95, 0xd0,
-	0xfc, 0xab, 0x84, 0xd6, 0xa5, 0x12, 0x7e, 0x5a, 0xe0, 0x8c, 0xa2, 0x24, 0x1b, 0xc6, 0x55, 0xaa,
-	0xff, 0x5b, 0x8b, 0xc4, 0x83, 0xeb, 0x6f, 0x3f, 0xc7, 0x72, 0x33, 0x23, 0x29, 0x46, 0xb1, 0x98,
-	0x4f, 0x72, 0x1f, 0xec, 0x57, 0xd1, 0x31, 0x4b, 0x3d, 0x1b, 0x49, 0xb6, 0x35, 0x49, 0x65, 0x1e,
-	0x7e, 0x06, 0xa1, 0xbf, 0x2c, 0x80, 0xf1, 0x84, 0x87, 0xec, 0x3f, 0xe8, 0xdc, 0x85, 0x36, 0x56,
-	0x35, 0x42, 0x0d, 0x4b, 0xae, 0x51, 0x87, 0x95, 0x8a, 0x69, 0xf4, 0x8d, 0x79, 0x6d, 0x99, 0xdf,
-	0xf4, 0xd1, 0xa6, 0xbf, 0xe5, 0x78, 0x4d, 0x11, 0x55, 0x63, 0xa6, 0xa0, 0xb9, 0x76, 0xf3, 0xa9,
-	0x56, 0x8a, 0x26, 0xe6, 0x37, 0x30, 0xbf, 0x70, 0x90, 0x1e, 0x38, 0x09, 0x8b, 0x05, 0x8a, 0x6b,
-	0x62, 0x62, 0xfe, 0x4d, 0xee, 0x02, 0x48, 0x39, 0x9f, 0xa2, 0xb0, 0x24, 0xbd, 0xe4, 0x21, 0x7b,
-	0xb0, 0x91, 0x61, 0xa7, 0xd1, 0x22, 0x0e, 0xc4, 0x59, 0xc2, 0x64, 0x1b, 0x0a, 0xb4, 0xea, 0x26,
-	0x0f, 0xa0, 0x6b, 0xf2, 0x0a, 0x6c, 0x1b, 0xb1, 0xf5, 0x00, 0x7d, 0x07, 0xdd, 0xa9, 0xe0, 0x09,
-	0xd3, 0x53, 0xf8, 0x78, 0xc6, 0xd2, 0x52, 0x83, 0x61, 0xb5, 0xc1, 0x90, 0x50, 0xb0, 0xd1, 0xc4,
-	0xe6, 0xd6, 0x06, 0x6e, 0x65, 0x86, 0x59, 0x88, 0x6e, 0x03, 0x29, 0x53, 0xa6, 0xa7, 0xf2, 0x9c,
-	0x19, 0xdd, 0x87, 0x8d, 0xd7, 0x4c, 0x5c, 0xad, 0x0c, 0x7d, 0x02, 0x9b, 0x05, 0x38, 0x23, 0x28,
-	0x4a, 0x5b, 0x17, 0x97, 0x7e, 0x0e, 0x9b, 0x13, 0xb6, 0xe0, 0x22, 0x0a, 0x04, 0x33, 0x55, 0xf6,
-	0xc1, 0x99, 0xeb, 0xcd, 0xe9, 0xd4, 0xda, 0xfd, 0xe4, 0x00, 0xfa, 0x01, 0xba, 0x25, 0x02, 0x5d,
-	0xb9, 0xcc, 0xd0, 0xb8, 0x84, 0x41, 0x2d, 0x12, 0xbb, 0x7f, 0xcf, 0x97, 0x2c, 0xd6, 0x6b, 0x2e,
-	0x79, 0xe8, 0x3a, 0xac, 0xa9, 0xd7, 0x4d, 0xab, 0xa3, 0x43, 0x70, 0x0f, 0xcd, 0x96, 0xcf, 0x7b,
-	0xf4, 0x28, 0xb8, 0x27, 0xc1, 0x97, 0x61, 0xe5, 0xa8, 0x6c, 0xbf, 0xe2, 0xa3, 0x4f, 0xc1, 0xcd,
-	0x28, 0xb5, 0xde, 0x5d, 0x68, 0x45, 0xf2, 0x5b, 0x77, 0xbb, 0xa5, 0xb5, 0x96, 0xcb, 0xf8, 0x08,
-	0x18, 0xfc, 0x68, 0xc8, 0xe7, 0x56, 0xbb, 0xc9, 0x23, 0x68, 0xa1, 0x02, 0xa2, 0xf1, 0x25, 0x95,
-	0xbd, 0xad, 0x8a, 0x4f, 0x6f, 0xf4, 0x1a, 0x79, 0x01, 0x9d, 0x7c, 0x5a, 0x64, 0xc7, 0xfc, 0xf1,
-	0x57, 0x16, 0xd0, 0xf3, 0xea, 0x81, 0x9c, 0xe1, 0x40, 0x4f, 0x2b, 0x7b, 0x0f, 0x0c, 0xb2, 0x76,
-	0x91, 0xbd, 0x5b, 0xe7, 0x44, 0x72, 0x92, 0x67, 0xe0, 0x98, 0x6b, 0x21, 0x37, 0x35, 0x70, 0xe5,
-	0xd6, 0x7a, 0x3b, 0x35, 0xbf, 0x49, 0x9f, 0xb5, 0x31, 0xf2, 0xf8, 0x4f, 0x00, 0x00, 0x00, 0xff,
-	0xff, 0xc9, 0xf5, 0xec, 0x7d, 0x91, 0x06, 0x00, 0x00,
+	// 898 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xc4, 0x55, 0x41, 0x73, 0xdc, 0x34,
+	0x14, 0xc6, 0xeb, 0xf5, 0xc6, 0x7e, 0xbb, 0x25, 0x8d, 0x92, 0x69, 0xdd, 0xa5, 0xc3, 0xec, 0xe8,
+	0xd2, 0x1d, 0x28, 0x1d, 0x08, 0x07, 0x4e, 0x0c, 0x24, 0xd9, 0x29, 0xb3, 0x43, 0x49, 0x8b, 0xd3,
+	0x1f, 0x80, 0x63, 0x2b, 0x19, 0x4f, 0xb2, 0xd2, 0x22, 0x2b, 0x85, 0xe5, 0xc4, 0x0c, 0x57, 0xfe,
+	0x02, 0x27, 0xfe, 0x09, 0x77, 0x66, 0xf8, 0x49, 0x8c, 0x9e, 0x24, 0x5b, 0xde, 0xdd, 0x26, 0xe5,
+	0xc4, 0xc9, 0x7a, 0x9f, 0x9e, 0x3e, 0x7d, 0xfa, 0xf4, 0xf4, 0x0c, 0xa3, 0xfa, 0x6a, 0x75, 0x5e,
+	0xf1, 0x67, 0x4b, 0x29, 0x94, 0x20, 0x11, 0x7e, 0xe8, 0x0c, 0xe2, 0x57, 0x8c, 0xc9, 0x39, 0xbf,
+	0x10, 0xe4, 0x7d, 0xe8, 0xcd, 0x67, 0x69, 0x30, 0x09, 0xa6, 0x49, 0xd6, 0x9b, 0xcf, 0x08, 0x81,
+	0xfe, 0x51, 0x59, 0xca, 0xb4, 0x87, 0x08, 0x8e, 0xc9, 0x01, 0x44, 0x19, 0xbb, 0xce, 0x57, 0x69,
+	0x88, 0xa0, 0x09, 0xe8, 0x07, 0x10, 0x1d, 0x5f, 0x8b, 0xe2, 0x4a, 0x2f, 0x99, 0xe5, 0x2a, 0x47,
+	0x92, 0x51, 0x86, 0x63, 0xfa, 0x47, 0x00, 0x31, 0xce, 0x66, 0xec, 0x62, 0x63, 0x8f, 0xc7, 0x90,
+	0xbc, 0x10, 0x45, 0xae, 0x2a, 0xc1, 0xeb, 0xb4, 0x37, 0x09, 0xa7, 0x49, 0xd6, 0x02, 0xe4, 0x13,
+	0x48, 0x4e, 0x04, 0x57, 0x32, 0x2f, 0x54, 0x9d, 0x86, 0x93, 0x70, 0x3a, 0x3c, 0xdc, 0x35, 0xfa,
+	0x9f, 0x39, 0x3c, 0x6b, 0x33, 0xc8, 0x04, 0x86, 0x27, 0x62, 0xb1, 0x94, 0xac, 0xae, 0x2b, 0xc1,
+	0xd3, 0x3e, 0xee, 0xe2, 0x43, 0x5a, 0xdf, 0x59, 0xf5, 0x0b, 0x4b, 0xa3, 0x49, 0x30, 0x0d, 0x33,
+	0x1c, 0xd3, 0x5f, 0x03, 0xb8, 0x77, 0x9a, 0x2f, 0x58, 0xf9, 0x56, 0x91, 0x04, 0xfa, 0x3a, 0xc1,
+	0x19, 0xa1, 0xc7, 0x5d, 0xe1, 0xe1, 0xad, 0xc2, 0xfb, 0x77, 0x09, 0xa7, 0x7f, 0x06, 0x10, 0xcf,
+	0x2a, 0x69, 0x3c, 0x7c, 0x97, 0xdd, 0xff, 0xa3, 0x31, 0x29, 0xec, 0xbc, 0xfc, 0x89, 0x33, 0x39,
+	0x9f, 0x59, 0x53, 0x5c, 0x48, 0x3e, 0x82, 0xe8, 0x79, 0x75, 0xcd, 0xea, 0x34, 0x42, 0x92, 0x03,
+	0x4b, 0xd2, 0xf1, 0x23, 0x33, 0x29, 0xf4, 0x9f, 0x00, 0x60, 0x7e, 0x2a, 0x4a, 0xf6, 0x3f, 0xe8,
+	0x7c, 0x02, 0x03, 0xdc, 0xd5, 0x09, 0x75, 0x2c, 0x8d, 0x46, 0x3b, 0xdd, 0xdc, 0xf0, 0xa0, 0xbd,
+	0x61, 0x4d, 0xfb, 0x9d, 0x28, 0x5f, 0x57, 0x0b, 0x96, 0xee, 0x20, 0xec, 0x42, 0xfa, 0x7b, 0x08,
+	0xb1, 0xdb, 0x5e, 0xa7, 0x9d, 0x6b, 0x92, 0xe6, 0x54, 0x2e, 0xd4, 0x97, 0x8d, 0x43, 0x64, 0xee,
+	0x21, 0x45, 0x0b, 0x90, 0x31, 0xc4, 0x92, 0x71, 0x85, 0xb2, 0xcd, 0xb3, 0x68, 0x62, 0xf2, 0x21,
+	0xc0, 0x52, 0x8a, 0x37, 0x55, 0xe9, 0x1d, 0xca, 0x43, 0xc8, 0x14, 0x76, 0x4d, 0xee, 0x59, 0x75,
+	0xc9, 0x73, 0x75, 0x23, 0x4d, 0x6d, 0x26, 0xd9, 0x3a, 0x4c, 0x9e, 0xc2, 0x9e, 0x5b, 0xd7, 0xe6,
+	0x0e, 0x30, 0x77, 0x73, 0x42, 0x6b, 0x2a, 0x6e, 0xa4, 0x64, 0xbc, 0x58, 0xe1, 0x99, 0x93, 0xac,
+	0x89, 0xf5, 0x33, 0xa9, 0x95, 0x90, 0xf9, 0x25, 0xcb, 0x72, 0xc5, 0xd2, 0x18, 0xcf, 0xe3, 0x43,
+	0x5a, 0x35, 0xbb, 0xd4, 0x6f, 0x06, 0x13, 0x12, 0x4c, 0xf0, 0x10, 0xed, 0x47, 0xad, 0x72, 0xa9,
+	0xd0, 0x52, 0x30, 0x7e, 0x34, 0x80, 0xde, 0xbb, 0xbc, 0x91, 0xf8, 0x12, 0xd2, 0x21, 0x4e, 0x36,
+	0xb1, 0x5e, 0x69, 0x0e, 0xf6, 0x2d, 0x5b, 0xa5, 0x23, 0x14, 0xd6, 0x02, 0xf4, 0x7b, 0xd8, 0x3b,
+	0x53, 0x42, 0x32, 0x7b, 0xab, 0x3f, 0xde, 0xb0, 0xda, 0xbb, 0x96, 0xb2, 0x7b, 0x2d, 0x25, 0xa1,
+	0x10, 0xe1, 0x10, 0xaf, 0x64, 0x78, 0x38, 0xea, 0xd4, 0x84, 0x99, 0xa2, 0x07, 0x40, 0x7c, 0xca,
+	0x7a, 0x29, 0x78, 0xcd, 0xe8, 0x11, 0xec, 0x7e, 0xc3, 0xd4, 0x3b, 0x6e, 0x73, 0x00, 0x11, 0x17,
+	0xbc, 0x30, 0x37, 0x3f, 0xca, 0x4c, 0x40, 0x5f, 0xc0, 0xfd, 0x96, 0xc2, 0xd0, 0xb6, 0x82, 0x82,
+	0xb7, 0x0a, 0xd2, 0x6c, 0x4b, 0x29, 0xc4, 0x85, 0x63, 0xc3, 0x80, 0x7e, 0x05, 0xf7, 0x4f, 0xd9,
+	0xa5, 0x50, 0x55, 0xae, 0x98, 0x53, 0xf4, 0x31, 0xc4, 0x85, 0xad, 0x4d, 0x4b, 0xb8, 0xf1, 0x76,
+	0x9a, 0x04, 0xfa, 0x03, 0xec, 0x79, 0x04, 0x56, 0x8f, 0xcf, 0xd0, 0xbb, 0x83, 0x41, 0x5f, 0x3a,
+	0x3a, 0xf5, 0x5a, 0x5c, 0x31, 0x6e, 0x0b, 0xd9, 0x43, 0xe8, 0x3d, 0x18, 0xea, 0xdf, 0x84, 0x55,
+	0x47, 0xff, 0x0a, 0x60, 0xf4, 0xca, 0x15, 0xf2, 0xb6, 0xdf, 0x07, 0x85, 0xd1, 0x22, 0xff, 0xf9,
+	0xb8, 0xf3, 0x6e, 0xa2, 0xac, 0x83, 0x75, 0xca, 0x34, 0xbc, 0xbd, 0x4c, 0xfb, 0x77, 0x95, 0x69,
+	0xb4, 0x51, 0xa6, 0x13, 0x18, 0x2e, 0x2a, 0x3e, 0x73, 0xb5, 0x68, 0x5a, 0x82, 0x0f, 0xd1, 0x2f,
+	0x60, 0x64, 0xce, 0x64, 0x0d, 0x7b, 0x02, 0xfd, 0x8a, 0x5f, 0x08, 0x6b, 0xf7, 0xbe, 0x35, 0xcb,
+	0x3f, 0x66, 0x86, 0x09, 0xf4, 0xef, 0x00, 0x86, 0x99, 0x79, 0xa1, 0x2a, 0x57, 0x75, 0xa7, 0x07,
+	0x04, 0x6b, 0x3d, 0xe0, 0x31, 0x24, 0x45, 0xd3, 0x04, 0x6d, 0xf7, 0x68, 0x00, 0xdd, 0x01, 0x5c,
+	0xc0, 0xca, 0xe3, 0x95, 0x62, 0x35, 0x3a, 0x11, 0x66, 0xeb, 0x30, 0x79, 0x00, 0x83, 0x73, 0xd3,
+	0x03, 0x8d, 0x17, 0x36, 0x72, 0x46, 0xb9, 0xd5, 0x51, 0x6b, 0x94, 0x5b, 0xa9, 0x33, 0x98, 0x7c,
+	0xe3, 0x32, 0xac, 0x11, 0x1e, 0x44, 0x3f, 0x05, 0xe2, 0x1d, 0xc7, 0x55, 0xe0, 0x2d, 0xa7, 0xa2,
+	0x27, 0xb0, 0xdf, 0x59, 0x61, 0x1d, 0x7c, 0x0a, 0x3b, 0x26, 0xa5, 0x4e, 0x03, 0xec, 0xd4, 0xc4,
+	0x9a, 0xe8, 0x27, 0xbb, 0x94, 0xc3, 0xdf, 0x7a, 0x10, 0x3b, 0x77, 0xc9, 0x67, 0xd0, 0xc7, 0x42,
+	0x72, 0x2b, 0xbc, 0x6a, 0x1b, 0xef, 0x77, 0x30, 0xfb, 0x8a, 0xdf, 0x23, 0x5f, 0x43, 0xd2, 0x54,
+	0x3d, 0x79, 0xe8, 0x7e, 0x5e, 0x6b, 0x0f, 0x69, 0x9c, 0x6e, 0x4e, 0x34, 0x0c, 0x27, 0xb6, 0xea,
+	0xcd, 0x3f, 0xcd, 0x65, 0x6e, 0x74, 0xa1, 0xf1, 0xa3, 0x2d, 0x33, 0x0d, 0xc9, 0x97, 0x10, 0xbb,
+	0x5e, 0x40, 0x1e, 0xd8, 0xc4, 0xb5, 0xfe, 0x32, 0x7e, 0xb8, 0x81, 0xbb, 0xe5, 0x87, 0x2f, 0x21,
+	0x3a, 0x2a, 0x17, 0x15, 0x27, 0xcf, 0xbb, 0x45, 0xf5, 0x68, 0x8b, 0x75, 0x96, 0x6d, 0xbc, 0x6d,
+	0xca, 0x11, 0x9e, 0x0f, 0x70, 0xf2, 0xf3, 0x7f, 0x07, 0x00, 0x06, 0xae, 0x75, 0xc2, 0xf3, 0x09,
+	0x00, 0x00,
 }
@@ -0,0 +1,281 @@
+package daemon
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"golang.org/x/net/context"
+	"io"
+	"net"
+	"net/rpc"
+	"path/filepath"
+	core "skybin/core/proto"
+	skybinrepo "skybin/repo"
+	"time"
+)
+
+// Client is a Repo whose operations are carried out by a daemon.
+type Client struct {
+	homedir string
+	rpc     *rpc.Client
+}
+
+// Dial connects to the daemon for the repo in homedir. It fails quickly if
+// no daemon is running.
+func Dial(homedir string) (*Client, error) {
+	conn, err := net.DialTimeout("unix", SocketPath(homedir), time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		homedir: homedir,
+		rpc:     rpc.NewClient(conn),
+	}, nil
+}
+
+func (c *Client) Close() error {
+	return c.rpc.Close()
+}
+
+// newOpID returns a random ID for an operation carried out by the daemon.
+func newOpID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// callOp makes a call for a cancelable operation. If ctx is done before the
+// call returns, the daemon is told to cancel the operation and ctx's error is
+// returned without waiting for the operation to stop.
+func (c *Client) callOp(ctx context.Context, method string, op string, args interface{}, reply interface{}) error {
+	return c.wait(ctx, op, c.rpc.Go(method, args, reply, make(chan *rpc.Call, 1)))
+}
+
+// wait waits for a call made for the operation op, canceling the operation
+// if ctx is done first.
+func (c *Client) wait(ctx context.Context, op string, call *rpc.Call) error {
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		c.cancel(op)
+		return ctx.Err()
+	}
+}
+
+// cancel tells the daemon to cancel an operation, without waiting for it to
+// stop.
+func (c *Client) cancel(op string) {
+	c.rpc.Go("Repo.Cancel", op, &Empty{}, make(chan *rpc.Call, 1))
+}
+
+// openStream opens a stream for op's data and starts op with a call of
+// method, returning the call.
+func (c *Client) openStream(op string, method string, args interface{}) (*rpc.Call, error) {
+	err := c.rpc.Call("Repo.OpenStream", op, &Empty{})
+	if err != nil {
+		return nil, err
+	}
+	return c.rpc.Go(method, args, &Empty{}, make(chan *rpc.Call, 1)), nil
+}
+
+// Info returns the daemon's repo info. If the daemon cannot be reached, the
+// returned info has no config.
+func (c *Client) Info() skybinrepo.Info {
+	var info skybinrepo.Info
+	err := c.rpc.Call("Repo.Info", &Empty{}, &info)
+	if err != nil {
+		return skybinrepo.Info{HomeDir: c.homedir}
+	}
+	return info
+}
+
+func (c *Client) SaveConfig(config *skybinrepo.Config) error {
+	return c.rpc.Call("Repo.SaveConfig", config, &Empty{})
+}
+
+// Put stores a file. The file is read by the daemon, so its path is made
+// absolute, but by default it is named as given.
+func (c *Client) Put(ctx context.Context, filename string, opts *skybinrepo.StorageOptions) error {
+	if opts == nil {
+		info := c.Info()
+		if info.Config == nil {
+			return errors.New("cannot get repo config from daemon")
+		}
+		opts = info.Config.DefaultStorageOpts(filename)
+	}
+	abspath, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	op, err := newOpID()
+	if err != nil {
+		return err
+	}
+	return c.callOp(ctx, "Repo.Put", op, &PutArgs{Op: op, Path: abspath, Opts: opts}, &Empty{})
+}
+
+// PutReader sends the data to the daemon in chunks as it is read, so the file
+// is stored in a single pass as it would be without the daemon.
+func (c *Client) PutReader(ctx context.Context, name string, in io.Reader, opts *skybinrepo.StorageOptions) error {
+	if opts == nil {
+		info := c.Info()
+		if info.Config == nil {
+			return errors.New("cannot get repo config from daemon")
+		}
+		opts = info.Config.DefaultStorageOpts(name)
+	} else {
+		o := *opts
+		o.FileName = name
+		opts = &o
+	}
+	op, err := newOpID()
+	if err != nil {
+		return err
+	}
+	put, err := c.openStream(op, "Repo.PutReader", &PutArgs{Op: op, Opts: opts})
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, readErr := io.ReadFull(in, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			c.cancel(op)
+			return readErr
+		}
+		eof := readErr != nil
+		args := &WriteArgs{Op: op, Data: buf[:n], EOF: eof}
+		err = c.wait(ctx, op, c.rpc.Go("Repo.Write", args, &Empty{}, make(chan *rpc.Call, 1)))
+		if err != nil {
+			break
+		}
+		if eof {
+			return c.wait(ctx, op, put)
+		}
+	}
+	// The put stopped reading the stream; its error says why.
+	if ctx.Err() == nil {
+		if putErr := c.wait(ctx, op, put); putErr != nil {
+			return putErr
+		}
+	}
+	return err
+}
+
+func (c *Client) ListFiles() ([]string, error) {
+	var files []string
+	err := c.rpc.Call("Repo.ListFiles", &Empty{}, &files)
+	return files, err
+}
+
+func (c *Client) Stat(filename string) (*skybinrepo.FileInfo, error) {
+	finfo := &skybinrepo.FileInfo{}
+	err := c.rpc.Call("Repo.Stat", filename, finfo)
+	if err != nil {
+		return nil, err
+	}
+	return finfo, nil
+}
+
+func (c *Client) Get(ctx context.Context, filename string, out io.Writer) error {
+	return c.GetRange(ctx, filename, 0, -1, out)
+}
+
+// GetRange reads the range from the daemon in chunks as it is downloaded,
+// writing each to out.
+func (c *Client) GetRange(ctx context.Context, filename string, offset int64, length int64, out io.Writer) error {
+	op, err := newOpID()
+	if err != nil {
+		return err
+	}
+	args := &GetArgs{
+		Op:     op,
+		Name:   filename,
+		Offset: offset,
+		Length: length,
+	}
+	get, err := c.openStream(op, "Repo.Get", args)
+	if err != nil {
+		return err
+	}
+	for {
+		var reply ReadReply
+		err = c.wait(ctx, op, c.rpc.Go("Repo.Read", op, &reply, make(chan *rpc.Call, 1)))
+		if err != nil {
+			break
+		}
+		if reply.EOF {
+			return c.wait(ctx, op, get)
+		}
+		_, err = out.Write(reply.Data)
+		if err != nil {
+			c.cancel(op)
+			return err
+		}
+	}
+	if ctx.Err() == nil {
+		if getErr := c.wait(ctx, op, get); getErr != nil {
+			return getErr
+		}
+	}
+	return err
+}
+
+func (c *Client) Remove(filename string) error {
+	return c.rpc.Call("Repo.Remove", filename, &Empty{})
+}
+
+func (c *Client) Sync(ctx context.Context) error {
+	op, err := newOpID()
+	if err != nil {
+		return err
+	}
+	return c.callOp(ctx, "Repo.Sync", op, &OpArgs{Op: op}, &Empty{})
+}
+
+func (c *Client) ListProviders() ([]core.PeerInfo, error) {
+	var pvdrs []core.PeerInfo
+	err := c.rpc.Call("Repo.ListProviders", &Empty{}, &pvdrs)
+	return pvdrs, err
+}
+
+func (c *Client) AddProvider(pinfo core.PeerInfo) error {
+	return c.rpc.Call("Repo.AddProvider", &pinfo, &Empty{})
+}
+
+func (c *Client) RemoveProvider(providerID string) error {
+	return c.rpc.Call("Repo.RemoveProvider", providerID, &Empty{})
+}
+
+func (c *Client) ListContracts() ([]*core.Contract, error) {
+	var contracts []*core.Contract
+	err := c.rpc.Call("Repo.ListContracts", &Empty{}, &contracts)
+	return contracts, err
+}
+
+func (c *Client) Billing() ([]*skybinrepo.Bill, error) {
+	var bills []*skybinrepo.Bill
+	err := c.rpc.Call("Repo.Billing", &Empty{}, &bills)
+	return bills, err
+}
+
+func (c *Client) Repair(ctx context.Context) (*skybinrepo.RepairReport, error) {
+	op, err := newOpID()
+	if err != nil {
+		return nil, err
+	}
+	report := &skybinrepo.RepairReport{}
+	err = c.callOp(ctx, "Repo.Repair", op, &OpArgs{Op: op}, report)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (c *Client) SetBandwidthLimits(limits skybinrepo.BandwidthLimits) {
+	c.rpc.Call("Repo.SetBandwidthLimits", &limits, &Empty{})
+}
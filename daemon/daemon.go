@@ -0,0 +1,149 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"path"
+	skybinrepo "skybin/repo"
+	"time"
+)
+
+// SocketPath returns the path of the Unix socket the daemon for the repo in
+// homedir listens on.
+func SocketPath(homedir string) string {
+	return path.Join(homedir, "daemon.sock")
+}
+
+// Daemon owns a repo and serves it to clients over a Unix socket. It runs
+// periodic maintenance on the repo while serving.
+type Daemon struct {
+	repo     skybinrepo.Repo
+	logger   *log.Logger
+	listener net.Listener
+	ctx      context.Context // Canceled when the daemon is closed
+	cancel   context.CancelFunc
+}
+
+// New creates a daemon for repo.
+func New(repo skybinrepo.Repo, logger *log.Logger) *Daemon {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Daemon{
+		repo:   repo,
+		logger: logger,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Listen creates the daemon's socket. A socket left behind by a daemon that
+// is no longer running is replaced.
+func (d *Daemon) Listen() error {
+	sockPath := SocketPath(d.repo.Info().HomeDir)
+	if _, err := os.Stat(sockPath); err == nil {
+		conn, err := net.Dial("unix", sockPath)
+		if err == nil {
+			conn.Close()
+			return errors.New("daemon is already running")
+		}
+		d.logger.Println("removing stale daemon socket")
+		os.Remove(sockPath)
+	}
+
+	listener, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return fmt.Errorf("cannot listen on %s: %s", sockPath, err)
+	}
+	err = os.Chmod(sockPath, 0600)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	d.listener = listener
+	return nil
+}
+
+// Serve handles client connections until the daemon is closed, when it
+// returns nil.
+func (d *Daemon) Serve() error {
+	go d.runPeriodically("sync", d.syncInterval(), func() error {
+		return d.repo.Sync(d.ctx)
+	})
+	go d.runPeriodically("repair", d.repairInterval(), func() error {
+		report, err := d.repo.Repair(d.ctx)
+		if err == nil && len(report.BlocksLost) > 0 {
+			err = fmt.Errorf("%d blocks have no remaining replicas", len(report.BlocksLost))
+		}
+		return err
+	})
+
+	d.logger.Println("Serving repo at", d.listener.Addr())
+	for {
+		conn, err := d.listener.Accept()
+		if err != nil {
+			if d.ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go d.serveConn(conn)
+	}
+}
+
+// serveConn serves a client connection until it closes. Each connection has
+// its own service, so operations the client leaves running when it goes away
+// are canceled, and their streams and cancellations are dropped.
+func (d *Daemon) serveConn(conn net.Conn) {
+	ctx, cancel := context.WithCancel(d.ctx)
+	defer cancel()
+	server := rpc.NewServer()
+	err := server.RegisterName("Repo", newService(ctx, d.repo))
+	if err != nil {
+		d.logger.Println("cannot serve client:", err)
+		conn.Close()
+		return
+	}
+	server.ServeConn(conn)
+}
+
+// Close stops accepting clients, cancels the operations in progress, and
+// removes the daemon's socket.
+func (d *Daemon) Close() error {
+	d.cancel()
+	return d.listener.Close()
+}
+
+func (d *Daemon) syncInterval() time.Duration {
+	return time.Duration(d.repo.Info().Config.SyncInterval) * time.Minute
+}
+
+func (d *Daemon) repairInterval() time.Duration {
+	return time.Duration(d.repo.Info().Config.RepairInterval) * time.Hour
+}
+
+// runPeriodically runs task after every interval. Keeping the user's data
+// safe requires syncing metadata and repairing, which replaces lost replicas
+// and renews contracts before they expire.
+func (d *Daemon) runPeriodically(name string, interval time.Duration, task func() error) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.ctx.Done():
+			return
+		}
+		d.logger.Println("running", name)
+		err := task()
+		if err != nil {
+			d.logger.Println(name, "error:", err)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package daemon
+
+import (
+	"bytes"
+	"errors"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+	core "skybin/core/proto"
+	skybinrepo "skybin/repo"
+	"sync"
+	"testing"
+	"time"
+)
+
+func startDaemon(t *testing.T) (*Daemon, string) {
+	homedir := path.Join(t.TempDir(), "repo")
+	skybinrepo.Init(homedir)
+	repo, err := skybinrepo.OpenAt(homedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	return serveRepo(t, repo), homedir
+}
+
+func serveRepo(t *testing.T, repo skybinrepo.Repo) *Daemon {
+	d := New(repo, log.New(ioutil.Discard, "", 0))
+	err := d.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- d.Serve() }()
+	t.Cleanup(func() {
+		d.Close()
+		if err := <-served; err != nil {
+			t.Error(err)
+		}
+	})
+	return d
+}
+
+// memRepo keeps files in memory, to test how file contents pass between the
+// daemon and its clients.
+type memRepo struct {
+	skybinrepo.Repo
+	homedir string
+
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func newMemRepo(t *testing.T) *memRepo {
+	return &memRepo{
+		homedir: t.TempDir(),
+		files:   make(map[string][]byte),
+	}
+}
+
+func (r *memRepo) Info() skybinrepo.Info {
+	return skybinrepo.Info{HomeDir: r.homedir, Config: &skybinrepo.Config{}}
+}
+
+func (r *memRepo) PutReader(ctx context.Context, name string, in io.Reader, opts *skybinrepo.StorageOptions) error {
+	if name == "refused" {
+		return errors.New("refused")
+	}
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.files[name] = data
+	return nil
+}
+
+func (r *memRepo) GetRange(ctx context.Context, name string, offset int64, length int64, out io.Writer) error {
+	r.mu.Lock()
+	data, exists := r.files[name]
+	r.mu.Unlock()
+	if !exists {
+		return errors.New("no such file")
+	}
+	data = data[offset:]
+	if length >= 0 {
+		data = data[:length]
+	}
+	_, err := out.Write(data)
+	return err
+}
+
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestClient(t *testing.T) {
+	_, homedir := startDaemon(t)
+
+	client, err := Dial(homedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	info := client.Info()
+	if info.HomeDir != homedir || info.Config == nil {
+		t.Fatalf("unexpected repo info %+v", info)
+	}
+
+	pinfo := core.PeerInfo{ID: "provider1", Addr: "127.0.0.1:8002"}
+	err = client.AddProvider(pinfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pvdrs, err := client.ListProviders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pvdrs) != 1 || pvdrs[0] != pinfo {
+		t.Fatalf("expected [%v], got %v", pinfo, pvdrs)
+	}
+
+	// Errors from the repo are returned to the client.
+	err = client.AddProvider(pinfo)
+	if err == nil {
+		t.Fatal("expected error adding duplicate provider")
+	}
+	var buf bytes.Buffer
+	err = client.Get(context.Background(), "missing.txt", &buf)
+	if err == nil {
+		t.Fatal("expected error getting missing file")
+	}
+}
+
+func TestSecondDaemonRefused(t *testing.T) {
+	d, _ := startDaemon(t)
+
+	other := New(d.repo, log.New(ioutil.Discard, "", 0))
+	err := other.Listen()
+	if err == nil {
+		t.Fatal("expected second daemon to fail to listen")
+	}
+}
+
+func TestDialWithoutDaemon(t *testing.T) {
+	_, err := Dial(t.TempDir())
+	if err == nil {
+		t.Fatal("expected dial to fail with no daemon running")
+	}
+}
+
+func TestCancelOperation(t *testing.T) {
+	s := newService(context.Background(), nil)
+	ctx, end := s.begin("op1")
+	defer end()
+	s.Cancel("op1", &Empty{})
+	if ctx.Err() != context.Canceled {
+		t.Fatalf("expected operation to be canceled, got %v", ctx.Err())
+	}
+
+	// A cancellation arriving before its operation cancels it as it starts.
+	s.Cancel("op2", &Empty{})
+	ctx, end = s.begin("op2")
+	defer end()
+	if ctx.Err() != context.Canceled {
+		t.Fatalf("expected operation to start canceled, got %v", ctx.Err())
+	}
+	if len(s.canceled) != 0 {
+		t.Fatal("expected early cancellation to be forgotten once used")
+	}
+}
+
+func TestCancellationAfterOperationForgotten(t *testing.T) {
+	s := newService(context.Background(), nil)
+	_, end := s.begin("op1")
+	end()
+	s.Cancel("op1", &Empty{})
+	s.canceled["op1"] = time.Now().Add(-2 * cancelMemory)
+	s.Cancel("op2", &Empty{})
+	if _, exists := s.canceled["op1"]; exists {
+		t.Fatal("expected stale cancellation to be forgotten")
+	}
+}
+
+func TestClientGetStreamsRange(t *testing.T) {
+	repo := newMemRepo(t)
+	data := randomData(3*streamChunkSize + 100)
+	repo.files["file"] = data
+	serveRepo(t, repo)
+
+	client, err := Dial(repo.homedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var buf bytes.Buffer
+	err = client.GetRange(context.Background(), "file", 10, int64(len(data)-20), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data[10:len(data)-10]) {
+		t.Fatal("range read through the daemon differs from the file")
+	}
+
+	// The client can be reused once the stream has ended.
+	buf.Reset()
+	err = client.Get(context.Background(), "missing", &buf)
+	if err == nil || err.Error() != "no such file" {
+		t.Fatalf("expected the repo's error, got %v", err)
+	}
+}
+
+func TestClientPutReaderStreams(t *testing.T) {
+	repo := newMemRepo(t)
+	serveRepo(t, repo)
+
+	client, err := Dial(repo.homedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	data := randomData(2*streamChunkSize + 100)
+	opts := &skybinrepo.StorageOptions{}
+	err = client.PutReader(context.Background(), "file", bytes.NewReader(data), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(repo.files["file"], data) {
+		t.Fatal("file stored through the daemon differs from the input")
+	}
+
+	// A put that stops reading returns its own error to the client.
+	err = client.PutReader(context.Background(), "refused", bytes.NewReader(data), opts)
+	if err == nil || err.Error() != "refused" {
+		t.Fatalf("expected the repo's error, got %v", err)
+	}
+}
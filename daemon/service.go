@@ -0,0 +1,287 @@
+package daemon
+
+import (
+	"golang.org/x/net/context"
+	core "skybin/core/proto"
+	skybinrepo "skybin/repo"
+	"sync"
+	"time"
+)
+
+// cancelMemory is how long a cancellation is kept waiting for its operation
+// to start. The client sends the operation's call first, so only a
+// cancellation arriving after the operation ended waits this long.
+const cancelMemory = time.Minute
+
+// Service exposes a repo's operations over net/rpc to a single client
+// connection. Files named by the client are passed by path, since the daemon
+// and its clients share a filesystem. File contents are passed through
+// streams: the client opens a stream with OpenStream, then writes a file's
+// contents to it with Write or reads them from it with Read.
+//
+// net/rpc calls can't be canceled, so operations that contact providers are
+// given an ID by the client, which names it in a call to Cancel to stop the
+// operation.
+type Service struct {
+	repo skybinrepo.Repo
+	ctx  context.Context // Parent of every operation's context
+
+	mu       sync.Mutex
+	ops      map[string]context.CancelFunc // Operations in progress by ID
+	canceled map[string]time.Time          // Operations canceled before they started, by when
+	streams  map[string]*stream            // Streams opened for operations by ID
+}
+
+func newService(ctx context.Context, repo skybinrepo.Repo) *Service {
+	return &Service{
+		repo:     repo,
+		ctx:      ctx,
+		ops:      make(map[string]context.CancelFunc),
+		canceled: make(map[string]time.Time),
+		streams:  make(map[string]*stream),
+	}
+}
+
+type Empty struct{}
+
+// OpArgs identifies an operation so that it can be canceled.
+type OpArgs struct {
+	Op string
+}
+
+type PutArgs struct {
+	Op   string
+	Path string // Unset when the file's contents are streamed
+	Opts *skybinrepo.StorageOptions
+}
+
+// WriteArgs holds the next chunk of a stream.
+type WriteArgs struct {
+	Op   string
+	Data []byte
+	EOF  bool // Set on the last chunk
+}
+
+type GetArgs struct {
+	Op     string
+	Name   string
+	Offset int64
+	Length int64 // Negative to read to the end of the file
+}
+
+// ReadReply holds the next chunk of a stream.
+type ReadReply struct {
+	Data []byte
+	EOF  bool // Set once the operation has written everything
+}
+
+// begin returns the context of the operation with the given ID. The returned
+// function must be called when the operation ends.
+func (s *Service) begin(op string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	if len(op) == 0 {
+		return ctx, cancel
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.canceled[op]; exists {
+		delete(s.canceled, op)
+		cancel()
+	}
+	s.ops[op] = cancel
+	return ctx, func() {
+		s.mu.Lock()
+		delete(s.ops, op)
+		s.mu.Unlock()
+		cancel()
+	}
+}
+
+// Cancel stops the operation with the given ID. The call may arrive before
+// the operation's own, in which case the operation is canceled as it starts.
+// A cancellation arriving after its operation ended is forgotten after
+// cancelMemory.
+func (s *Service) Cancel(op string, reply *Empty) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cancel, exists := s.ops[op]; exists {
+		cancel()
+		return nil
+	}
+	now := time.Now()
+	for other, at := range s.canceled {
+		if now.Sub(at) > cancelMemory {
+			delete(s.canceled, other)
+		}
+	}
+	s.canceled[op] = now
+	return nil
+}
+
+// OpenStream opens a stream for the operation with the given ID. It must be
+// called before the operation's own call.
+func (s *Service) OpenStream(op string, reply *Empty) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streams[op] = newStream()
+	return nil
+}
+
+// stream returns the stream opened for op.
+func (s *Service) stream(op string) (*stream, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, exists := s.streams[op]
+	return st, exists
+}
+
+func (s *Service) closeStream(op string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, op)
+}
+
+// Write passes the next chunk to the operation the stream was opened for,
+// returning once the operation has taken it.
+func (s *Service) Write(args *WriteArgs, reply *Empty) error {
+	st, exists := s.stream(args.Op)
+	if !exists {
+		return errStreamClosed
+	}
+	if len(args.Data) > 0 {
+		err := st.send(args.Data)
+		if err != nil {
+			return err
+		}
+	}
+	if args.EOF {
+		close(st.chunks)
+	}
+	return nil
+}
+
+// Read returns the next chunk written by the operation the stream was
+// opened for. Once the operation has ended, its stream is gone and EOF is set.
+func (s *Service) Read(op string, reply *ReadReply) error {
+	st, exists := s.stream(op)
+	if !exists {
+		reply.EOF = true
+		return nil
+	}
+	chunk, err := st.receive()
+	if err != nil {
+		reply.EOF = true
+		return nil
+	}
+	reply.Data = chunk
+	return nil
+}
+
+func (s *Service) Info(args *Empty, reply *skybinrepo.Info) error {
+	*reply = s.repo.Info()
+	return nil
+}
+
+func (s *Service) SaveConfig(config *skybinrepo.Config, reply *Empty) error {
+	return s.repo.SaveConfig(config)
+}
+
+func (s *Service) Put(args *PutArgs, reply *Empty) error {
+	ctx, end := s.begin(args.Op)
+	defer end()
+	return s.repo.Put(ctx, args.Path, args.Opts)
+}
+
+// PutReader stores the contents written to the stream opened for the
+// operation as the file named in its options.
+func (s *Service) PutReader(args *PutArgs, reply *Empty) error {
+	ctx, end := s.begin(args.Op)
+	defer end()
+	st, exists := s.stream(args.Op)
+	if !exists {
+		return errStreamClosed
+	}
+	defer close(st.ended)
+	defer s.closeStream(args.Op)
+	return s.repo.PutReader(ctx, args.Opts.FileName, &streamReader{ctx: ctx, st: st}, args.Opts)
+}
+
+func (s *Service) ListFiles(args *Empty, reply *[]string) error {
+	files, err := s.repo.ListFiles()
+	*reply = files
+	return err
+}
+
+func (s *Service) Stat(name string, reply *skybinrepo.FileInfo) error {
+	finfo, err := s.repo.Stat(name)
+	if err != nil {
+		return err
+	}
+	*reply = *finfo
+	return nil
+}
+
+// Get writes a file's contents to the stream opened for the operation.
+func (s *Service) Get(args *GetArgs, reply *Empty) error {
+	ctx, end := s.begin(args.Op)
+	defer end()
+	st, exists := s.stream(args.Op)
+	if !exists {
+		return errStreamClosed
+	}
+	defer s.closeStream(args.Op)
+	defer close(st.chunks)
+	return s.repo.GetRange(ctx, args.Name, args.Offset, args.Length, &streamWriter{ctx: ctx, st: st})
+}
+
+func (s *Service) Remove(name string, reply *Empty) error {
+	return s.repo.Remove(name)
+}
+
+func (s *Service) Sync(args *OpArgs, reply *Empty) error {
+	ctx, end := s.begin(args.Op)
+	defer end()
+	return s.repo.Sync(ctx)
+}
+
+func (s *Service) ListProviders(args *Empty, reply *[]core.PeerInfo) error {
+	pvdrs, err := s.repo.ListProviders()
+	*reply = pvdrs
+	return err
+}
+
+func (s *Service) AddProvider(pinfo *core.PeerInfo, reply *Empty) error {
+	return s.repo.AddProvider(*pinfo)
+}
+
+func (s *Service) RemoveProvider(providerID string, reply *Empty) error {
+	return s.repo.RemoveProvider(providerID)
+}
+
+func (s *Service) ListContracts(args *Empty, reply *[]*core.Contract) error {
+	contracts, err := s.repo.ListContracts()
+	*reply = contracts
+	return err
+}
+
+func (s *Service) Billing(args *Empty, reply *[]*skybinrepo.Bill) error {
+	bills, err := s.repo.Billing()
+	*reply = bills
+	return err
+}
+
+func (s *Service) Repair(args *OpArgs, reply *skybinrepo.RepairReport) error {
+	ctx, end := s.begin(args.Op)
+	defer end()
+	report, err := s.repo.Repair(ctx)
+	if err != nil {
+		return err
+	}
+	*reply = *report
+	return nil
+}
+
+func (s *Service) SetBandwidthLimits(limits *skybinrepo.BandwidthLimits, reply *Empty) error {
+	s.repo.SetBandwidthLimits(*limits)
+	return nil
+}
@@ -0,0 +1,98 @@
+package daemon
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"io"
+)
+
+// streamChunkSize is the most data passed in a single call of a stream.
+const streamChunkSize = 256 * 1024
+
+var errStreamClosed = errors.New("stream is closed")
+
+// stream passes a file's data between a client and an operation over the
+// daemon's socket, in chunks carried by the client's calls. The operation
+// reads or writes the stream as it would a file, and is held up while the
+// client is slow, so no side buffers more than a chunk.
+type stream struct {
+	chunks chan []byte
+	ended  chan struct{} // Closed when a put using the stream ends
+}
+
+func newStream() *stream {
+	return &stream{
+		chunks: make(chan []byte),
+		ended:  make(chan struct{}),
+	}
+}
+
+// send passes a chunk written by the client to a put.
+func (st *stream) send(chunk []byte) error {
+	select {
+	case st.chunks <- chunk:
+		return nil
+	case <-st.ended:
+		return errStreamClosed
+	}
+}
+
+// receive returns the next chunk written by a get, or io.EOF once the get
+// has ended.
+func (st *stream) receive() ([]byte, error) {
+	chunk, ok := <-st.chunks
+	if !ok {
+		return nil, io.EOF
+	}
+	return chunk, nil
+}
+
+// streamReader reads the chunks a client sends for an operation.
+type streamReader struct {
+	ctx  context.Context // The operation's context
+	st   *stream
+	rest []byte // Part of the last chunk not yet read
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	if len(r.rest) == 0 {
+		select {
+		case chunk, ok := <-r.st.chunks:
+			if !ok {
+				return 0, io.EOF
+			}
+			r.rest = chunk
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+	}
+	n := copy(p, r.rest)
+	r.rest = r.rest[n:]
+	return n, nil
+}
+
+// streamWriter writes an operation's output as chunks for a client to read.
+type streamWriter struct {
+	ctx context.Context // The operation's context
+	st  *stream
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > streamChunkSize {
+			n = streamChunkSize
+		}
+		chunk := make([]byte, n)
+		copy(chunk, p)
+		select {
+		case w.st.chunks <- chunk:
+		case <-w.ctx.Done():
+			return written, w.ctx.Err()
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
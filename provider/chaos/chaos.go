@@ -0,0 +1,260 @@
+package chaos
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"math/rand"
+	core "skybin/core/proto"
+	"sync"
+	"time"
+)
+
+// Faults that can be injected into requests.
+const (
+	Latency  = "latency"  // Delay the request by LatencyMs
+	Error    = "error"    // Fail the request
+	Drop     = "drop"     // Fail the request as if the connection dropped
+	Corrupt  = "corrupt"  // Flip bits in stored or retrieved block data
+	Truncate = "truncate" // Cut stored or retrieved block data in half
+	Refuse   = "refuse"   // Return negotiated contracts unsigned
+	Lose     = "lose"     // Fail block retrievals as if the block was never stored
+)
+
+// Provider methods that rules can match.
+const (
+	Info       = "Info"
+	Negotiate  = "Negotiate"
+	StoreBlock = "StoreBlock"
+	GetBlock   = "GetBlock"
+)
+
+// Rule describes a fault and the requests it is injected into.
+type Rule struct {
+	Fault       string  `json:"fault"`
+	Method      string  `json:"method"`      // Method to match. Empty matches all methods.
+	BlockID     string  `json:"blockId"`     // Block to match. Empty matches all blocks.
+	Probability float64 `json:"probability"` // Chance of injecting into a matching request. Zero means always.
+	After       int     `json:"after"`       // Number of matching requests to let through first
+	Count       int     `json:"count"`       // Maximum number of injections. Zero means unlimited.
+	LatencyMs   int     `json:"latencyMs"`
+	Message     string  `json:"message"` // Message for injected errors
+}
+
+// Policy is a script of rules applied to each request in order. Latency
+// from all applicable rules is added together; otherwise the first applicable
+// rule decides the request's fault.
+type Policy struct {
+	Rules []Rule `json:"rules"`
+	Seed  int64  `json:"seed"` // Seeds random choices so runs can be reproduced
+}
+
+// LoadPolicy reads a policy from a JSON file.
+func LoadPolicy(filename string) (*Policy, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	policy := &Policy{}
+	err = json.Unmarshal(data, policy)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse chaos policy: %s", err)
+	}
+	return policy, policy.validate()
+}
+
+func (policy *Policy) validate() error {
+	for i, rule := range policy.Rules {
+		switch rule.Fault {
+		case Latency, Error, Drop, Corrupt, Truncate, Refuse, Lose:
+		default:
+			return fmt.Errorf("rule %d: unknown fault %q", i+1, rule.Fault)
+		}
+		switch rule.Method {
+		case "", Info, Negotiate, StoreBlock, GetBlock:
+		default:
+			return fmt.Errorf("rule %d: unknown method %q", i+1, rule.Method)
+		}
+	}
+	return nil
+}
+
+type ruleState struct {
+	Rule
+	matched  int
+	injected int
+}
+
+// Provider wraps a core.Provider, injecting faults according to a policy.
+type Provider struct {
+	core.Provider
+	mu    sync.Mutex
+	rules []*ruleState
+	rand  *rand.Rand
+}
+
+// New wraps provider with the given policy. A nil policy injects no faults.
+func New(provider core.Provider, policy *Policy) *Provider {
+	p := &Provider{Provider: provider}
+	p.SetPolicy(policy)
+	return p
+}
+
+// SetPolicy replaces the provider's policy, resetting rule counts.
+func (p *Provider) SetPolicy(policy *Policy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if policy == nil {
+		policy = &Policy{}
+	}
+	p.rules = nil
+	for _, rule := range policy.Rules {
+		p.rules = append(p.rules, &ruleState{Rule: rule})
+	}
+	p.rand = rand.New(rand.NewSource(policy.Seed))
+}
+
+// inject applies latency from matching rules and returns the first other
+// fault to inject into the request, if any. It returns ctx's error if ctx is
+// done during the delay.
+func (p *Provider) inject(ctx context.Context, method string, blockID string) (*Rule, error) {
+	p.mu.Lock()
+	var delay time.Duration
+	var fault *Rule
+	for _, rule := range p.rules {
+		if len(rule.Method) > 0 && rule.Method != method {
+			continue
+		}
+		if len(rule.BlockID) > 0 && rule.BlockID != blockID {
+			continue
+		}
+		if rule.Fault != Latency && fault != nil {
+			continue
+		}
+		rule.matched++
+		if rule.matched <= rule.After {
+			continue
+		}
+		if rule.Count > 0 && rule.injected >= rule.Count {
+			continue
+		}
+		if rule.Probability > 0 && p.rand.Float64() >= rule.Probability {
+			continue
+		}
+		rule.injected++
+		if rule.Fault == Latency {
+			delay += time.Duration(rule.LatencyMs) * time.Millisecond
+		} else {
+			r := rule.Rule
+			fault = &r
+		}
+	}
+	p.mu.Unlock()
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return fault, nil
+}
+
+func (rule *Rule) err() error {
+	msg := rule.Message
+	if len(msg) == 0 {
+		msg = "injected " + rule.Fault
+	}
+	switch rule.Fault {
+	case Drop:
+		return status.Error(codes.Unavailable, "chaos: "+msg)
+	case Lose:
+		return status.Error(codes.NotFound, "chaos: "+msg)
+	}
+	return errors.New("chaos: " + msg)
+}
+
+// damage returns a corrupted or truncated copy of a block.
+func (rule *Rule) damage(block []byte) []byte {
+	switch rule.Fault {
+	case Corrupt:
+		damaged := append([]byte{}, block...)
+		for i := 0; i < len(damaged); i += 512 {
+			damaged[i] ^= 0xff
+		}
+		return damaged
+	case Truncate:
+		return block[:len(block)/2]
+	}
+	return block
+}
+
+func (p *Provider) Info(ctx context.Context) (*core.ProviderInfo, error) {
+	fault, err := p.inject(ctx, Info, "")
+	if err != nil {
+		return nil, err
+	}
+	if fault != nil && (fault.Fault == Error || fault.Fault == Drop) {
+		return nil, fault.err()
+	}
+	return p.Provider.Info(ctx)
+}
+
+func (p *Provider) Negotiate(ctx context.Context, contract *core.Contract) (*core.Contract, error) {
+	fault, err := p.inject(ctx, Negotiate, contract.BlockID)
+	if err != nil {
+		return nil, err
+	}
+	if fault != nil {
+		switch fault.Fault {
+		case Error, Drop:
+			return nil, fault.err()
+		case Refuse:
+			c := *contract
+			c.ProviderSignature = ""
+			return &c, nil
+		}
+	}
+	return p.Provider.Negotiate(ctx, contract)
+}
+
+func (p *Provider) StoreBlock(ctx context.Context, id string, block []byte) error {
+	fault, err := p.inject(ctx, StoreBlock, id)
+	if err != nil {
+		return err
+	}
+	if fault != nil {
+		switch fault.Fault {
+		case Error, Drop:
+			return fault.err()
+		case Corrupt, Truncate:
+			block = fault.damage(block)
+		}
+	}
+	return p.Provider.StoreBlock(ctx, id, block)
+}
+
+func (p *Provider) GetBlock(ctx context.Context, id string) ([]byte, error) {
+	fault, err := p.inject(ctx, GetBlock, id)
+	if err != nil {
+		return nil, err
+	}
+	if fault != nil && (fault.Fault == Error || fault.Fault == Drop || fault.Fault == Lose) {
+		return nil, fault.err()
+	}
+	block, err := p.Provider.GetBlock(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if fault != nil {
+		block = fault.damage(block)
+	}
+	return block, nil
+}
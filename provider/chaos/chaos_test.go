@@ -0,0 +1,112 @@
+package chaos
+
+import (
+	"bytes"
+	"errors"
+	"golang.org/x/net/context"
+	core "skybin/core/proto"
+	"testing"
+	"time"
+)
+
+// memProvider stores blocks in memory.
+type memProvider struct {
+	blocks map[string][]byte
+}
+
+func (p *memProvider) Info(ctx context.Context) (*core.ProviderInfo, error) {
+	return &core.ProviderInfo{ID: "mem"}, nil
+}
+
+func (p *memProvider) Negotiate(ctx context.Context, contract *core.Contract) (*core.Contract, error) {
+	c := *contract
+	c.ProviderSignature = "sig"
+	return &c, nil
+}
+
+func (p *memProvider) StoreBlock(ctx context.Context, id string, block []byte) error {
+	p.blocks[id] = block
+	return nil
+}
+
+func (p *memProvider) GetBlock(ctx context.Context, id string) ([]byte, error) {
+	block, exists := p.blocks[id]
+	if !exists {
+		return nil, errors.New("no such block")
+	}
+	return block, nil
+}
+
+func TestRuleAfterAndCount(t *testing.T) {
+	p := New(&memProvider{blocks: make(map[string][]byte)}, &Policy{
+		Rules: []Rule{{Fault: Error, Method: StoreBlock, After: 1, Count: 2}},
+	})
+
+	var failed []bool
+	for i := 0; i < 5; i++ {
+		err := p.StoreBlock(context.Background(), "block", []byte("data"))
+		failed = append(failed, err != nil)
+	}
+	expected := []bool{false, true, true, false, false}
+	for i := range expected {
+		if failed[i] != expected[i] {
+			t.Fatalf("request %d: expected failure %v, got %v", i, expected[i], failed[i])
+		}
+	}
+}
+
+func TestDamageBlocks(t *testing.T) {
+	mem := &memProvider{blocks: make(map[string][]byte)}
+	mem.blocks["block"] = []byte("hello world")
+	p := New(mem, &Policy{
+		Rules: []Rule{
+			{Fault: Truncate, Method: GetBlock, Count: 1},
+			{Fault: Corrupt, Method: GetBlock},
+		},
+	})
+
+	block, err := p.GetBlock(context.Background(), "block")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(block) != "hello" {
+		t.Fatalf("expected truncated block, got %q", block)
+	}
+
+	block, err = p.GetBlock(context.Background(), "block")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(block) != len("hello world") || bytes.Equal(block, mem.blocks["block"]) {
+		t.Fatalf("expected corrupted block, got %q", block)
+	}
+}
+
+func TestRefuseNegotiation(t *testing.T) {
+	p := New(&memProvider{}, &Policy{
+		Rules: []Rule{{Fault: Refuse}},
+	})
+	c, err := p.Negotiate(context.Background(), &core.Contract{BlockID: "block"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.ProviderSignature) > 0 {
+		t.Fatal("expected unsigned contract")
+	}
+}
+
+func TestLatencyStopsWhenCanceled(t *testing.T) {
+	p := New(&memProvider{}, &Policy{
+		Rules: []Rule{{Fault: Latency, LatencyMs: 60 * 1000}},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := p.Info(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Fatal("injected latency ignored the deadline")
+	}
+}
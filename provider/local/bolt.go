@@ -0,0 +1,149 @@
+package peer
+
+import (
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"path"
+	"time"
+)
+
+var (
+	blocksBucket     = []byte("blocks")
+	checksumsBucket  = []byte("checksums")
+	quarantineBucket = []byte("quarantine")
+)
+
+// boltStore stores blocks in a bbolt database. Blocks and their checksums
+// are written in the same transaction.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(filename string) (*boltStore, error) {
+	err := os.MkdirAll(path.Dir(filename), 0700)
+	if err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{blocksBucket, checksumsBucket, quarantineBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Put(id string, block []byte) error {
+	if err := checkBlockId(id); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(blocksBucket).Put([]byte(id), block)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(checksumsBucket).Put([]byte(id), []byte(checksum(block)))
+	})
+}
+
+func (s *boltStore) putUnchecked(id string, block []byte) error {
+	if err := checkBlockId(id); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(blocksBucket).Put([]byte(id), block)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(checksumsBucket).Delete([]byte(id))
+	})
+}
+
+func (s *boltStore) Get(id string) ([]byte, error) {
+	var block []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(blocksBucket).Get([]byte(id))
+		if v == nil {
+			return &os.PathError{Op: "get", Path: id, Err: os.ErrNotExist}
+		}
+		sum := tx.Bucket(checksumsBucket).Get([]byte(id))
+		if sum != nil && string(sum) != checksum(v) {
+			return ErrCorruptBlock
+		}
+		block = append([]byte{}, v...)
+		return nil
+	})
+	return block, err
+}
+
+func (s *boltStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(blocksBucket).Delete([]byte(id))
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(checksumsBucket).Delete([]byte(id))
+	})
+}
+
+func (s *boltStore) Quarantine(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		v := tx.Bucket(blocksBucket).Get([]byte(id))
+		if v == nil {
+			return &os.PathError{Op: "quarantine", Path: id, Err: os.ErrNotExist}
+		}
+		sum := tx.Bucket(checksumsBucket).Get([]byte(id))
+		if sum == nil || string(sum) == checksum(v) {
+			return ErrBlockIntact
+		}
+		err := tx.Bucket(quarantineBucket).Put([]byte(quarantineName(id)), v)
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(blocksBucket).Delete([]byte(id))
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(checksumsBucket).Delete([]byte(id))
+	})
+}
+
+func (s *boltStore) AddChecksum(id string, verify func(block []byte) bool) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		v := tx.Bucket(blocksBucket).Get([]byte(id))
+		if v == nil {
+			return &os.PathError{Op: "add checksum", Path: id, Err: os.ErrNotExist}
+		}
+		sums := tx.Bucket(checksumsBucket)
+		if sums.Get([]byte(id)) != nil {
+			return nil
+		}
+		if !verify(v) {
+			return ErrUnverifiedBlock
+		}
+		return sums.Put([]byte(id), []byte(checksum(v)))
+	})
+}
+
+func (s *boltStore) Walk(fn func(id string, size int64) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(blocksBucket).ForEach(func(k, v []byte) error {
+			return fn(string(k), int64(len(v)))
+		})
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
@@ -2,15 +2,16 @@ package peer
 
 import (
 	"fmt"
-	"io/ioutil"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"os"
-	"path"
 	core "skybin/core/proto"
 )
 
 type Options struct {
 	core.ProviderInfo
-	Dir string // Dir is the directory where peers' content is stored.
+	Store BlockStore // Store holds peers' content.
 }
 
 func New(options Options) (core.Provider, error) {
@@ -24,35 +25,72 @@ type provider struct {
 	Options
 }
 
-func (p *provider) Info() (*core.ProviderInfo, error) {
+func (p *provider) Info(ctx context.Context) (*core.ProviderInfo, error) {
 	return &p.ProviderInfo, nil
 }
 
-func (p *provider) Negotiate(contract *core.Contract) (*core.Contract, error) {
+// Negotiate signs contracts that meet the provider's terms. Contracts
+// offering a lower price or a shorter duration than the provider accepts are
+// returned unsigned with the provider's terms filled in, as a counter-offer.
+// Blocks larger than the provider's maximum are refused.
+func (p *provider) Negotiate(ctx context.Context, contract *core.Contract) (*core.Contract, error) {
+	if p.MaxBlockSize > 0 && contract.BlockSize > int64(p.MaxBlockSize) {
+		return nil, fmt.Errorf("block size %d exceeds maximum of %d", contract.BlockSize, p.MaxBlockSize)
+	}
 
-	// TODO: Implement.
 	c := *contract
+	c.ProviderSignature = ""
+	counter := false
+	charges := p.StorageRate > 0 || p.EgressRate > 0
+	if charges && c.Currency != p.Currency {
+		c.Currency = p.Currency
+		c.StorageRate = p.StorageRate
+		c.EgressRate = p.EgressRate
+		counter = true
+	}
+	if c.StorageRate < p.StorageRate {
+		c.StorageRate = p.StorageRate
+		counter = true
+	}
+	if c.EgressRate < p.EgressRate {
+		c.EgressRate = p.EgressRate
+		counter = true
+	}
+	if c.Duration < p.MinDuration {
+		c.Duration = p.MinDuration
+		counter = true
+	}
+	if counter {
+		return &c, nil
+	}
+
+	// TODO: Sign with the provider's key.
 	c.ProviderSignature = "sig"
 	return &c, nil
 }
 
-func (p *provider) StoreBlock(ID string, block []byte) error {
-	path := path.Join(p.Dir, ID)
-
-	ioutil.WriteFile(path, block, 0666)
-
-	return nil
+func (p *provider) StoreBlock(ctx context.Context, ID string, block []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return p.Store.Put(ID, block)
 }
 
-func (p *provider) GetBlock(ID string) (block []byte, err error) {
-	path := path.Join(p.Dir, ID)
-
-	block, err = ioutil.ReadFile(path)
+func (p *provider) GetBlock(ctx context.Context, ID string) (block []byte, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	block, err = p.Store.Get(ID)
+	if err == ErrCorruptBlock && p.Store.Quarantine(ID) == ErrBlockIntact {
+		// The block was replaced after it was read.
+		block, err = p.Store.Get(ID)
+	}
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("No block with id %s", ID)
+		// A corrupt block has been quarantined, so it is gone too.
+		if err == ErrCorruptBlock || os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "No block with id %s", ID)
 		}
-		return nil, fmt.Errorf("Error reading block %s", ID)
+		return nil, status.Errorf(codes.Internal, "Error reading block %s", ID)
 	}
 	return block, nil
 }
@@ -0,0 +1,34 @@
+package peer
+
+import (
+	"golang.org/x/net/context"
+	"os"
+	core "skybin/core/proto"
+	"testing"
+)
+
+func TestGetBlockQuarantinesCorruptBlock(t *testing.T) {
+	store := openTestStore(t, FlatStore)
+	pvdr, err := New(Options{ProviderInfo: core.ProviderInfo{ID: "provider"}, Store: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	err = pvdr.StoreBlock(ctx, "block", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt(t, store, "block", []byte("jello"))
+
+	_, err = pvdr.GetBlock(ctx, "block")
+	if err == nil {
+		t.Fatal("expected corrupt block not to be served")
+	}
+	_, err = store.Get("block")
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected corrupt block to be quarantined, got %v", err)
+	}
+	if n := quarantined(t, store); n != 1 {
+		t.Fatalf("expected 1 quarantined copy, got %d", n)
+	}
+}
@@ -0,0 +1,60 @@
+package peer
+
+import (
+	"os"
+	core "skybin/core/proto"
+)
+
+// ScrubReport describes the result of scrubbing a block store.
+type ScrubReport struct {
+	Checked     int      // Number of blocks read
+	Quarantined []string // IDs of blocks that failed verification
+	Failed      []string // IDs of blocks that could not be read
+	Unverified  []string // IDs of blocks with no checksum that could not be verified
+}
+
+// Scrub reads every block in the store, verifying it against its checksum,
+// and quarantines blocks that fail verification. Blocks stored before
+// checksums were recorded are verified against their ID if they are named
+// by the hash of their content, as file blocks are, and their checksum is
+// recorded. Others, such as metadata blocks named by their owner and path,
+// can't be verified and are reported.
+func Scrub(store BlockStore) (*ScrubReport, error) {
+	var ids []string
+	err := store.Walk(func(id string, size int64) error {
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ScrubReport{}
+	for _, id := range ids {
+		_, err := store.Get(id)
+		report.Checked++
+		if err == nil {
+			err = store.AddChecksum(id, func(block []byte) bool {
+				return core.ContentID(block) == id
+			})
+			if err == ErrUnverifiedBlock {
+				report.Unverified = append(report.Unverified, id)
+			} else if err != nil && !os.IsNotExist(err) {
+				report.Failed = append(report.Failed, id)
+			}
+		} else if err == ErrCorruptBlock {
+			err = store.Quarantine(id)
+			if err == ErrBlockIntact {
+				continue // Replaced since it was read
+			}
+			if err != nil {
+				report.Failed = append(report.Failed, id)
+				continue
+			}
+			report.Quarantined = append(report.Quarantined, id)
+		} else if err != nil {
+			report.Failed = append(report.Failed, id)
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,451 @@
+package peer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	core "skybin/core/proto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrCorruptBlock is returned when a stored block does not match its checksum.
+var ErrCorruptBlock = errors.New("block does not match its checksum")
+
+// ErrBlockIntact is returned when asked to quarantine a block that matches
+// its checksum, such as one replaced since it failed verification.
+var ErrBlockIntact = errors.New("block matches its checksum")
+
+// ErrUnverifiedBlock is returned when a block stored without a checksum
+// cannot be verified by other means.
+var ErrUnverifiedBlock = errors.New("block has no checksum and cannot be verified")
+
+// BlockStore persists blocks by ID.
+type BlockStore interface {
+	// Put stores a block and its checksum, replacing any existing block with
+	// the same ID. A block is either stored completely or not at all, and a
+	// crash never leaves a block with no checksum or with an old one that
+	// matches it.
+	Put(id string, block []byte) error
+
+	// Get retrieves a block. If the block does not exist, the returned
+	// error satisfies os.IsNotExist. If the block does not match its
+	// checksum, ErrCorruptBlock is returned.
+	Get(id string) ([]byte, error)
+
+	// Delete removes a block. Deleting a missing block is not an error.
+	Delete(id string) error
+
+	// Quarantine moves a block that does not match its checksum out of the
+	// store so it is no longer served. The block is kept for inspection,
+	// alongside any earlier quarantined copies. If the block matches its
+	// checksum, it is left in place and ErrBlockIntact is returned.
+	Quarantine(id string) error
+
+	// AddChecksum records the checksum of a block stored before checksums
+	// were recorded, if verify accepts the block's data. A block that has a
+	// checksum is left alone. If verify rejects the block,
+	// ErrUnverifiedBlock is returned and the block is left as it is.
+	AddChecksum(id string, verify func(block []byte) bool) error
+
+	// Walk calls fn with the ID and size of each stored block. Walk stops
+	// and returns the error if fn returns one. fn must not modify the store.
+	Walk(fn func(id string, size int64) error) error
+
+	Close() error
+}
+
+// quarantineDirName names the directory quarantined blocks are moved to.
+const quarantineDirName = "quarantine"
+
+// Block store types.
+const (
+	FlatStore    = "flat"    // One file per block in a single directory
+	ShardedStore = "sharded" // One file per block, fanned out by ID prefix
+	BoltStore    = "bolt"    // Embedded bbolt key-value store
+)
+
+// OpenBlockStore opens a block store of the given type rooted at dir. An empty
+// type opens a flat store, the layout used before block stores were
+// configurable.
+func OpenBlockStore(storeType string, dir string) (BlockStore, error) {
+	quarantineDir := path.Join(dir, quarantineDirName)
+	switch storeType {
+	case FlatStore, "":
+		return newFileStore(dir, quarantineDir, 0)
+	case ShardedStore:
+		return newFileStore(path.Join(dir, ShardedStore), quarantineDir, 2)
+	case BoltStore:
+		return openBoltStore(path.Join(dir, BoltStore, "blocks.db"))
+	}
+	return nil, fmt.Errorf("unknown block store type %q", storeType)
+}
+
+// CopyReport describes the result of copying blocks between stores.
+type CopyReport struct {
+	Copied      []string // IDs of blocks copied
+	Quarantined []string // IDs of blocks that failed verification
+	Failed      []string // IDs of blocks that could not be copied
+	Unverified  []string // IDs of blocks copied with no checksum to verify
+}
+
+// CopyBlocks copies every block in src to dst. Blocks that fail
+// verification are quarantined in src and not copied. Blocks stored before
+// checksums were recorded are verified as Scrub verifies them; those that
+// can't be are copied without a checksum, so dst doesn't vouch for them.
+// Blocks that can't be read or written are reported and the copy goes on.
+func CopyBlocks(src BlockStore, dst BlockStore) (*CopyReport, error) {
+	var ids []string
+	err := src.Walk(func(id string, size int64) error {
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot list blocks: %s", err)
+	}
+
+	report := &CopyReport{}
+	for _, id := range ids {
+		block, err := src.Get(id)
+		if err == ErrCorruptBlock {
+			err = src.Quarantine(id)
+			if err != nil {
+				report.Failed = append(report.Failed, id)
+				continue
+			}
+			report.Quarantined = append(report.Quarantined, id)
+			continue
+		}
+		if err != nil {
+			report.Failed = append(report.Failed, id)
+			continue
+		}
+
+		err = src.AddChecksum(id, func(block []byte) bool {
+			return core.ContentID(block) == id
+		})
+		if err == ErrUnverifiedBlock {
+			err = putUnchecked(dst, id, block)
+			if err == nil {
+				report.Unverified = append(report.Unverified, id)
+			}
+		} else if err == nil {
+			err = dst.Put(id, block)
+		}
+		if err != nil {
+			report.Failed = append(report.Failed, id)
+			continue
+		}
+		report.Copied = append(report.Copied, id)
+	}
+	return report, nil
+}
+
+// putUnchecked stores a block without a checksum, as blocks were stored
+// before checksums were recorded.
+func putUnchecked(store BlockStore, id string, block []byte) error {
+	switch s := store.(type) {
+	case *fileStore:
+		return s.putUnchecked(id, block)
+	case *boltStore:
+		return s.putUnchecked(id, block)
+	}
+	return fmt.Errorf("cannot store block %s without a checksum", id)
+}
+
+// checksumSuffix is appended to a block's file name to name the file holding
+// its checksum.
+const checksumSuffix = ".sha256"
+
+func checksum(block []byte) string {
+	sum := sha256.Sum256(block)
+	return hex.EncodeToString(sum[:])
+}
+
+func checkBlockId(id string) error {
+	if len(id) == 0 || strings.HasPrefix(id, ".") || strings.HasSuffix(id, checksumSuffix) ||
+		strings.ContainsAny(id, `/\`) {
+		return fmt.Errorf("invalid block id %q", id)
+	}
+	// A flat store shares its directory with the quarantine and the other
+	// stores' directories.
+	switch id {
+	case quarantineDirName, ShardedStore, BoltStore:
+		return fmt.Errorf("block id %q is reserved", id)
+	}
+	return nil
+}
+
+// quarantineName returns a name for a quarantined copy of a block that does
+// not clash with earlier copies of the same block.
+func quarantineName(id string) string {
+	return fmt.Sprintf("%s.%d", id, time.Now().UnixNano())
+}
+
+// lockStripes is the number of locks a fileStore spreads block IDs over.
+const lockStripes = 64
+
+// fileStore stores each block in its own file alongside a file holding the
+// block's checksum. Blocks are placed in nested directories named by
+// successive two-character prefixes of their ID, to the given depth.
+//
+// Since a block and its checksum are replaced separately, reads and writes
+// of the same block are serialized so a read never sees a block with
+// another version's checksum. The checksum is written first, so a crash
+// part way through a write leaves a block that fails verification.
+type fileStore struct {
+	dir           string
+	quarantineDir string
+	depth         int
+	locks         [lockStripes]sync.RWMutex
+}
+
+func newFileStore(dir string, quarantineDir string, depth int) (*fileStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &fileStore{dir: dir, quarantineDir: quarantineDir, depth: depth}, nil
+}
+
+func (s *fileStore) blockPath(id string) string {
+	elems := []string{s.dir}
+	padded := id + strings.Repeat("_", 2*s.depth)
+	for i := 0; i < s.depth; i++ {
+		elems = append(elems, padded[2*i:2*i+2])
+	}
+	return path.Join(append(elems, id)...)
+}
+
+// lock returns the lock guarding the block with the given ID.
+func (s *fileStore) lock(id string) *sync.RWMutex {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return &s.locks[h.Sum32()%lockStripes]
+}
+
+func (s *fileStore) Put(id string, block []byte) error {
+	if err := checkBlockId(id); err != nil {
+		return err
+	}
+	mu := s.lock(id)
+	mu.Lock()
+	defer mu.Unlock()
+	p := s.blockPath(id)
+	if s.depth > 0 {
+		err := os.MkdirAll(path.Dir(p), 0700)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Write the new checksum first. If we crash before the block is
+	// written, the old block fails verification and is quarantined rather
+	// than being served unchecked.
+	err := writeFileAtomic(p+checksumSuffix, []byte(checksum(block)))
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(p, block)
+}
+
+func (s *fileStore) putUnchecked(id string, block []byte) error {
+	if err := checkBlockId(id); err != nil {
+		return err
+	}
+	mu := s.lock(id)
+	mu.Lock()
+	defer mu.Unlock()
+	p := s.blockPath(id)
+	if s.depth > 0 {
+		err := os.MkdirAll(path.Dir(p), 0700)
+		if err != nil {
+			return err
+		}
+	}
+	err := os.Remove(p + checksumSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return writeFileAtomic(p, block)
+}
+
+func (s *fileStore) Get(id string) ([]byte, error) {
+	if err := checkBlockId(id); err != nil {
+		return nil, err
+	}
+	mu := s.lock(id)
+	mu.RLock()
+	defer mu.RUnlock()
+	return s.read(id)
+}
+
+// read reads and verifies a block. The caller must hold the block's lock.
+func (s *fileStore) read(id string) ([]byte, error) {
+	p := s.blockPath(id)
+	block, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	// Blocks stored before checksums were recorded have no checksum file.
+	sum, err := ioutil.ReadFile(p + checksumSuffix)
+	if os.IsNotExist(err) {
+		return block, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(sum, []byte(checksum(block))) {
+		return nil, ErrCorruptBlock
+	}
+	return block, nil
+}
+
+func (s *fileStore) Delete(id string) error {
+	if err := checkBlockId(id); err != nil {
+		return err
+	}
+	mu := s.lock(id)
+	mu.Lock()
+	defer mu.Unlock()
+	p := s.blockPath(id)
+	for _, name := range []string{p, p + checksumSuffix} {
+		err := os.Remove(name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileStore) Quarantine(id string) error {
+	if err := checkBlockId(id); err != nil {
+		return err
+	}
+	mu := s.lock(id)
+	mu.Lock()
+	defer mu.Unlock()
+	_, err := s.read(id)
+	if err != ErrCorruptBlock {
+		if err == nil {
+			err = ErrBlockIntact
+		}
+		return err
+	}
+
+	err = os.MkdirAll(s.quarantineDir, 0700)
+	if err != nil {
+		return err
+	}
+	p := s.blockPath(id)
+	name := path.Join(s.quarantineDir, quarantineName(id))
+	err = os.Rename(p, name)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(p+checksumSuffix, name+checksumSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *fileStore) AddChecksum(id string, verify func(block []byte) bool) error {
+	if err := checkBlockId(id); err != nil {
+		return err
+	}
+	mu := s.lock(id)
+	mu.Lock()
+	defer mu.Unlock()
+	p := s.blockPath(id)
+	_, err := os.Stat(p + checksumSuffix)
+	if err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	block, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	if !verify(block) {
+		return ErrUnverifiedBlock
+	}
+	return writeFileAtomic(p+checksumSuffix, []byte(checksum(block)))
+}
+
+func (s *fileStore) Walk(fn func(id string, size int64) error) error {
+	visit := func(info os.FileInfo) error {
+		if checkBlockId(info.Name()) != nil {
+			return nil // Checksum or temporary file
+		}
+		return fn(info.Name(), info.Size())
+	}
+	if s.depth == 0 {
+		files, err := ioutil.ReadDir(s.dir)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			if err := visit(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return filepath.Walk(s.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return visit(info)
+	})
+}
+
+func (s *fileStore) Close() error {
+	return nil
+}
+
+// writeFileAtomic writes data to a synced temporary file and renames it to
+// filename, so a crash never leaves a partially written file behind.
+func writeFileAtomic(filename string, data []byte) error {
+	dir := path.Dir(filename)
+	f, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	// Sync the directory so the rename is durable.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
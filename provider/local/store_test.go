@@ -0,0 +1,577 @@
+package peer
+
+import (
+	"bytes"
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"os"
+	"path"
+	core "skybin/core/proto"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var storeTypes = []string{FlatStore, ShardedStore, BoltStore}
+
+func openTestStore(t *testing.T, storeType string) BlockStore {
+	store, err := OpenBlockStore(storeType, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// corrupt replaces a stored block's data without updating its checksum.
+func corrupt(t *testing.T, store BlockStore, id string, data []byte) {
+	var err error
+	switch s := store.(type) {
+	case *fileStore:
+		err = ioutil.WriteFile(s.blockPath(id), data, 0600)
+	case *boltStore:
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(blocksBucket).Put([]byte(id), data)
+		})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dropChecksum removes a stored block's checksum, as for blocks stored
+// before checksums were recorded.
+func dropChecksum(t *testing.T, store BlockStore, id string) {
+	var err error
+	switch s := store.(type) {
+	case *fileStore:
+		err = os.Remove(s.blockPath(id) + checksumSuffix)
+	case *boltStore:
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(checksumsBucket).Delete([]byte(id))
+		})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// quarantined returns the number of quarantined block copies in a store.
+func quarantined(t *testing.T, store BlockStore) int {
+	n := 0
+	switch s := store.(type) {
+	case *fileStore:
+		files, err := ioutil.ReadDir(s.quarantineDir)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		for _, f := range files {
+			if !strings.HasSuffix(f.Name(), checksumSuffix) {
+				n++
+			}
+		}
+	case *boltStore:
+		err := s.db.View(func(tx *bolt.Tx) error {
+			n = tx.Bucket(quarantineBucket).Stats().KeyN
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return n
+}
+
+func TestCorruptBlockDetected(t *testing.T) {
+	for _, storeType := range storeTypes {
+		store := openTestStore(t, storeType)
+		err := store.Put("block", []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		corrupt(t, store, "block", []byte("jello"))
+		_, err = store.Get("block")
+		if err != ErrCorruptBlock {
+			t.Fatalf("%s: expected %v, got %v", storeType, ErrCorruptBlock, err)
+		}
+	}
+}
+
+func TestTruncatedBlockDetected(t *testing.T) {
+	for _, storeType := range storeTypes {
+		store := openTestStore(t, storeType)
+		err := store.Put("block", []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		corrupt(t, store, "block", []byte("hel"))
+		_, err = store.Get("block")
+		if err != ErrCorruptBlock {
+			t.Fatalf("%s: expected %v, got %v", storeType, ErrCorruptBlock, err)
+		}
+	}
+}
+
+func TestBlockWithoutChecksum(t *testing.T) {
+	// Blocks stored before checksums were recorded are served unverified.
+	dir := t.TempDir()
+	store := openTestStore(t, FlatStore)
+	store.(*fileStore).dir = dir
+	err := ioutil.WriteFile(path.Join(dir, "old"), []byte("hello"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := store.Get("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(block) != "hello" {
+		t.Fatalf("expected %q, got %q", "hello", block)
+	}
+	err = store.Quarantine("old")
+	if err != ErrBlockIntact {
+		t.Fatalf("expected %v, got %v", ErrBlockIntact, err)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	for _, storeType := range storeTypes {
+		store := openTestStore(t, storeType)
+		for i := 1; i <= 2; i++ {
+			err := store.Put("block", []byte("hello"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			corrupt(t, store, "block", []byte("jello"))
+			err = store.Quarantine("block")
+			if err != nil {
+				t.Fatalf("%s: %s", storeType, err)
+			}
+			_, err = store.Get("block")
+			if !os.IsNotExist(err) {
+				t.Fatalf("%s: expected quarantined block to be gone, got %v", storeType, err)
+			}
+			if n := quarantined(t, store); n != i {
+				t.Fatalf("%s: expected %d quarantined copies, got %d", storeType, i, n)
+			}
+		}
+	}
+}
+
+func TestQuarantineKeepsIntactBlock(t *testing.T) {
+	for _, storeType := range storeTypes {
+		store := openTestStore(t, storeType)
+		err := store.Put("block", []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.Quarantine("block")
+		if err != ErrBlockIntact {
+			t.Fatalf("%s: expected %v, got %v", storeType, ErrBlockIntact, err)
+		}
+		block, err := store.Get("block")
+		if err != nil {
+			t.Fatalf("%s: %s", storeType, err)
+		}
+		if string(block) != "hello" {
+			t.Fatalf("%s: expected %q, got %q", storeType, "hello", block)
+		}
+		if n := quarantined(t, store); n != 0 {
+			t.Fatalf("%s: expected no quarantined copies, got %d", storeType, n)
+		}
+	}
+}
+
+func TestReplaceWhileReading(t *testing.T) {
+	versions := [][]byte{bytes.Repeat([]byte("a"), 64*1024), bytes.Repeat([]byte("b"), 32*1024)}
+	for _, storeType := range storeTypes {
+		store := openTestStore(t, storeType)
+		err := store.Put("root", versions[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				if err := store.Put("root", versions[i%2]); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		errs := make(chan error, 1)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				select {
+				case <-errs:
+					return
+				default:
+				}
+				block, err := store.Get("root")
+				if err == nil && !bytes.Equal(block, versions[0]) && !bytes.Equal(block, versions[1]) {
+					err = ErrCorruptBlock
+				}
+				if err != nil {
+					t.Errorf("%s: read during replace failed: %v", storeType, err)
+					return
+				}
+			}
+		}()
+		wg.Wait()
+		errs <- nil
+		<-done
+		if n := quarantined(t, store); n != 0 {
+			t.Fatalf("%s: expected no quarantined copies, got %d", storeType, n)
+		}
+	}
+}
+
+func TestScrub(t *testing.T) {
+	for _, storeType := range storeTypes {
+		store := openTestStore(t, storeType)
+		for _, id := range []string{"good", "bad"} {
+			err := store.Put(id, []byte("hello"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		corrupt(t, store, "bad", []byte("jello"))
+
+		report, err := Scrub(store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Checked != 2 {
+			t.Fatalf("%s: expected 2 blocks checked, got %d", storeType, report.Checked)
+		}
+		if len(report.Quarantined) != 1 || report.Quarantined[0] != "bad" {
+			t.Fatalf("%s: expected block bad to be quarantined, got %v", storeType, report.Quarantined)
+		}
+		if len(report.Failed) != 0 {
+			t.Fatalf("%s: expected no failures, got %v", storeType, report.Failed)
+		}
+		_, err = store.Get("good")
+		if err != nil {
+			t.Fatalf("%s: %s", storeType, err)
+		}
+		_, err = store.Get("bad")
+		if !os.IsNotExist(err) {
+			t.Fatalf("%s: expected quarantined block to be gone, got %v", storeType, err)
+		}
+	}
+}
+
+func TestInterruptedPutDetected(t *testing.T) {
+	// A write interrupted after the new checksum is written leaves the old
+	// block, which must fail verification rather than be served.
+	for _, storeType := range []string{FlatStore, ShardedStore} {
+		store := openTestStore(t, storeType)
+		err := store.Put("block", []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := store.(*fileStore).blockPath("block")
+		err = writeFileAtomic(p+checksumSuffix, []byte(checksum([]byte("jello"))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.Get("block")
+		if err != ErrCorruptBlock {
+			t.Fatalf("%s: expected %v, got %v", storeType, ErrCorruptBlock, err)
+		}
+		report, err := Scrub(store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Quarantined) != 1 {
+			t.Fatalf("%s: expected the block to be quarantined, got %v", storeType, report.Quarantined)
+		}
+	}
+}
+
+func TestScrubVerifiesBlocksWithoutChecksum(t *testing.T) {
+	data := []byte("file data")
+	fileID := core.ContentID(data)
+	for _, storeType := range storeTypes {
+		store := openTestStore(t, storeType)
+		for id, block := range map[string][]byte{fileID: data, "metadata": []byte("root")} {
+			err := store.Put(id, block)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dropChecksum(t, store, id)
+		}
+
+		report, err := Scrub(store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Unverified) != 1 || report.Unverified[0] != "metadata" {
+			t.Fatalf("%s: expected only block metadata to be unverified, got %v", storeType, report.Unverified)
+		}
+		if len(report.Quarantined) != 0 || len(report.Failed) != 0 {
+			t.Fatalf("%s: expected no blocks quarantined or failed, got %v and %v", storeType, report.Quarantined, report.Failed)
+		}
+
+		// The file block's checksum has been recorded, so it is verified
+		// from now on.
+		corrupt(t, store, fileID, []byte("file dat4"))
+		_, err = store.Get(fileID)
+		if err != ErrCorruptBlock {
+			t.Fatalf("%s: expected %v, got %v", storeType, ErrCorruptBlock, err)
+		}
+		_, err = store.Get("metadata")
+		if err != nil {
+			t.Fatalf("%s: %s", storeType, err)
+		}
+	}
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	for _, storeType := range storeTypes {
+		store := openTestStore(t, storeType)
+		_, err := store.Get("block")
+		if !os.IsNotExist(err) {
+			t.Fatalf("%s: expected missing block error, got %v", storeType, err)
+		}
+
+		for _, data := range []string{"hello", "replaced", ""} {
+			err = store.Put("block", []byte(data))
+			if err != nil {
+				t.Fatalf("%s: %s", storeType, err)
+			}
+			block, err := store.Get("block")
+			if err != nil {
+				t.Fatalf("%s: %s", storeType, err)
+			}
+			if string(block) != data {
+				t.Fatalf("%s: expected %q, got %q", storeType, data, block)
+			}
+		}
+
+		err = store.Delete("block")
+		if err != nil {
+			t.Fatalf("%s: %s", storeType, err)
+		}
+		_, err = store.Get("block")
+		if !os.IsNotExist(err) {
+			t.Fatalf("%s: expected deleted block to be gone, got %v", storeType, err)
+		}
+		err = store.Delete("block")
+		if err != nil {
+			t.Fatalf("%s: deleting a missing block failed: %s", storeType, err)
+		}
+	}
+}
+
+func TestStoreRejectsInvalidIDs(t *testing.T) {
+	for _, storeType := range storeTypes {
+		store := openTestStore(t, storeType)
+		for _, id := range []string{"", ".hidden", "a/b", `a\b`, "block" + checksumSuffix,
+			"quarantine", "sharded", "bolt"} {
+			err := store.Put(id, []byte("hello"))
+			if err == nil {
+				t.Fatalf("%s: expected block ID %q to be rejected", storeType, id)
+			}
+		}
+	}
+}
+
+func TestStoreWalk(t *testing.T) {
+	blocks := map[string]string{"a": "1", "ab": "22", "abcdef": "333", "zz": "4444"}
+	for _, storeType := range storeTypes {
+		store := openTestStore(t, storeType)
+		for id, data := range blocks {
+			err := store.Put(id, []byte(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		seen := make(map[string]int64)
+		err := store.Walk(func(id string, size int64) error {
+			seen[id] = size
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", storeType, err)
+		}
+		if len(seen) != len(blocks) {
+			t.Fatalf("%s: expected %d blocks, got %v", storeType, len(blocks), seen)
+		}
+		for id, data := range blocks {
+			if seen[id] != int64(len(data)) {
+				t.Fatalf("%s: expected block %s of size %d, got %d", storeType, id, len(data), seen[id])
+			}
+		}
+	}
+}
+
+func TestShardedLayout(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenBlockStore(ShardedStore, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for _, id := range []string{"abcdef", "a"} {
+		err = store.Put(id, []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []string{"sharded/ab/cd/abcdef", "sharded/a_/__/a"} {
+		_, err = os.Stat(path.Join(dir, p))
+		if err != nil {
+			t.Fatalf("expected block at %s: %s", p, err)
+		}
+	}
+}
+
+func TestWriteLeavesNoTemporaryFiles(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenBlockStore(FlatStore, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	err = store.Put("block", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	if strings.Join(names, " ") != "block block"+checksumSuffix {
+		t.Fatalf("expected only the block and its checksum, got %v", names)
+	}
+}
+
+func TestCopyBlocks(t *testing.T) {
+	for _, srcType := range storeTypes {
+		for _, dstType := range storeTypes {
+			if srcType == dstType {
+				continue
+			}
+			dir := t.TempDir()
+			src, err := OpenBlockStore(srcType, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dst, err := OpenBlockStore(dstType, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range []string{"a", "b", "c"} {
+				err = src.Put(id, []byte("block "+id))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			report, err := CopyBlocks(src, dst)
+			if err != nil {
+				t.Fatalf("%s to %s: %s", srcType, dstType, err)
+			}
+			ids := report.Copied
+			if len(ids) != 3 {
+				t.Fatalf("%s to %s: expected 3 blocks copied, got %v", srcType, dstType, ids)
+			}
+			for _, id := range ids {
+				block, err := dst.Get(id)
+				if err != nil {
+					t.Fatalf("%s to %s: %s", srcType, dstType, err)
+				}
+				if string(block) != "block "+id {
+					t.Fatalf("%s to %s: expected %q, got %q", srcType, dstType, "block "+id, block)
+				}
+			}
+			src.Close()
+			dst.Close()
+		}
+	}
+}
+
+func TestCopyBlocksQuarantinesCorruptBlocks(t *testing.T) {
+	src := openTestStore(t, FlatStore)
+	dst := openTestStore(t, BoltStore)
+	for _, id := range []string{"bad", "good"} {
+		err := src.Put(id, []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	corrupt(t, src, "bad", []byte("jello"))
+	report, err := CopyBlocks(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Copied) != 1 || report.Copied[0] != "good" {
+		t.Fatalf("expected only block good to be copied, got %v", report.Copied)
+	}
+	if len(report.Quarantined) != 1 || report.Quarantined[0] != "bad" {
+		t.Fatalf("expected block bad to be quarantined, got %v", report.Quarantined)
+	}
+	if quarantined(t, src) != 1 {
+		t.Fatal("expected the corrupt block to be quarantined in the source store")
+	}
+	_, err = dst.Get("bad")
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected corrupt block not to be copied, got %v", err)
+	}
+	_, err = dst.Get("good")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCopyBlocksWithoutChecksum(t *testing.T) {
+	data := []byte("file data")
+	fileID := core.ContentID(data)
+	for _, dstType := range []string{ShardedStore, BoltStore} {
+		src := openTestStore(t, FlatStore)
+		dst := openTestStore(t, dstType)
+		for id, block := range map[string][]byte{fileID: data, "metadata": []byte("root")} {
+			err := src.Put(id, block)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dropChecksum(t, src, id)
+		}
+
+		report, err := CopyBlocks(src, dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Copied) != 2 {
+			t.Fatalf("%s: expected 2 blocks copied, got %v", dstType, report.Copied)
+		}
+		if len(report.Unverified) != 1 || report.Unverified[0] != "metadata" {
+			t.Fatalf("%s: expected only block metadata to be unverified, got %v", dstType, report.Unverified)
+		}
+
+		// The file block was verified by its ID and is checked in its new
+		// store. The metadata block could not be, so it is stored unchecked
+		// rather than with a checksum that vouches for it.
+		corrupt(t, dst, fileID, []byte("file dat4"))
+		_, err = dst.Get(fileID)
+		if err != ErrCorruptBlock {
+			t.Fatalf("%s: expected %v, got %v", dstType, ErrCorruptBlock, err)
+		}
+		corrupt(t, dst, "metadata", []byte("rot!"))
+		block, err := dst.Get("metadata")
+		if err != nil || string(block) != "rot!" {
+			t.Fatalf("%s: expected unchecked block, got %q, %v", dstType, block, err)
+		}
+	}
+}
@@ -0,0 +1,537 @@
+// Package relay lets providers that can't accept connections, such as
+// machines behind NAT, serve renters through a publicly reachable server.
+//
+// A provider opens a tunnel to the relay by connecting to the relay's
+// provider address and sending tunnelMagic and its ID. The relay replies
+// with a random challenge, which the provider signs with the key its ID is
+// derived from, so no one else can take its place. The relay then sends
+// requests for the provider over the tunnel, acting as the gRPC client while
+// the provider acts as the server. Renters reach a relayed provider by
+// sending requests to the relay with the provider's ID in the
+// remote.RelayTargetKey metadata.
+package relay
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	"log"
+	"net"
+	core "skybin/core/proto"
+	"skybin/provider/remote"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tunnelMagic starts every tunnel connection. gRPC connections start with
+// the HTTP/2 preface instead, so the two can share a port.
+const tunnelMagic = "SKYBIN-RELAY/1\n"
+
+// handshakeTimeout bounds how long either side waits for the other during
+// the tunnel handshake.
+const handshakeTimeout = 10 * time.Second
+
+// maxLineLength bounds the lines exchanged during the tunnel handshake.
+// The provider's answer to the challenge holds its public key and a
+// signature.
+const maxLineLength = 4096
+
+// challengeSize is the number of random bytes in a tunnel challenge.
+const challengeSize = 32
+
+// liveCheckTimeout bounds how long the relay waits for a provider's tunnel
+// to answer when the provider connects again.
+const liveCheckTimeout = 5 * time.Second
+
+var errListenerClosed = errors.New("relay: listener closed")
+
+// Relay serves Provider requests, forwarding requests addressed to a
+// provider connected through a tunnel and serving the rest itself.
+type Relay struct {
+	local  core.ProviderServer // Serves requests without a target. May be nil.
+	logger *log.Logger
+
+	mu      sync.Mutex
+	tunnels map[string]*tunnel // Connected providers by ID
+}
+
+type tunnel struct {
+	conn   *grpc.ClientConn
+	client core.ProviderClient
+}
+
+// New creates a relay. Requests not addressed to a relayed provider are
+// served by local, or refused if local is nil.
+func New(local core.ProviderServer, logger *log.Logger) *Relay {
+	return &Relay{
+		local:   local,
+		logger:  logger,
+		tunnels: make(map[string]*tunnel),
+	}
+}
+
+// Providers returns the IDs of the providers connected to the relay.
+func (r *Relay) Providers() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ids []string
+	for id := range r.tunnels {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Listen takes the tunnels opened on connections accepted by l. The returned
+// listener accepts the other connections, to be served with gRPC.
+func (r *Relay) Listen(l net.Listener) net.Listener {
+	ml := &muxListener{
+		Listener: l,
+		conns:    make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+	go ml.run(r)
+	return ml
+}
+
+// muxListener passes on the connections that aren't tunnels.
+type muxListener struct {
+	net.Listener
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error // Set before closed is closed
+}
+
+func (ml *muxListener) run(r *Relay) {
+	for {
+		conn, err := ml.Listener.Accept()
+		if err != nil {
+			ml.closeOnce.Do(func() {
+				ml.err = err
+				close(ml.closed)
+			})
+			return
+		}
+		go ml.sniff(r, conn)
+	}
+}
+
+// sniff reads the start of conn to tell tunnels from other connections.
+func (ml *muxListener) sniff(r *Relay, conn net.Conn) {
+	prefix := make([]byte, len(tunnelMagic))
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	n, err := io.ReadFull(conn, prefix)
+	conn.SetReadDeadline(time.Time{})
+	if err == nil && string(prefix) == tunnelMagic {
+		r.openTunnel(conn)
+		return
+	}
+	if n == 0 {
+		conn.Close()
+		return
+	}
+	select {
+	case ml.conns <- &prefixedConn{Conn: conn, prefix: prefix[:n]}:
+	case <-ml.closed:
+		conn.Close()
+	}
+}
+
+func (ml *muxListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ml.conns:
+		return conn, nil
+	case <-ml.closed:
+		return nil, ml.err
+	}
+}
+
+func (ml *muxListener) Close() error {
+	ml.closeOnce.Do(func() {
+		ml.err = errListenerClosed
+		close(ml.closed)
+	})
+	return ml.Listener.Close()
+}
+
+// prefixedConn replays the bytes read while sniffing a connection.
+type prefixedConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixedConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// readLine reads a newline-terminated line a byte at a time, so nothing
+// after it is consumed.
+func readLine(conn net.Conn) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < maxLineLength {
+		_, err := conn.Read(b)
+		if err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", errors.New("relay: handshake line too long")
+}
+
+// openTunnel completes the handshake of a tunnel and starts forwarding
+// requests over it. A provider that reconnects replaces its old tunnel only
+// if the old tunnel no longer answers.
+func (r *Relay) openTunnel(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	id, err := r.handshake(conn)
+	if err != nil {
+		r.logger.Println("relay: tunnel handshake failed:", err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	tc := newNotifyConn(conn)
+	unused := make(chan net.Conn, 1)
+	unused <- tc
+	dialer := func(ctx context.Context, addr string) (net.Conn, error) {
+		// The tunnel can only be used once. Once it closes the provider
+		// has to open a new one.
+		select {
+		case c := <-unused:
+			return c, nil
+		default:
+			return nil, errors.New("relay: tunnel closed")
+		}
+	}
+	cc, err := grpc.Dial(id, grpc.WithInsecure(), grpc.WithContextDialer(dialer))
+	if err != nil {
+		r.logger.Println("relay: cannot open tunnel:", err)
+		conn.Close()
+		return
+	}
+	t := &tunnel{conn: cc, client: core.NewProviderClient(cc)}
+
+	r.mu.Lock()
+	old := r.tunnels[id]
+	r.tunnels[id] = t
+	r.mu.Unlock()
+	if old != nil {
+		// The handshake found the old tunnel dead.
+		old.conn.Close()
+	}
+	r.logger.Println("relay: provider", id, "connected from", conn.RemoteAddr())
+
+	go func() {
+		<-tc.done
+		r.mu.Lock()
+		if r.tunnels[id] == t {
+			delete(r.tunnels, id)
+		}
+		r.mu.Unlock()
+		cc.Close()
+		r.logger.Println("relay: provider", id, "disconnected")
+	}()
+}
+
+// handshake reads the ID of the provider opening a tunnel on conn and checks
+// that the provider holds the ID's key. It refuses the tunnel if the
+// provider is already connected through a tunnel that still answers.
+func (r *Relay) handshake(conn net.Conn) (string, error) {
+	id, err := readLine(conn)
+	if err != nil {
+		return "", err
+	}
+	refuse := func(err error) (string, error) {
+		fmt.Fprintf(conn, "ERR %s\n", err)
+		return "", err
+	}
+	if len(id) == 0 || strings.ContainsAny(id, " \t\r") {
+		return refuse(fmt.Errorf("invalid provider ID %q", id))
+	}
+
+	challenge := make([]byte, challengeSize)
+	_, err = rand.Read(challenge)
+	if err != nil {
+		return refuse(errors.New("cannot create challenge"))
+	}
+	_, err = fmt.Fprintf(conn, "CHALLENGE %s\n", base64.StdEncoding.EncodeToString(challenge))
+	if err != nil {
+		return "", err
+	}
+	answer, err := readLine(conn)
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(answer)
+	if len(fields) != 2 {
+		return refuse(errors.New("invalid challenge answer"))
+	}
+	err = core.VerifyTunnel(fields[0], fields[1], id, challenge)
+	if err != nil {
+		return refuse(fmt.Errorf("cannot authenticate provider %s: %s", id, err))
+	}
+
+	if r.tunnelAlive(id) {
+		return refuse(fmt.Errorf("provider %s is already connected", id))
+	}
+	_, err = io.WriteString(conn, "OK\n")
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// tunnelAlive reports whether the provider with the given ID is connected
+// through a tunnel that answers requests.
+func (r *Relay) tunnelAlive(id string) bool {
+	r.mu.Lock()
+	t := r.tunnels[id]
+	r.mu.Unlock()
+	if t == nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), liveCheckTimeout)
+	defer cancel()
+	_, err := t.client.Info(ctx, &core.InfoRequest{})
+	return err == nil
+}
+
+// notifyConn closes done when the connection fails or is closed.
+type notifyConn struct {
+	net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newNotifyConn(conn net.Conn) *notifyConn {
+	return &notifyConn{Conn: conn, done: make(chan struct{})}
+}
+
+func (c *notifyConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err != nil {
+		c.Close()
+	}
+	return n, err
+}
+
+func (c *notifyConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() { close(c.done) })
+	return err
+}
+
+// forwardedKeys are the request metadata keys passed on to relayed
+// providers.
+var forwardedKeys = []string{remote.RenterKeyKey, remote.RequestTimeKey, remote.RenterSignatureKey}
+
+// route returns the client of the provider a request is addressed to, or
+// nil if the request is for the relay itself. The returned context carries
+// the request's metadata for the provider.
+func (r *Relay) route(ctx context.Context) (context.Context, core.ProviderClient, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	targets := md.Get(remote.RelayTargetKey)
+	if len(targets) == 0 {
+		if r.local == nil {
+			return nil, nil, status.Error(codes.Unimplemented, "relay does not serve as a provider")
+		}
+		return ctx, nil, nil
+	}
+	r.mu.Lock()
+	t := r.tunnels[targets[0]]
+	r.mu.Unlock()
+	if t == nil {
+		return nil, nil, status.Errorf(codes.Unavailable, "provider %s is not connected to the relay", targets[0])
+	}
+	out := metadata.MD{}
+	for _, key := range forwardedKeys {
+		if values := md.Get(key); len(values) > 0 {
+			out.Set(key, values...)
+		}
+	}
+	return metadata.NewOutgoingContext(ctx, out), t.client, nil
+}
+
+func (r *Relay) Info(ctx context.Context, req *core.InfoRequest) (*core.InfoResponse, error) {
+	ctx, client, err := r.route(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		return r.local.Info(ctx, req)
+	}
+	return client.Info(ctx, req)
+}
+
+func (r *Relay) Negotiate(ctx context.Context, req *core.NegotiateRequest) (*core.NegotiateResponse, error) {
+	ctx, client, err := r.route(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		return r.local.Negotiate(ctx, req)
+	}
+	return client.Negotiate(ctx, req)
+}
+
+func (r *Relay) StoreBlock(ctx context.Context, req *core.StoreBlockRequest) (*core.StoreBlockResponse, error) {
+	ctx, client, err := r.route(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		return r.local.StoreBlock(ctx, req)
+	}
+	return client.StoreBlock(ctx, req)
+}
+
+func (r *Relay) GetBlock(ctx context.Context, req *core.GetBlockRequest) (*core.GetBlockResponse, error) {
+	ctx, client, err := r.route(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		return r.local.GetBlock(ctx, req)
+	}
+	return client.GetBlock(ctx, req)
+}
+
+// Serve connects to the relay at addr as the provider with the given ID and
+// serves the requests the relay forwards with server. The provider proves
+// its ID with key, the node key the ID is derived from. If the connection
+// fails or is lost it reconnects, waiting longer after each failure. Serve
+// returns only once server is stopped.
+//
+// If wrap is not nil, each tunnel's listener is passed through it before
+// being served, so that the provider's own rate limits apply to the
+// requests it receives through the relay.
+func Serve(addr string, id string, key *rsa.PrivateKey, server *grpc.Server, wrap func(net.Listener) net.Listener, logger *log.Logger) error {
+	const minRetryDelay = time.Second
+	const maxRetryDelay = time.Minute
+	delay := minRetryDelay
+	for {
+		start := time.Now()
+		err := serveTunnel(addr, id, key, server, wrap, logger)
+		if err == grpc.ErrServerStopped {
+			return err
+		}
+		logger.Println("relay: tunnel to", addr, "failed:", err)
+
+		// A tunnel that stayed up for a while was working, so
+		// reconnect promptly.
+		if time.Since(start) > maxRetryDelay {
+			delay = minRetryDelay
+		}
+		time.Sleep(delay)
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// serveTunnel opens a tunnel to the relay at addr and serves it until it
+// closes.
+func serveTunnel(addr string, id string, key *rsa.PrivateKey, server *grpc.Server, wrap func(net.Listener) net.Listener, logger *log.Logger) error {
+	conn, err := net.DialTimeout("tcp", addr, handshakeTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	err = answerHandshake(conn, id, key)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	logger.Println("relay: serving through", addr)
+	var l net.Listener = newTunnelListener(conn)
+	if wrap != nil {
+		l = wrap(l)
+	}
+	return server.Serve(l)
+}
+
+// answerHandshake opens a tunnel on conn for the provider with the given ID,
+// answering the relay's challenge with key.
+func answerHandshake(conn net.Conn, id string, key *rsa.PrivateKey) error {
+	_, err := io.WriteString(conn, tunnelMagic+id+"\n")
+	if err != nil {
+		return err
+	}
+	reply, err := readLine(conn)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(reply, "CHALLENGE ") {
+		return fmt.Errorf("relay refused tunnel: %s", strings.TrimPrefix(reply, "ERR "))
+	}
+	challenge, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(reply, "CHALLENGE "))
+	if err != nil {
+		return fmt.Errorf("invalid challenge from relay: %s", err)
+	}
+	pub, sig, err := core.SignTunnel(key, id, challenge)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(conn, "%s %s\n", pub, sig)
+	if err != nil {
+		return err
+	}
+	reply, err = readLine(conn)
+	if err != nil {
+		return err
+	}
+	if reply != "OK" {
+		return fmt.Errorf("relay refused tunnel: %s", strings.TrimPrefix(reply, "ERR "))
+	}
+	return nil
+}
+
+// tunnelListener accepts a single tunnel connection, then blocks until the
+// tunnel closes.
+type tunnelListener struct {
+	conn     *notifyConn
+	accepted bool
+}
+
+func newTunnelListener(conn net.Conn) *tunnelListener {
+	return &tunnelListener{conn: newNotifyConn(conn)}
+}
+
+func (l *tunnelListener) Accept() (net.Conn, error) {
+	if !l.accepted {
+		l.accepted = true
+		return l.conn, nil
+	}
+	<-l.conn.done
+	return nil, errors.New("relay: tunnel closed")
+}
+
+func (l *tunnelListener) Close() error {
+	return l.conn.Close()
+}
+
+func (l *tunnelListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
@@ -0,0 +1,361 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"log"
+	"net"
+	"path"
+	core "skybin/core/proto"
+	local "skybin/provider/local"
+	"skybin/provider/remote"
+	providerserver "skybin/provider/server"
+	"skybin/throttle"
+	"testing"
+	"time"
+)
+
+var testLogger = log.New(ioutil.Discard, "", 0)
+
+// startProviderServer returns a gRPC server for a provider with the given ID
+// that isn't listening on any address. The provider records renter
+// accounts, so it only stores contracted blocks for the renter holding the
+// contract.
+func startProviderServer(t *testing.T, id string) *grpc.Server {
+	store, err := local.OpenBlockStore(local.FlatStore, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	pvdr, err := local.New(local.Options{
+		ProviderInfo: core.ProviderInfo{ID: id, MaxBlockSize: 1 << 20},
+		Store:        store,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	accounts, err := providerserver.OpenAccounts(path.Join(t.TempDir(), "renters.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { accounts.Close() })
+	ps := providerserver.New(pvdr, testLogger)
+	ps.SetAccounts(accounts)
+
+	server := grpc.NewServer()
+	core.RegisterProviderServer(server, ps)
+	t.Cleanup(server.Stop)
+	return server
+}
+
+// startRelay runs a relay on a loopback address. If id is not empty, the
+// relay is also a provider with that ID.
+func startRelay(t *testing.T, id string) (*Relay, string) {
+	var localServer core.ProviderServer
+	if len(id) > 0 {
+		store, err := local.OpenBlockStore(local.FlatStore, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		pvdr, err := local.New(local.Options{
+			ProviderInfo: core.ProviderInfo{ID: id, MaxBlockSize: 1 << 20},
+			Store:        store,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		localServer = providerserver.New(pvdr, testLogger)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rly := New(localServer, testLogger)
+	server := grpc.NewServer()
+	core.RegisterProviderServer(server, rly)
+	go server.Serve(rly.Listen(listener))
+	t.Cleanup(server.Stop)
+	return rly, listener.Addr().String()
+}
+
+// providerKey returns a new node key and the provider ID derived from it.
+func providerKey(t *testing.T) (*rsa.PrivateKey, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := core.KeyID(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, id
+}
+
+// waitConnected waits until the provider with the given ID is connected to
+// the relay.
+func waitConnected(t *testing.T, rly *Relay, id string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, connected := range rly.Providers() {
+			if connected == id {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("provider %s did not connect to the relay", id)
+}
+
+func TestRelayForwardsRequests(t *testing.T) {
+	ctx := context.Background()
+	rly, addr := startRelay(t, "relay")
+	nodeKey, natted := providerKey(t)
+	server := startProviderServer(t, natted)
+	go Serve(addr, natted, nodeKey, server, nil, testLogger)
+	waitConnected(t, rly, natted)
+
+	pvdr, err := remote.DialPeer(core.PeerInfo{ID: natted, Relay: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pvdr.Close()
+	info, err := pvdr.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ID != natted {
+		t.Fatalf("expected info of provider %s, got %s", natted, info.ID)
+	}
+
+	// The renter's signatures reach the provider through the relay.
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renterID, err := core.KeyID(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer := &core.Contract{BlockID: "block1", BlockSize: 5, RenterID: renterID, ProviderID: natted}
+	err = core.SignContract(offer, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract, err := pvdr.Negotiate(ctx, offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contract.ProviderSignature) == 0 {
+		t.Fatal("expected a signed contract")
+	}
+	data := []byte("hello")
+	err = pvdr.StoreBlock(ctx, "block1", data)
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected unsigned block to be refused, got %v", err)
+	}
+	signed, err := remote.SignStoreBlock(ctx, key, "block1", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pvdr.StoreBlock(signed, "block1", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := pvdr.GetBlock(ctx, "block1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(block, data) {
+		t.Fatalf("expected block %q, got %q", data, block)
+	}
+
+	// Requests without a target are served by the relay's own provider.
+	direct, err := remote.DialPeer(core.PeerInfo{ID: "relay", Addr: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer direct.Close()
+	info, err = direct.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ID != "relay" {
+		t.Fatalf("expected info of provider relay, got %s", info.ID)
+	}
+	_, err = direct.GetBlock(ctx, "block1")
+	if err == nil {
+		t.Fatal("expected block stored through the relay to be missing from the relay")
+	}
+}
+
+func TestRelayUnknownProvider(t *testing.T) {
+	ctx := context.Background()
+	_, addr := startRelay(t, "")
+	pvdr, err := remote.DialPeer(core.PeerInfo{ID: "missing", Relay: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pvdr.Close()
+	_, err = pvdr.Info(ctx)
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected %s error, got %v", codes.Unavailable, err)
+	}
+
+	direct, err := remote.DialPeer(core.PeerInfo{ID: "relay", Addr: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer direct.Close()
+	_, err = direct.Info(ctx)
+	if status.Code(err) != codes.Unimplemented {
+		t.Fatalf("expected %s error, got %v", codes.Unimplemented, err)
+	}
+}
+
+func TestRelayForgetsDisconnectedProvider(t *testing.T) {
+	rly, addr := startRelay(t, "")
+	nodeKey, natted := providerKey(t)
+	server := startProviderServer(t, natted)
+	done := make(chan error)
+	go func() { done <- Serve(addr, natted, nodeKey, server, nil, testLogger) }()
+	waitConnected(t, rly, natted)
+
+	server.Stop()
+	err := <-done
+	if err != grpc.ErrServerStopped {
+		t.Fatalf("expected Serve to stop with the server, got %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(rly.Providers()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("relay still lists disconnected provider")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProviderReconnects(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	// Start the provider before the relay is up.
+	nodeKey, natted := providerKey(t)
+	server := startProviderServer(t, natted)
+	go Serve(addr, natted, nodeKey, server, nil, testLogger)
+
+	listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip("cannot listen at", addr, ":", err)
+	}
+	rly := New(nil, testLogger)
+	relayServer := grpc.NewServer()
+	core.RegisterProviderServer(relayServer, rly)
+	go relayServer.Serve(rly.Listen(listener))
+	defer relayServer.Stop()
+	waitConnected(t, rly, natted)
+}
+
+// dialTunnel opens a tunnel connection to the relay at addr as the provider
+// with the given ID, answering the challenge with key.
+func dialTunnel(t *testing.T, addr string, id string, key *rsa.PrivateKey) (net.Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	return conn, answerHandshake(conn, id, key)
+}
+
+func TestRelayRefusesImpersonation(t *testing.T) {
+	rly, addr := startRelay(t, "")
+	_, victim := providerKey(t)
+	otherKey, _ := providerKey(t)
+	_, err := dialTunnel(t, addr, victim, otherKey)
+	if err == nil {
+		t.Fatal("expected relay to refuse a provider without the ID's key")
+	}
+	if len(rly.Providers()) > 0 {
+		t.Fatalf("relay lists unauthenticated providers %v", rly.Providers())
+	}
+}
+
+func TestRelayKeepsLiveTunnel(t *testing.T) {
+	ctx := context.Background()
+	rly, addr := startRelay(t, "")
+	nodeKey, natted := providerKey(t)
+	server := startProviderServer(t, natted)
+	go Serve(addr, natted, nodeKey, server, nil, testLogger)
+	waitConnected(t, rly, natted)
+
+	// Even the key's holder can't replace a tunnel that still answers.
+	_, err := dialTunnel(t, addr, natted, nodeKey)
+	if err == nil {
+		t.Fatal("expected relay to refuse a second tunnel for a connected provider")
+	}
+	pvdr, err := remote.DialPeer(core.PeerInfo{ID: natted, Relay: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pvdr.Close()
+	_, err = pvdr.Info(ctx)
+	if err != nil {
+		t.Fatal("original tunnel no longer works:", err)
+	}
+}
+
+func TestRelayReplacesDeadTunnel(t *testing.T) {
+	rly, addr := startRelay(t, "")
+	nodeKey, natted := providerKey(t)
+
+	// A tunnel nothing serves doesn't answer the relay's check.
+	_, err := dialTunnel(t, addr, natted, nodeKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitConnected(t, rly, natted)
+	_, err = dialTunnel(t, addr, natted, nodeKey)
+	if err != nil {
+		t.Fatal("expected relay to replace a dead tunnel, got", err)
+	}
+}
+
+func TestRelayThrottlesRelayedBlocks(t *testing.T) {
+	ctx := context.Background()
+	rly, addr := startRelay(t, "")
+	const rate = 64 * 1024
+	download := throttle.NewGroup(rate, 0)
+	throttled := func(l net.Listener) net.Listener {
+		return throttle.Listen(l, nil, download)
+	}
+	nodeKey, natted := providerKey(t)
+	server := startProviderServer(t, natted)
+	go Serve(addr, natted, nodeKey, server, throttled, testLogger)
+	waitConnected(t, rly, natted)
+
+	pvdr, err := remote.DialPeer(core.PeerInfo{ID: natted, Relay: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pvdr.Close()
+
+	// The first burst passes at once; the rest waits for the limit.
+	data := make([]byte, 3*rate)
+	start := time.Now()
+	pvdr.StoreBlock(ctx, "block1", data)
+	if elapsed := time.Since(start); elapsed < 1500*time.Millisecond {
+		t.Fatalf("relayed %d bytes in %s at %d bytes per second", len(data), elapsed, rate)
+	}
+}
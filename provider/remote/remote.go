@@ -1,18 +1,61 @@
 package remote
 
 import (
+	"crypto/rsa"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 	core "skybin/core/proto"
+	"strconv"
+	"time"
 )
 
+// RelayTargetKey is the request metadata key naming the provider a relay
+// should forward the request to.
+const RelayTargetKey = "skybin-relay-target"
+
+// Request metadata keys that prove a StoreBlock request comes from a
+// renter: the renter's public key, the unix time of the request, and the
+// renter's signature of the request.
+const (
+	RenterKeyKey       = "skybin-renter-key"
+	RequestTimeKey     = "skybin-request-time"
+	RenterSignatureKey = "skybin-renter-signature"
+)
+
+// SignStoreBlock returns a context for storing a block whose request is
+// signed with the renter's key.
+func SignStoreBlock(ctx context.Context, key *rsa.PrivateKey, id string, block []byte) (context.Context, error) {
+	pub, err := core.EncodePublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	t := time.Now().Unix()
+	sig, err := core.SignStoreBlock(key, id, block, t)
+	if err != nil {
+		return nil, err
+	}
+	return metadata.AppendToOutgoingContext(ctx,
+		RenterKeyKey, pub,
+		RequestTimeKey, strconv.FormatInt(t, 10),
+		RenterSignatureKey, sig), nil
+}
+
 type RemoteProvider interface {
 	core.Provider
+
+	// ProveBlock asks the provider to show that it holds a block by
+	// returning core.BlockProof of the block and nonce.
+	ProveBlock(ctx context.Context, id string, nonce []byte) ([]byte, error)
+
 	Close() error
 }
 
-func Dial(addr string) (RemoteProvider, error) {
-	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+// Dial connects to the provider at addr. Additional options are passed to
+// grpc.Dial.
+func Dial(addr string, opts ...grpc.DialOption) (RemoteProvider, error) {
+	opts = append([]grpc.DialOption{grpc.WithInsecure()}, opts...)
+	conn, err := grpc.Dial(addr, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -23,21 +66,35 @@ func Dial(addr string) (RemoteProvider, error) {
 	return pvdr, nil
 }
 
+// DialPeer connects to a peer, directly at its address or through its relay.
+func DialPeer(pinfo core.PeerInfo, opts ...grpc.DialOption) (RemoteProvider, error) {
+	if len(pinfo.Relay) == 0 {
+		return Dial(pinfo.Addr, opts...)
+	}
+	target := func(ctx context.Context, method string, req, reply interface{},
+		cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx = metadata.AppendToOutgoingContext(ctx, RelayTargetKey, pinfo.ID)
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	opts = append(opts, grpc.WithChainUnaryInterceptor(target))
+	return Dial(pinfo.Relay, opts...)
+}
+
 type remote struct {
 	conn   *grpc.ClientConn
 	client core.ProviderClient
 }
 
-func (p *remote) Info() (*core.ProviderInfo, error) {
-	resp, err := p.client.Info(context.TODO(), &core.InfoRequest{})
+func (p *remote) Info(ctx context.Context) (*core.ProviderInfo, error) {
+	resp, err := p.client.Info(ctx, &core.InfoRequest{})
 	if err != nil {
 		return nil, err
 	}
 	return resp.Info, nil
 }
 
-func (p *remote) Negotiate(contract *core.Contract) (*core.Contract, error) {
-	resp, err := p.client.Negotiate(context.TODO(), &core.NegotiateRequest{
+func (p *remote) Negotiate(ctx context.Context, contract *core.Contract) (*core.Contract, error) {
+	resp, err := p.client.Negotiate(ctx, &core.NegotiateRequest{
 		Contract: contract,
 	})
 	if err != nil {
@@ -46,16 +103,16 @@ func (p *remote) Negotiate(contract *core.Contract) (*core.Contract, error) {
 	return resp.Contract, nil
 }
 
-func (p *remote) StoreBlock(ID string, block []byte) error {
-	_, err := p.client.StoreBlock(context.TODO(), &core.StoreBlockRequest{
+func (p *remote) StoreBlock(ctx context.Context, ID string, block []byte) error {
+	_, err := p.client.StoreBlock(ctx, &core.StoreBlockRequest{
 		BlockId: ID,
-		Block:   &core.Block{block},
+		Block:   &core.Block{Data: block},
 	})
 	return err
 }
 
-func (p *remote) GetBlock(ID string) (block []byte, err error) {
-	resp, err := p.client.GetBlock(context.TODO(), &core.GetBlockRequest{
+func (p *remote) GetBlock(ctx context.Context, ID string) (block []byte, err error) {
+	resp, err := p.client.GetBlock(ctx, &core.GetBlockRequest{
 		BlockId: ID,
 	})
 	if err != nil {
@@ -64,6 +121,17 @@ func (p *remote) GetBlock(ID string) (block []byte, err error) {
 	return resp.Block.Data, nil
 }
 
+func (p *remote) ProveBlock(ctx context.Context, ID string, nonce []byte) ([]byte, error) {
+	resp, err := p.client.GetBlock(ctx, &core.GetBlockRequest{
+		BlockId: ID,
+		Nonce:   nonce,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Proof, nil
+}
+
 func (p *remote) Close() error {
 	return p.conn.Close()
 }
@@ -0,0 +1,393 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	bolt "go.etcd.io/bbolt"
+	core "skybin/core/proto"
+	"sort"
+	"time"
+)
+
+var (
+	contractsBucket = []byte("contracts")
+	rentersBucket   = []byte("renters")
+)
+
+// RenterAccount sums the contracts a server has signed with a renter and
+// the renter's use of the server.
+type RenterAccount struct {
+	Contracts       int   `json:"contracts"`
+	ContractedBytes int64 `json:"contractedBytes"` // Total block size under contract
+	Blocks          int   `json:"blocks"`          // Contracted blocks that have been stored
+	StoredBytes     int64 `json:"storedBytes"`
+	ServedBytes     int64 `json:"servedBytes"` // Bytes of blocks sent to renters
+}
+
+// Accounts records the contracts a server has signed with each renter, so
+// it knows who blocks are stored for, and sums each renter's usage. Blocks
+// stored or served without a contract are counted for the renter with an
+// empty ID. Records are kept in a bbolt database and survive restarts.
+type Accounts struct {
+	db *bolt.DB
+}
+
+// OpenAccounts opens the accounts database in filename, creating it if it
+// doesn't exist.
+func OpenAccounts(filename string) (*Accounts, error) {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{contractsBucket, rentersBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Accounts{db: db}, nil
+}
+
+func (a *Accounts) Close() error {
+	return a.db.Close()
+}
+
+// contractKey is the key of a renter's contract for a block. Keys for the
+// same block share a prefix.
+func contractKey(blockID string, renterID string) []byte {
+	return []byte(blockID + "\x00" + renterID)
+}
+
+// contractRecord is the value recorded for a renter's contract for a block.
+type contractRecord struct {
+	contracted int64 // Block size under contract
+	stored     int64 // Size of the block as stored. Zero until it is stored.
+	expires    int64 // Unix time the contract ends. Zero if it doesn't.
+}
+
+func (r contractRecord) encode() []byte {
+	v := make([]byte, 24)
+	binary.BigEndian.PutUint64(v, uint64(r.contracted))
+	binary.BigEndian.PutUint64(v[8:], uint64(r.stored))
+	binary.BigEndian.PutUint64(v[16:], uint64(r.expires))
+	return v
+}
+
+// decodeContract decodes a contract record. Records made before stored
+// sizes or expiry times were kept lack them.
+func decodeContract(v []byte) contractRecord {
+	var r contractRecord
+	r.contracted = int64(binary.BigEndian.Uint64(v))
+	if len(v) >= 16 {
+		r.stored = int64(binary.BigEndian.Uint64(v[8:]))
+	}
+	if len(v) >= 24 {
+		r.expires = int64(binary.BigEndian.Uint64(v[16:]))
+	}
+	return r
+}
+
+// contractExpiry returns the unix time a contract ends, or zero if it has
+// no duration.
+func contractExpiry(contract *core.Contract) int64 {
+	if contract.Duration <= 0 {
+		return 0
+	}
+	return contract.StartTime + contract.Duration
+}
+
+// forBlock calls fn with each renter with a record for a block.
+func forBlock(tx *bolt.Tx, blockID string, fn func(renterID string, v []byte) error) error {
+	prefix := []byte(blockID + "\x00")
+	c := tx.Bucket(contractsBucket).Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		err := fn(string(k[len(prefix):]), v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// noRenterKey stores the account of blocks without a contract, since bbolt
+// doesn't allow empty keys.
+const noRenterKey = "\x00"
+
+func accountKey(renterID string) []byte {
+	if len(renterID) == 0 {
+		return []byte(noRenterKey)
+	}
+	return []byte(renterID)
+}
+
+func getAccount(tx *bolt.Tx, renterID string) (RenterAccount, error) {
+	var acct RenterAccount
+	v := tx.Bucket(rentersBucket).Get(accountKey(renterID))
+	if v == nil {
+		return acct, nil
+	}
+	err := json.Unmarshal(v, &acct)
+	return acct, err
+}
+
+func putAccount(tx *bolt.Tx, renterID string, acct RenterAccount) error {
+	v, err := json.Marshal(&acct)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(rentersBucket).Put(accountKey(renterID), v)
+}
+
+// Renter returns the account of a renter.
+func (a *Accounts) Renter(renterID string) (RenterAccount, error) {
+	var acct RenterAccount
+	err := a.db.View(func(tx *bolt.Tx) error {
+		var err error
+		acct, err = getAccount(tx, renterID)
+		return err
+	})
+	return acct, err
+}
+
+// hasContract reports whether a renter already has a contract for a block.
+func (a *Accounts) hasContract(blockID string, renterID string) (bool, error) {
+	found := false
+	err := a.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket(contractsBucket).Get(contractKey(blockID, renterID)) != nil
+		return nil
+	})
+	return found, err
+}
+
+// addContract records a signed contract. admit is called with the renter's
+// account before the contract is added to it, and the contract is not
+// recorded if it returns an error. A new contract for a block the renter
+// already has a contract for, such as a renewal, replaces the old one.
+func (a *Accounts) addContract(contract *core.Contract, admit func(acct RenterAccount) error) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		key := contractKey(contract.BlockID, contract.RenterID)
+		contracts := tx.Bucket(contractsBucket)
+		acct, err := getAccount(tx, contract.RenterID)
+		if err != nil {
+			return err
+		}
+		record := contractRecord{contracted: contract.BlockSize, expires: contractExpiry(contract)}
+		if v := contracts.Get(key); v != nil {
+			old := decodeContract(v)
+			acct.Contracts--
+			acct.ContractedBytes -= old.contracted
+			record.stored = old.stored
+		}
+		err = admit(acct)
+		if err != nil {
+			return err
+		}
+		err = contracts.Put(key, record.encode())
+		if err != nil {
+			return err
+		}
+		acct.Contracts++
+		acct.ContractedBytes += contract.BlockSize
+		return putAccount(tx, contract.RenterID, acct)
+	})
+}
+
+// Expire removes the contracts that ended before now, releasing the storage
+// they held against their renters' quotas, and returns how many it removed.
+// Blocks stay stored until they are deleted.
+func (a *Accounts) Expire(now time.Time) (int, error) {
+	n := 0
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		contracts := tx.Bucket(contractsBucket)
+		var expired [][]byte
+		err := contracts.ForEach(func(k, v []byte) error {
+			record := decodeContract(v)
+			if record.expires > 0 && record.expires <= now.Unix() {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range expired {
+			record := decodeContract(contracts.Get(k))
+			renterID := string(k[bytes.IndexByte(k, 0)+1:])
+			acct, err := getAccount(tx, renterID)
+			if err != nil {
+				return err
+			}
+			acct.Contracts--
+			acct.ContractedBytes -= record.contracted
+			if record.stored > 0 {
+				acct.Blocks--
+				acct.StoredBytes -= record.stored
+			}
+			err = putAccount(tx, renterID, acct)
+			if err != nil {
+				return err
+			}
+			err = contracts.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		n = len(expired)
+		return nil
+	})
+	return n, err
+}
+
+// blockContracts returns the record of each renter's contract for a block.
+func (a *Accounts) blockContracts(blockID string) (map[string]contractRecord, error) {
+	records := make(map[string]contractRecord)
+	err := a.db.View(func(tx *bolt.Tx) error {
+		return forBlock(tx, blockID, func(renterID string, v []byte) error {
+			if len(renterID) > 0 {
+				records[renterID] = decodeContract(v)
+			}
+			return nil
+		})
+	})
+	return records, err
+}
+
+// recordStored counts a stored block for each renter with a contract for it.
+// Blocks stored again, such as updated metadata, replace their old size.
+func (a *Accounts) recordStored(blockID string, size int64) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		type renterRecord struct {
+			renterID string
+			contractRecord
+		}
+		var records []renterRecord
+		err := forBlock(tx, blockID, func(renterID string, v []byte) error {
+			records = append(records, renterRecord{renterID, decodeContract(v)})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			records = append(records, renterRecord{renterID: ""})
+		}
+
+		for _, r := range records {
+			prev := r.stored
+			r.stored = size
+			err := tx.Bucket(contractsBucket).Put(contractKey(blockID, r.renterID), r.encode())
+			if err != nil {
+				return err
+			}
+			acct, err := getAccount(tx, r.renterID)
+			if err != nil {
+				return err
+			}
+			if prev == 0 {
+				acct.Blocks++
+			}
+			acct.StoredBytes += size - prev
+			err = putAccount(tx, r.renterID, acct)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// recordServed counts bytes of a block sent to a renter. Requests don't
+// identify the renter, so the bytes are split between the renters storing
+// the block.
+func (a *Accounts) recordServed(blockID string, n int64) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		var renters []string
+		err := forBlock(tx, blockID, func(renterID string, v []byte) error {
+			renters = append(renters, renterID)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(renters) == 0 {
+			renters = append(renters, "")
+		}
+
+		share := n / int64(len(renters))
+		for i, renterID := range renters {
+			acct, err := getAccount(tx, renterID)
+			if err != nil {
+				return err
+			}
+			acct.ServedBytes += share
+			if i == 0 {
+				acct.ServedBytes += n % int64(len(renters))
+			}
+			err = putAccount(tx, renterID, acct)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Renters returns the accounts of every renter, by renter ID.
+func (a *Accounts) Renters() (map[string]RenterAccount, error) {
+	accts := make(map[string]RenterAccount)
+	err := a.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(rentersBucket).ForEach(func(k, v []byte) error {
+			var acct RenterAccount
+			err := json.Unmarshal(v, &acct)
+			if err != nil {
+				return err
+			}
+			renterID := string(k)
+			if renterID == noRenterKey {
+				renterID = ""
+			}
+			accts[renterID] = acct
+			return nil
+		})
+	})
+	return accts, err
+}
+
+// Stats returns the usage of the renter with the given ID, or of every
+// renter if renterID is empty, ordered by renter ID.
+func (a *Accounts) Stats(renterID string) (*core.RenterStatsResponse, error) {
+	accts, err := a.Renters()
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for id := range accts {
+		if len(renterID) == 0 || id == renterID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	resp := &core.RenterStatsResponse{}
+	for _, id := range ids {
+		acct := accts[id]
+		resp.Renters = append(resp.Renters, &core.RenterStats{
+			RenterID:        id,
+			Contracts:       int64(acct.Contracts),
+			ContractedBytes: acct.ContractedBytes,
+			Blocks:          int64(acct.Blocks),
+			StoredBytes:     acct.StoredBytes,
+			ServedBytes:     acct.ServedBytes,
+		})
+	}
+	return resp, nil
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"io/ioutil"
+	"log"
+	core "skybin/core/proto"
+	"testing"
+)
+
+func get(ps *Server, blockID string) error {
+	_, err := ps.GetBlock(context.Background(), &core.GetBlockRequest{BlockId: blockID})
+	return err
+}
+
+func renterStats(t *testing.T, ps *Server, renterID string) *core.RenterStats {
+	t.Helper()
+	resp, err := ps.RenterStats(context.Background(), &core.RenterStatsRequest{RenterID: renterID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Renters) != 1 {
+		t.Fatalf("expected stats for 1 renter, got %d", len(resp.Renters))
+	}
+	return resp.Renters[0]
+}
+
+func TestRenterUsage(t *testing.T) {
+	ps, _ := newTestServer(t, AdmissionPolicy{})
+	for _, blockID := range []string{"block1", "block2"} {
+		err := negotiate(t, ps, "alice", blockID, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store(t, ps, "alice", blockID, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Storing a block again replaces its size rather than adding to it.
+	err := store(t, ps, "alice", "block2", 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = get(ps, "block1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := renterStats(t, ps, renterID(t, "alice"))
+	if stats.Contracts != 2 || stats.ContractedBytes != 20 {
+		t.Fatalf("expected 2 contracts for 20 bytes, got %d for %d", stats.Contracts, stats.ContractedBytes)
+	}
+	if stats.Blocks != 2 || stats.StoredBytes != 16 {
+		t.Fatalf("expected 2 blocks of 16 bytes, got %d of %d", stats.Blocks, stats.StoredBytes)
+	}
+	if stats.ServedBytes != 10 {
+		t.Fatalf("expected 10 bytes served, got %d", stats.ServedBytes)
+	}
+}
+
+func TestServedBytesSplitBetweenRenters(t *testing.T) {
+	ps, _ := newTestServer(t, AdmissionPolicy{})
+	for _, renter := range []string{"alice", "bob"} {
+		err := negotiate(t, ps, renter, "block1", 11)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := store(t, ps, "bob", "block1", 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = get(ps, "block1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := renterStats(t, ps, renterID(t, "alice"))
+	bob := renterStats(t, ps, renterID(t, "bob"))
+	if alice.ServedBytes+bob.ServedBytes != 11 {
+		t.Fatalf("expected 11 bytes served in total, got %d", alice.ServedBytes+bob.ServedBytes)
+	}
+	if bob.StoredBytes != 11 || bob.Blocks != 1 {
+		t.Fatalf("expected bob to store 1 block of 11 bytes, got %d of %d", bob.Blocks, bob.StoredBytes)
+	}
+}
+
+func TestUncontractedBlocksUsage(t *testing.T) {
+	ps, _ := newTestServer(t, AdmissionPolicy{})
+	err := store(t, ps, "", "block1", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := renterStats(t, ps, "")
+	if stats.Blocks != 1 || stats.StoredBytes != 5 {
+		t.Fatalf("expected 1 uncontracted block of 5 bytes, got %d of %d", stats.Blocks, stats.StoredBytes)
+	}
+}
+
+func TestRenterUsagePersists(t *testing.T) {
+	ps, filename := newTestServer(t, AdmissionPolicy{})
+	err := negotiate(t, ps, "alice", "block1", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store(t, ps, "alice", "block1", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, accounts := ps.currentAdmission()
+	accounts.Close()
+
+	accounts, err = OpenAccounts(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accounts.Close()
+	resp, err := accounts.Stats(renterID(t, "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Renters) != 1 || resp.Renters[0].StoredBytes != 10 {
+		t.Fatalf("expected usage to persist, got %v", resp.Renters)
+	}
+}
+
+func TestRenterStatsWithoutAccounts(t *testing.T) {
+	ps := New(nil, log.New(ioutil.Discard, "", 0))
+	_, err := ps.RenterStats(context.Background(), &core.RenterStatsRequest{})
+	expectCode(t, err, codes.Unavailable)
+}
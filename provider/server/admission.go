@@ -0,0 +1,203 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	core "skybin/core/proto"
+	"skybin/provider/remote"
+	"strconv"
+	"time"
+)
+
+// maxRequestAge bounds how far the time of a signed request may be from the
+// server's clock, limiting how long a captured request can be replayed.
+const maxRequestAge = 10 * time.Minute
+
+// AdmissionPolicy limits which renters may store blocks with a server, and
+// how much. Renters are identified by the renter ID in their contracts,
+// which they prove by signing with the key the ID is derived from.
+type AdmissionPolicy struct {
+	AllowedRenters        []string `json:"allowedRenters"`        // If not empty, only these renters are admitted
+	DeniedRenters         []string `json:"deniedRenters"`         // Renters that are never admitted
+	MaxStoragePerRenter   int64    `json:"maxStoragePerRenter"`   // Bytes under contract per renter. Zero is unlimited.
+	MaxContractsPerRenter int      `json:"maxContractsPerRenter"` // Contracts per renter. Zero is unlimited.
+}
+
+// restricted reports whether the policy limits any renter.
+func (p *AdmissionPolicy) restricted() bool {
+	return len(p.AllowedRenters) > 0 || len(p.DeniedRenters) > 0 ||
+		p.MaxStoragePerRenter > 0 || p.MaxContractsPerRenter > 0
+}
+
+// admits reports whether the policy lets a renter store blocks at all.
+func (p *AdmissionPolicy) admits(renterID string) bool {
+	for _, id := range p.DeniedRenters {
+		if id == renterID {
+			return false
+		}
+	}
+	if len(p.AllowedRenters) == 0 {
+		return true
+	}
+	for _, id := range p.AllowedRenters {
+		if id == renterID {
+			return true
+		}
+	}
+	return false
+}
+
+// checkQuota checks that a renter with the given account may sign another
+// contract for a block of the given size.
+func (p *AdmissionPolicy) checkQuota(acct RenterAccount, size int64) error {
+	if p.MaxContractsPerRenter > 0 && acct.Contracts >= p.MaxContractsPerRenter {
+		return status.Errorf(codes.ResourceExhausted, "renter has reached the limit of %d contracts", p.MaxContractsPerRenter)
+	}
+	if p.MaxStoragePerRenter > 0 && acct.ContractedBytes+size > p.MaxStoragePerRenter {
+		return status.Errorf(codes.ResourceExhausted, "contract would exceed the renter's storage quota of %d bytes", p.MaxStoragePerRenter)
+	}
+	return nil
+}
+
+// SetAdmission changes the policy applied to new contracts and stored
+// blocks. Quotas are only enforced once accounts are set.
+func (ps *Server) SetAdmission(policy AdmissionPolicy) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.admission = policy
+}
+
+// SetAccounts sets where the server records the contracts it signs.
+func (ps *Server) SetAccounts(accounts *Accounts) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.accounts = accounts
+}
+
+func (ps *Server) currentAdmission() (AdmissionPolicy, *Accounts) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.admission, ps.accounts
+}
+
+// admitContract checks that a renter may negotiate a contract before it is
+// passed to the provider. While the server records contracts or restricts
+// renters, contracts must be signed by the renter they name.
+func (ps *Server) admitContract(contract *core.Contract) error {
+	policy, accounts := ps.currentAdmission()
+	if accounts != nil || policy.restricted() {
+		_, err := core.VerifyContract(contract)
+		if err != nil {
+			return status.Errorf(codes.Unauthenticated, "renter %s: %s", contract.RenterID, err)
+		}
+	}
+	if !policy.admits(contract.RenterID) {
+		return status.Errorf(codes.PermissionDenied, "renter %s is not admitted", contract.RenterID)
+	}
+	if accounts == nil {
+		return nil
+	}
+	exists, err := accounts.hasContract(contract.BlockID, contract.RenterID)
+	if err != nil || exists {
+		return err
+	}
+	acct, err := accounts.Renter(contract.RenterID)
+	if err != nil {
+		return err
+	}
+	return policy.checkQuota(acct, contract.BlockSize)
+}
+
+// recordContract records a contract the provider signed. The quota is
+// checked again, since other contracts may have been signed since the
+// renter was admitted.
+func (ps *Server) recordContract(contract *core.Contract) error {
+	policy, accounts := ps.currentAdmission()
+	if accounts == nil {
+		return nil
+	}
+	return accounts.addContract(contract, func(acct RenterAccount) error {
+		return policy.checkQuota(acct, contract.BlockSize)
+	})
+}
+
+// admitBlock checks that a block may be stored. A block under contract may
+// only be stored by an admitted renter holding a contract for it, and only up
+// to the contracted size. While the policy restricts renters, blocks without
+// a contract are refused.
+//
+// Blocks named by the hash of their content, such as file blocks, are shared
+// by every renter storing the same data, and anyone may store their content.
+// Other blocks, such as metadata rewritten as it changes, belong to a single
+// renter, so a block that doesn't match its ID can't replace one stored
+// under another renter's contract.
+func (ps *Server) admitBlock(ctx context.Context, blockID string, block []byte) error {
+	policy, accounts := ps.currentAdmission()
+	if accounts == nil {
+		return nil
+	}
+	contracts, err := accounts.blockContracts(blockID)
+	if err != nil {
+		return err
+	}
+	if len(contracts) == 0 {
+		if policy.restricted() {
+			return status.Errorf(codes.PermissionDenied, "no contract for block %s", blockID)
+		}
+		return nil
+	}
+
+	renterID, err := blockRenter(ctx, blockID, block)
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "cannot store block %s: %s", blockID, err)
+	}
+	contract, ok := contracts[renterID]
+	if !ok {
+		return status.Errorf(codes.PermissionDenied, "renter %s has no contract for block %s", renterID, blockID)
+	}
+	if !policy.admits(renterID) {
+		return status.Errorf(codes.PermissionDenied, "renter %s is not admitted", renterID)
+	}
+	if int64(len(block)) > contract.contracted {
+		return status.Errorf(codes.PermissionDenied, "block %s of size %d exceeds its contracted size of %d",
+			blockID, len(block), contract.contracted)
+	}
+	if core.ContentID(block) == blockID {
+		return nil
+	}
+	for otherID, other := range contracts {
+		if otherID != renterID && other.stored > 0 {
+			return status.Errorf(codes.PermissionDenied, "block %s does not match its ID and is stored for another renter", blockID)
+		}
+	}
+	return nil
+}
+
+// blockRenter returns the ID of the renter that signed a request to store a
+// block.
+func blockRenter(ctx context.Context, blockID string, block []byte) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	get := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	key, sig := get(remote.RenterKeyKey), get(remote.RenterSignatureKey)
+	if len(key) == 0 || len(sig) == 0 {
+		return "", errors.New("request is not signed by a renter")
+	}
+	t, err := strconv.ParseInt(get(remote.RequestTimeKey), 10, 64)
+	if err != nil {
+		return "", errors.New("request has no valid time")
+	}
+	age := time.Since(time.Unix(t, 0))
+	if age > maxRequestAge || age < -maxRequestAge {
+		return "", fmt.Errorf("request time is %s from the server's", age.Round(time.Second))
+	}
+	return core.VerifyStoreBlock(key, sig, blockID, block, t)
+}
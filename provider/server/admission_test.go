@@ -0,0 +1,342 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"log"
+	"path"
+	core "skybin/core/proto"
+	local "skybin/provider/local"
+	"skybin/provider/remote"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// renterKeys holds the key of each test renter, by name.
+var renterKeys = make(map[string]*rsa.PrivateKey)
+
+func renterKey(t *testing.T, name string) *rsa.PrivateKey {
+	key, ok := renterKeys[name]
+	if !ok {
+		var err error
+		key, err = rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		renterKeys[name] = key
+	}
+	return key
+}
+
+// renterID returns the ID of the test renter with the given name.
+func renterID(t *testing.T, name string) string {
+	id, err := core.KeyID(&renterKey(t, name).PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func newTestServer(t *testing.T, policy AdmissionPolicy) (*Server, string) {
+	store, err := local.OpenBlockStore(local.FlatStore, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	pvdr, err := local.New(local.Options{
+		ProviderInfo: core.ProviderInfo{ID: "provider", MaxBlockSize: 1 << 20},
+		Store:        store,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filename := path.Join(t.TempDir(), "renters.db")
+	accounts, err := OpenAccounts(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { accounts.Close() })
+
+	ps := New(pvdr, log.New(ioutil.Discard, "", 0))
+	ps.SetAccounts(accounts)
+	ps.SetAdmission(policy)
+	return ps, filename
+}
+
+// negotiate offers a contract signed by the named renter.
+func negotiate(t *testing.T, ps *Server, renter string, blockID string, size int64) error {
+	return negotiateContract(t, ps, renter, &core.Contract{BlockID: blockID, BlockSize: size})
+}
+
+func negotiateContract(t *testing.T, ps *Server, renter string, contract *core.Contract) error {
+	contract.RenterID = renterID(t, renter)
+	contract.ProviderID = "provider"
+	err := core.SignContract(contract, renterKey(t, renter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ps.Negotiate(context.Background(), &core.NegotiateRequest{Contract: contract})
+	return err
+}
+
+// store stores a block on behalf of the named renter. Requests without a
+// renter are not signed.
+func store(t *testing.T, ps *Server, renter string, blockID string, size int) error {
+	return storeData(t, ps, renter, blockID, make([]byte, size))
+}
+
+// storeData stores the given data as a block on behalf of the named renter.
+func storeData(t *testing.T, ps *Server, renter string, blockID string, data []byte) error {
+	ctx := context.Background()
+	if len(renter) > 0 {
+		signed, err := remote.SignStoreBlock(ctx, renterKey(t, renter), blockID, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		md, _ := metadata.FromOutgoingContext(signed)
+		ctx = metadata.NewIncomingContext(ctx, md)
+	}
+	_, err := ps.StoreBlock(ctx, &core.StoreBlockRequest{
+		BlockId: blockID,
+		Block:   &core.Block{Data: data},
+	})
+	return err
+}
+
+func expectCode(t *testing.T, err error, code codes.Code) {
+	t.Helper()
+	if status.Code(err) != code {
+		t.Fatalf("expected %s error, got %v", code, err)
+	}
+}
+
+func TestAdmissionLists(t *testing.T) {
+	ps, _ := newTestServer(t, AdmissionPolicy{
+		AllowedRenters: []string{renterID(t, "alice"), renterID(t, "bob")},
+		DeniedRenters:  []string{renterID(t, "bob")},
+	})
+	err := negotiate(t, ps, "alice", "block1", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectCode(t, negotiate(t, ps, "bob", "block2", 10), codes.PermissionDenied)
+	expectCode(t, negotiate(t, ps, "mallory", "block3", 10), codes.PermissionDenied)
+}
+
+func TestAdmissionQuotas(t *testing.T) {
+	ps, filename := newTestServer(t, AdmissionPolicy{
+		MaxContractsPerRenter: 2,
+		MaxStoragePerRenter:   25,
+	})
+	for _, id := range []string{"block1", "block2", "block1"} {
+		err := negotiate(t, ps, "alice", id, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectCode(t, negotiate(t, ps, "alice", "block3", 1), codes.ResourceExhausted)
+	expectCode(t, negotiate(t, ps, "bob", "block3", 30), codes.ResourceExhausted)
+	err := negotiate(t, ps, "bob", "block3", 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Accounts survive a restart.
+	ps.accounts.Close()
+	accounts, err := OpenAccounts(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps.SetAccounts(accounts)
+	acct, err := accounts.Renter(renterID(t, "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acct.Contracts != 2 || acct.ContractedBytes != 20 {
+		t.Fatalf("alice's account is %+v after restart", acct)
+	}
+	expectCode(t, negotiate(t, ps, "alice", "block4", 1), codes.ResourceExhausted)
+}
+
+func TestAdmissionStoreBlock(t *testing.T) {
+	ps, _ := newTestServer(t, AdmissionPolicy{AllowedRenters: []string{renterID(t, "alice")}})
+	expectCode(t, store(t, ps, "alice", "block1", 10), codes.PermissionDenied)
+
+	err := negotiate(t, ps, "alice", "block1", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store(t, ps, "alice", "block1", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectCode(t, store(t, ps, "alice", "block1", 11), codes.PermissionDenied)
+
+	// Renters removed from the policy can no longer store blocks.
+	ps.SetAdmission(AdmissionPolicy{DeniedRenters: []string{renterID(t, "alice")}})
+	expectCode(t, store(t, ps, "alice", "block1", 10), codes.PermissionDenied)
+}
+
+func TestOpenPolicyAcceptsUncontractedBlocks(t *testing.T) {
+	ps, _ := newTestServer(t, AdmissionPolicy{})
+	err := store(t, ps, "", "block1", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContractMustBeSignedByRenter(t *testing.T) {
+	ps, _ := newTestServer(t, AdmissionPolicy{AllowedRenters: []string{renterID(t, "alice")}})
+
+	// Mallory claims to be alice.
+	contract := &core.Contract{BlockID: "block1", BlockSize: 10, RenterID: renterID(t, "alice"), ProviderID: "provider"}
+	err := core.SignContract(contract, renterKey(t, "mallory"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ps.Negotiate(context.Background(), &core.NegotiateRequest{Contract: contract})
+	expectCode(t, err, codes.Unauthenticated)
+
+	// Changing a signed contract invalidates the signature.
+	contract = &core.Contract{BlockID: "block1", BlockSize: 10, RenterID: renterID(t, "alice"), ProviderID: "provider"}
+	err = core.SignContract(contract, renterKey(t, "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract.BlockSize = 1000
+	_, err = ps.Negotiate(context.Background(), &core.NegotiateRequest{Contract: contract})
+	expectCode(t, err, codes.Unauthenticated)
+
+	contract.RenterSignature = ""
+	_, err = ps.Negotiate(context.Background(), &core.NegotiateRequest{Contract: contract})
+	expectCode(t, err, codes.Unauthenticated)
+}
+
+func TestOnlyContractedRenterStoresBlock(t *testing.T) {
+	// Even with an open policy, a contracted block can't be replaced by
+	// anyone but the renters holding contracts for it.
+	ps, _ := newTestServer(t, AdmissionPolicy{})
+	err := negotiate(t, ps, "alice", "root", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectCode(t, store(t, ps, "", "root", 10), codes.Unauthenticated)
+	expectCode(t, store(t, ps, "mallory", "root", 10), codes.PermissionDenied)
+	err = store(t, ps, "alice", "root", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSharedBlockCannotBeReplaced(t *testing.T) {
+	// Two renters storing the same file block hold contracts for one ID.
+	// Neither may replace the other's copy with data that doesn't match it.
+	ps, _ := newTestServer(t, AdmissionPolicy{})
+	data := []byte("shared file data")
+	blockID := core.ContentID(data)
+	for _, renter := range []string{"alice", "bob"} {
+		err := negotiate(t, ps, renter, blockID, int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := storeData(t, ps, "alice", blockID, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectCode(t, storeData(t, ps, "bob", blockID, []byte("other file data!")), codes.PermissionDenied)
+	err = storeData(t, ps, "bob", blockID, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ps.GetBlock(context.Background(), &core.GetBlockRequest{BlockId: blockID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Block.Data) != string(data) {
+		t.Fatalf("stored block is %q, want %q", resp.Block.Data, data)
+	}
+}
+
+func TestStaleStoreBlockRefused(t *testing.T) {
+	ps, _ := newTestServer(t, AdmissionPolicy{})
+	err := negotiate(t, ps, "alice", "block1", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 10)
+	key := renterKey(t, "alice")
+	then := time.Now().Add(-time.Hour).Unix()
+	sig, err := core.SignStoreBlock(key, "block1", data, then)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := core.EncodePublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		remote.RenterKeyKey, pub,
+		remote.RequestTimeKey, strconv.FormatInt(then, 10),
+		remote.RenterSignatureKey, sig))
+	_, err = ps.StoreBlock(ctx, &core.StoreBlockRequest{BlockId: "block1", Block: &core.Block{Data: data}})
+	expectCode(t, err, codes.Unauthenticated)
+}
+
+func TestExpiredContractsReleaseQuota(t *testing.T) {
+	ps, _ := newTestServer(t, AdmissionPolicy{MaxStoragePerRenter: 15})
+	start := time.Now().Add(-time.Hour).Unix()
+	err := negotiateContract(t, ps, "alice", &core.Contract{BlockID: "block1", BlockSize: 10, StartTime: start, Duration: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store(t, ps, "alice", "block1", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectCode(t, negotiate(t, ps, "alice", "block2", 10), codes.ResourceExhausted)
+
+	n, err := ps.accounts.Expire(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 contract to expire, got %d", n)
+	}
+	acct, err := ps.accounts.Renter(renterID(t, "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acct != (RenterAccount{}) {
+		t.Fatalf("expected expired contract to be released, got %+v", acct)
+	}
+	err = negotiate(t, ps, "alice", "block2", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRenewalReplacesContract(t *testing.T) {
+	ps, _ := newTestServer(t, AdmissionPolicy{MaxStoragePerRenter: 15})
+	for _, size := range []int64{10, 12} {
+		err := negotiate(t, ps, "alice", "block1", size)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	acct, err := ps.accounts.Renter(renterID(t, "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acct.Contracts != 1 || acct.ContractedBytes != 12 {
+		t.Fatalf("expected 1 contract for 12 bytes, got %d for %d", acct.Contracts, acct.ContractedBytes)
+	}
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"net/http"
+	"path"
+	local "skybin/provider/local"
+	"sync"
+	"time"
+)
+
+// storageWalkInterval is how long the stored block counts are reused before
+// the block store is walked again, since a walk visits every block.
+const storageWalkInterval = time.Minute
+
+// Metrics records Prometheus metrics for a provider server.
+type Metrics struct {
+	registry      *prometheus.Registry
+	requests      *prometheus.CounterVec
+	errors        *prometheus.CounterVec
+	bytesReceived *prometheus.CounterVec
+	bytesSent     *prometheus.CounterVec
+	latency       *prometheus.HistogramVec
+	storage       *storageCollector
+}
+
+// NewMetrics creates metrics for a server storing blocks in store.
+func NewMetrics(store local.BlockStore) *Metrics {
+	labels := []string{"method"}
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "skybin_provider_requests_total",
+			Help: "Number of provider RPCs received.",
+		}, labels),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "skybin_provider_request_errors_total",
+			Help: "Number of provider RPCs that returned an error.",
+		}, labels),
+		bytesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "skybin_provider_received_bytes_total",
+			Help: "Size of provider RPC requests in bytes.",
+		}, labels),
+		bytesSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "skybin_provider_sent_bytes_total",
+			Help: "Size of provider RPC responses in bytes.",
+		}, labels),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "skybin_provider_request_duration_seconds",
+			Help:    "Time taken to handle provider RPCs.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+		}, labels),
+		storage: &storageCollector{store: store},
+	}
+	m.registry.MustRegister(
+		m.requests,
+		m.errors,
+		m.bytesReceived,
+		m.bytesSent,
+		m.latency,
+		m.storage,
+	)
+	return m
+}
+
+// Interceptor records metrics for each unary RPC handled by the server.
+func (m *Metrics) Interceptor(ctxt context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	method := path.Base(info.FullMethod)
+	start := time.Now()
+	resp, err := handler(ctxt, req)
+	m.latency.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	m.requests.WithLabelValues(method).Inc()
+	if err != nil {
+		m.errors.WithLabelValues(method).Inc()
+	}
+	if msg, ok := req.(proto.Message); ok {
+		m.bytesReceived.WithLabelValues(method).Add(float64(proto.Size(msg)))
+	}
+	if msg, ok := resp.(proto.Message); ok && err == nil {
+		m.bytesSent.WithLabelValues(method).Add(float64(proto.Size(msg)))
+	}
+	return resp, err
+}
+
+// Handler returns an HTTP handler serving the metrics.
+func (m *Metrics) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	return mux
+}
+
+var (
+	storedBlocksDesc = prometheus.NewDesc(
+		"skybin_provider_stored_blocks",
+		"Number of blocks stored by the provider.",
+		nil, nil,
+	)
+	storedBytesDesc = prometheus.NewDesc(
+		"skybin_provider_stored_block_bytes",
+		"Total size of blocks stored by the provider, not the disk space they use.",
+		nil, nil,
+	)
+)
+
+// storageCollector reports the number and total size of stored blocks. The
+// size is the sum of the block sizes, not the disk space they use. The counts
+// come from walking the block store, at most once per storageWalkInterval
+// however often metrics are collected.
+type storageCollector struct {
+	store local.BlockStore
+
+	mu      sync.Mutex
+	walked  time.Time // When the counts were last taken. Zero if never.
+	nblocks int64
+	nbytes  int64
+}
+
+func (c *storageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- storedBlocksDesc
+	ch <- storedBytesDesc
+}
+
+func (c *storageCollector) Collect(ch chan<- prometheus.Metric) {
+	nblocks, nbytes, err := c.counts()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(storedBlocksDesc, err)
+		ch <- prometheus.NewInvalidMetric(storedBytesDesc, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(storedBlocksDesc, prometheus.GaugeValue, float64(nblocks))
+	ch <- prometheus.MustNewConstMetric(storedBytesDesc, prometheus.GaugeValue, float64(nbytes))
+}
+
+// counts returns the number and size of stored blocks, walking the store
+// only if the last counts are older than storageWalkInterval. A failed walk
+// is retried on the next collection.
+func (c *storageCollector) counts() (nblocks int64, nbytes int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.walked.IsZero() && time.Since(c.walked) < storageWalkInterval {
+		return c.nblocks, c.nbytes, nil
+	}
+	err = c.store.Walk(func(id string, size int64) error {
+		nblocks++
+		nbytes += size
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	c.walked = time.Now()
+	c.nblocks = nblocks
+	c.nbytes = nbytes
+	return nblocks, nbytes, nil
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	core "skybin/core/proto"
+	local "skybin/provider/local"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestMetrics(t *testing.T) (*Metrics, local.BlockStore, *httptest.Server) {
+	store, err := local.OpenBlockStore(local.FlatStore, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	m := NewMetrics(store)
+	srv := httptest.NewServer(m.Handler())
+	t.Cleanup(srv.Close)
+	return m, store, srv
+}
+
+// scrape returns the metrics served at srv.
+func scrape(t *testing.T, srv *httptest.Server) string {
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("metrics endpoint returned %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func expectMetric(t *testing.T, metrics string, line string) {
+	for _, l := range strings.Split(metrics, "\n") {
+		if l == line {
+			return
+		}
+	}
+	t.Fatalf("expected metric %q in:\n%s", line, metrics)
+}
+
+func TestMetricsRecordRequests(t *testing.T) {
+	m, _, srv := newTestMetrics(t)
+	info := &grpc.UnaryServerInfo{FullMethod: "/core.Provider/GetBlock"}
+	ok := func(ctxt context.Context, req interface{}) (interface{}, error) {
+		return &core.GetBlockResponse{Block: &core.Block{Data: []byte("data")}}, nil
+	}
+	failed := func(ctxt context.Context, req interface{}) (interface{}, error) {
+		return nil, context.Canceled
+	}
+	req := &core.GetBlockRequest{BlockId: "block1"}
+	m.Interceptor(context.Background(), req, info, ok)
+	m.Interceptor(context.Background(), req, info, failed)
+
+	metrics := scrape(t, srv)
+	expectMetric(t, metrics, `skybin_provider_requests_total{method="GetBlock"} 2`)
+	expectMetric(t, metrics, `skybin_provider_request_errors_total{method="GetBlock"} 1`)
+	expectMetric(t, metrics, `skybin_provider_request_duration_seconds_count{method="GetBlock"} 2`)
+	if !strings.Contains(metrics, `skybin_provider_sent_bytes_total{method="GetBlock"}`) {
+		t.Fatal("expected sent bytes to be recorded")
+	}
+}
+
+func TestMetricsReportStorage(t *testing.T) {
+	m, store, srv := newTestMetrics(t)
+	store.Put("block1", []byte("12345"))
+	store.Put("block2", []byte("123"))
+
+	metrics := scrape(t, srv)
+	expectMetric(t, metrics, "skybin_provider_stored_blocks 2")
+	expectMetric(t, metrics, "skybin_provider_stored_block_bytes 8")
+
+	// Later scrapes reuse the counts instead of walking the store again.
+	store.Delete("block2")
+	expectMetric(t, scrape(t, srv), "skybin_provider_stored_blocks 2")
+
+	m.storage.walked = time.Now().Add(-storageWalkInterval)
+	metrics = scrape(t, srv)
+	expectMetric(t, metrics, "skybin_provider_stored_blocks 1")
+	expectMetric(t, metrics, "skybin_provider_stored_block_bytes 5")
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log"
+	"net"
+	core "skybin/core/proto"
+	"skybin/throttle"
+	"sync"
+)
+
+// Server exposes a core.Provider to renters over gRPC.
+type Server struct {
+	provider core.Provider
+	logger   *log.Logger
+	upload   *throttle.Group // Limits data sent to renters
+	download *throttle.Group // Limits data received from renters
+
+	mu        sync.Mutex
+	admission AdmissionPolicy
+	accounts  *Accounts // Contracts signed with renters. Nil if not recorded.
+}
+
+// New creates a server for the given provider. Transfers are not rate limited
+// until limits are set.
+func New(provider core.Provider, logger *log.Logger) *Server {
+	return &Server{
+		provider: provider,
+		logger:   logger,
+		upload:   throttle.NewGroup(0, 0),
+		download: throttle.NewGroup(0, 0),
+	}
+}
+
+// SetUploadRates limits the rate in bytes per second at which data is sent to
+// all renters and to each renter. Zero means unlimited.
+func (ps *Server) SetUploadRates(rate int64, peerRate int64) {
+	ps.upload.SetRates(rate, peerRate)
+}
+
+// SetDownloadRates limits the rate in bytes per second at which data is
+// received from all renters and from each renter. Zero means unlimited.
+func (ps *Server) SetDownloadRates(rate int64, peerRate int64) {
+	ps.download.SetRates(rate, peerRate)
+}
+
+// Listen returns a listener whose connections are held to the server's
+// rates as data streams over them. Only transfers on connections it accepts
+// are limited, including requests relayed for other providers when it wraps
+// a relay's listener.
+func (ps *Server) Listen(l net.Listener) net.Listener {
+	return throttle.Listen(l, ps.upload, ps.download)
+}
+
+func (ps *Server) Info(ctxt context.Context, req *core.InfoRequest) (*core.InfoResponse, error) {
+	ps.logger.Println("get provider info")
+	info, err := ps.provider.Info(ctxt)
+	if err != nil {
+		return nil, err
+	}
+	return &core.InfoResponse{Info: info}, nil
+}
+
+func (ps *Server) Negotiate(ctxt context.Context, req *core.NegotiateRequest) (*core.NegotiateResponse, error) {
+	ps.logger.Println("create contract")
+	err := ps.admitContract(req.Contract)
+	if err != nil {
+		return nil, err
+	}
+	contract, err := ps.provider.Negotiate(ctxt, req.Contract)
+	if err != nil {
+		return nil, err
+	}
+	if len(contract.ProviderSignature) > 0 {
+		err = ps.recordContract(contract)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &core.NegotiateResponse{Contract: contract}, nil
+}
+
+func (ps *Server) StoreBlock(ctxt context.Context, req *core.StoreBlockRequest) (*core.StoreBlockResponse, error) {
+	ps.logger.Println("store block id", req.BlockId)
+
+	err := ps.admitBlock(ctxt, req.BlockId, req.Block.GetData())
+	if err != nil {
+		return nil, err
+	}
+	err = ps.provider.StoreBlock(ctxt, req.BlockId, req.Block.Data)
+	if err != nil {
+		return nil, err
+	}
+	if _, accounts := ps.currentAdmission(); accounts != nil {
+		err := accounts.recordStored(req.BlockId, int64(len(req.Block.Data)))
+		if err != nil {
+			ps.logger.Println("cannot record stored block:", err)
+		}
+	}
+	return &core.StoreBlockResponse{}, nil
+}
+
+func (ps *Server) GetBlock(ctxt context.Context, req *core.GetBlockRequest) (*core.GetBlockResponse, error) {
+	ps.logger.Println("get block id:", req.BlockId)
+	bytes, err := ps.provider.GetBlock(ctxt, req.BlockId)
+	if err != nil {
+		return &core.GetBlockResponse{}, err
+	}
+	if len(req.Nonce) > 0 {
+		// Only the proof is sent, so nothing is served.
+		return &core.GetBlockResponse{Proof: core.BlockProof(req.Nonce, bytes)}, nil
+	}
+	if _, accounts := ps.currentAdmission(); accounts != nil {
+		err := accounts.recordServed(req.BlockId, int64(len(bytes)))
+		if err != nil {
+			ps.logger.Println("cannot record served block:", err)
+		}
+	}
+	return &core.GetBlockResponse{
+		Block: &core.Block{Data: bytes},
+	}, nil
+}
+
+// RenterStats implements the Admin service, reporting the usage of one
+// renter or of all renters.
+func (ps *Server) RenterStats(ctxt context.Context, req *core.RenterStatsRequest) (*core.RenterStatsResponse, error) {
+	_, accounts := ps.currentAdmission()
+	if accounts == nil {
+		return nil, status.Error(codes.Unavailable, "server does not record renter usage")
+	}
+	return accounts.Stats(req.RenterID)
+}
@@ -1,21 +1,20 @@
 package repo
 
 import (
-	"crypto/sha1"
-	"encoding/base32"
-
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/golang/protobuf/proto"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
 	core "skybin/core/proto"
 )
 
 func hash(data []byte) string {
-	h := sha1.New()
-	h.Write(data)
-	return base32.StdEncoding.EncodeToString(h.Sum(nil))
+	return core.ContentID(data)
 }
 
 func makeBlockId(ownerID string, name string) string {
@@ -23,45 +22,95 @@ func makeBlockId(ownerID string, name string) string {
 	return hash([]byte(s))
 }
 
+// Metadata blocks are encoded as blockMagic, a version byte, and the block's
+// protobuf encoding. Blocks written before this encoding are JSON and can
+// still be read.
+var blockMagic = []byte("SKYB")
+
+const blockVersion = 1
+
 func loadINodeBlock(filename string) (*core.INodeBlock, error) {
-	f, err := os.Open(filename)
+	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
 	block := &core.INodeBlock{}
-	err = json.NewDecoder(f).Decode(block)
+	err = unmarshalBlock(data, block)
 	return block, err
 }
 
 func loadDirBlock(filename string) (*core.DirBlock, error) {
-	f, err := os.Open(filename)
+	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
 	block := &core.DirBlock{}
-	err = json.NewDecoder(f).Decode(block)
+	err = unmarshalBlock(data, block)
 	return block, err
 }
 
-func marshalBlock(block interface{}) ([]byte, error) {
-	var buf bytes.Buffer
-	e := json.NewEncoder(&buf)
-	err := e.Encode(block)
+func marshalBlock(block proto.Message) ([]byte, error) {
+	data, err := proto.Marshal(block)
 	if err != nil {
 		return nil, err
 	}
-	return buf.Bytes(), nil
+	buf := make([]byte, 0, len(blockMagic)+1+len(data))
+	buf = append(buf, blockMagic...)
+	buf = append(buf, blockVersion)
+	return append(buf, data...), nil
+}
+
+func unmarshalBlock(data []byte, block proto.Message) error {
+	if isLegacyBlock(data) {
+		return json.Unmarshal(data, block)
+	}
+	data = data[len(blockMagic):]
+	if len(data) == 0 {
+		return errors.New("truncated metadata block")
+	}
+	if data[0] != blockVersion {
+		return fmt.Errorf("unsupported metadata block version %d", data[0])
+	}
+	return proto.Unmarshal(data[1:], block)
+}
+
+// isLegacyBlock reports whether a metadata block is encoded as JSON.
+func isLegacyBlock(data []byte) bool {
+	return !bytes.HasPrefix(data, blockMagic)
 }
 
-func saveBlock(filename string, block interface{}) error {
-	f, err := os.Create(filename)
+// saveBlock writes a block to a file. The block is written to a temporary
+// file first so readers never see a partially written block.
+func saveBlock(filename string, block proto.Message) error {
+	data, err := marshalBlock(block)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	return json.NewEncoder(f).Encode(block)
+	return writeFileAtomic(filename, data)
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to
+// filename. The file is synced before the rename, so a crash leaves either
+// the old contents or the new, never an empty or partial file.
+func writeFileAtomic(filename string, data []byte) error {
+	f, err := ioutil.TempFile(path.Dir(filename), path.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
 }
 
 type blockInfo struct {
@@ -69,24 +118,6 @@ type blockInfo struct {
 	Size int
 }
 
-func getBlockInfo(file io.Reader, blockSize int) ([]blockInfo, error) {
-	var info []blockInfo
-	for {
-		buf, err := readNextBlock(file, blockSize)
-		if err != nil {
-			return nil, err
-		}
-		if len(buf) == 0 {
-			break
-		}
-		info = append(info, blockInfo{
-			ID:   hash(buf),
-			Size: len(buf),
-		})
-	}
-	return info, nil
-}
-
 func readNextBlock(file io.Reader, blockSize int) ([]byte, error) {
 	buf := make([]byte, blockSize)
 	nr := 0
@@ -0,0 +1,112 @@
+package repo
+
+import (
+	"encoding/json"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"path"
+	core "skybin/core/proto"
+	"testing"
+)
+
+func TestMarshalBlock(t *testing.T) {
+	inode := &core.INodeBlock{
+		ID:   "inode",
+		Name: "file.txt",
+		Size: 10,
+		Blocks: []*core.BlockRef{
+			{ID: "block", Contracts: []*core.Contract{{BlockID: "block", BlockSize: 10}}},
+		},
+	}
+	data, err := marshalBlock(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isLegacyBlock(data) {
+		t.Fatal("marshaled block has no header")
+	}
+
+	decoded := &core.INodeBlock{}
+	err = unmarshalBlock(data, decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.String() != inode.String() {
+		t.Fatalf("expected %v, got %v", inode, decoded)
+	}
+
+	data[len(blockMagic)] = blockVersion + 1
+	err = unmarshalBlock(data, decoded)
+	if err == nil {
+		t.Fatal("expected error decoding unknown version")
+	}
+}
+
+func TestMigrateMetadata(t *testing.T) {
+	tn := newTestNet(t, 1)
+	data := []byte("hello")
+	opts := tn.repo.config.DefaultStorageOpts("hello.txt")
+	err := tn.repo.Put(context.Background(), tn.writeFile(data), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewrite the cached metadata as JSON, as older versions stored it.
+	inode, err := tn.repo.loadINode("hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeJSON(t, path.Join(tn.repo.homedir, "user", inode.ID), inode)
+	writeJSON(t, tn.repo.rootBlockPath(), tn.repo.rootBlock)
+
+	// JSON metadata can still be read.
+	r, err := OpenAt(tn.repo.homedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.(*repo).dial = tn.dial
+	defer r.Close()
+	finfo, err := r.Stat("hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finfo.Size != int64(len(data)) {
+		t.Fatalf("expected size %d, got %d", len(data), finfo.Size)
+	}
+
+	n, err := MigrateMetadata(tn.repo.homedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 blocks migrated, got %d", n)
+	}
+	for _, filename := range []string{path.Join(tn.repo.homedir, "user", inode.ID), tn.repo.rootBlockPath()} {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isLegacyBlock(data) {
+			t.Fatalf("%s was not migrated", filename)
+		}
+	}
+
+	files, err := r.ListFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] != "hello.txt" {
+		t.Fatalf("expected [hello.txt], got %v", files)
+	}
+}
+
+func writeJSON(t *testing.T, filename string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filename, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,101 @@
+package repo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Compression algorithms for file blocks.
+const (
+	NoCompression   = "none"
+	GzipCompression = "gzip"
+	ZstdCompression = "zstd"
+)
+
+// validateCompression checks that algo names a supported algorithm. An empty
+// name means no compression.
+func validateCompression(algo string) error {
+	switch algo {
+	case "", NoCompression, GzipCompression, ZstdCompression:
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q", algo)
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func initZstd() {
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(1<<30))
+}
+
+// compressBlock compresses a file block with algo. Blocks that do not
+// shrink by at least 1/16th are returned unchanged, since storing them
+// compressed would cost nearly as much and slow down reads. The algorithm
+// actually applied is returned, or "" if the block is left uncompressed.
+func compressBlock(algo string, block []byte) ([]byte, string, error) {
+	var compressed []byte
+	switch algo {
+	case "", NoCompression:
+		return block, "", nil
+	case GzipCompression:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, err := w.Write(block)
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		compressed = buf.Bytes()
+	case ZstdCompression:
+		zstdOnce.Do(initZstd)
+		compressed = zstdEncoder.EncodeAll(block, nil)
+	default:
+		return nil, "", fmt.Errorf("unknown compression %q", algo)
+	}
+
+	if len(compressed) > len(block)-len(block)/16 {
+		return block, "", nil
+	}
+	return compressed, algo, nil
+}
+
+// decompressBlock reverses compressBlock. size is the block's size before
+// compression; decompressed data of any other size is rejected.
+func decompressBlock(algo string, data []byte, size int64) ([]byte, error) {
+	var block []byte
+	var err error
+	switch algo {
+	case "":
+		return data, nil
+	case GzipCompression:
+		var r *gzip.Reader
+		r, err = gzip.NewReader(bytes.NewReader(data))
+		if err == nil {
+			block, err = ioutil.ReadAll(io.LimitReader(r, size+1))
+		}
+	case ZstdCompression:
+		zstdOnce.Do(initZstd)
+		block, err = zstdDecoder.DecodeAll(data, make([]byte, 0, size))
+	default:
+		return nil, fmt.Errorf("unknown compression %q", algo)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress block: %s", err)
+	}
+	if int64(len(block)) != size {
+		return nil, fmt.Errorf("decompressed block has size %d, expected %d", len(block), size)
+	}
+	return block, nil
+}
@@ -0,0 +1,147 @@
+package repo
+
+import (
+	"bytes"
+	"golang.org/x/net/context"
+	"path"
+	"testing"
+)
+
+var compressionAlgos = []string{GzipCompression, ZstdCompression}
+
+func TestCompressBlock(t *testing.T) {
+	text := bytes.Repeat([]byte("timestamp,level,message\n"), 1000)
+	for _, algo := range compressionAlgos {
+		stored, used, err := compressBlock(algo, text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if used != algo || len(stored) >= len(text) {
+			t.Fatalf("%s: text was not compressed", algo)
+		}
+		block, err := decompressBlock(used, stored, int64(len(text)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(block, text) {
+			t.Fatalf("%s: decompressed block does not match", algo)
+		}
+	}
+}
+
+func TestCompressBlockNone(t *testing.T) {
+	text := bytes.Repeat([]byte("timestamp,level,message\n"), 1000)
+	for _, algo := range []string{"", NoCompression} {
+		stored, used, err := compressBlock(algo, text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if used != "" || !bytes.Equal(stored, text) {
+			t.Fatalf("%q: block was compressed", algo)
+		}
+	}
+}
+
+func TestCompressBlockIncompressible(t *testing.T) {
+	random := randomBytes(t, 24*1024)
+
+	// Data that shrinks by less than 1/16th is stored as it is.
+	mostlyRandom := append(randomBytes(t, 15*1024), make([]byte, 512)...)
+	for _, algo := range compressionAlgos {
+		for _, block := range [][]byte{random, mostlyRandom} {
+			stored, used, err := compressBlock(algo, block)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if used != "" || !bytes.Equal(stored, block) {
+				t.Fatalf("%s: incompressible block of %d bytes was compressed", algo, len(block))
+			}
+		}
+	}
+}
+
+func TestDecompressBlockRejectsBadData(t *testing.T) {
+	text := bytes.Repeat([]byte("timestamp,level,message\n"), 1000)
+	for _, algo := range compressionAlgos {
+		stored, used, err := compressBlock(algo, text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = decompressBlock(used, stored, int64(len(text))-1)
+		if err == nil {
+			t.Fatalf("%s: expected error for wrong size", algo)
+		}
+		_, err = decompressBlock(used, stored[:len(stored)/2], int64(len(text)))
+		if err == nil {
+			t.Fatalf("%s: expected error for truncated data", algo)
+		}
+		_, err = decompressBlock(used, randomBytes(t, 100), int64(len(text)))
+		if err == nil {
+			t.Fatalf("%s: expected error for data it did not compress", algo)
+		}
+	}
+}
+
+func TestCompressBlockUnknown(t *testing.T) {
+	_, _, err := compressBlock("lzma", []byte("data"))
+	if err == nil {
+		t.Fatal("expected error for unknown compression")
+	}
+	_, err = decompressBlock("lzma", []byte("data"), 4)
+	if err == nil {
+		t.Fatal("expected error for unknown compression")
+	}
+}
+
+// Blocks stored before compression was added record neither a compression
+// algorithm nor a size in their refs.
+func TestGetBlocksStoredBeforeCompression(t *testing.T) {
+	tn := newTestNet(t, 1)
+	tn.setConfig(func(config *Config) {
+		config.BlockSize = 1024
+	})
+
+	data := randomBytes(t, 3*1024+100)
+	opts := tn.repo.config.DefaultStorageOpts("old.bin")
+	opts.Compression = NoCompression
+	err := tn.repo.Put(context.Background(), tn.writeFile(data), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inode, err := tn.repo.loadINode("old.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range inode.Blocks {
+		ref.Compression = ""
+		ref.Size = 0
+	}
+	err = saveBlock(path.Join(tn.repo.homedir, "user", inode.ID), inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err = tn.repo.Get(context.Background(), "old.bin", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("downloaded file does not match uploaded file")
+	}
+	buf.Reset()
+	err = tn.repo.GetRange(context.Background(), "old.bin", 1000, 1100, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data[1000:2100]) {
+		t.Fatal("downloaded range does not match uploaded file")
+	}
+	finfo, err := tn.repo.Stat("old.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finfo.Size != int64(len(data)) {
+		t.Fatalf("expected size %d, got %d", len(data), finfo.Size)
+	}
+}
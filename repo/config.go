@@ -1,25 +1,107 @@
 package repo
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"path"
+	"reflect"
 	core "skybin/core/proto"
+	local "skybin/provider/local"
+	providerserver "skybin/provider/server"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// configVersion is the version of the config file's schema. Configs written
+// before the schema was versioned have version 0.
+const configVersion = 1
+
 type Config struct {
+	Version         int               `json:"version"` // Schema version of the config file
 	UserId          string            `json:"userId"`
 	NodeId          string            `json:"providerID"`
 	DhtAddress      string            `json:"dhtAddress"`
 	ProviderAddress string            `json:"providerAddress"`
 	ApiAddress      string            `json:"apiAddress"`
+	MetricsAddress  string            `json:"metricsAddress"`
+	RelayAddress    string            `json:"relayAddress"`   // Relay the provider server is reached through, if set
+	RelayProviders  bool              `json:"relayProviders"` // Whether the provider server relays for other providers
 	SeedAddresses   []string          `json:"seedAddresses"`
 	LogFolder       string            `json:"logFolder"`
 	LogEnabled      bool              `json:"logEnabled"`
 	BlockSize       int               `json:"blockSize"`
 	EncryptionType  string            `json:"encryptionType"`
+	Compression     string            `json:"compression"` // How file blocks are compressed: none, gzip, or zstd
 	Redundancy      int               `json:"redundancy"`
+	MinReputation   float64           `json:"minReputation"` // Providers scoring lower are not used
 	ProviderInfo    core.ProviderInfo `json:"providerInfo"`
+	BlockStore      string            `json:"blockStore"`     // How the provider stores blocks: flat, sharded, or bolt
+	ScrubInterval   int               `json:"scrubInterval"`  // Hours between scrubs of stored blocks. Zero scrubs only at startup.
+	SyncInterval    int               `json:"syncInterval"`   // Minutes between syncs run by the daemon. Zero disables them.
+	RepairInterval  int               `json:"repairInterval"` // Hours between repairs run by the daemon. Zero disables them.
+
+	// Terms of the storage contracts the renter agrees to.
+	ContractTerms ContractTerms `json:"contractTerms"`
+
+	// Bandwidth limits for the renter's transfers to and from providers.
+	RenterBandwidth BandwidthLimits `json:"renterBandwidth"`
+
+	// Time limits for the renter's requests to providers.
+	ProviderTimeouts ProviderTimeouts `json:"providerTimeouts"`
+
+	// Bandwidth limits for the provider server's transfers to and from renters.
+	ProviderBandwidth BandwidthLimits `json:"providerBandwidth"`
+
+	// Renters the provider server stores blocks for, and how much.
+	ProviderAdmission providerserver.AdmissionPolicy `json:"providerAdmission"`
+}
+
+// BandwidthLimits holds transfer rate limits in bytes per second.
+// A limit of zero means unlimited.
+type BandwidthLimits struct {
+	UploadRate       int64 `json:"uploadRate"`
+	DownloadRate     int64 `json:"downloadRate"`
+	PeerUploadRate   int64 `json:"peerUploadRate"`
+	PeerDownloadRate int64 `json:"peerDownloadRate"`
+}
+
+// ProviderTimeouts holds the number of seconds the renter waits for each
+// kind of request to a provider before giving up on it. Zero uses the
+// default.
+type ProviderTimeouts struct {
+	Info       int `json:"info"`
+	Negotiate  int `json:"negotiate"`
+	StoreBlock int `json:"storeBlock"`
+	GetBlock   int `json:"getBlock"`
+}
+
+var defaultProviderTimeouts = ProviderTimeouts{
+	Info:       10,
+	Negotiate:  30,
+	StoreBlock: 300,
+	GetBlock:   300,
+}
+
+// timeout returns a configured number of seconds as a duration, or the
+// default if it isn't set.
+func timeout(seconds int, defaultSeconds int) time.Duration {
+	if seconds <= 0 {
+		seconds = defaultSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// ContractTerms bounds the storage contracts a renter negotiates. Providers
+// asking for more are not used.
+type ContractTerms struct {
+	Currency       string `json:"currency"`       // Currency to pay in. Empty accepts any.
+	MaxStorageRate int64  `json:"maxStorageRate"` // Highest price per GB-month. Zero accepts the advertised price.
+	MaxEgressRate  int64  `json:"maxEgressRate"`  // Highest price per GB downloaded. Zero accepts the advertised price.
+	Duration       int    `json:"duration"`       // Days of storage to ask for
+	MaxDuration    int    `json:"maxDuration"`    // Longest contract accepted, in days. Zero accepts any.
 }
 
 type StorageOptions struct {
@@ -27,6 +109,13 @@ type StorageOptions struct {
 	Redundancy     int
 	BlockSize      int
 	EncryptionType string
+	Compression    string
+
+	// Replace stores the file in place of an existing file with the same
+	// name. Otherwise the file is stored under a new name, such as
+	// "name (1)". The existing file is replaced only once the new one is
+	// uploaded.
+	Replace bool
 }
 
 func (c *Config) DefaultStorageOpts(filename string) *StorageOptions {
@@ -35,38 +124,248 @@ func (c *Config) DefaultStorageOpts(filename string) *StorageOptions {
 		Redundancy:     c.Redundancy,
 		BlockSize:      c.BlockSize,
 		EncryptionType: c.EncryptionType,
+		Compression:    c.Compression,
 	}
 }
 
 func defaultConfig(userId string, nodeId string) *Config {
 	return &Config{
+		Version:         configVersion,
 		UserId:          userId,
 		NodeId:          nodeId,
 		DhtAddress:      "0.0.0.0:8001",
 		ProviderAddress: "0.0.0.0:8002",
 		ApiAddress:      "127.0.0.1:8003",
+		MetricsAddress:  "127.0.0.1:8005",
 		LogFolder:       "",
 		LogEnabled:      false,
 		BlockSize:       1 << 20,
 		EncryptionType:  "aes",
+		Compression:     ZstdCompression,
 		Redundancy:      1,
+		MinReputation:   0.2,
 		ProviderInfo: core.ProviderInfo{
 			ID:           nodeId,
 			MaxBlockSize: 1 << 30,
 		},
+		BlockStore:     "sharded",
+		ScrubInterval:  24,
+		SyncInterval:   10,
+		RepairInterval: 24,
+		ContractTerms: ContractTerms{
+			Duration: 30,
+		},
+		ProviderTimeouts: defaultProviderTimeouts,
 	}
 }
 
+// LoadConfig reads and validates the config of the repo in homedir.
+func LoadConfig(homedir string) (*Config, error) {
+	return loadConfig(path.Join(homedir, "config.json"))
+}
+
 func loadConfig(filename string) (*Config, error) {
 	configBytes, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, fmt.Errorf("Cannot read config: %s", err)
 	}
 
+	// Unknown fields are rejected so misspelled settings aren't silently
+	// ignored.
 	config := &Config{}
-	err = json.Unmarshal(configBytes, config)
+	decoder := json.NewDecoder(bytes.NewReader(configBytes))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(config)
 	if err != nil {
-		return nil, fmt.Errorf("Cannot not parse config: %s", err)
+		return nil, fmt.Errorf("Cannot parse config: %s", err)
+	}
+	if config.Version > configVersion {
+		return nil, fmt.Errorf("Config version %d is newer than this version of skybin supports", config.Version)
+	}
+	err = config.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config: %s", err)
 	}
 	return config, nil
 }
+
+func saveConfig(filename string, config *Config) error {
+	err := config.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid config: %s", err)
+	}
+	c := *config
+	c.Version = configVersion
+	configBytes, err := json.MarshalIndent(&c, "", "    ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, configBytes)
+}
+
+// Validate checks that every setting in the config has a usable value. All
+// problems found are reported together.
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	checkAddress := func(key string, addr string, optional bool) {
+		if optional && len(addr) == 0 {
+			return
+		}
+		if err := ValidateAddress(addr); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", key, err))
+		}
+	}
+	checkRates := func(key string, limits BandwidthLimits) {
+		check(limits.UploadRate >= 0, "%s.uploadRate must not be negative", key)
+		check(limits.DownloadRate >= 0, "%s.downloadRate must not be negative", key)
+		check(limits.PeerUploadRate >= 0, "%s.peerUploadRate must not be negative", key)
+		check(limits.PeerDownloadRate >= 0, "%s.peerDownloadRate must not be negative", key)
+	}
+
+	check(len(c.UserId) > 0, "userId must be set")
+	check(len(c.NodeId) > 0, "providerID must be set")
+	checkAddress("dhtAddress", c.DhtAddress, false)
+	checkAddress("providerAddress", c.ProviderAddress, false)
+	checkAddress("apiAddress", c.ApiAddress, false)
+	checkAddress("metricsAddress", c.MetricsAddress, true)
+	checkAddress("relayAddress", c.RelayAddress, true)
+	for i, addr := range c.SeedAddresses {
+		checkAddress(fmt.Sprintf("seedAddresses[%d]", i), addr, false)
+	}
+	check(c.BlockSize > 0, "blockSize must be positive")
+	check(c.BlockSize <= int(c.ProviderInfo.MaxBlockSize) || c.ProviderInfo.MaxBlockSize <= 0,
+		"blockSize must not exceed providerInfo.maxBlockSize")
+	check(c.EncryptionType == "" || c.EncryptionType == "aes", "encryptionType must be aes")
+	if err := validateCompression(c.Compression); err != nil {
+		problems = append(problems, "compression: "+err.Error())
+	}
+	check(c.Redundancy >= 1, "redundancy must be at least 1")
+	check(c.MinReputation >= 0 && c.MinReputation <= 1, "minReputation must be between 0 and 1")
+	check(len(c.ProviderInfo.ID) > 0, "providerInfo.ID must be set")
+	check(c.ProviderInfo.MaxBlockSize > 0, "providerInfo.maxBlockSize must be positive")
+	check(c.ProviderInfo.StorageRate >= 0, "providerInfo.storageRate must not be negative")
+	check(c.ProviderInfo.EgressRate >= 0, "providerInfo.egressRate must not be negative")
+	check(len(c.ProviderInfo.Currency) > 0 || (c.ProviderInfo.StorageRate == 0 && c.ProviderInfo.EgressRate == 0),
+		"providerInfo.currency must be set to charge for storage")
+	switch c.BlockStore {
+	case "", local.FlatStore, local.ShardedStore, local.BoltStore:
+	default:
+		problems = append(problems, fmt.Sprintf("blockStore must be %s, %s, or %s",
+			local.FlatStore, local.ShardedStore, local.BoltStore))
+	}
+	check(c.ScrubInterval >= 0, "scrubInterval must not be negative")
+	check(c.SyncInterval >= 0, "syncInterval must not be negative")
+	check(c.RepairInterval >= 0, "repairInterval must not be negative")
+	check(c.ContractTerms.MaxStorageRate >= 0, "contractTerms.maxStorageRate must not be negative")
+	check(c.ContractTerms.MaxEgressRate >= 0, "contractTerms.maxEgressRate must not be negative")
+	check(c.ContractTerms.Duration >= 0, "contractTerms.duration must not be negative")
+	check(c.ContractTerms.MaxDuration >= 0, "contractTerms.maxDuration must not be negative")
+	check(c.ContractTerms.MaxDuration == 0 || c.ContractTerms.Duration <= c.ContractTerms.MaxDuration,
+		"contractTerms.duration must not exceed contractTerms.maxDuration")
+	check(c.ProviderInfo.MinDuration >= 0, "providerInfo.minDuration must not be negative")
+	checkRates("renterBandwidth", c.RenterBandwidth)
+	check(c.ProviderTimeouts.Info >= 0, "providerTimeouts.info must not be negative")
+	check(c.ProviderTimeouts.Negotiate >= 0, "providerTimeouts.negotiate must not be negative")
+	check(c.ProviderTimeouts.StoreBlock >= 0, "providerTimeouts.storeBlock must not be negative")
+	check(c.ProviderTimeouts.GetBlock >= 0, "providerTimeouts.getBlock must not be negative")
+	checkRates("providerBandwidth", c.ProviderBandwidth)
+	check(c.ProviderAdmission.MaxStoragePerRenter >= 0, "providerAdmission.maxStoragePerRenter must not be negative")
+	check(c.ProviderAdmission.MaxContractsPerRenter >= 0, "providerAdmission.maxContractsPerRenter must not be negative")
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Get returns the value of the setting with the given key. Keys are the
+// setting's name in config.json, with nested settings joined by dots, such
+// as "renterBandwidth.uploadRate". List values are joined with commas.
+func (c *Config) Get(key string) (string, error) {
+	field, err := configField(c, key)
+	if err != nil {
+		return "", err
+	}
+	if field.Kind() == reflect.Slice {
+		var values []string
+		for i := 0; i < field.Len(); i++ {
+			values = append(values, fmt.Sprint(field.Index(i).Interface()))
+		}
+		return strings.Join(values, ","), nil
+	}
+	return fmt.Sprint(field.Interface()), nil
+}
+
+// Set parses value as the type of the setting with the given key and
+// stores it in the config. The config is not validated.
+func (c *Config) Set(key string, value string) error {
+	field, err := configField(c, key)
+	if err != nil {
+		return err
+	}
+	if key == "version" {
+		return fmt.Errorf("version cannot be changed")
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s must be true or false", key)
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%s must be an integer", key)
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%s must be a number", key)
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		var values []string
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); len(v) > 0 {
+				values = append(values, v)
+			}
+		}
+		field.Set(reflect.ValueOf(values))
+	default:
+		return fmt.Errorf("%s is a group of settings; set its fields individually", key)
+	}
+	return nil
+}
+
+// configField finds the field of a config with the given key.
+func configField(c *Config, key string) (reflect.Value, error) {
+	v := reflect.ValueOf(c).Elem()
+	for _, name := range strings.Split(key, ".") {
+		if v.Kind() != reflect.Struct {
+			return reflect.Value{}, fmt.Errorf("unknown config key %q", key)
+		}
+		found := false
+		for i := 0; i < v.NumField(); i++ {
+			tag := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+			if tag == name {
+				v = v.Field(i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return reflect.Value{}, fmt.Errorf("unknown config key %q", key)
+		}
+	}
+	return v, nil
+}
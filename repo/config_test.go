@@ -0,0 +1,104 @@
+package repo
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestConfigSet(t *testing.T) {
+	config := defaultConfig("user", "node")
+
+	tests := []struct {
+		key   string
+		value string
+	}{
+		{"blockSize", "4096"},
+		{"logEnabled", "true"},
+		{"minReputation", "0.5"},
+		{"providerAddress", "0.0.0.0:9002"},
+		{"seedAddresses", "10.0.0.1:8001,10.0.0.2:8001"},
+		{"renterBandwidth.uploadRate", "1000000"},
+		{"providerInfo.maxBlockSize", "65536"},
+	}
+	for _, test := range tests {
+		err := config.Set(test.key, test.value)
+		if err != nil {
+			t.Fatalf("set %s: %s", test.key, err)
+		}
+		value, err := config.Get(test.key)
+		if err != nil {
+			t.Fatalf("get %s: %s", test.key, err)
+		}
+		if value != test.value {
+			t.Fatalf("%s: expected %s, got %s", test.key, test.value, value)
+		}
+	}
+	if config.RenterBandwidth.UploadRate != 1000000 {
+		t.Fatal("nested setting was not changed")
+	}
+
+	for _, bad := range [][2]string{
+		{"blocksize", "4096"},
+		{"blockSize", "big"},
+		{"logEnabled", "maybe"},
+		{"renterBandwidth", "10"},
+		{"version", "2"},
+	} {
+		if err := config.Set(bad[0], bad[1]); err == nil {
+			t.Fatalf("expected error setting %s to %s", bad[0], bad[1])
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	config := defaultConfig("user", "node")
+	err := config.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.BlockSize = 0
+	config.Redundancy = 0
+	config.ProviderAddress = "localhost"
+	config.Compression = "rar"
+	err = config.Validate()
+	if err == nil {
+		t.Fatal("expected invalid config")
+	}
+	for _, key := range []string{"blockSize", "redundancy", "providerAddress", "compression"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("expected problem with %s in %q", key, err)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	filename := path.Join(t.TempDir(), "config.json")
+	err := saveConfig(filename, defaultConfig("user", "node"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Version != configVersion {
+		t.Fatalf("expected version %d, got %d", configVersion, config.Version)
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	misspelled := strings.Replace(string(data), `"redundancy"`, `"redundnacy"`, 1)
+	err = ioutil.WriteFile(filename, []byte(misspelled), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadConfig(filename)
+	if err == nil || !strings.Contains(err.Error(), "redundnacy") {
+		t.Fatalf("expected error for unknown field, got %v", err)
+	}
+}
@@ -2,7 +2,10 @@ package repo
 
 import (
 	"errors"
+	"fmt"
+	"golang.org/x/net/context"
 	core "skybin/core/proto"
+	"time"
 )
 
 type contractInfo struct {
@@ -10,44 +13,174 @@ type contractInfo struct {
 	contract *core.Contract
 }
 
-func (r *repo) negotiateContract(block blockInfo, provider core.Provider) (*core.Contract, error) {
-	info, err := provider.Info()
+// maxNegotiationRounds bounds the offers made to a provider for a contract.
+const maxNegotiationRounds = 4
+
+const secondsPerDay = 24 * 60 * 60
+
+// renewalFraction is the part of a contract's term left when it is due for
+// renewal.
+const renewalFraction = 4
+
+// contractEnd returns when a contract's term ends. Contracts without a
+// duration don't end.
+func contractEnd(c *core.Contract) (time.Time, bool) {
+	if c.Duration <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(c.StartTime+c.Duration, 0), true
+}
+
+// contractExpired reports whether a contract's term is over.
+func contractExpired(c *core.Contract, now time.Time) bool {
+	end, ok := contractEnd(c)
+	return ok && !now.Before(end)
+}
+
+// dueForRenewal reports whether little enough of a contract's term is left
+// that it should be renewed.
+func dueForRenewal(c *core.Contract, now time.Time) bool {
+	end, ok := contractEnd(c)
+	if !ok {
+		return false
+	}
+	left := time.Duration(c.Duration) * time.Second / renewalFraction
+	return !now.Before(end.Add(-left))
+}
+
+// negotiateContract agrees on a contract with a provider. The renter offers
+// the provider's advertised price, capped by its own limits, and accepts
+// counter-offers that are within its limits. Without a limit of its own, the
+// renter accepts no more than the advertised price.
+func (r *repo) negotiateContract(ctx context.Context, block blockInfo, provider core.Provider) (*core.Contract, error) {
+	info, err := provider.Info(ctx)
 	if err != nil {
 		return nil, err
 	}
 	if info.MaxBlockSize < int32(block.Size) {
 		return nil, errors.New("provider.MaxBlockSize < block.Size")
 	}
-	contract := core.Contract{
-		BlockID:    block.ID,
-		BlockSize:  int64(block.Size),
-		RenterID:   r.config.UserId,
-		ProviderID: info.ID,
+	terms := r.currentConfig().ContractTerms
+	offer := &core.Contract{
+		BlockID:     block.ID,
+		BlockSize:   int64(block.Size),
+		RenterID:    r.currentConfig().UserId,
+		ProviderID:  info.ID,
+		Currency:    info.Currency,
+		StorageRate: info.StorageRate,
+		EgressRate:  info.EgressRate,
+		Duration:    int64(terms.Duration) * secondsPerDay,
+	}
+	if len(terms.Currency) > 0 {
+		offer.Currency = terms.Currency
+	}
+	if terms.MaxStorageRate > 0 && offer.StorageRate > terms.MaxStorageRate {
+		offer.StorageRate = terms.MaxStorageRate
 	}
-	c, err := provider.Negotiate(&contract)
+	if terms.MaxEgressRate > 0 && offer.EgressRate > terms.MaxEgressRate {
+		offer.EgressRate = terms.MaxEgressRate
+	}
+	key, err := r.userKey()
 	if err != nil {
 		return nil, err
 	}
-	accepted := len(c.ProviderSignature) > 0
-	if !accepted {
-		return nil, errors.New("contract terms not accepted")
+
+	for round := 0; round < maxNegotiationRounds; round++ {
+		offer.StartTime = time.Now().Unix()
+		err = core.SignContract(offer, key)
+		if err != nil {
+			return nil, err
+		}
+		c, err := provider.Negotiate(ctx, offer)
+		if err != nil {
+			return nil, err
+		}
+		err = checkContractTerms(c, offer, terms, info)
+		if err != nil {
+			return nil, fmt.Errorf("provider %s: %s", info.ID, err)
+		}
+		accepted := len(c.ProviderSignature) > 0
+		if accepted {
+			if c.Currency != offer.Currency || c.StorageRate > offer.StorageRate ||
+				c.EgressRate > offer.EgressRate || c.Duration != offer.Duration {
+				return nil, fmt.Errorf("provider %s signed different terms than offered", info.ID)
+			}
+			// Only the provider needs the renter's key and signature, so
+			// they aren't kept in the repo's metadata.
+			c.RenterKey = ""
+			c.RenterSignature = ""
+			return c, nil
+		}
+		if c.Currency == offer.Currency && c.StorageRate == offer.StorageRate &&
+			c.EgressRate == offer.EgressRate && c.Duration == offer.Duration {
+			return nil, errors.New("contract terms not accepted")
+		}
+		offer = c
+	}
+	return nil, fmt.Errorf("no agreement with provider %s after %d offers", info.ID, maxNegotiationRounds)
+}
+
+// rateLimit returns the highest rate a renter accepts: its own limit, or
+// without one, the rate the provider advertised.
+func rateLimit(limit int64, advertised int64) int64 {
+	if limit > 0 {
+		return limit
+	}
+	return advertised
+}
+
+// checkContractTerms checks that a contract returned by a provider is for
+// the block offered and within the renter's limits.
+func checkContractTerms(c *core.Contract, offer *core.Contract, terms ContractTerms, info *core.ProviderInfo) error {
+	if c.BlockID != offer.BlockID || c.BlockSize != offer.BlockSize ||
+		c.RenterID != offer.RenterID || c.ProviderID != offer.ProviderID {
+		return errors.New("contract changed the block or parties")
+	}
+	charged := c.StorageRate > 0 || c.EgressRate > 0
+	if charged && len(terms.Currency) > 0 && c.Currency != terms.Currency {
+		return fmt.Errorf("asks for payment in %s instead of %s", c.Currency, terms.Currency)
+	}
+	if max := rateLimit(terms.MaxStorageRate, info.StorageRate); c.StorageRate > max {
+		return fmt.Errorf("storage rate %d exceeds maximum of %d", c.StorageRate, max)
+	}
+	if max := rateLimit(terms.MaxEgressRate, info.EgressRate); c.EgressRate > max {
+		return fmt.Errorf("egress rate %d exceeds maximum of %d", c.EgressRate, max)
+	}
+	if terms.MaxDuration > 0 && c.Duration > int64(terms.MaxDuration)*secondsPerDay {
+		return fmt.Errorf("duration of %d days exceeds maximum of %d",
+			c.Duration/secondsPerDay, terms.MaxDuration)
 	}
-	return c, nil
+	return nil
 }
 
-func (r *repo) negotiateContracts(block blockInfo, providers []core.Provider) ([]contractInfo, error) {
+// negotiateContracts negotiates contracts to store a block with up to n of the
+// given providers, trying them in order. It stops early if ctx is done.
+func (r *repo) negotiateContracts(ctx context.Context, block blockInfo, providers []core.Provider, n int) ([]contractInfo, error) {
+	if n < 1 {
+		n = 1
+	}
 	var contracts []contractInfo
+	var lastErr error
 	for _, provider := range providers {
-		contract, err := r.negotiateContract(block, provider)
+		if len(contracts) >= n {
+			break
+		}
+		contract, err := r.negotiateContract(ctx, block, provider)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		if err != nil {
 			r.logger.Println(err)
+			lastErr = err
 			continue
 		}
 		contracts = append(contracts, contractInfo{
 			provider: provider,
 			contract: contract,
 		})
-		break
+	}
+	if len(contracts) == 0 && lastErr != nil {
+		return nil, fmt.Errorf("cannot find provider for block. last error: %s", lastErr)
 	}
 	if len(contracts) == 0 {
 		return nil, errors.New("cannot find provider for block")
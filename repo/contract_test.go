@@ -0,0 +1,122 @@
+package repo
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	core "skybin/core/proto"
+	"testing"
+)
+
+func TestNegotiateCounterOffer(t *testing.T) {
+	tn := newTestNet(t, 1)
+	tn.setConfig(func(config *Config) {
+		config.ContractTerms.Duration = 1
+	})
+
+	opts := tn.repo.config.DefaultStorageOpts("hello.txt")
+	err := tn.repo.Put(context.Background(), tn.writeFile([]byte("hello")), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contracts, err := tn.repo.ListContracts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, contract := range contracts {
+		if contract.Duration != testMinDuration {
+			t.Errorf("contract duration is %d, want the provider's minimum of %d", contract.Duration, testMinDuration)
+		}
+		if contract.StorageRate != testStorageRate || contract.Currency != testCurrency {
+			t.Errorf("contract price is %d %s", contract.StorageRate, contract.Currency)
+		}
+		if len(contract.ProviderSignature) == 0 {
+			t.Error("contract is not signed")
+		}
+	}
+}
+
+func TestNegotiateRejectsTermsOverLimits(t *testing.T) {
+	for name, terms := range map[string]ContractTerms{
+		"storage rate": {Duration: 30, MaxStorageRate: testStorageRate - 1},
+		"egress rate":  {Duration: 30, MaxEgressRate: testEgressRate - 1},
+		"duration":     {Duration: 1, MaxDuration: 3},
+		"currency":     {Duration: 30, Currency: "EUR"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tn := newTestNet(t, 2)
+			tn.setConfig(func(config *Config) {
+				config.ContractTerms = terms
+			})
+			opts := tn.repo.config.DefaultStorageOpts("hello.txt")
+			err := tn.repo.Put(context.Background(), tn.writeFile([]byte("hello")), opts)
+			if err == nil {
+				t.Fatal("stored file with contract terms over the renter's limits")
+			}
+		})
+	}
+}
+
+// hagglingProvider never signs, asking for a longer contract each time.
+type hagglingProvider struct {
+	offers int
+}
+
+func (p *hagglingProvider) Info(ctx context.Context) (*core.ProviderInfo, error) {
+	return &core.ProviderInfo{ID: "haggler", MaxBlockSize: 1 << 20}, nil
+}
+
+func (p *hagglingProvider) Negotiate(ctx context.Context, contract *core.Contract) (*core.Contract, error) {
+	p.offers++
+	c := *contract
+	c.Duration++
+	return &c, nil
+}
+
+func (p *hagglingProvider) StoreBlock(ctx context.Context, id string, block []byte) error {
+	return errors.New("no contract")
+}
+
+func (p *hagglingProvider) GetBlock(ctx context.Context, id string) ([]byte, error) {
+	return nil, errors.New("no contract")
+}
+
+func TestNegotiateIsBounded(t *testing.T) {
+	tn := newTestNet(t, 0)
+	pvdr := &hagglingProvider{}
+	_, err := tn.repo.negotiateContract(context.Background(), blockInfo{ID: "block", Size: 10}, pvdr)
+	if err == nil {
+		t.Fatal("agreed on a contract the provider never signed")
+	}
+	if pvdr.offers != maxNegotiationRounds {
+		t.Fatalf("made %d offers, want %d", pvdr.offers, maxNegotiationRounds)
+	}
+}
+
+// gougingProvider advertises a price, then asks for more.
+type gougingProvider struct {
+	hagglingProvider
+}
+
+func (p *gougingProvider) Info(ctx context.Context) (*core.ProviderInfo, error) {
+	return &core.ProviderInfo{ID: "gouger", MaxBlockSize: 1 << 20, StorageRate: testStorageRate}, nil
+}
+
+func (p *gougingProvider) Negotiate(ctx context.Context, contract *core.Contract) (*core.Contract, error) {
+	p.offers++
+	c := *contract
+	c.StorageRate *= 10
+	return &c, nil
+}
+
+func TestNegotiateRejectsCounterOfferOverAdvertisedRate(t *testing.T) {
+	tn := newTestNet(t, 0)
+	pvdr := &gougingProvider{}
+	_, err := tn.repo.negotiateContract(context.Background(), blockInfo{ID: "block", Size: 10}, pvdr)
+	if err == nil {
+		t.Fatal("accepted a counter-offer over the provider's advertised rate")
+	}
+	if pvdr.offers != 1 {
+		t.Fatalf("made %d offers, want 1", pvdr.offers)
+	}
+}
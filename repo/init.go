@@ -3,18 +3,39 @@ package repo
 import (
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/x509"
-	"encoding/asn1"
-	"encoding/json"
-	"encoding/pem"
-	"io/ioutil"
 	"log"
 	"os"
 	"path"
-	core "skybin/core/proto"
 )
 
+// InitOptions control how a new repo is created.
+type InitOptions struct {
+	// Passphrase encrypts the repo's private keys. The keys are stored
+	// unencrypted if it is empty.
+	Passphrase []byte
+
+	// Mnemonic is a recovery phrase from which the user and node keys are
+	// derived. Random keys are generated if it is empty.
+	Mnemonic string
+}
+
+// Init creates a repo in homedir with unencrypted keys.
 func Init(homedir string) {
+	InitWithOptions(homedir, InitOptions{})
+}
+
+// InitWithOptions creates a repo in homedir.
+func InitWithOptions(homedir string, opts InitOptions) {
+
+	// Check the recovery phrase before creating anything
+	var serverkey, userkey *rsa.PrivateKey
+	var err error
+	if len(opts.Mnemonic) > 0 {
+		userkey, serverkey, err = deriveKeys(opts.Mnemonic)
+		if err != nil {
+			log.Fatal("init error: ", err)
+		}
+	}
 
 	if _, err := os.Stat(homedir); err == nil {
 		log.Fatalf("error: %s already exists", homedir)
@@ -26,66 +47,19 @@ func Init(homedir string) {
 	checkErr(os.MkdirAll(path.Join(homedir, "peer"), 0700))
 	checkErr(os.MkdirAll(path.Join(homedir, "user"), 0700))
 
-	// Create server keys
-	serverkey, err := rsa.GenerateKey(rand.Reader, 2048)
-	checkErr(err)
-	savePrivateKey(serverkey, path.Join(homedir, "keys", "nodeid"))
-	savePublicKey(serverkey.PublicKey, path.Join(homedir, "keys", "nodeid.pub"))
-
-	// Create node ID
-	bytes, err := asn1.Marshal(serverkey.PublicKey)
-	checkErr(err)
-	nodeId := hash(bytes)
-
-	// Create user keys
-	userkey, err := rsa.GenerateKey(rand.Reader, 2048)
-	checkErr(err)
-	savePrivateKey(userkey, path.Join(homedir, "keys", "userid"))
-	savePublicKey(userkey.PublicKey, path.Join(homedir, "keys", "userid.pub"))
-
-	// Create user ID
-	bytes, err = asn1.Marshal(userkey.PublicKey)
-	checkErr(err)
-	userId := hash(bytes)
-
-	// Create and save default repo config file
-	config := defaultConfig(userId, nodeId)
-	configBytes, err := json.MarshalIndent(config, "", "    ")
-	checkErr(err)
-	checkErr(ioutil.WriteFile(path.Join(homedir, "config.json"), configBytes, 0666))
-
-	// Create and save the user's root block
-	rootBlock := core.DirBlock{
-		ID:      makeBlockId(userId, "/"),
-		Name:    "/",
-		OwnerID: userId,
-	}
-	checkErr(saveBlock(path.Join(homedir, "user", rootBlock.ID), &rootBlock))
-}
-
-func savePrivateKey(key *rsa.PrivateKey, path string) {
-	keyBlock := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	// Create server and user keys
+	if len(opts.Mnemonic) == 0 {
+		serverkey, err = rsa.GenerateKey(rand.Reader, 2048)
+		checkErr(err)
+		userkey, err = rsa.GenerateKey(rand.Reader, 2048)
+		checkErr(err)
 	}
-	savePemBlock(keyBlock, path)
-}
-
-func savePublicKey(key rsa.PublicKey, path string) {
-	bytes, err := asn1.Marshal(key)
-	checkErr(err)
-	keyBlock := &pem.Block{
-		Type:  "RSA PUBLIC KEY",
-		Bytes: bytes,
-	}
-	savePemBlock(keyBlock, path)
-}
 
-func savePemBlock(block *pem.Block, path string) {
-	f, err := os.Create(path)
-	checkErr(err)
-	defer f.Close()
-	checkErr(pem.Encode(f, block))
+	// Save the keys along with the default repo config file and the
+	// user's root block
+	config := defaultConfig("", "")
+	checkErr(installKeys(homedir, userkey, serverkey, opts.Passphrase, config))
+	checkErr(saveConfig(path.Join(homedir, "config.json"), config))
 }
 
 func checkErr(err error) {
@@ -0,0 +1,382 @@
+package repo
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	core "skybin/core/proto"
+)
+
+// Private keys are stored as PEM. Keys protected by a passphrase are
+// encrypted with AES-256-GCM under a key derived from the passphrase with
+// scrypt. The scrypt parameters, salt, and nonce are kept in PEM headers.
+const (
+	plainKeyType     = "RSA PRIVATE KEY"
+	encryptedKeyType = "SKYBIN ENCRYPTED RSA PRIVATE KEY"
+
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// ErrWrongPassphrase is returned when a key cannot be decrypted with the
+// given passphrase.
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// The repo's private keys, by file name in the keys directory.
+var keyNames = []string{"userid", "nodeid"}
+
+func encodePrivateKey(key *rsa.PrivateKey, passphrase []byte) (*pem.Block, error) {
+	der := x509.MarshalPKCS1PrivateKey(key)
+	if len(passphrase) == 0 {
+		return &pem.Block{Type: plainKeyType, Bytes: der}, nil
+	}
+
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := passphraseCipher(passphrase, salt, scryptN, scryptR, scryptP)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{
+		Type: encryptedKeyType,
+		Headers: map[string]string{
+			"KDF":    fmt.Sprintf("scrypt,%d,%d,%d", scryptN, scryptR, scryptP),
+			"Salt":   hex.EncodeToString(salt),
+			"Cipher": "AES-256-GCM",
+			"Nonce":  hex.EncodeToString(nonce),
+		},
+		Bytes: gcm.Seal(nil, nonce, der, nil),
+	}, nil
+}
+
+func decodePrivateKey(block *pem.Block, passphrase []byte) (*rsa.PrivateKey, error) {
+	switch block.Type {
+	case plainKeyType:
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case encryptedKeyType:
+	default:
+		return nil, fmt.Errorf("unknown key type %q", block.Type)
+	}
+
+	var n, r, p int
+	_, err := fmt.Sscanf(block.Headers["KDF"], "scrypt,%d,%d,%d", &n, &r, &p)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported key derivation %q", block.Headers["KDF"])
+	}
+	if block.Headers["Cipher"] != "AES-256-GCM" {
+		return nil, fmt.Errorf("unsupported key cipher %q", block.Headers["Cipher"])
+	}
+	salt, err := hex.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, errors.New("invalid key salt")
+	}
+	nonce, err := hex.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, errors.New("invalid key nonce")
+	}
+	gcm, err := passphraseCipher(passphrase, salt, n, r, p)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid key nonce")
+	}
+	der, err := gcm.Open(nil, nonce, block.Bytes, nil)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return x509.ParsePKCS1PrivateKey(der)
+}
+
+func passphraseCipher(passphrase []byte, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, n, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func savePrivateKey(key *rsa.PrivateKey, filename string, passphrase []byte) error {
+	block, err := encodePrivateKey(key, passphrase)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, pem.EncodeToMemory(block))
+}
+
+func loadPrivateKey(filename string, passphrase []byte) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not contain a PEM key", filename)
+	}
+	return decodePrivateKey(block, passphrase)
+}
+
+func savePublicKey(key rsa.PublicKey, filename string) error {
+	bytes, err := asn1.Marshal(key)
+	if err != nil {
+		return err
+	}
+	keyBlock := &pem.Block{
+		Type:  "RSA PUBLIC KEY",
+		Bytes: bytes,
+	}
+	return writeFileAtomic(filename, pem.EncodeToMemory(keyBlock))
+}
+
+// keyId returns the ID derived from a public key.
+func keyId(key rsa.PublicKey) (string, error) {
+	return core.KeyID(&key)
+}
+
+// PassphraseFunc returns the passphrase of a repo's keys when an operation
+// needs to sign with them. If it is nil, repos with encrypted keys cannot
+// sign.
+var PassphraseFunc func() ([]byte, error)
+
+// userKey returns the user's private key, loading it the first time it is
+// needed. Renters sign contracts and stored blocks with it so providers can
+// check who they are.
+func (r *repo) userKey() (*rsa.PrivateKey, error) {
+	r.keyMu.Lock()
+	defer r.keyMu.Unlock()
+	if r.key != nil {
+		return r.key, nil
+	}
+	key, err := loadSigningKey(r.homedir, keyNames[0])
+	if err != nil {
+		return nil, err
+	}
+	r.key = key
+	return key, nil
+}
+
+// NodeKey returns the node's private key of the repo in homedir. Relayed
+// providers prove their ID to the relay with it.
+func NodeKey(homedir string) (*rsa.PrivateKey, error) {
+	return loadSigningKey(homedir, keyNames[1])
+}
+
+// loadSigningKey loads the named private key, asking PassphraseFunc for the
+// passphrase if the key is encrypted.
+func loadSigningKey(homedir string, name string) (*rsa.PrivateKey, error) {
+	encrypted, err := KeysEncrypted(homedir)
+	if err != nil {
+		return nil, err
+	}
+	var passphrase []byte
+	if encrypted {
+		if PassphraseFunc == nil {
+			return nil, errors.New("cannot sign without the passphrase of the repo's keys")
+		}
+		passphrase, err = PassphraseFunc()
+		if err != nil {
+			return nil, err
+		}
+	}
+	key, err := loadPrivateKey(path.Join(homedir, "keys", name), passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load %s key: %s", name, err)
+	}
+	return key, nil
+}
+
+// KeysEncrypted reports whether the private keys of the repo in homedir are
+// protected by a passphrase.
+func KeysEncrypted(homedir string) (bool, error) {
+	data, err := ioutil.ReadFile(path.Join(homedir, "keys", keyNames[0]))
+	if err != nil {
+		return false, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return false, errors.New("invalid key file")
+	}
+	return block.Type == encryptedKeyType, nil
+}
+
+// loadKeys loads the repo's private keys, by name.
+func loadKeys(homedir string, passphrase []byte) (map[string]*rsa.PrivateKey, error) {
+	keys := make(map[string]*rsa.PrivateKey)
+	for _, name := range keyNames {
+		key, err := loadPrivateKey(path.Join(homedir, "keys", name), passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load %s key: %s", name, err)
+		}
+		keys[name] = key
+	}
+	return keys, nil
+}
+
+// ChangePassphrase re-encrypts the private keys of the repo in homedir with
+// a new passphrase. An empty passphrase stores the keys unencrypted.
+func ChangePassphrase(homedir string, oldPassphrase []byte, newPassphrase []byte) error {
+	l, err := acquireLock(path.Join(homedir, "repo.lock"), lockTimeout, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		return err
+	}
+	defer l.release()
+
+	keys, err := loadKeys(homedir, oldPassphrase)
+	if err != nil {
+		return err
+	}
+	for _, name := range keyNames {
+		err := savePrivateKey(keys[name], path.Join(homedir, "keys", name), newPassphrase)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportKeys writes the private keys of the repo in homedir to out,
+// encrypted with passphrase. The keys must already be protected by the
+// passphrase, so exported keys are never written in the clear.
+func ExportKeys(homedir string, passphrase []byte, out io.Writer) error {
+	if len(passphrase) == 0 {
+		return errors.New("keys must be protected by a passphrase to be exported")
+	}
+	keys, err := loadKeys(homedir, passphrase)
+	if err != nil {
+		return err
+	}
+	for _, name := range keyNames {
+		block, err := encodePrivateKey(keys[name], passphrase)
+		if err != nil {
+			return err
+		}
+		block.Headers["Name"] = name
+		err = pem.Encode(out, block)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportKeys replaces the private keys of the repo in homedir with keys
+// written by ExportKeys, which are decrypted with passphrase. The repo's
+// user and node IDs are changed to those of the imported keys. If the
+// imported user has no root block in the repo, an empty one is created, and
+// the next Sync fetches the user's root block from providers in its place.
+func ImportKeys(homedir string, in io.Reader, passphrase []byte) error {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]*rsa.PrivateKey)
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		name := block.Headers["Name"]
+		delete(block.Headers, "Name")
+		key, err := decodePrivateKey(block, passphrase)
+		if err != nil {
+			return fmt.Errorf("cannot decrypt %s key: %s", name, err)
+		}
+		keys[name] = key
+	}
+	for _, name := range keyNames {
+		if keys[name] == nil {
+			return fmt.Errorf("no %s key found", name)
+		}
+	}
+	if len(bytes.TrimSpace(data)) > 0 {
+		return errors.New("unexpected data after keys")
+	}
+
+	l, err := acquireLock(path.Join(homedir, "repo.lock"), lockTimeout, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		return err
+	}
+	defer l.release()
+
+	config, err := loadConfig(path.Join(homedir, "config.json"))
+	if err != nil {
+		return err
+	}
+	err = installKeys(homedir, keys["userid"], keys["nodeid"], passphrase, config)
+	if err != nil {
+		return err
+	}
+	return saveConfig(path.Join(homedir, "config.json"), config)
+}
+
+// installKeys saves a user and node key in the repo in homedir and sets the
+// IDs in config to match. The user's root block is created if it doesn't
+// exist.
+func installKeys(homedir string, userkey *rsa.PrivateKey, nodekey *rsa.PrivateKey, passphrase []byte, config *Config) error {
+	userId, err := keyId(userkey.PublicKey)
+	if err != nil {
+		return err
+	}
+	nodeId, err := keyId(nodekey.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	keydir := path.Join(homedir, "keys")
+	for _, key := range []struct {
+		name string
+		key  *rsa.PrivateKey
+	}{{"userid", userkey}, {"nodeid", nodekey}} {
+		err := savePrivateKey(key.key, path.Join(keydir, key.name), passphrase)
+		if err != nil {
+			return err
+		}
+		err = savePublicKey(key.key.PublicKey, path.Join(keydir, key.name+".pub"))
+		if err != nil {
+			return err
+		}
+	}
+
+	config.UserId = userId
+	config.NodeId = nodeId
+	config.ProviderInfo.ID = nodeId
+
+	rootBlockPath := path.Join(homedir, "user", makeBlockId(userId, "/"))
+	if _, err := os.Stat(rootBlockPath); os.IsNotExist(err) {
+		rootBlock := &core.DirBlock{
+			ID:      makeBlockId(userId, "/"),
+			Name:    "/",
+			OwnerID: userId,
+		}
+		return saveBlock(rootBlockPath, rootBlock)
+	}
+	return nil
+}
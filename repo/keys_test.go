@@ -0,0 +1,104 @@
+package repo
+
+import (
+	"bytes"
+	"path"
+	"testing"
+)
+
+func TestChangePassphrase(t *testing.T) {
+	homedir := path.Join(t.TempDir(), "repo")
+	InitWithOptions(homedir, InitOptions{Passphrase: []byte("old")})
+
+	encrypted, err := KeysEncrypted(homedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !encrypted {
+		t.Fatal("keys are not encrypted")
+	}
+	_, err = loadKeys(homedir, []byte("wrong"))
+	if err == nil {
+		t.Fatal("loaded keys with the wrong passphrase")
+	}
+
+	err = ChangePassphrase(homedir, []byte("wrong"), []byte("new"))
+	if err == nil {
+		t.Fatal("changed passphrase without the current one")
+	}
+	err = ChangePassphrase(homedir, []byte("old"), []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadKeys(homedir, []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ChangePassphrase(homedir, []byte("new"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err = KeysEncrypted(homedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encrypted {
+		t.Fatal("keys are still encrypted")
+	}
+}
+
+func TestExportImportKeys(t *testing.T) {
+	src := path.Join(t.TempDir(), "src")
+	InitWithOptions(src, InitOptions{Passphrase: []byte("secret")})
+	dst := path.Join(t.TempDir(), "dst")
+	Init(dst)
+
+	err := ExportKeys(dst, nil, &bytes.Buffer{})
+	if err == nil {
+		t.Fatal("exported unencrypted keys")
+	}
+
+	var exported bytes.Buffer
+	err = ExportKeys(src, []byte("secret"), &exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(exported.Bytes(), []byte("BEGIN "+plainKeyType)) {
+		t.Fatal("exported keys are not encrypted")
+	}
+
+	err = ImportKeys(dst, bytes.NewReader(exported.Bytes()), []byte("wrong"))
+	if err == nil {
+		t.Fatal("imported keys with the wrong passphrase")
+	}
+	err = ImportKeys(dst, bytes.NewReader(exported.Bytes()), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srcConfig, err := LoadConfig(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstConfig, err := LoadConfig(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dstConfig.UserId != srcConfig.UserId || dstConfig.NodeId != srcConfig.NodeId {
+		t.Fatal("imported keys did not change the repo's IDs")
+	}
+
+	r, err := OpenAt(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	files, err := r.ListFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("imported user has files %v", files)
+	}
+}
@@ -0,0 +1,272 @@
+package repo
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	core "skybin/core/proto"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Storage is priced per GB-month, with 30 day months.
+const (
+	bytesPerGB      = 1000 * 1000 * 1000
+	secondsPerMonth = 30 * 24 * 60 * 60
+)
+
+// ledgerAccount holds charges owed to a provider in one currency that are
+// not tied to a live contract. Amounts are in millionths of the currency,
+// with fractions kept so many small charges add up.
+type ledgerAccount struct {
+	ProviderID  string  `json:"providerID"`
+	Currency    string  `json:"currency"`
+	Storage     float64 `json:"storage"` // Charges for contracts that have ended
+	Egress      float64 `json:"egress"`
+	EgressBytes int64   `json:"egressBytes"`
+}
+
+// ledger records what is owed to providers. Charges for storage under live
+// contracts are computed from the contracts when a bill is made, so only
+// downloads and ended contracts are recorded. Charges are kept in memory
+// until saved, when they are added to the ledger file under its own lock so
+// concurrent operations don't lose each other's charges.
+type ledger struct {
+	mu       sync.Mutex
+	filename string
+	pending  []*ledgerAccount
+}
+
+func newLedger(filename string) *ledger {
+	return &ledger{filename: filename}
+}
+
+// storageCharge returns the cost of storing a contract's block from its start
+// time until end. Nothing is charged past the end of the contract's term.
+func storageCharge(contract *core.Contract, end time.Time) float64 {
+	if contract.StorageRate <= 0 || contract.StartTime <= 0 {
+		return 0
+	}
+	if expiry, ok := contractEnd(contract); ok && end.After(expiry) {
+		end = expiry
+	}
+	seconds := end.Unix() - contract.StartTime
+	if seconds <= 0 {
+		return 0
+	}
+	months := float64(seconds) / secondsPerMonth
+	return float64(contract.BlockSize) / bytesPerGB * float64(contract.StorageRate) * months
+}
+
+// egressCharge returns the cost of downloading n bytes under a contract.
+func egressCharge(contract *core.Contract, n int64) float64 {
+	return float64(n) / bytesPerGB * float64(contract.EgressRate)
+}
+
+func (l *ledger) account(contract *core.Contract) *ledgerAccount {
+	for _, acct := range l.pending {
+		if acct.ProviderID == contract.ProviderID && acct.Currency == contract.Currency {
+			return acct
+		}
+	}
+	acct := &ledgerAccount{ProviderID: contract.ProviderID, Currency: contract.Currency}
+	l.pending = append(l.pending, acct)
+	return acct
+}
+
+// recordEgress records a download of n bytes under a contract.
+func (l *ledger) recordEgress(contract *core.Contract, n int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	acct := l.account(contract)
+	acct.Egress += egressCharge(contract, n)
+	acct.EgressBytes += n
+}
+
+// recordEnded records the storage owed for a contract that ended now.
+// Contracts ended before their duration is up are charged for all of it.
+func (l *ledger) recordEnded(contract *core.Contract) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	end := time.Now()
+	if minEnd := time.Unix(contract.StartTime+contract.Duration, 0); end.Before(minEnd) {
+		end = minEnd
+	}
+	l.account(contract).Storage += storageCharge(contract, end)
+}
+
+// recordRenewed records the storage owed for a contract whose renewal took
+// over from it now, so it is charged only until now.
+func (l *ledger) recordRenewed(contract *core.Contract) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.account(contract).Storage += storageCharge(contract, time.Now())
+}
+
+// recordReplaced records the end of each old contract that is not in
+// contracts. Old contracts in renewed were renewed rather than ended.
+func (l *ledger) recordReplaced(old []*core.Contract, contracts []*core.Contract, renewed []*core.Contract) {
+	kept := make(map[*core.Contract]bool)
+	for _, contract := range contracts {
+		kept[contract] = true
+	}
+	wasRenewed := make(map[*core.Contract]bool)
+	for _, contract := range renewed {
+		wasRenewed[contract] = true
+	}
+	for _, contract := range old {
+		switch {
+		case kept[contract]:
+		case wasRenewed[contract]:
+			l.recordRenewed(contract)
+		default:
+			l.recordEnded(contract)
+		}
+	}
+}
+
+func loadLedgerAccounts(filename string) ([]*ledgerAccount, error) {
+	var accounts []*ledgerAccount
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &accounts)
+	if err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// save adds the pending charges to the ledger file.
+func (l *ledger) save() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.pending) == 0 {
+		return nil
+	}
+
+	fl, err := acquireLock(l.filename+".lock", lockTimeout, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		return err
+	}
+	defer fl.release()
+
+	accounts, err := loadLedgerAccounts(l.filename)
+	if err != nil {
+		return err
+	}
+	for _, charges := range l.pending {
+		accounts = addCharges(accounts, charges)
+	}
+	data, err := json.MarshalIndent(accounts, "", "    ")
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(l.filename, data)
+	if err != nil {
+		return err
+	}
+	l.pending = nil
+	return nil
+}
+
+// addCharges adds charges to the matching account, creating it if needed.
+func addCharges(accounts []*ledgerAccount, charges *ledgerAccount) []*ledgerAccount {
+	for _, acct := range accounts {
+		if acct.ProviderID == charges.ProviderID && acct.Currency == charges.Currency {
+			acct.Storage += charges.Storage
+			acct.Egress += charges.Egress
+			acct.EgressBytes += charges.EgressBytes
+			return accounts
+		}
+	}
+	acct := *charges
+	return append(accounts, &acct)
+}
+
+// Bill sums what is owed to a provider in one currency. Amounts are in
+// millionths of the currency.
+type Bill struct {
+	ProviderID  string
+	Currency    string
+	Contracts   int   // Live contracts with the provider
+	StoredBytes int64 // Bytes stored under live contracts
+	Monthly     int64 // Cost of a month of storage under live contracts
+	Storage     int64 // Storage charges accrued so far, including ended contracts
+	Egress      int64
+	EgressBytes int64
+}
+
+// Total returns the amount owed to the provider.
+func (b *Bill) Total() int64 {
+	return b.Storage + b.Egress
+}
+
+// makeBills sums the charges in the ledger file and those accrued by live
+// contracts up to now.
+func (l *ledger) makeBills(contracts []*core.Contract, now time.Time) ([]*Bill, error) {
+	err := l.save()
+	if err != nil {
+		return nil, err
+	}
+	accounts, err := loadLedgerAccounts(l.filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// Amounts are summed before rounding.
+	type sums struct {
+		bill             *Bill
+		monthly, storage float64
+		egress           float64
+	}
+	var all []*sums
+	get := func(providerID string, currency string) *sums {
+		for _, sum := range all {
+			if sum.bill.ProviderID == providerID && sum.bill.Currency == currency {
+				return sum
+			}
+		}
+		sum := &sums{bill: &Bill{ProviderID: providerID, Currency: currency}}
+		all = append(all, sum)
+		return sum
+	}
+	for _, acct := range accounts {
+		sum := get(acct.ProviderID, acct.Currency)
+		sum.storage += acct.Storage
+		sum.egress += acct.Egress
+		sum.bill.EgressBytes += acct.EgressBytes
+	}
+	for _, contract := range contracts {
+		sum := get(contract.ProviderID, contract.Currency)
+		sum.storage += storageCharge(contract, now)
+		if contractExpired(contract, now) {
+			continue
+		}
+		sum.bill.Contracts++
+		sum.bill.StoredBytes += contract.BlockSize
+		sum.monthly += float64(contract.BlockSize) / bytesPerGB * float64(contract.StorageRate)
+	}
+
+	var bills []*Bill
+	for _, sum := range all {
+		sum.bill.Monthly = int64(math.Round(sum.monthly))
+		sum.bill.Storage = int64(math.Round(sum.storage))
+		sum.bill.Egress = int64(math.Round(sum.egress))
+		bills = append(bills, sum.bill)
+	}
+	sort.Slice(bills, func(i, j int) bool {
+		if bills[i].ProviderID != bills[j].ProviderID {
+			return bills[i].ProviderID < bills[j].ProviderID
+		}
+		return bills[i].Currency < bills[j].Currency
+	})
+	return bills, nil
+}
@@ -0,0 +1,181 @@
+package repo
+
+import (
+	"bytes"
+	"golang.org/x/net/context"
+	"path"
+	core "skybin/core/proto"
+	"testing"
+	"time"
+)
+
+func TestStorageCharge(t *testing.T) {
+	now := time.Now()
+	contract := &core.Contract{
+		ProviderID:  "provider0",
+		BlockSize:   2 * bytesPerGB,
+		Currency:    testCurrency,
+		StorageRate: testStorageRate,
+		StartTime:   now.Add(-15 * 24 * time.Hour).Unix(),
+	}
+	l := newLedger(path.Join(t.TempDir(), "ledger.json"))
+	bills, err := l.makeBills([]*core.Contract{contract}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bills) != 1 {
+		t.Fatalf("expected 1 bill, got %d", len(bills))
+	}
+	bill := bills[0]
+	if bill.Monthly != 2*testStorageRate {
+		t.Errorf("monthly cost is %d, want %d", bill.Monthly, 2*testStorageRate)
+	}
+	if bill.Storage != testStorageRate {
+		t.Errorf("storage cost of half a month is %d, want %d", bill.Storage, testStorageRate)
+	}
+
+	// Contracts made before pricing was supported cost nothing.
+	bills, err = l.makeBills([]*core.Contract{{ProviderID: "provider0", BlockSize: bytesPerGB}}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bills[0].Total() != 0 {
+		t.Errorf("unpriced contract costs %d", bills[0].Total())
+	}
+}
+
+func TestBilling(t *testing.T) {
+	tn := newTestNet(t, 2)
+	tn.setConfig(func(config *Config) {
+		config.BlockSize = 1024
+	})
+
+	data := randomBytes(t, 10*1024)
+	opts := tn.repo.config.DefaultStorageOpts("data.bin")
+	opts.Compression = NoCompression
+	err := tn.repo.Put(context.Background(), tn.writeFile(data), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tn.repo.Get(context.Background(), "data.bin", &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bills, err := tn.repo.Billing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contracts int
+	var stored, egressBytes, egress int64
+	for _, bill := range bills {
+		if bill.Currency != testCurrency {
+			t.Errorf("bill for %s in %q", bill.ProviderID, bill.Currency)
+		}
+		contracts += bill.Contracts
+		stored += bill.StoredBytes
+		egressBytes += bill.EgressBytes
+		egress += bill.Egress
+	}
+	// 10 file blocks and the inode
+	if contracts != 11 {
+		t.Errorf("billed for %d contracts, want 11", contracts)
+	}
+	if stored < int64(len(data)) {
+		t.Errorf("billed for storing %d bytes, want at least %d", stored, len(data))
+	}
+	if egressBytes != int64(len(data)) {
+		t.Errorf("billed for downloading %d bytes, want %d", egressBytes, len(data))
+	}
+	if want := int64(len(data)) * testEgressRate / bytesPerGB; egress != want {
+		t.Errorf("egress cost is %d, want %d", egress, want)
+	}
+
+	// Removing the file ends its contracts, but the charges so far remain.
+	err = tn.repo.Remove("data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bills, err = newLedger(tn.repo.ledger.filename).makeBills(nil, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	egressBytes = 0
+	for _, bill := range bills {
+		if bill.Contracts != 0 {
+			t.Errorf("still billed for %d contracts with %s", bill.Contracts, bill.ProviderID)
+		}
+		egressBytes += bill.EgressBytes
+	}
+	if egressBytes != int64(len(data)) {
+		t.Errorf("ledger records %d bytes downloaded, want %d", egressBytes, len(data))
+	}
+}
+
+func TestEndedContractChargedForDuration(t *testing.T) {
+	l := newLedger(path.Join(t.TempDir(), "ledger.json"))
+	l.recordEnded(&core.Contract{
+		ProviderID:  "provider0",
+		BlockSize:   bytesPerGB,
+		Currency:    testCurrency,
+		StorageRate: testStorageRate,
+		StartTime:   time.Now().Unix(),
+		Duration:    secondsPerMonth,
+	})
+	bills, err := l.makeBills(nil, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bills) != 1 || bills[0].Storage != testStorageRate {
+		t.Fatalf("contract ended early was not charged for its full duration: %+v", bills)
+	}
+}
+
+func TestStorageNotChargedPastExpiry(t *testing.T) {
+	now := time.Now()
+	contract := &core.Contract{
+		ProviderID:  "provider0",
+		BlockSize:   bytesPerGB,
+		Currency:    testCurrency,
+		StorageRate: testStorageRate,
+		StartTime:   now.Add(-3 * secondsPerMonth * time.Second).Unix(),
+		Duration:    secondsPerMonth,
+	}
+	l := newLedger(path.Join(t.TempDir(), "ledger.json"))
+	bills, err := l.makeBills([]*core.Contract{contract}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bills) != 1 {
+		t.Fatalf("expected 1 bill, got %d", len(bills))
+	}
+	if bills[0].Storage != testStorageRate {
+		t.Errorf("charged %d for a month-long contract, want %d", bills[0].Storage, testStorageRate)
+	}
+	if bills[0].Contracts != 0 || bills[0].Monthly != 0 {
+		t.Errorf("expired contract billed as live: %+v", bills[0])
+	}
+}
+
+func TestRenewedContractChargedUntilRenewal(t *testing.T) {
+	start := time.Now().Add(-secondsPerMonth / 2 * time.Second)
+	old := &core.Contract{
+		ProviderID:  "provider0",
+		BlockSize:   bytesPerGB,
+		Currency:    testCurrency,
+		StorageRate: testStorageRate,
+		StartTime:   start.Unix(),
+		Duration:    secondsPerMonth,
+	}
+	renewal := *old
+	renewal.StartTime = time.Now().Unix()
+	l := newLedger(path.Join(t.TempDir(), "ledger.json"))
+	l.recordReplaced([]*core.Contract{old}, []*core.Contract{&renewal}, []*core.Contract{old})
+	bills, err := l.makeBills(nil, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bills) != 1 || bills[0].Storage > testStorageRate/2+1 {
+		t.Fatalf("renewed contract charged past its renewal: %+v", bills)
+	}
+}
@@ -0,0 +1,124 @@
+package repo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+// How long to wait for another process to release the repo lock.
+var lockTimeout = 10 * time.Minute
+
+const lockPollInterval = 100 * time.Millisecond
+
+// errLockHeld is returned by tryLockFile when another process holds a lock.
+var errLockHeld = errors.New("lock held by another process")
+
+// lockOwner records who holds a repo lock.
+type lockOwner struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Created time.Time `json:"created"`
+}
+
+// repoLock is an exclusive lock on a repo, held while its files are
+// modified. The lock is an advisory lock on a lock file, so it is released
+// by the operating system if the holder dies. The file also records its
+// owner, which is used to report who holds the lock and to detect stale lock
+// files left behind by processes that exited without releasing them.
+type repoLock struct {
+	f *os.File
+}
+
+// LockProvider takes the lock held by a process using the provider block
+// store of the repo in homedir, such as a running server, so no two
+// processes modify the store at once. It fails at once if the lock is held.
+// The returned function releases the lock.
+func LockProvider(homedir string) (func(), error) {
+	l, err := acquireLock(path.Join(homedir, "provider.lock"), 0, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		return nil, fmt.Errorf("provider block store is in use: %s", err)
+	}
+	return l.release, nil
+}
+
+// acquireLock takes the lock on filename, waiting up to timeout for another
+// process to release it.
+func acquireLock(filename string, timeout time.Duration, logger *log.Logger) (*repoLock, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open lock file: %s", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err = tryLockFile(f)
+		if err == nil {
+			break
+		}
+		if err != errLockHeld {
+			f.Close()
+			return nil, fmt.Errorf("cannot lock repo: %s", err)
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("repo is locked %s", describeOwner(filename))
+		}
+		time.Sleep(lockPollInterval)
+	}
+
+	// A lock file with an owner that we could lock was left behind by a
+	// process that died while holding it.
+	data, err := ioutil.ReadAll(f)
+	if err == nil && len(data) > 0 {
+		logger.Println("removing stale repo lock", describeOwner(filename))
+	}
+
+	host, _ := os.Hostname()
+	data, err = json.Marshal(lockOwner{PID: os.Getpid(), Host: host, Created: time.Now()})
+	if err == nil {
+		err = writeLockOwner(f, data)
+	}
+	if err != nil {
+		unlockFile(f)
+		f.Close()
+		return nil, fmt.Errorf("cannot write lock file: %s", err)
+	}
+	return &repoLock{f: f}, nil
+}
+
+func writeLockOwner(f *os.File, data []byte) error {
+	err := f.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(data, 0)
+	return err
+}
+
+// describeOwner describes the owner recorded in a lock file.
+func describeOwner(filename string) string {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return ""
+	}
+	var owner lockOwner
+	err = json.Unmarshal(data, &owner)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("by process %d on %s since %s",
+		owner.PID, owner.Host, owner.Created.Format(time.RFC3339))
+}
+
+// release clears the lock's owner and unlocks it.
+func (l *repoLock) release() {
+	l.f.Truncate(0)
+	unlockFile(l.f)
+	l.f.Close()
+}
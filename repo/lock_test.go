@@ -0,0 +1,140 @@
+package repo
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentPuts(t *testing.T) {
+	tn := newTestNet(t, 2)
+
+	// A second repo opened on the same home directory stands in for another
+	// skybin process.
+	other, err := OpenAt(tn.repo.homedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.(*repo).dial = tn.dial
+
+	const n = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		r := Repo(tn.repo)
+		if i%2 == 1 {
+			r = other
+		}
+		filename := tn.writeFile([]byte(fmt.Sprintf("file %d", i)))
+		opts := tn.repo.config.DefaultStorageOpts(fmt.Sprintf("file%d.txt", i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- r.Put(context.Background(), filename, opts)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := OpenAt(tn.repo.homedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := r.ListFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != n {
+		t.Fatalf("expected %d files, got %v", n, files)
+	}
+}
+
+func TestLockWaitsForHolder(t *testing.T) {
+	filename := path.Join(t.TempDir(), "repo.lock")
+	logger := log.New(ioutil.Discard, "", 0)
+
+	l, err := acquireLock(filename, time.Second, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = acquireLock(filename, 200*time.Millisecond, logger)
+	if err == nil || !strings.Contains(err.Error(), "locked by process") {
+		t.Fatalf("expected lock to be held, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		l.release()
+	}()
+	l2, err := acquireLock(filename, 5*time.Second, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2.release()
+}
+
+func TestStaleLock(t *testing.T) {
+	filename := path.Join(t.TempDir(), "repo.lock")
+	owner := `{"pid": 999999, "host": "example", "created": "2017-01-01T00:00:00Z"}`
+	err := ioutil.WriteFile(filename, []byte(owner), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := acquireLock(filename, time.Second, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.release()
+}
+
+func TestLockFilePrivate(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not enforced on Windows")
+	}
+	filename := path.Join(t.TempDir(), "repo.lock")
+	l, err := acquireLock(filename, time.Second, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.release()
+	st, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := st.Mode().Perm(); mode&0077 != 0 {
+		t.Fatalf("expected lock file to be private, has mode %o", mode)
+	}
+}
+
+func TestLockProvider(t *testing.T) {
+	homedir := t.TempDir()
+	unlock, err := LockProvider(homedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LockProvider(homedir)
+	if err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("expected the provider lock to be held, got %v", err)
+	}
+	unlock()
+	unlock, err = LockProvider(homedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+}
@@ -0,0 +1,25 @@
+package repo
+
+import (
+	"golang.org/x/sys/windows"
+	"os"
+)
+
+// Windows locks are mandatory, so the lock is taken on a byte far past the
+// end of the lock file, leaving its owner readable by other processes.
+const lockOffsetHigh = 0x7fffffff
+
+func tryLockFile(f *os.File) error {
+	ol := windows.Overlapped{OffsetHigh: lockOffsetHigh}
+	err := windows.LockFileEx(windows.Handle(f.Fd()),
+		windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &ol)
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return errLockHeld
+	}
+	return err
+}
+
+func unlockFile(f *os.File) error {
+	ol := windows.Overlapped{OffsetHigh: lockOffsetHigh}
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, &ol)
+}
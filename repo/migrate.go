@@ -0,0 +1,66 @@
+package repo
+
+import (
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"io/ioutil"
+	"log"
+	"path"
+	core "skybin/core/proto"
+	"strings"
+)
+
+// MigrateMetadata rewrites the JSON metadata blocks cached in the repo's
+// user directory in the current binary encoding. It returns the number of
+// blocks rewritten.
+func MigrateMetadata(homedir string) (int, error) {
+	l, err := acquireLock(path.Join(homedir, "repo.lock"), lockTimeout, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		return 0, err
+	}
+	defer l.release()
+
+	dir := path.Join(homedir, "user")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	config, err := loadConfig(path.Join(homedir, "config.json"))
+	if err != nil {
+		return 0, err
+	}
+	rootID := makeBlockId(config.UserId, "/")
+
+	migrated := 0
+	for _, entry := range entries {
+		if entry.IsDir() || strings.Contains(entry.Name(), ".tmp") {
+			continue
+		}
+		filename := path.Join(dir, entry.Name())
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return migrated, err
+		}
+		if !isLegacyBlock(data) {
+			continue
+		}
+
+		var block proto.Message
+		if entry.Name() == rootID {
+			block = &core.DirBlock{}
+		} else {
+			block = &core.INodeBlock{}
+		}
+		err = unmarshalBlock(data, block)
+		if err != nil {
+			return migrated, fmt.Errorf("cannot read %s: %s", entry.Name(), err)
+		}
+		err = saveBlock(filename, block)
+		if err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	return migrated, nil
+}
@@ -0,0 +1,115 @@
+package repo
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"github.com/tyler-smith/go-bip39"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"math/big"
+	"strings"
+)
+
+// Keys derived from a mnemonic are generated from a stream of bytes that
+// depends only on the phrase, so the same phrase always gives the same user
+// and node IDs. The keys are not generated with rsa.GenerateKey since its
+// output for a given random stream may change between Go releases.
+const (
+	mnemonicEntropyBits = 256
+	derivedKeyBits      = 2048
+)
+
+// NewMnemonic returns a new random BIP39 recovery phrase.
+func NewMnemonic() (string, error) {
+	entropy, err := bip39.NewEntropy(mnemonicEntropyBits)
+	if err != nil {
+		return "", err
+	}
+	return bip39.NewMnemonic(entropy)
+}
+
+// normalizeMnemonic folds case and whitespace so a phrase copied from paper
+// is accepted however it was typed.
+func normalizeMnemonic(mnemonic string) string {
+	return strings.Join(strings.Fields(strings.ToLower(mnemonic)), " ")
+}
+
+// deriveKeys derives the user and node keys from a recovery phrase.
+func deriveKeys(mnemonic string) (userkey *rsa.PrivateKey, nodekey *rsa.PrivateKey, err error) {
+	seed, err := bip39.NewSeedWithErrorChecking(normalizeMnemonic(mnemonic), "")
+	if err != nil {
+		return nil, nil, errors.New("invalid recovery phrase")
+	}
+	userkey, err = deriveKey(seed, "skybin user key")
+	if err != nil {
+		return nil, nil, err
+	}
+	nodekey, err = deriveKey(seed, "skybin node key")
+	if err != nil {
+		return nil, nil, err
+	}
+	return userkey, nodekey, nil
+}
+
+// deriveKey generates an RSA key from the bytes HKDF derives from seed and
+// label.
+func deriveKey(seed []byte, label string) (*rsa.PrivateKey, error) {
+	stream := hkdf.New(sha256.New, seed, nil, []byte(label))
+	e := big.NewInt(65537)
+	for {
+		p, err := derivePrime(stream, derivedKeyBits/2, e)
+		if err != nil {
+			return nil, err
+		}
+		q, err := derivePrime(stream, derivedKeyBits/2, e)
+		if err != nil {
+			return nil, err
+		}
+		if p.Cmp(q) == 0 {
+			continue
+		}
+
+		one := big.NewInt(1)
+		n := new(big.Int).Mul(p, q)
+		phi := new(big.Int).Mul(new(big.Int).Sub(p, one), new(big.Int).Sub(q, one))
+		d := new(big.Int).ModInverse(e, phi)
+		if d == nil || n.BitLen() != derivedKeyBits {
+			continue
+		}
+
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: n, E: int(e.Int64())},
+			D:         d,
+			Primes:    []*big.Int{p, q},
+		}
+		key.Precompute()
+		return key, key.Validate()
+	}
+}
+
+// derivePrime reads a starting point from stream and returns the first
+// prime after it for which e is a valid RSA exponent. The two high bits are
+// set so the product of two such primes has exactly twice as many bits.
+func derivePrime(stream io.Reader, bits int, e *big.Int) (*big.Int, error) {
+	one := big.NewInt(1)
+	two := big.NewInt(2)
+	gcd := new(big.Int)
+	buf := make([]byte, bits/8)
+	for {
+		_, err := io.ReadFull(stream, buf)
+		if err != nil {
+			return nil, err
+		}
+		buf[0] |= 0xc0
+		buf[len(buf)-1] |= 1
+
+		p := new(big.Int).SetBytes(buf)
+		for p.BitLen() == bits {
+			if p.ProbablyPrime(20) && gcd.GCD(nil, nil, e, new(big.Int).Sub(p, one)).Cmp(one) == 0 {
+				return p, nil
+			}
+			p.Add(p, two)
+		}
+	}
+}
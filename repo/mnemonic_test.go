@@ -0,0 +1,85 @@
+package repo
+
+import (
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestInitFromMnemonic(t *testing.T) {
+	mnemonic, err := NewMnemonic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(strings.Fields(mnemonic)); n != 24 {
+		t.Fatalf("mnemonic has %d words, want 24", n)
+	}
+
+	first := path.Join(t.TempDir(), "first")
+	InitWithOptions(first, InitOptions{Mnemonic: mnemonic})
+	second := path.Join(t.TempDir(), "second")
+	InitWithOptions(second, InitOptions{
+		Mnemonic:   "  " + strings.ToUpper(mnemonic) + "\n",
+		Passphrase: []byte("secret"),
+	})
+	other := path.Join(t.TempDir(), "other")
+	Init(other)
+
+	firstConfig, err := LoadConfig(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondConfig, err := LoadConfig(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherConfig, err := LoadConfig(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if firstConfig.UserId != secondConfig.UserId || firstConfig.NodeId != secondConfig.NodeId {
+		t.Fatal("restoring from the mnemonic gave different IDs")
+	}
+	if firstConfig.UserId == firstConfig.NodeId {
+		t.Fatal("user and node keys are the same")
+	}
+	if firstConfig.UserId == otherConfig.UserId {
+		t.Fatal("random keys match derived keys")
+	}
+}
+
+// The IDs derived from a phrase must never change, or phrases written down
+// by users would no longer restore their repos.
+func TestDeriveKeysIsStable(t *testing.T) {
+	mnemonic := strings.Repeat("abandon ", 23) + "art"
+	userkey, nodekey, err := deriveKeys(mnemonic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userId, err := keyId(userkey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeId, err := keyId(nodekey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userId != "6YKIKP6ZVIDVVUJVMAMTSS7WTBSR352J" {
+		t.Errorf("derived user ID %s", userId)
+	}
+	if nodeId != "RI3FXHLVITUQH4UCMH2WSBTMWUD7WOUZ" {
+		t.Errorf("derived node ID %s", nodeId)
+	}
+}
+
+func TestDeriveKeysRejectsBadMnemonic(t *testing.T) {
+	// The last word holds a checksum, which is wrong here
+	_, _, err := deriveKeys(strings.Repeat("abandon ", 24))
+	if err == nil {
+		t.Fatal("accepted mnemonic with a bad checksum")
+	}
+	_, _, err = deriveKeys("not a recovery phrase")
+	if err == nil {
+		t.Fatal("accepted words that are not a mnemonic")
+	}
+}
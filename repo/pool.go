@@ -0,0 +1,59 @@
+package repo
+
+import (
+	core "skybin/core/proto"
+	provider "skybin/provider/remote"
+	"sync"
+)
+
+// connPool keeps connections to providers open so they can be reused by
+// later operations.
+type connPool struct {
+	mu    sync.Mutex
+	conns map[string]provider.RemoteProvider // Connections by peer address
+}
+
+func newConnPool() *connPool {
+	return &connPool{conns: make(map[string]provider.RemoteProvider)}
+}
+
+// get returns the open connection to a peer, using dial to connect if there
+// is none. Closing the returned provider leaves the connection open.
+func (p *connPool) get(pinfo core.PeerInfo, dial func(pinfo core.PeerInfo) (provider.RemoteProvider, error)) (provider.RemoteProvider, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	addr := peerAddress(pinfo)
+	conn, exists := p.conns[addr]
+	if !exists {
+		var err error
+		conn, err = dial(pinfo)
+		if err != nil {
+			return nil, err
+		}
+		p.conns[addr] = conn
+	}
+	return pooledConn{conn}, nil
+}
+
+// close closes every connection in the pool.
+func (p *connPool) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var firstErr error
+	for addr, conn := range p.conns {
+		err := conn.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(p.conns, addr)
+	}
+	return firstErr
+}
+
+type pooledConn struct {
+	provider.RemoteProvider
+}
+
+func (c pooledConn) Close() error {
+	return nil
+}
@@ -3,14 +3,25 @@ package repo
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"net"
 	"os"
 	"path"
 	core "skybin/core/proto"
+	provider "skybin/provider/remote"
+	"skybin/throttle"
+	"strconv"
+	"time"
 )
 
 func (r *repo) listProviders() ([]core.PeerInfo, error) {
-	if r.pcache != nil {
-		return r.pcache, nil
+	r.mu.RLock()
+	pcache := r.pcache
+	r.mu.RUnlock()
+	if pcache != nil {
+		return pcache, nil
 	}
 
 	pvdrs, err := loadProviders(path.Join(r.homedir, "providers.json"))
@@ -18,12 +29,19 @@ func (r *repo) listProviders() ([]core.PeerInfo, error) {
 		return nil, err
 	}
 
+	r.mu.Lock()
 	r.pcache = pvdrs
+	r.mu.Unlock()
 	return pvdrs, nil
 }
 
+// loadProviders reads and validates the list of known providers. A missing
+// file is treated as an empty list.
 func loadProviders(filename string) ([]core.PeerInfo, error) {
 	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -32,12 +50,131 @@ func loadProviders(filename string) ([]core.PeerInfo, error) {
 	var providers []core.PeerInfo
 	err = json.NewDecoder(f).Decode(&providers)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("cannot parse %s: %s", filename, err)
+	}
+
+	err = validateProviders(providers)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", filename, err)
 	}
 
 	return providers, nil
 }
 
+func saveProviders(filename string, providers []core.PeerInfo) error {
+	data, err := json.MarshalIndent(providers, "", "    ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, data)
+}
+
+func validateProviders(providers []core.PeerInfo) error {
+	ids := make(map[string]bool)
+	for i, pinfo := range providers {
+		if len(pinfo.ID) == 0 {
+			return fmt.Errorf("provider %d has no ID", i+1)
+		}
+		if ids[pinfo.ID] {
+			return fmt.Errorf("provider %s is listed twice", pinfo.ID)
+		}
+		ids[pinfo.ID] = true
+		addr := pinfo.Addr
+		if len(pinfo.Relay) > 0 {
+			if len(pinfo.Addr) > 0 {
+				return fmt.Errorf("provider %s has both an address and a relay", pinfo.ID)
+			}
+			addr = pinfo.Relay
+		}
+		err := ValidateAddress(addr)
+		if err != nil {
+			return fmt.Errorf("provider %s: %s", pinfo.ID, err)
+		}
+	}
+	return nil
+}
+
+// ValidateAddress checks that addr is a valid host:port network address.
+func ValidateAddress(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %s", addr, err)
+	}
+	if len(host) == 0 {
+		return fmt.Errorf("invalid address %q: missing host", addr)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid address %q: bad port %q", addr, port)
+	}
+	return nil
+}
+
+func (r *repo) ListProviders() ([]core.PeerInfo, error) {
+	return r.listProviders()
+}
+
+func (r *repo) AddProvider(pinfo core.PeerInfo) error {
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	pvdrs, err := r.listProviders()
+	if err != nil {
+		return err
+	}
+	for _, pvdr := range pvdrs {
+		if pvdr.ID == pinfo.ID {
+			return fmt.Errorf("provider %s already exists", pinfo.ID)
+		}
+	}
+	pvdrs = append(append([]core.PeerInfo{}, pvdrs...), pinfo)
+	return r.saveProviders(pvdrs)
+}
+
+func (r *repo) RemoveProvider(providerID string) error {
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	pvdrs, err := r.listProviders()
+	if err != nil {
+		return err
+	}
+	var remaining []core.PeerInfo
+	for _, pvdr := range pvdrs {
+		if pvdr.ID != providerID {
+			remaining = append(remaining, pvdr)
+		}
+	}
+	if len(remaining) == len(pvdrs) {
+		return fmt.Errorf("provider %s not found", providerID)
+	}
+	return r.saveProviders(remaining)
+}
+
+func (r *repo) saveProviders(pvdrs []core.PeerInfo) error {
+	if pvdrs == nil {
+		pvdrs = []core.PeerInfo{}
+	}
+	err := validateProviders(pvdrs)
+	if err != nil {
+		return err
+	}
+	err = saveProviders(path.Join(r.homedir, "providers.json"), pvdrs)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.pcache = pvdrs
+	r.mu.Unlock()
+	return nil
+}
+
 func (r *repo) getProviderInfo(providerID string) (*core.PeerInfo, error) {
 	pvdrs, err := r.listProviders()
 	if err != nil {
@@ -50,3 +187,147 @@ func (r *repo) getProviderInfo(providerID string) (*core.PeerInfo, error) {
 	}
 	return nil, errors.New("provider not found")
 }
+
+// peerAddress identifies where a peer is reached. Peers behind the same relay
+// share its address, so they are told apart by ID.
+func peerAddress(pinfo core.PeerInfo) string {
+	if len(pinfo.Relay) > 0 {
+		return pinfo.Relay + "/" + pinfo.ID
+	}
+	return pinfo.Addr
+}
+
+// dialProvider connects to a provider. Transfers with the returned provider
+// are subject to the repo's bandwidth limits and time limits, and their
+// outcomes are recorded in the provider's reputation.
+func (r *repo) dialProvider(pinfo core.PeerInfo) (provider.RemoteProvider, error) {
+	pvdr, err := r.conns.get(pinfo, r.dialPeer)
+	if err != nil {
+		r.reputation.recordFailure(pinfo.ID, dialFailure)
+		return nil, err
+	}
+	config := r.currentConfig()
+	timed := &timedProvider{
+		RemoteProvider: pvdr,
+		timeouts:       config.ProviderTimeouts,
+		limits:         config.RenterBandwidth,
+		blockSize:      int64(config.BlockSize),
+	}
+	monitored := &monitoredProvider{
+		RemoteProvider: timed,
+		id:             pinfo.ID,
+		rep:            r.reputation,
+	}
+	return &signedProvider{RemoteProvider: monitored, repo: r}, nil
+}
+
+// dialPeer opens a connection to a provider that is held to the repo's
+// bandwidth limits as data streams over it.
+func (r *repo) dialPeer(pinfo core.PeerInfo) (provider.RemoteProvider, error) {
+	peer := peerAddress(pinfo)
+	dialer := func(ctx context.Context, addr string) (net.Conn, error) {
+		c, err := r.dial(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		return throttle.NewConn(c, peer, r.upload, r.download), nil
+	}
+	return provider.DialPeer(pinfo, grpc.WithContextDialer(dialer))
+}
+
+// dialTCP connects to a provider's address over the network.
+func dialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// signedProvider signs the blocks it stores with the user's key, so the
+// provider only lets the renter holding the contract replace them.
+type signedProvider struct {
+	provider.RemoteProvider
+	repo *repo
+}
+
+func (p *signedProvider) StoreBlock(ctx context.Context, id string, block []byte) error {
+	key, err := p.repo.userKey()
+	if err != nil {
+		return err
+	}
+	ctx, err = provider.SignStoreBlock(ctx, key, id, block)
+	if err != nil {
+		return err
+	}
+	return p.RemoteProvider.StoreBlock(ctx, id, block)
+}
+
+// timedProvider gives up on requests to a provider that take longer than
+// the repo's time limits. Block transfers are also given the time the
+// repo's bandwidth limits take to pass the block.
+type timedProvider struct {
+	provider.RemoteProvider
+	timeouts  ProviderTimeouts
+	limits    BandwidthLimits
+	blockSize int64 // Size of the largest blocks downloaded
+}
+
+// throttledTime returns how long n bytes take to pass at the lower of a
+// total and a per-peer rate in bytes per second. Zero rates are unlimited.
+func throttledTime(n int64, rate int64, peerRate int64) time.Duration {
+	if peerRate > 0 && (rate <= 0 || peerRate < rate) {
+		rate = peerRate
+	}
+	if rate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(n) / float64(rate) * float64(time.Second))
+}
+
+// timedOut describes the error of a request that ran out of time.
+func timedOut(ctx context.Context, parent context.Context, limit time.Duration, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded && parent.Err() == nil {
+		return fmt.Errorf("provider did not respond within %s", limit)
+	}
+	return err
+}
+
+func (p *timedProvider) Info(parent context.Context) (*core.ProviderInfo, error) {
+	limit := timeout(p.timeouts.Info, defaultProviderTimeouts.Info)
+	ctx, cancel := context.WithTimeout(parent, limit)
+	defer cancel()
+	info, err := p.RemoteProvider.Info(ctx)
+	return info, timedOut(ctx, parent, limit, err)
+}
+
+func (p *timedProvider) Negotiate(parent context.Context, contract *core.Contract) (*core.Contract, error) {
+	limit := timeout(p.timeouts.Negotiate, defaultProviderTimeouts.Negotiate)
+	ctx, cancel := context.WithTimeout(parent, limit)
+	defer cancel()
+	c, err := p.RemoteProvider.Negotiate(ctx, contract)
+	return c, timedOut(ctx, parent, limit, err)
+}
+
+func (p *timedProvider) StoreBlock(parent context.Context, id string, block []byte) error {
+	limit := timeout(p.timeouts.StoreBlock, defaultProviderTimeouts.StoreBlock)
+	limit += throttledTime(int64(len(block)), p.limits.UploadRate, p.limits.PeerUploadRate)
+	ctx, cancel := context.WithTimeout(parent, limit)
+	defer cancel()
+	err := p.RemoteProvider.StoreBlock(ctx, id, block)
+	return timedOut(ctx, parent, limit, err)
+}
+
+func (p *timedProvider) GetBlock(parent context.Context, id string) ([]byte, error) {
+	limit := timeout(p.timeouts.GetBlock, defaultProviderTimeouts.GetBlock)
+	limit += throttledTime(p.blockSize, p.limits.DownloadRate, p.limits.PeerDownloadRate)
+	ctx, cancel := context.WithTimeout(parent, limit)
+	defer cancel()
+	block, err := p.RemoteProvider.GetBlock(ctx, id)
+	return block, timedOut(ctx, parent, limit, err)
+}
+
+func (p *timedProvider) ProveBlock(parent context.Context, id string, nonce []byte) ([]byte, error) {
+	limit := timeout(p.timeouts.GetBlock, defaultProviderTimeouts.GetBlock)
+	ctx, cancel := context.WithTimeout(parent, limit)
+	defer cancel()
+	proof, err := p.RemoteProvider.ProveBlock(ctx, id, nonce)
+	return proof, timedOut(ctx, parent, limit, err)
+}
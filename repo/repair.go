@@ -0,0 +1,659 @@
+package repo
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"path"
+	core "skybin/core/proto"
+	provider "skybin/provider/remote"
+	"time"
+)
+
+// RepairReport describes the result of repairing the repo's stored data.
+type RepairReport struct {
+	Files             int      // Number of files checked
+	BlocksChecked     int      // Number of file and metadata blocks checked
+	BlocksRepaired    int      // Number of blocks whose lost replicas were dropped or replaced
+	ContractsReplaced int      // Number of lost replicas replaced
+	ContractsRenewed  int      // Number of contracts renewed before they expired
+	BlocksLost        []string // IDs of blocks with no remaining replica
+}
+
+// replacement records the contracts that replaced a block's old contracts.
+type replacement struct {
+	old       []*core.Contract
+	contracts []*core.Contract
+	renewed   []*core.Contract // Old contracts that were renewed
+}
+
+// providerSet dials providers on demand, keeping connections open until the
+// set is closed.
+type providerSet struct {
+	r     *repo
+	conns map[string]provider.RemoteProvider
+}
+
+func (r *repo) newProviderSet() *providerSet {
+	return &providerSet{
+		r:     r,
+		conns: make(map[string]provider.RemoteProvider),
+	}
+}
+
+func (ps *providerSet) get(providerID string) (provider.RemoteProvider, error) {
+	if pvdr, exists := ps.conns[providerID]; exists {
+		return pvdr, nil
+	}
+	pinfo, err := ps.r.getProviderInfo(providerID)
+	if err != nil {
+		return nil, err
+	}
+	pvdr, err := ps.r.dialProvider(*pinfo)
+	if err != nil {
+		return nil, err
+	}
+	ps.conns[providerID] = pvdr
+	return pvdr, nil
+}
+
+func (ps *providerSet) close() {
+	for _, pvdr := range ps.conns {
+		pvdr.Close()
+	}
+}
+
+// replicateBlock stores a block with new providers until it has n replicas.
+// contracts are the live replicas of the block and previous are all contracts
+// ever made for it; providers in either are skipped, so a provider that lost
+// the block or couldn't be reached is not given another copy. The contracts
+// for all replicas are returned.
+func (r *repo) replicateBlock(ctx context.Context, id string, data []byte, contracts []*core.Contract, previous []*core.Contract, n int, ps *providerSet) ([]*core.Contract, error) {
+	if len(contracts) >= n {
+		return contracts, nil
+	}
+	holders := make(map[string]bool)
+	for _, contract := range append(previous, contracts...) {
+		holders[contract.ProviderID] = true
+	}
+
+	pinfos, err := r.listProviders()
+	if err != nil {
+		return nil, err
+	}
+	var candidates []core.Provider
+	for _, pinfo := range r.reputation.rank(pinfos, r.currentConfig().MinReputation) {
+		if holders[pinfo.ID] {
+			continue
+		}
+		pvdr, err := ps.get(pinfo.ID)
+		if err != nil {
+			continue
+		}
+		candidates = append(candidates, pvdr)
+	}
+
+	binfo := blockInfo{ID: id, Size: len(data)}
+	cinfos, err := r.negotiateContracts(ctx, binfo, candidates, n-len(contracts))
+	if err != nil {
+		return nil, err
+	}
+	for _, cinfo := range cinfos {
+		err := cinfo.provider.StoreBlock(ctx, id, data)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			r.logger.Println("cannot store replica of block", id, "error:", err)
+			continue
+		}
+		contracts = append(contracts, cinfo.contract)
+	}
+	return contracts, nil
+}
+
+// probeAttempts is the number of times a replica is checked before giving up
+// on errors that may be transient.
+const probeAttempts = 3
+
+// probeRetryDelay is how long to wait before checking a replica again.
+const probeRetryDelay = 500 * time.Millisecond
+
+// errCorruptReplica is returned by replica checks when a provider holds
+// other data than the block.
+var errCorruptReplica = errors.New("replica does not match the block")
+
+// errUnknownProvider is returned by replica checks when the repo can no
+// longer connect to the replica's provider.
+var errUnknownProvider = errors.New("provider cannot be dialed")
+
+// replicaLost reports whether a replica check failed because the provider no
+// longer holds the block, rather than because it couldn't be reached.
+func replicaLost(err error) bool {
+	return err == errCorruptReplica || err == errUnknownProvider || status.Code(err) == codes.NotFound
+}
+
+// probeReplica runs check against the provider of a replica, retrying
+// errors other than the replica being lost.
+func (r *repo) probeReplica(ctx context.Context, contract *core.Contract, ps *providerSet, check func(pvdr provider.RemoteProvider) error) error {
+	pvdr, err := ps.get(contract.ProviderID)
+	if err != nil {
+		r.logger.Println("cannot connect to provider", contract.ProviderID, "error:", err)
+		return errUnknownProvider
+	}
+	for attempt := 1; ; attempt++ {
+		err = check(pvdr)
+		if err == nil || ctx.Err() != nil || replicaLost(err) || attempt == probeAttempts {
+			return err
+		}
+		select {
+		case <-time.After(probeRetryDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// newNonce returns a random nonce for replicas to prove they hold a block
+// against.
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+// proveReplica checks that a provider holds data under id without
+// downloading it.
+func proveReplica(ctx context.Context, pvdr provider.RemoteProvider, id string, data []byte) error {
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	proof, err := pvdr.ProveBlock(ctx, id, nonce)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(proof, core.BlockProof(nonce, data)) {
+		return errCorruptReplica
+	}
+	return nil
+}
+
+// checkBlock sorts the replicas of a file block into live ones and ones
+// that couldn't be reached, dropping replicas whose provider lost the block
+// or holds corrupt data. Every replica proves it holds the block against the
+// same nonce, so nothing is downloaded while their proofs agree. If they
+// disagree, the block is downloaded to tell which replicas are corrupt and
+// returned. If ctx is done, nothing can be said about the replicas and ctx's
+// error is returned.
+func (r *repo) checkBlock(ctx context.Context, id string, contracts []*core.Contract, ps *providerSet) (live []*core.Contract, unreachable []*core.Contract, data []byte, err error) {
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	proofs := make(map[*core.Contract][]byte)
+	agree := true
+	for _, contract := range contracts {
+		var proof []byte
+		err := r.probeReplica(ctx, contract, ps, func(pvdr provider.RemoteProvider) error {
+			var err error
+			proof, err = pvdr.ProveBlock(ctx, id, nonce)
+			return err
+		})
+		if ctx.Err() != nil {
+			return nil, nil, nil, ctx.Err()
+		}
+		switch {
+		case replicaLost(err):
+			r.logger.Println("provider", contract.ProviderID, "lost block", id)
+		case err != nil:
+			r.logger.Println("cannot check block", id, "with provider", contract.ProviderID, "error:", err)
+			unreachable = append(unreachable, contract)
+		default:
+			if len(live) > 0 && !bytes.Equal(proof, proofs[live[0]]) {
+				agree = false
+			}
+			live = append(live, contract)
+			proofs[contract] = proof
+		}
+	}
+	if agree {
+		return live, unreachable, nil, nil
+	}
+
+	data, live, err = r.fetchBlock(ctx, id, live, ps)
+	if ctx.Err() != nil {
+		return nil, nil, nil, ctx.Err()
+	}
+	if err != nil {
+		r.logger.Println("cannot download block", id, "to check its replicas, error:", err)
+		return live, unreachable, nil, nil
+	}
+	want := core.BlockProof(nonce, data)
+	var matching []*core.Contract
+	for _, contract := range live {
+		if !bytes.Equal(proofs[contract], want) {
+			r.logger.Println("provider", contract.ProviderID, "holds corrupt block", id)
+			r.reputation.recordFailure(contract.ProviderID, integrityFailure)
+			continue
+		}
+		matching = append(matching, contract)
+	}
+	return matching, unreachable, data, nil
+}
+
+// fetchBlock downloads a file block from the first of its replicas that
+// holds a copy matching its ID. Replicas found to have lost the block or to
+// hold corrupt data are dropped from the returned contracts.
+func (r *repo) fetchBlock(ctx context.Context, id string, contracts []*core.Contract, ps *providerSet) ([]byte, []*core.Contract, error) {
+	var kept []*core.Contract
+	err := errors.New("no replica to download from")
+	for i, contract := range contracts {
+		var block []byte
+		err = r.probeReplica(ctx, contract, ps, func(pvdr provider.RemoteProvider) error {
+			var err error
+			block, err = pvdr.GetBlock(ctx, id)
+			if err == nil && hash(block) != id {
+				return errCorruptReplica
+			}
+			return err
+		})
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		switch {
+		case err == errCorruptReplica:
+			r.logger.Println("provider", contract.ProviderID, "returned corrupt block", id)
+			r.reputation.recordFailure(contract.ProviderID, integrityFailure)
+		case replicaLost(err):
+			r.logger.Println("provider", contract.ProviderID, "lost block", id)
+		case err != nil:
+			kept = append(kept, contract)
+		default:
+			r.ledger.recordEgress(contract, int64(len(block)))
+			return block, append(kept, contracts[i:]...), nil
+		}
+	}
+	return nil, kept, err
+}
+
+// checkMetadata sorts the replicas of a metadata block like checkBlock,
+// checking them against data, the repo's copy of the block. Metadata blocks
+// are rewritten as they change, so a replica holding other data is reported
+// as stale rather than lost.
+func (r *repo) checkMetadata(ctx context.Context, id string, data []byte, contracts []*core.Contract, ps *providerSet) (live []*core.Contract, unreachable []*core.Contract, stale bool, err error) {
+	for _, contract := range contracts {
+		err := r.probeReplica(ctx, contract, ps, func(pvdr provider.RemoteProvider) error {
+			return proveReplica(ctx, pvdr, id, data)
+		})
+		if ctx.Err() != nil {
+			return nil, nil, false, ctx.Err()
+		}
+		switch {
+		case err == errCorruptReplica:
+			stale = true
+			live = append(live, contract)
+		case replicaLost(err):
+			r.logger.Println("provider", contract.ProviderID, "lost block", id)
+		case err != nil:
+			r.logger.Println("cannot check block", id, "with provider", contract.ProviderID, "error:", err)
+			unreachable = append(unreachable, contract)
+		default:
+			live = append(live, contract)
+		}
+	}
+	return live, unreachable, stale, nil
+}
+
+// renewContracts renews the live contracts of a block that are due for
+// renewal with the same providers, and drops expired contracts that weren't
+// renewed, including those of unreachable replicas. It returns the live and
+// unreachable contracts kept and the old contracts that were renewed.
+func (r *repo) renewContracts(ctx context.Context, id string, live []*core.Contract, unreachable []*core.Contract, ps *providerSet) ([]*core.Contract, []*core.Contract, []*core.Contract) {
+	now := time.Now()
+	var kept, renewed []*core.Contract
+	for _, contract := range live {
+		if !dueForRenewal(contract, now) {
+			kept = append(kept, contract)
+			continue
+		}
+		c, err := r.renewContract(ctx, id, contract, ps)
+		if err == nil {
+			kept = append(kept, c)
+			renewed = append(renewed, contract)
+			continue
+		}
+		r.logger.Println("cannot renew contract for block", id, "with provider", contract.ProviderID, "error:", err)
+		if !contractExpired(contract, now) {
+			kept = append(kept, contract)
+		}
+	}
+	var keptUnreachable []*core.Contract
+	for _, contract := range unreachable {
+		if !contractExpired(contract, now) {
+			keptUnreachable = append(keptUnreachable, contract)
+		}
+	}
+	return kept, keptUnreachable, renewed
+}
+
+// renewContract negotiates a new contract for a block with the provider
+// holding it under contract. The provider's new contract replaces the old.
+func (r *repo) renewContract(ctx context.Context, id string, contract *core.Contract, ps *providerSet) (*core.Contract, error) {
+	pvdr, err := ps.get(contract.ProviderID)
+	if err != nil {
+		return nil, err
+	}
+	return r.negotiateContract(ctx, blockInfo{ID: id, Size: int(contract.BlockSize)}, pvdr)
+}
+
+// Repair stops when ctx is done, keeping the repairs made so far. Replicas
+// are checked, renewed and copied without the repo's lock, so that puts and
+// removals can go on meanwhile; the lock is taken only to record each
+// file's repairs, which are dropped if the file changed in the meantime.
+func (r *repo) Repair(ctx context.Context) (*RepairReport, error) {
+	unlock, err := r.lock()
+	if err != nil {
+		return nil, err
+	}
+	files := r.currentRootBlock().Files
+	unlock()
+
+	defer r.saveReputation()
+	defer r.saveLedger()
+
+	ps := r.newProviderSet()
+	defer ps.close()
+
+	target := r.currentConfig().Redundancy
+	if target < 1 {
+		target = 1
+	}
+	report := &RepairReport{}
+	for _, entry := range files {
+		err := r.repairFile(ctx, entry, target, report, ps)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = r.repairRootBlock(ctx, target, report, ps)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// repairFile repairs the blocks of a file and its inode, adding the results
+// to report.
+func (r *repo) repairFile(ctx context.Context, entry *core.NamedBlockRef, target int, report *RepairReport, ps *providerSet) error {
+	inode, err := loadINodeBlock(path.Join(r.homedir, "user", entry.ID))
+	if os.IsNotExist(err) {
+		// Removed since the repair started.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	report.Files++
+	storedINode, err := marshalBlock(inode)
+	if err != nil {
+		return err
+	}
+
+	// Repairs are counted in report only once they are recorded. Charges
+	// move to replacement contracts only once the inode recording them is
+	// saved, since a canceled repair doesn't save it.
+	var repairs RepairReport
+	var replaced []replacement
+	inodeChanged := false
+
+	for _, ref := range inode.Blocks {
+		report.BlocksChecked++
+		live, unreachable, data, err := r.checkBlock(ctx, ref.ID, ref.Contracts, ps)
+		if err != nil {
+			return err
+		}
+		if len(live) == 0 {
+			if len(unreachable) == 0 {
+				report.BlocksLost = append(report.BlocksLost, ref.ID)
+			}
+			continue
+		}
+		live, unreachable, renewed := r.renewContracts(ctx, ref.ID, live, unreachable, ps)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if len(renewed) == 0 && len(live) == len(ref.Contracts) && len(live) >= target {
+			continue
+		}
+		// Replicas that couldn't be reached are kept, since they may
+		// come back, but don't count toward the target. The block is
+		// downloaded only to give new providers a copy.
+		if len(live) < target && data == nil {
+			data, live, err = r.fetchBlock(ctx, ref.ID, live, ps)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				r.logger.Println("cannot download block", ref.ID, "to replicate it, error:", err)
+			}
+		}
+		contracts := live
+		if data != nil {
+			contracts, err = r.replicateBlock(ctx, ref.ID, data, live, ref.Contracts, target, ps)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				r.logger.Println("cannot replicate block", ref.ID, "error:", err)
+				contracts = live
+			}
+		}
+		lost := len(ref.Contracts) - len(live) - len(unreachable)
+		added := len(contracts) - len(live)
+		if len(renewed) == 0 && lost == 0 && added == 0 {
+			continue
+		}
+		contracts = append(contracts, unreachable...)
+		if len(contracts) == 0 {
+			report.BlocksLost = append(report.BlocksLost, ref.ID)
+		}
+		if lost > 0 || added > 0 {
+			repairs.BlocksRepaired++
+		}
+		repairs.ContractsReplaced += added
+		repairs.ContractsRenewed += len(renewed)
+		replaced = append(replaced, replacement{ref.Contracts, contracts, renewed})
+		ref.Contracts = contracts
+		inodeChanged = true
+	}
+
+	// The inode is rewritten to every replica when its blocks change or
+	// a replica is out of date.
+	report.BlocksChecked++
+	live, unreachable, stale, err := r.checkMetadata(ctx, inode.ID, storedINode, inode.Contracts, ps)
+	if err != nil {
+		return err
+	}
+	live, unreachable, renewed := r.renewContracts(ctx, inode.ID, live, unreachable, ps)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if !inodeChanged && !stale && len(renewed) == 0 && len(live) == len(inode.Contracts) && len(live) >= target {
+		return nil
+	}
+
+	// The file may have been replaced or removed while it was checked.
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	current := r.findFile(entry.Name)
+	if current == nil || current.ID != inode.ID {
+		r.logger.Println("file", entry.Name, "changed during repair, not recording its repairs")
+		return nil
+	}
+	currentBytes, err := marshalBlock(current)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(currentBytes, storedINode) {
+		r.logger.Println("file", entry.Name, "changed during repair, not recording its repairs")
+		return nil
+	}
+
+	inodeBytes, err := marshalBlock(inode)
+	if err != nil {
+		return err
+	}
+	contracts, err := r.replicateBlock(ctx, inode.ID, inodeBytes, live, inode.Contracts, target, ps)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		r.logger.Println("cannot replicate inode", inode.ID, "error:", err)
+		contracts = live
+	}
+	if len(contracts) == 0 && len(unreachable) == 0 {
+		report.BlocksLost = append(report.BlocksLost, inode.ID)
+	}
+	lost := len(inode.Contracts) - len(live) - len(unreachable)
+	added := len(contracts) - len(live)
+	if stale || lost > 0 || added > 0 {
+		repairs.BlocksRepaired++
+		repairs.ContractsReplaced += added
+	}
+	repairs.ContractsRenewed += len(renewed)
+	contracts = append(contracts, unreachable...)
+	replaced = append(replaced, replacement{inode.Contracts, contracts, renewed})
+	inode.Contracts = contracts
+	inodeBytes, err = marshalBlock(inode)
+	if err != nil {
+		return err
+	}
+	r.storeReplicas(ctx, inode.ID, inodeBytes, inode.Contracts, ps)
+	err = saveBlock(path.Join(r.homedir, "user", inode.ID), inode)
+	if err != nil {
+		return err
+	}
+	for _, rep := range replaced {
+		r.ledger.recordReplaced(rep.old, rep.contracts, rep.renewed)
+	}
+	report.BlocksRepaired += repairs.BlocksRepaired
+	report.ContractsReplaced += repairs.ContractsReplaced
+	report.ContractsRenewed += repairs.ContractsRenewed
+	return nil
+}
+
+// repairRootBlock replaces lost replicas of the user's root block and renews
+// its contracts. Root blocks without contracts have never been synced and
+// are left alone. The root block changes with every put and removal, so the
+// current version is rewritten under the repo's lock, as long as its
+// contracts are still the ones checked.
+func (r *repo) repairRootBlock(ctx context.Context, target int, report *RepairReport, ps *providerSet) error {
+	rootBlock := copyDirBlock(r.currentRootBlock())
+	if len(rootBlock.Contracts) == 0 {
+		return nil
+	}
+	report.BlocksChecked++
+	blockBytes, err := marshalBlock(rootBlock)
+	if err != nil {
+		return err
+	}
+	live, unreachable, stale, err := r.checkMetadata(ctx, rootBlock.ID, blockBytes, rootBlock.Contracts, ps)
+	if err != nil {
+		return err
+	}
+	live, unreachable, renewed := r.renewContracts(ctx, rootBlock.ID, live, unreachable, ps)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if !stale && len(renewed) == 0 && len(live) == len(rootBlock.Contracts) && len(live) >= target {
+		return nil
+	}
+
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	checked := rootBlock.Contracts
+	rootBlock = copyDirBlock(r.currentRootBlock())
+	if !sameContracts(rootBlock.Contracts, checked) {
+		r.logger.Println("root block synced during repair, not recording its repairs")
+		return nil
+	}
+	blockBytes, err = marshalBlock(rootBlock)
+	if err != nil {
+		return err
+	}
+
+	contracts, err := r.replicateBlock(ctx, rootBlock.ID, blockBytes, live, rootBlock.Contracts, target, ps)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		r.logger.Println("cannot replicate root block error:", err)
+		contracts = live
+	}
+	if len(contracts) == 0 {
+		if len(unreachable) > 0 {
+			return errors.New("no provider holding the root block can be reached")
+		}
+		report.BlocksLost = append(report.BlocksLost, rootBlock.ID)
+		return errors.New("no provider holds the root block")
+	}
+	report.BlocksRepaired++
+	report.ContractsReplaced += len(contracts) - len(live)
+	report.ContractsRenewed += len(renewed)
+	contracts = append(contracts, unreachable...)
+	r.ledger.recordReplaced(rootBlock.Contracts, contracts, renewed)
+	rootBlock.Contracts = contracts
+
+	blockBytes, err = marshalBlock(rootBlock)
+	if err != nil {
+		return err
+	}
+	r.storeReplicas(ctx, rootBlock.ID, blockBytes, rootBlock.Contracts, ps)
+	err = r.saveRootBlock(rootBlock)
+	if err != nil {
+		return fmt.Errorf("cannot save root block: %s", err)
+	}
+	return nil
+}
+
+// storeReplicas uploads a block to every provider holding a contract for it.
+func (r *repo) storeReplicas(ctx context.Context, id string, data []byte, contracts []*core.Contract, ps *providerSet) {
+	for _, contract := range contracts {
+		pvdr, err := ps.get(contract.ProviderID)
+		if err != nil {
+			r.logger.Println("cannot connect to provider", contract.ProviderID, "error:", err)
+			continue
+		}
+		err = pvdr.StoreBlock(ctx, id, data)
+		if err != nil {
+			r.logger.Println("cannot store block", id, "with provider", contract.ProviderID, "error:", err)
+		}
+	}
+}
+
+// sameContracts reports whether a and b hold the same contracts in the same
+// order.
+func sameContracts(a []*core.Contract, b []*core.Contract) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !proto.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -2,16 +2,24 @@ package repo
 
 import (
 	"bytes"
+	"crypto/rsa"
 	"errors"
 	"fmt"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/user"
 	"path"
 	core "skybin/core/proto"
-	provider "skybin/provider/remote"
+	"skybin/throttle"
+	"sync"
+	"time"
 )
 
 func DefaultHomeDir() (string, error) {
@@ -27,24 +35,103 @@ type Info struct {
 	Config  *Config
 }
 
+// FileInfo describes a file stored in the repo.
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time // Zero for files stored before times were recorded
+}
+
+// Operations that contact providers take a context. Canceling it, or
+// letting its deadline pass, stops the operation and makes it return the
+// context's error.
 type Repo interface {
 	Info() Info
-	Put(filename string, opts *StorageOptions) error
+
+	// SaveConfig replaces the repo's config and writes it to disk. Changed
+	// bandwidth limits apply to transfers already in progress.
+	SaveConfig(config *Config) error
+
+	Put(ctx context.Context, filename string, opts *StorageOptions) error
+
+	// PutReader stores the data read from in as a file called name, reading
+	// it in a single pass and holding at most one block in memory. Any name
+	// in opts is ignored.
+	PutReader(ctx context.Context, name string, in io.Reader, opts *StorageOptions) error
 	ListFiles() ([]string, error)
-	Get(filename string, out io.Writer) error
-	Sync() error
+	Stat(filename string) (*FileInfo, error)
+	Get(ctx context.Context, filename string, out io.Writer) error
+
+	// GetRange writes length bytes of a file starting at offset to out,
+	// downloading only the blocks that hold them. A negative length reads to
+	// the end of the file.
+	GetRange(ctx context.Context, filename string, offset int64, length int64, out io.Writer) error
+
+	// Remove deletes a file from the user's namespace. The file's blocks
+	// are left with providers, but their storage is no longer charged for
+	// in the ledger.
+	Remove(filename string) error
+
+	Sync(ctx context.Context) error
+
+	ListProviders() ([]core.PeerInfo, error)
+	AddProvider(pinfo core.PeerInfo) error
+	RemoveProvider(providerID string) error
+
+	// ListContracts returns the contracts for the user's root block, inodes,
+	// and file blocks.
+	ListContracts() ([]*core.Contract, error)
+
+	// Billing returns what is owed to each provider for storage and
+	// downloads, by currency.
+	Billing() ([]*Bill, error)
+
+	// Repair checks that every stored block is held by its providers,
+	// replaces lost replicas with contracts from other providers, and
+	// renews contracts that are close to expiring.
+	Repair(ctx context.Context) (*RepairReport, error)
+
+	// SetBandwidthLimits changes the rate limits applied to transfers with
+	// providers, including transfers already in progress.
+	SetBandwidthLimits(limits BandwidthLimits)
+
+	// Close closes the repo's connections to providers.
+	Close() error
 }
 
+// A repo is safe for concurrent use. Operations that modify the repo hold
+// its lock, which serializes them with each other and with other processes
+// sharing the repo's home directory. The config and root block are replaced
+// rather than modified, so readers use them without holding the lock.
 type repo struct {
-	homedir   string
+	homedir string
+	opMu    sync.Mutex // Serializes mutating operations within the process
+
+	mu        sync.RWMutex // Guards config, rootBlock, and pcache
 	config    *Config
 	rootBlock *core.DirBlock
 	pcache    []core.PeerInfo // Known storage providers
-	logger    *log.Logger
+
+	logger   *log.Logger
+	upload   *throttle.Group
+	download *throttle.Group
+
+	reputation *reputation // Reliability of known providers
+	ledger     *ledger     // Charges owed to providers
+
+	// Open connections to providers, reused across operations.
+	conns *connPool
+
+	// dial connects to a provider's address, or to its relay's. Tests
+	// replace it to reach in-memory providers.
+	dial func(ctx context.Context, addr string) (net.Conn, error)
+
+	keyMu sync.Mutex
+	key   *rsa.PrivateKey // User's private key, loaded when first needed
 }
 
 func Open() (Repo, error) {
-	homedir, err := findHomeDir()
+	homedir, err := FindHomeDir()
 	if err != nil {
 		return nil, err
 	}
@@ -79,24 +166,143 @@ func OpenAt(homedir string) (Repo, error) {
 		logger.SetOutput(os.Stdout)
 	}
 
+	reputation, err := loadReputation(path.Join(homedir, "reputation.json"))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load provider reputation: %s", err)
+	}
+
+	limits := config.RenterBandwidth
 	return &repo{
-		homedir:   homedir,
-		config:    config,
-		rootBlock: rootBlock,
-		pcache:    nil,
-		logger:    logger,
+		homedir:    homedir,
+		config:     config,
+		rootBlock:  rootBlock,
+		pcache:     nil,
+		logger:     logger,
+		upload:     throttle.NewGroup(limits.UploadRate, limits.PeerUploadRate),
+		download:   throttle.NewGroup(limits.DownloadRate, limits.PeerDownloadRate),
+		reputation: reputation,
+		ledger:     newLedger(path.Join(homedir, "ledger.json")),
+		conns:      newConnPool(),
+		dial:       dialTCP,
 	}, nil
 }
 
+// lock takes the repo's lock, waiting for other operations to finish, and
+// reloads the metadata they may have changed. The returned function
+// releases the lock.
+func (r *repo) lock() (func(), error) {
+	r.opMu.Lock()
+	l, err := acquireLock(path.Join(r.homedir, "repo.lock"), lockTimeout, r.logger)
+	if err != nil {
+		r.opMu.Unlock()
+		return nil, err
+	}
+	unlock := func() {
+		l.release()
+		r.opMu.Unlock()
+	}
+
+	rootBlock, err := loadDirBlock(r.rootBlockPath())
+	if err != nil {
+		unlock()
+		return nil, fmt.Errorf("Cannot load user's root block: %s", err)
+	}
+	pvdrs, err := loadProviders(path.Join(r.homedir, "providers.json"))
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	r.mu.Lock()
+	r.rootBlock = rootBlock
+	r.pcache = pvdrs
+	r.mu.Unlock()
+	return unlock, nil
+}
+
+func (r *repo) currentConfig() *Config {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.config
+}
+
+func (r *repo) currentRootBlock() *core.DirBlock {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.rootBlock
+}
+
+func (r *repo) rootBlockPath() string {
+	return path.Join(r.homedir, "user", makeBlockId(r.currentConfig().UserId, "/"))
+}
+
+// saveRootBlock writes a new version of the root block to disk and makes it
+// current. The caller must hold the repo's lock.
+func (r *repo) saveRootBlock(rootBlock *core.DirBlock) error {
+	err := saveBlock(path.Join(r.homedir, "user", rootBlock.ID), rootBlock)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.rootBlock = rootBlock
+	r.mu.Unlock()
+	return nil
+}
+
+// copyDirBlock returns a copy of a directory block that can be modified
+// without affecting the original.
+func copyDirBlock(block *core.DirBlock) *core.DirBlock {
+	c := *block
+	c.Contracts = append([]*core.Contract{}, block.Contracts...)
+	c.Files = append([]*core.NamedBlockRef{}, block.Files...)
+	return &c
+}
+
 func (r *repo) Info() Info {
 	return Info{
 		HomeDir: r.homedir,
-		Config:  r.config,
+		Config:  r.currentConfig(),
 	}
 }
 
+func (r *repo) SaveConfig(config *Config) error {
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = saveConfig(path.Join(r.homedir, "config.json"), config)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	old := r.config
+	r.config = config
+	r.mu.Unlock()
+	if config.RenterBandwidth != old.RenterBandwidth {
+		limits := config.RenterBandwidth
+		r.upload.SetRates(limits.UploadRate, limits.PeerUploadRate)
+		r.download.SetRates(limits.DownloadRate, limits.PeerDownloadRate)
+	}
+	return nil
+}
+
+func (r *repo) SetBandwidthLimits(limits BandwidthLimits) {
+	r.mu.Lock()
+	config := *r.config
+	config.RenterBandwidth = limits
+	r.config = &config
+	r.mu.Unlock()
+	r.upload.SetRates(limits.UploadRate, limits.PeerUploadRate)
+	r.download.SetRates(limits.DownloadRate, limits.PeerDownloadRate)
+}
+
+func (r *repo) Close() error {
+	return r.conns.close()
+}
+
 func (r *repo) ContainsFile(filename string) bool {
-	for _, entry := range r.rootBlock.Files {
+	for _, entry := range r.currentRootBlock().Files {
 		if entry.Name == filename {
 			return true
 		}
@@ -104,7 +310,7 @@ func (r *repo) ContainsFile(filename string) bool {
 	return false
 }
 
-func (r *repo) Put(filename string, opts *StorageOptions) error {
+func (r *repo) Put(ctx context.Context, filename string, opts *StorageOptions) error {
 
 	finfo, err := os.Stat(filename)
 	if err != nil {
@@ -115,35 +321,29 @@ func (r *repo) Put(filename string, opts *StorageOptions) error {
 		return errors.New("directories not supported")
 	}
 
-	if opts == nil {
-		opts = r.config.DefaultStorageOpts(filename)
-	}
-
-	if r.ContainsFile(opts.FileName) {
-		var name string
-		for i := 1; ; i++ {
-			name = fmt.Sprintf("%s (%d)", opts.FileName, i)
-			if !r.ContainsFile(name) {
-				break
-			}
-		}
-		opts.FileName = name
-	}
-
 	file, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	// Determine how many blocks are in the file.
-	blockInfos, err := getBlockInfo(file, r.config.BlockSize)
-	if err != nil {
-		return err
+	name := filename
+	if opts != nil {
+		name = opts.FileName
 	}
+	return r.PutReader(ctx, name, file, opts)
+}
 
-	// Rewind the file.
-	_, err = file.Seek(0, os.SEEK_SET)
+func (r *repo) PutReader(ctx context.Context, name string, in io.Reader, opts *StorageOptions) error {
+	config := r.currentConfig()
+	if opts == nil {
+		opts = config.DefaultStorageOpts(name)
+	} else {
+		o := *opts
+		o.FileName = name
+		opts = &o
+	}
+	err := validateCompression(opts.Compression)
 	if err != nil {
 		return err
 	}
@@ -153,68 +353,103 @@ func (r *repo) Put(filename string, opts *StorageOptions) error {
 		return err
 	}
 
+	defer r.saveReputation()
 	var providers []core.Provider
-	for _, pinfo := range pvdrinfo {
-		pvdr, err := provider.Dial(pinfo.Addr)
+	for _, pinfo := range r.reputation.rank(pvdrinfo, config.MinReputation) {
+		pvdr, err := r.dialProvider(pinfo)
 		if err != nil {
-			r.logger.Println("cannot dial", pinfo.Addr, "error:", err)
+			r.logger.Println("cannot dial", peerAddress(pinfo), "error:", err)
 			continue
 		}
 		defer pvdr.Close()
 		providers = append(providers, pvdr)
 	}
 
-	inode := core.INodeBlock{
-		ID:      makeBlockId(r.config.UserId, opts.FileName),
-		Name:    opts.FileName,
-		OwnerID: r.config.UserId,
-		Size:    finfo.Size(),
-	}
+	// Upload file blocks as they are read. Blocks are named by their
+	// contents, so they can be stored before the file has a name.
+	var blocks []*core.BlockRef
+	var size int64
+	for {
+		block, err := readNextBlock(in, config.BlockSize)
+		if err != nil {
+			return err
+		}
+		if len(block) == 0 {
+			break
+		}
+		size += int64(len(block))
 
-	var contractInfos [][]contractInfo
-	for _, binfo := range blockInfos {
+		// Compression must happen before any encryption, since encrypted
+		// data does not compress.
+		stored, compression, err := compressBlock(opts.Compression, block)
+		if err != nil {
+			return err
+		}
 
-		cinfos, err := r.negotiateContracts(binfo, providers)
+		binfo := blockInfo{ID: hash(stored), Size: len(stored)}
+		cinfos, err := r.negotiateContracts(ctx, binfo, providers, opts.Redundancy)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if err != nil {
 			return fmt.Errorf("unable to negotiate storage contracts for block: %s", err)
 		}
-		contractInfos = append(contractInfos, cinfos)
 
 		var contracts []*core.Contract
 		for _, cinfo := range cinfos {
+			err := cinfo.provider.StoreBlock(ctx, binfo.ID, stored)
+			if err != nil {
+				return err
+			}
 			contracts = append(contracts, cinfo.contract)
 		}
 
-		inode.Blocks = append(inode.Blocks, &core.BlockRef{
-			ID:        binfo.ID,
-			Contracts: contracts,
+		blocks = append(blocks, &core.BlockRef{
+			ID:          binfo.ID,
+			Contracts:   contracts,
+			Compression: compression,
+			Size:        int64(len(block)),
 		})
 	}
 
-	// Negotiate contract for inode.
-	cinfos, err := r.negotiateContracts(blockInfo{ID: inode.ID, Size: 1024 * 1024}, providers)
+	// Hold the lock only while naming the file and recording it in the
+	// root block, so slow inputs don't block other operations.
+	unlock, err := r.lock()
 	if err != nil {
 		return err
 	}
-	for _, cinfo := range cinfos {
-		inode.Contracts = append(inode.Contracts, cinfo.contract)
-	}
-
-	// Upload file blocks
-	for _, contracts := range contractInfos {
-		block, err := readNextBlock(file, r.config.BlockSize)
-		if err != nil {
-			return err
-		}
+	defer unlock()
 
-		for _, cinfo := range contracts {
-			err := cinfo.provider.StoreBlock(cinfo.contract.BlockID, block)
-			if err != nil {
-				return err
+	name = opts.FileName
+	replaced := r.findFile(name)
+	if replaced != nil && !opts.Replace {
+		replaced = nil
+		for i := 1; ; i++ {
+			name = fmt.Sprintf("%s (%d)", opts.FileName, i)
+			if !r.ContainsFile(name) {
+				break
 			}
 		}
 	}
 
+	inode := core.INodeBlock{
+		ID:      makeBlockId(config.UserId, name),
+		Name:    name,
+		OwnerID: config.UserId,
+		Size:    size,
+		Blocks:  blocks,
+		ModTime: time.Now().Unix(),
+	}
+
+	// Negotiate contract for inode.
+	cinfos, err := r.negotiateContracts(ctx, blockInfo{ID: inode.ID, Size: 1024 * 1024}, providers, opts.Redundancy)
+	if err != nil {
+		return err
+	}
+	for _, cinfo := range cinfos {
+		inode.Contracts = append(inode.Contracts, cinfo.contract)
+	}
+
 	// Upload inode block
 	inodeBytes, err := marshalBlock(&inode)
 	if err != nil {
@@ -222,7 +457,7 @@ func (r *repo) Put(filename string, opts *StorageOptions) error {
 	}
 
 	for _, cinfo := range cinfos {
-		err := cinfo.provider.StoreBlock(cinfo.contract.BlockID, inodeBytes)
+		err := cinfo.provider.StoreBlock(ctx, cinfo.contract.BlockID, inodeBytes)
 		if err != nil {
 			return err
 		}
@@ -235,57 +470,217 @@ func (r *repo) Put(filename string, opts *StorageOptions) error {
 	}
 
 	// Add record of the file to the user's root block
-	r.rootBlock.Files = append(r.rootBlock.Files, &core.NamedBlockRef{ID: inode.ID, Name: inode.Name})
-	err = saveBlock(path.Join(r.homedir, "user", r.rootBlock.ID), r.rootBlock)
-	if err != nil {
+	rootBlock := copyDirBlock(r.currentRootBlock())
+	if replaced == nil {
+		rootBlock.Files = append(rootBlock.Files, &core.NamedBlockRef{ID: inode.ID, Name: inode.Name})
+	} else {
+		for i, entry := range rootBlock.Files {
+			if entry.Name == name {
+				rootBlock.Files[i] = &core.NamedBlockRef{ID: inode.ID, Name: inode.Name}
+			}
+		}
+	}
+	err = r.saveRootBlock(rootBlock)
+	if err != nil || replaced == nil {
 		return err
 	}
 
+	// Storage of the replaced file's blocks is no longer paid for.
+	defer r.saveLedger()
+	r.recordINodeEnded(replaced)
 	return nil
 }
 
+// findFile returns the inode of the file with the given name, or nil if
+// there is no such file.
+func (r *repo) findFile(name string) *core.INodeBlock {
+	for _, entry := range r.currentRootBlock().Files {
+		if entry.Name == name {
+			inode, err := loadINodeBlock(path.Join(r.homedir, "user", entry.ID))
+			if err != nil {
+				return &core.INodeBlock{ID: entry.ID, Name: name}
+			}
+			return inode
+		}
+	}
+	return nil
+}
+
+// recordINodeEnded records the end of the contracts for an inode and its
+// file blocks in the ledger.
+func (r *repo) recordINodeEnded(inode *core.INodeBlock) {
+	for _, contract := range inode.Contracts {
+		r.ledger.recordEnded(contract)
+	}
+	for _, ref := range inode.Blocks {
+		for _, contract := range ref.Contracts {
+			r.ledger.recordEnded(contract)
+		}
+	}
+}
+
 func (r *repo) ListFiles() ([]string, error) {
 	var res []string
-	for _, blockInfo := range r.rootBlock.Files {
+	for _, blockInfo := range r.currentRootBlock().Files {
 		res = append(res, blockInfo.Name)
 	}
 	return res, nil
 }
 
-func (r *repo) Get(filename string, out io.Writer) error {
+func (r *repo) Stat(filename string) (*FileInfo, error) {
+	inode, err := r.loadINode(filename)
+	if err != nil {
+		return nil, err
+	}
+	finfo := &FileInfo{
+		Name: inode.Name,
+		Size: inode.Size,
+	}
+	if inode.ModTime > 0 {
+		finfo.ModTime = time.Unix(inode.ModTime, 0)
+	}
+	return finfo, nil
+}
 
-	// Find locally cached inode for file.
-	blockId := makeBlockId(r.config.UserId, filename)
-	path := path.Join(r.homedir, "user", blockId)
+func (r *repo) Get(ctx context.Context, filename string, out io.Writer) error {
+	return r.GetRange(ctx, filename, 0, -1, out)
+}
 
-	inode, err := loadINodeBlock(path)
+func (r *repo) GetRange(ctx context.Context, filename string, offset int64, length int64, out io.Writer) error {
+	inode, err := r.loadINode(filename)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return errors.New("cannot find record of file " + filename)
-		}
 		return err
 	}
+	if offset < 0 || offset > inode.Size {
+		return fmt.Errorf("offset %d is outside file of size %d", offset, inode.Size)
+	}
+	end := inode.Size
+	if length >= 0 && offset+length < end {
+		end = offset + length
+	}
 
-	// Download file blocks.
+	defer r.saveReputation()
+	defer r.saveLedger()
+
+	// Download the file blocks overlapping [offset, end).
+	var blockStart int64
 	for _, blockRef := range inode.Blocks {
-		data, err := r.downloadBlock(blockRef)
+		if blockStart >= end {
+			break
+		}
+		blockEnd := blockStart + refBlockSize(blockRef)
+		if blockEnd <= offset {
+			blockStart = blockEnd
+			continue
+		}
+		data, err := r.downloadBlock(ctx, blockRef)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if err != nil {
 			return fmt.Errorf("cannot download file block. error: %s", err)
 		}
-		buf := bytes.NewBuffer(data)
+		data, err = decompressBlock(blockRef.Compression, data, refBlockSize(blockRef))
+		if err != nil {
+			return err
+		}
+		lo, hi := int64(0), int64(len(data))
+		if offset > blockStart {
+			lo = offset - blockStart
+		}
+		if end < blockEnd {
+			hi = end - blockStart
+		}
+		buf := bytes.NewBuffer(data[lo:hi])
 		_, err = io.Copy(out, buf)
 		if err != nil {
 			return fmt.Errorf("cannot download file block. error: %s", err)
 		}
+		blockStart = blockEnd
+	}
+	return nil
+}
+
+// refBlockSize returns the uncompressed size of a file block. Blocks stored
+// before compression was supported only record their size in their storage
+// contracts.
+func refBlockSize(ref *core.BlockRef) int64 {
+	if ref.Size > 0 {
+		return ref.Size
+	}
+	if len(ref.Contracts) == 0 {
+		return 0
+	}
+	return ref.Contracts[0].BlockSize
+}
+
+func (r *repo) Remove(filename string) error {
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	rootBlock := copyDirBlock(r.currentRootBlock())
+	idx := -1
+	for i, entry := range rootBlock.Files {
+		if entry.Name == filename {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		return errors.New("cannot find record of file " + filename)
+	}
+
+	entry := rootBlock.Files[idx]
+	rootBlock.Files = append(rootBlock.Files[:idx], rootBlock.Files[idx+1:]...)
+	err = r.saveRootBlock(rootBlock)
+	if err != nil {
+		return err
+	}
+
+	// Storage of the file's blocks is no longer paid for.
+	inode, err := loadINodeBlock(path.Join(r.homedir, "user", entry.ID))
+	if err == nil {
+		defer r.saveLedger()
+		r.recordINodeEnded(inode)
+	}
+
+	err = os.Remove(path.Join(r.homedir, "user", entry.ID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
 	}
 	return nil
 }
 
-func (r *repo) Sync() error {
+func (r *repo) Sync(ctx context.Context) error {
 	// TODO: Pull and merge updates to remote metadata.
 
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	defer r.saveReputation()
+
+	config := r.currentConfig()
+	rootBlock := copyDirBlock(r.currentRootBlock())
+	if len(rootBlock.Contracts) == 0 {
+		// The root block has never been pushed from this repo, but the user
+		// may have pushed one from another, such as before restoring their
+		// keys here. That one is fetched rather than overwritten.
+		fetched, err := r.fetchRootBlock(ctx)
+		if err != nil {
+			return err
+		}
+		if fetched != nil {
+			rootBlock = fetched
+		}
+	}
 	var providers []core.Provider
-	if len(r.rootBlock.Contracts) == 0 {
+	if len(rootBlock.Contracts) == 0 {
 
 		// Create storage contracts for root block.
 		pinfos, err := r.listProviders()
@@ -294,8 +689,8 @@ func (r *repo) Sync() error {
 		}
 
 		var pvdrs []core.Provider
-		for _, pinfo := range pinfos {
-			pvdr, err := provider.Dial(pinfo.Addr)
+		for _, pinfo := range r.reputation.rank(pinfos, config.MinReputation) {
+			pvdr, err := r.dialProvider(pinfo)
 			if err != nil {
 				continue
 			}
@@ -304,27 +699,32 @@ func (r *repo) Sync() error {
 		}
 
 		binfo := blockInfo{
-			ID:   r.rootBlock.ID,
+			ID:   rootBlock.ID,
 			Size: 1024 * 1024,
 		}
 
-		cinfos, err := r.negotiateContracts(binfo, pvdrs)
+		cinfos, err := r.negotiateContracts(ctx, binfo, pvdrs, config.Redundancy)
 		if err != nil {
 			return err
 		}
 
 		for _, cinfo := range cinfos {
-			r.rootBlock.Contracts = append(r.rootBlock.Contracts, cinfo.contract)
+			rootBlock.Contracts = append(rootBlock.Contracts, cinfo.contract)
 			providers = append(providers, cinfo.provider)
 		}
 
+		err = r.saveRootBlock(rootBlock)
+		if err != nil {
+			return err
+		}
+
 	} else {
-		for _, contract := range r.rootBlock.Contracts {
+		for _, contract := range rootBlock.Contracts {
 			pinfo, err := r.getProviderInfo(contract.ProviderID)
 			if err != nil {
 				continue
 			}
-			pvdr, err := provider.Dial(pinfo.Addr)
+			pvdr, err := r.dialProvider(*pinfo)
 			if err != nil {
 				continue
 			}
@@ -337,51 +737,205 @@ func (r *repo) Sync() error {
 		return errors.New("cannot connect to any metadata storage providers")
 	}
 
-	blockBytes, err := marshalBlock(&r.rootBlock)
+	blockBytes, err := marshalBlock(rootBlock)
 	if err != nil {
 		return err
 	}
 
 	nupdated := 0
 	for _, pvdr := range providers {
-		err := pvdr.StoreBlock(r.rootBlock.ID, blockBytes)
+		err := pvdr.StoreBlock(ctx, rootBlock.ID, blockBytes)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if err != nil {
 			continue
 		}
 		nupdated++
 	}
 
-	if nupdated < len(r.rootBlock.Contracts)/2 {
+	if nupdated < len(rootBlock.Contracts)/2 {
 		return errors.New("unable to push metadata updates to enough providers")
 	}
 
 	return nil
 }
 
-func (r *repo) downloadBlock(ref *core.BlockRef) ([]byte, error) {
-	for _, contract := range ref.Contracts {
+// fetchRootBlock looks for the user's root block with the known providers.
+// If one is found, it and the file records it lists are saved in place of
+// the local root block, which must be empty. It returns nil if no provider
+// holds a root block. The caller must hold the repo's lock.
+func (r *repo) fetchRootBlock(ctx context.Context) (*core.DirBlock, error) {
+	pinfos, err := r.listProviders()
+	if err != nil {
+		return nil, err
+	}
+	ps := r.newProviderSet()
+	defer ps.close()
+
+	userId := r.currentConfig().UserId
+	rootBlock := &core.DirBlock{}
+	err = r.fetchMetadata(ctx, r.currentRootBlock().ID, pinfos, ps, rootBlock)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rootBlock.OwnerID != userId {
+		return nil, fmt.Errorf("remote root block is owned by %s", rootBlock.OwnerID)
+	}
+	if len(r.currentRootBlock().Files) > 0 {
+		return nil, errors.New("a root block was already pushed for this user from another repo")
+	}
+
+	// Fetch every file record before saving any, so a failure leaves the
+	// repo as it was.
+	inodes := make([]*core.INodeBlock, len(rootBlock.Files))
+	for i, entry := range rootBlock.Files {
+		inode := &core.INodeBlock{}
+		err := r.fetchMetadata(ctx, entry.ID, pinfos, ps, inode)
+		if err != nil {
+			return nil, fmt.Errorf("cannot fetch record of file %s: %s", entry.Name, err)
+		}
+		if inode.ID != entry.ID || inode.OwnerID != userId {
+			return nil, fmt.Errorf("remote record of file %s does not match its root block entry", entry.Name)
+		}
+		inodes[i] = inode
+	}
+	for _, inode := range inodes {
+		err := saveBlock(path.Join(r.homedir, "user", inode.ID), inode)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = r.saveRootBlock(rootBlock)
+	if err != nil {
+		return nil, err
+	}
+	return rootBlock, nil
+}
+
+// fetchMetadata downloads a metadata block from the first of the given
+// providers that holds it. It returns a NotFound error if the providers that
+// could be reached don't hold it.
+func (r *repo) fetchMetadata(ctx context.Context, id string, pinfos []core.PeerInfo, ps *providerSet, block proto.Message) error {
+	for _, pinfo := range pinfos {
+		pvdr, err := ps.get(pinfo.ID)
+		if err != nil {
+			r.logger.Println("cannot connect to provider", pinfo.ID, "error:", err)
+			continue
+		}
+		data, err := pvdr.GetBlock(ctx, id)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			if status.Code(err) != codes.NotFound {
+				r.logger.Println("could not download block", id, "error:", err)
+			}
+			continue
+		}
+		err = unmarshalBlock(data, block)
+		if err != nil {
+			r.logger.Println("provider", pinfo.ID, "returned corrupt block", id)
+			r.reputation.recordFailure(pinfo.ID, integrityFailure)
+			continue
+		}
+		return nil
+	}
+	return status.Errorf(codes.NotFound, "no provider holds block %s", id)
+}
+
+// downloadBlock downloads a file block, trying the most reliable providers
+// first. File blocks are named by the hash of their contents, which is checked
+// against the downloaded data. It stops trying providers once ctx is done.
+func (r *repo) downloadBlock(ctx context.Context, ref *core.BlockRef) ([]byte, error) {
+	for _, contract := range r.reputation.rankContracts(ref.Contracts) {
 		pinfo, err := r.getProviderInfo(contract.ProviderID)
 		if err != nil {
 			r.logger.Println("could not find provider info for", contract.ProviderID)
 			continue
 		}
-		pvdr, err := provider.Dial(pinfo.Addr)
+		pvdr, err := r.dialProvider(*pinfo)
 		if err != nil {
 			r.logger.Println("could not dial provider", pinfo)
 			continue
 		}
 		defer pvdr.Close()
-		block, err := pvdr.GetBlock(ref.ID)
+		block, err := pvdr.GetBlock(ctx, ref.ID)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		if err != nil {
 			r.logger.Println("could not download block", ref.ID, "error:", err)
 			continue
 		}
+		if hash(block) != ref.ID {
+			r.logger.Println("provider", contract.ProviderID, "returned corrupt block", ref.ID)
+			r.reputation.recordFailure(contract.ProviderID, integrityFailure)
+			continue
+		}
+		r.ledger.recordEgress(contract, int64(len(block)))
 		return block, nil
 	}
 	return nil, errors.New("failed to download block")
 }
 
-func findHomeDir() (string, error) {
+func (r *repo) ListContracts() ([]*core.Contract, error) {
+	rootBlock := r.currentRootBlock()
+	contracts := append([]*core.Contract{}, rootBlock.Contracts...)
+	for _, entry := range rootBlock.Files {
+		inode, err := r.loadINode(entry.Name)
+		if err != nil {
+			return nil, err
+		}
+		contracts = append(contracts, inode.Contracts...)
+		for _, ref := range inode.Blocks {
+			contracts = append(contracts, ref.Contracts...)
+		}
+	}
+	return contracts, nil
+}
+
+func (r *repo) Billing() ([]*Bill, error) {
+	contracts, err := r.ListContracts()
+	if err != nil {
+		return nil, err
+	}
+	return r.ledger.makeBills(contracts, time.Now())
+}
+
+func (r *repo) saveLedger() {
+	err := r.ledger.save()
+	if err != nil {
+		r.logger.Println("cannot save ledger:", err)
+	}
+}
+
+func (r *repo) saveReputation() {
+	err := r.reputation.save()
+	if err != nil {
+		r.logger.Println("cannot save provider reputation:", err)
+	}
+}
+
+// loadINode loads the locally cached inode for a file.
+func (r *repo) loadINode(filename string) (*core.INodeBlock, error) {
+	blockId := makeBlockId(r.currentConfig().UserId, filename)
+	inode, err := loadINodeBlock(path.Join(r.homedir, "user", blockId))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.New("cannot find record of file " + filename)
+		}
+		return nil, err
+	}
+	return inode, nil
+}
+
+// FindHomeDir returns the repo's home directory, which is $SKYBIN_HOME or
+// ~/.skybin if it is not set.
+func FindHomeDir() (string, error) {
 	skybinHome := os.Getenv("SKYBIN_HOME")
 
 	if len(skybinHome) == 0 {
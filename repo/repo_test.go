@@ -0,0 +1,986 @@
+package repo
+
+import (
+	"bytes"
+	"crypto/rand"
+	"golang.org/x/net/context"
+	"io"
+	"path"
+	core "skybin/core/proto"
+	"skybin/provider/chaos"
+	"testing"
+	"time"
+)
+
+func randomBytes(t *testing.T, n int) []byte {
+	data := make([]byte, n)
+	_, err := rand.Read(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestPutGet(t *testing.T) {
+	tn := newTestNet(t, 3)
+	tn.setConfig(func(config *Config) {
+		config.BlockSize = 1024
+	})
+
+	data := randomBytes(t, 10*1024+17)
+	opts := tn.repo.config.DefaultStorageOpts("data.bin")
+	err := tn.repo.Put(context.Background(), tn.writeFile(data), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := tn.repo.ListFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] != "data.bin" {
+		t.Fatalf("expected [data.bin], got %v", files)
+	}
+
+	var buf bytes.Buffer
+	err = tn.repo.Get(context.Background(), "data.bin", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("downloaded file does not match uploaded file")
+	}
+}
+
+func TestPutDuplicateName(t *testing.T) {
+	tn := newTestNet(t, 1)
+
+	for i := 0; i < 2; i++ {
+		opts := tn.repo.config.DefaultStorageOpts("hello.txt")
+		err := tn.repo.Put(context.Background(), tn.writeFile([]byte("hello")), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := tn.repo.ListFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0] != "hello.txt" || files[1] != "hello.txt (1)" {
+		t.Fatalf("expected [hello.txt hello.txt (1)], got %v", files)
+	}
+}
+
+func TestGetFailsOverToReplica(t *testing.T) {
+	tn := newTestNet(t, 3)
+	tn.setConfig(func(config *Config) {
+		config.BlockSize = 1024
+		config.Redundancy = 2
+	})
+
+	data := randomBytes(t, 4096)
+	opts := tn.repo.config.DefaultStorageOpts("data.bin")
+	err := tn.repo.Put(context.Background(), tn.writeFile(data), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inode, err := tn.repo.loadINode("data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range inode.Blocks {
+		if len(ref.Contracts) != 2 {
+			t.Fatalf("expected 2 contracts for block, got %d", len(ref.Contracts))
+		}
+	}
+
+	// Stop the provider holding the first replica of the first block.
+	tn.provider(inode.Blocks[0].Contracts[0].ProviderID).stop()
+
+	var buf bytes.Buffer
+	err = tn.repo.Get(context.Background(), "data.bin", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("downloaded file does not match uploaded file")
+	}
+}
+
+func TestSync(t *testing.T) {
+	tn := newTestNet(t, 2)
+
+	opts := tn.repo.config.DefaultStorageOpts("hello.txt")
+	err := tn.repo.Put(context.Background(), tn.writeFile([]byte("hello")), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tn.repo.Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tn.repo.rootBlock.Contracts) == 0 {
+		t.Fatal("root block has no contracts after sync")
+	}
+
+	// The root block should be stored with the contracted provider.
+	contract := tn.repo.rootBlock.Contracts[0]
+	for _, p := range tn.providers {
+		if p.info.ID != contract.ProviderID {
+			continue
+		}
+		data, err := p.store.Get(tn.repo.rootBlock.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root := &core.DirBlock{}
+		err = unmarshalBlock(data, root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(root.Files) != 1 || root.Files[0].Name != "hello.txt" {
+			t.Fatalf("unexpected files in synced root block: %v", root.Files)
+		}
+	}
+
+	// Reopening the repo should keep the root block's contracts.
+	r, err := OpenAt(tn.repo.homedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.(*repo).rootBlock.Contracts) == 0 {
+		t.Fatal("root block contracts were not saved")
+	}
+}
+
+func TestSyncAfterRestoringKeys(t *testing.T) {
+	tn := newTestNet(t, 2)
+	data := []byte("hello")
+	opts := tn.repo.config.DefaultStorageOpts("hello.txt")
+	err := tn.repo.Put(context.Background(), tn.writeFile(data), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tn.repo.Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Restore the user's keys into a new repo, as after losing the old one.
+	passphrase := []byte("secret")
+	err = ChangePassphrase(tn.repo.homedir, nil, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(f func() ([]byte, error)) { PassphraseFunc = f }(PassphraseFunc)
+	PassphraseFunc = func() ([]byte, error) { return passphrase, nil }
+	var exported bytes.Buffer
+	err = ExportKeys(tn.repo.homedir, passphrase, &exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	homedir := path.Join(t.TempDir(), "restored")
+	Init(homedir)
+	err = ImportKeys(homedir, &exported, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := OpenAt(homedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := opened.(*repo)
+	defer restored.Close()
+	restored.dial = tn.dial
+	err = restored.saveProviders(tn.repo.pcache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Syncing the restored repo fetches the user's files instead of
+	// replacing them with its empty root block.
+	err = restored.Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []*repo{restored, tn.repo} {
+		var buf bytes.Buffer
+		err = r.Get(context.Background(), "hello.txt", &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Fatal("downloaded file does not match uploaded file")
+		}
+	}
+	for _, contract := range tn.repo.rootBlock.Contracts {
+		block, err := tn.provider(contract.ProviderID).store.Get(tn.repo.rootBlock.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root := &core.DirBlock{}
+		err = unmarshalBlock(block, root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(root.Files) != 1 {
+			t.Fatalf("remote root block lists %d files, want 1", len(root.Files))
+		}
+	}
+}
+
+func TestGetFailsOverOnCorruptBlock(t *testing.T) {
+	tn := newTestNet(t, 2)
+	tn.setConfig(func(config *Config) {
+		config.Redundancy = 2
+	})
+
+	data := randomBytes(t, 4096)
+	opts := tn.repo.config.DefaultStorageOpts("data.bin")
+	err := tn.repo.Put(context.Background(), tn.writeFile(data), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inode, err := tn.repo.loadINode("data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make the provider returning corrupt blocks the preferred one.
+	first := inode.Blocks[0].Contracts[0].ProviderID
+	tn.provider(first).chaos.SetPolicy(&chaos.Policy{
+		Rules: []chaos.Rule{{Fault: chaos.Corrupt, Method: chaos.GetBlock}},
+	})
+	tn.repo.reputation.recordSuccess(first, 0)
+
+	var buf bytes.Buffer
+	err = tn.repo.Get(context.Background(), "data.bin", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("downloaded file does not match uploaded file")
+	}
+	if tn.repo.reputation.snapshot(first).IntegrityFailures == 0 {
+		t.Fatal("corrupt block was not recorded in provider reputation")
+	}
+}
+
+func TestPutSkipsRefusingProvider(t *testing.T) {
+	tn := newTestNet(t, 2)
+	refuser := tn.providers[0]
+	refuser.chaos.SetPolicy(&chaos.Policy{
+		Rules: []chaos.Rule{{Fault: chaos.Refuse, Method: chaos.Negotiate}},
+	})
+
+	opts := tn.repo.config.DefaultStorageOpts("hello.txt")
+	err := tn.repo.Put(context.Background(), tn.writeFile([]byte("hello")), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inode, err := tn.repo.loadINode("hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contracts := append(inode.Contracts, inode.Blocks[0].Contracts...)
+	for _, contract := range contracts {
+		if contract.ProviderID == refuser.info.ID {
+			t.Fatal("contract made with provider that refused negotiation")
+		}
+	}
+}
+
+func TestPutReplace(t *testing.T) {
+	tn := newTestNet(t, 2)
+	opts := tn.repo.config.DefaultStorageOpts("hello.txt")
+	err := tn.repo.Put(context.Background(), tn.writeFile([]byte("old")), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Replace = true
+	err = tn.repo.Put(context.Background(), tn.writeFile([]byte("new")), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := tn.repo.ListFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] != "hello.txt" {
+		t.Fatalf("expected only hello.txt, got %v", files)
+	}
+	var buf bytes.Buffer
+	err = tn.repo.Get(context.Background(), "hello.txt", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "new" {
+		t.Fatalf("expected %q, got %q", "new", buf.String())
+	}
+	finfo, err := tn.repo.Stat("hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finfo.ModTime.IsZero() {
+		t.Fatal("expected the file's modification time to be recorded")
+	}
+
+	// A failed upload leaves the file in place.
+	for _, p := range tn.providers {
+		p.chaos.SetPolicy(&chaos.Policy{
+			Rules: []chaos.Rule{{Fault: chaos.Refuse, Method: chaos.Negotiate}},
+		})
+	}
+	err = tn.repo.Put(context.Background(), tn.writeFile([]byte("newer")), opts)
+	if err == nil {
+		t.Fatal("expected put to fail without providers")
+	}
+	buf.Reset()
+	err = tn.repo.Get(context.Background(), "hello.txt", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "new" {
+		t.Fatalf("expected %q, got %q", "new", buf.String())
+	}
+}
+
+func TestPutSkipsSlowProvider(t *testing.T) {
+	tn := newTestNet(t, 2)
+	tn.setConfig(func(config *Config) {
+		config.ProviderTimeouts.Negotiate = 1
+	})
+	slow := tn.providers[0]
+	slow.chaos.SetPolicy(&chaos.Policy{
+		Rules: []chaos.Rule{{Fault: chaos.Latency, Method: chaos.Negotiate, LatencyMs: 10000}},
+	})
+
+	start := time.Now()
+	opts := tn.repo.config.DefaultStorageOpts("hello.txt")
+	err := tn.repo.Put(context.Background(), tn.writeFile([]byte("hello")), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("put waited %s for the slow provider", elapsed)
+	}
+	if tn.repo.reputation.snapshot(slow.info.ID).NegotiateFailures == 0 {
+		t.Fatal("timeout was not recorded in provider reputation")
+	}
+}
+
+func TestPutCanceled(t *testing.T) {
+	tn := newTestNet(t, 1)
+	pvdr := tn.providers[0]
+	pvdr.chaos.SetPolicy(&chaos.Policy{
+		Rules: []chaos.Rule{{Fault: chaos.Latency, Method: chaos.Negotiate, LatencyMs: 10000}},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	opts := tn.repo.config.DefaultStorageOpts("hello.txt")
+	err := tn.repo.Put(ctx, tn.writeFile([]byte("hello")), opts)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	stats := tn.repo.reputation.snapshot(pvdr.info.ID)
+	if stats.failures() != 0 {
+		t.Fatal("canceled request was recorded as a provider failure")
+	}
+	_, err = tn.repo.loadINode("hello.txt")
+	if err == nil {
+		t.Fatal("canceled put saved the file")
+	}
+}
+
+func TestRepairReplacesLostReplicas(t *testing.T) {
+	tn := newTestNet(t, 3)
+	tn.setConfig(func(config *Config) {
+		config.BlockSize = 1024
+		config.Redundancy = 2
+	})
+
+	data := randomBytes(t, 4096)
+	opts := tn.repo.config.DefaultStorageOpts("data.bin")
+	err := tn.repo.Put(context.Background(), tn.writeFile(data), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tn.repo.Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Make one replica holder lose everything it stores.
+	inode, err := tn.repo.loadINode("data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lost := inode.Blocks[0].Contracts[0].ProviderID
+	tn.provider(lost).chaos.SetPolicy(&chaos.Policy{
+		Rules: []chaos.Rule{{Fault: chaos.Lose, Method: chaos.GetBlock}},
+	})
+
+	report, err := tn.repo.Repair(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.BlocksLost) > 0 {
+		t.Fatalf("blocks lost: %v", report.BlocksLost)
+	}
+	if report.ContractsReplaced == 0 {
+		t.Fatal("no replicas replaced")
+	}
+
+	contracts, err := tn.repo.ListContracts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, contract := range contracts {
+		if contract.ProviderID == lost {
+			t.Fatalf("contract for block %s still held by lost provider", contract.BlockID)
+		}
+	}
+	inode, err = tn.repo.loadINode("data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range inode.Blocks {
+		if len(ref.Contracts) != 2 {
+			t.Fatalf("expected 2 replicas of block after repair, got %d", len(ref.Contracts))
+		}
+	}
+
+	var buf bytes.Buffer
+	err = tn.repo.Get(context.Background(), "data.bin", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("downloaded file does not match uploaded file")
+	}
+}
+
+// putReplicated stores data as data.bin with 1 KB blocks, each replicated to
+// two providers, and syncs the root block.
+func putReplicated(t *testing.T, tn *testNet, data []byte) *core.INodeBlock {
+	tn.setConfig(func(config *Config) {
+		config.BlockSize = 1024
+		config.Redundancy = 2
+	})
+	opts := tn.repo.config.DefaultStorageOpts("data.bin")
+	opts.Compression = NoCompression
+	err := tn.repo.Put(context.Background(), tn.writeFile(data), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tn.repo.Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	inode, err := tn.repo.loadINode("data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inode
+}
+
+func TestRepairRetriesTransientFailures(t *testing.T) {
+	tn := newTestNet(t, 3)
+	inode := putReplicated(t, tn, randomBytes(t, 4096))
+
+	// One failed check of each kind is retried rather than taken as loss.
+	holder := inode.Blocks[0].Contracts[0].ProviderID
+	tn.provider(holder).chaos.SetPolicy(&chaos.Policy{
+		Rules: []chaos.Rule{
+			{Fault: chaos.Error, Method: chaos.GetBlock, Count: 1},
+			{Fault: chaos.Drop, Method: chaos.GetBlock, Count: 1},
+		},
+	})
+	report, err := tn.repo.Repair(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.BlocksRepaired != 0 || report.ContractsReplaced != 0 {
+		t.Fatalf("transient failures changed replicas: %+v", report)
+	}
+}
+
+func TestRepairKeepsUnreachableReplicas(t *testing.T) {
+	tn := newTestNet(t, 3)
+	inode := putReplicated(t, tn, randomBytes(t, 4096))
+
+	down := inode.Blocks[0].Contracts[0].ProviderID
+	held := make(map[string]bool)
+	for _, ref := range inode.Blocks {
+		for _, contract := range ref.Contracts {
+			held[ref.ID] = held[ref.ID] || contract.ProviderID == down
+		}
+	}
+	tn.provider(down).chaos.SetPolicy(&chaos.Policy{
+		Rules: []chaos.Rule{{Fault: chaos.Drop, Method: chaos.GetBlock}},
+	})
+	report, err := tn.repo.Repair(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.BlocksLost) > 0 {
+		t.Fatalf("blocks lost: %v", report.BlocksLost)
+	}
+	if report.ContractsReplaced == 0 {
+		t.Fatal("no replicas added for unreachable provider")
+	}
+
+	// The unreachable replicas are kept in case the provider comes back.
+	inode, err = tn.repo.loadINode("data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range inode.Blocks {
+		kept := false
+		for _, contract := range ref.Contracts {
+			kept = kept || contract.ProviderID == down
+		}
+		if held[ref.ID] && !kept {
+			t.Fatalf("contract with unreachable provider dropped from block %s", ref.ID)
+		}
+	}
+}
+
+// repairEgress returns the bytes downloaded by the repo according to its
+// bills.
+func repairEgress(t *testing.T, tn *testNet) int64 {
+	bills, err := tn.repo.Billing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var egressBytes int64
+	for _, bill := range bills {
+		egressBytes += bill.EgressBytes
+	}
+	return egressBytes
+}
+
+func TestRepairDownloadsNothingWhenHealthy(t *testing.T) {
+	tn := newTestNet(t, 2)
+	putReplicated(t, tn, randomBytes(t, 4096))
+
+	report, err := tn.repo.Repair(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.BlocksRepaired != 0 {
+		t.Fatalf("healthy blocks repaired: %+v", report)
+	}
+	if egress := repairEgress(t, tn); egress != 0 {
+		t.Fatalf("repair of healthy blocks downloaded %d bytes", egress)
+	}
+}
+
+func TestRepairDownloadsOnlyBlocksToReplicate(t *testing.T) {
+	tn := newTestNet(t, 3)
+	inode := putReplicated(t, tn, randomBytes(t, 4096))
+
+	// Only the blocks the lost provider held need new replicas.
+	lost := inode.Blocks[0].Contracts[0].ProviderID
+	var want int64
+	for _, ref := range inode.Blocks {
+		for _, contract := range ref.Contracts {
+			if contract.ProviderID == lost {
+				want += refBlockSize(ref)
+			}
+		}
+	}
+	tn.provider(lost).chaos.SetPolicy(&chaos.Policy{
+		Rules: []chaos.Rule{{Fault: chaos.Lose, Method: chaos.GetBlock}},
+	})
+	_, err := tn.repo.Repair(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if egress := repairEgress(t, tn); egress != want {
+		t.Fatalf("repair downloaded %d bytes, want %d", egress, want)
+	}
+}
+
+func TestRepairReplacesCorruptReplica(t *testing.T) {
+	tn := newTestNet(t, 3)
+	inode := putReplicated(t, tn, randomBytes(t, 4096))
+
+	ref := inode.Blocks[0]
+	corrupt := ref.Contracts[0].ProviderID
+	err := tn.provider(corrupt).store.Put(ref.ID, randomBytes(t, 1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := tn.repo.Repair(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.BlocksRepaired != 1 || report.ContractsReplaced != 1 {
+		t.Fatalf("expected the corrupt replica to be replaced: %+v", report)
+	}
+	inode, err = tn.repo.loadINode("data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, contract := range inode.Blocks[0].Contracts {
+		if contract.ProviderID == corrupt {
+			t.Fatal("contract with provider holding a corrupt replica kept")
+		}
+	}
+}
+
+func TestPutDuringRepair(t *testing.T) {
+	tn := newTestNet(t, 2)
+	inode := putReplicated(t, tn, randomBytes(t, 4096))
+
+	// Slow checks keep the repair going well past the lock timeout.
+	for _, contract := range inode.Contracts {
+		tn.provider(contract.ProviderID).chaos.SetPolicy(&chaos.Policy{
+			Rules: []chaos.Rule{{Fault: chaos.Latency, Method: chaos.GetBlock, LatencyMs: 200}},
+		})
+	}
+	defer func(timeout time.Duration) { lockTimeout = timeout }(lockTimeout)
+	lockTimeout = 100 * time.Millisecond
+
+	repaired := make(chan error, 1)
+	go func() {
+		_, err := tn.repo.Repair(context.Background())
+		repaired <- err
+	}()
+	time.Sleep(300 * time.Millisecond)
+
+	// Another process puts a file while the repair runs.
+	other, err := OpenAt(tn.repo.homedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.(*repo).dial = tn.dial
+	opts := tn.repo.config.DefaultStorageOpts("other.bin")
+	err = other.Put(context.Background(), tn.writeFile([]byte("other")), opts)
+	if err != nil {
+		t.Fatal("put during repair failed:", err)
+	}
+	err = <-repaired
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepairRewritesDamagedMetadata(t *testing.T) {
+	tn := newTestNet(t, 2)
+	inode := putReplicated(t, tn, randomBytes(t, 4096))
+
+	holder := tn.provider(inode.Contracts[0].ProviderID)
+	err := holder.store.Put(inode.ID, []byte("not an inode"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := tn.repo.Repair(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.BlocksRepaired == 0 {
+		t.Fatal("damaged inode replica not repaired")
+	}
+	stored, err := holder.store.Get(inode.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inode, err = tn.repo.loadINode("data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := marshalBlock(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, want) {
+		t.Fatal("provider still holds a damaged inode")
+	}
+}
+
+// ageContracts moves the start of every contract of data.bin back by the
+// given fraction of its duration, as if that much time had passed.
+func ageContracts(t *testing.T, tn *testNet, fraction float64) *core.INodeBlock {
+	inode, err := tn.repo.loadINode("data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	age := func(contracts []*core.Contract) {
+		for _, contract := range contracts {
+			contract.StartTime -= int64(float64(contract.Duration) * fraction)
+		}
+	}
+	for _, ref := range inode.Blocks {
+		age(ref.Contracts)
+	}
+	age(inode.Contracts)
+	err = saveBlock(path.Join(tn.repo.homedir, "user", inode.ID), inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inode
+}
+
+func TestRepairRenewsExpiringContracts(t *testing.T) {
+	tn := newTestNet(t, 2)
+	putReplicated(t, tn, randomBytes(t, 2048))
+	inode := ageContracts(t, tn, 0.9)
+
+	report, err := tn.repo.Repair(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2 file blocks and the inode, each with 2 replicas
+	if report.ContractsRenewed != 6 {
+		t.Fatalf("renewed %d contracts, want 6", report.ContractsRenewed)
+	}
+	renewed, err := tn.repo.loadINode("data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ref := range renewed.Blocks {
+		if len(ref.Contracts) != 2 {
+			t.Fatalf("block has %d contracts after renewal, want 2", len(ref.Contracts))
+		}
+		for j, contract := range ref.Contracts {
+			if contract.ProviderID != inode.Blocks[i].Contracts[j].ProviderID {
+				t.Fatal("contract renewed with a different provider")
+			}
+			if dueForRenewal(contract, time.Now()) {
+				t.Fatal("renewed contract is still due for renewal")
+			}
+		}
+	}
+}
+
+func TestRepairDropsExpiredContracts(t *testing.T) {
+	tn := newTestNet(t, 3)
+	inode := putReplicated(t, tn, randomBytes(t, 1024))
+	ageContracts(t, tn, 1.1)
+
+	// One provider refuses to renew, so its expired contracts end.
+	refuser := inode.Blocks[0].Contracts[0].ProviderID
+	tn.provider(refuser).chaos.SetPolicy(&chaos.Policy{
+		Rules: []chaos.Rule{{Fault: chaos.Error, Method: chaos.Negotiate}},
+	})
+	report, err := tn.repo.Repair(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.BlocksLost) > 0 {
+		t.Fatalf("blocks lost: %v", report.BlocksLost)
+	}
+	inode, err = tn.repo.loadINode("data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, contract := range inode.Blocks[0].Contracts {
+		if contract.ProviderID == refuser {
+			t.Fatal("expired contract kept")
+		}
+	}
+	if len(inode.Blocks[0].Contracts) != 2 {
+		t.Fatalf("expected expired replica to be replaced, got %d contracts", len(inode.Blocks[0].Contracts))
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	tn := newTestNet(t, 2)
+	tn.setConfig(func(config *Config) {
+		config.BlockSize = 1024
+	})
+
+	data := randomBytes(t, 4*1024+100)
+	opts := tn.repo.config.DefaultStorageOpts("data.bin")
+	err := tn.repo.Put(context.Background(), tn.writeFile(data), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Make the first block unavailable. Ranges after it can still be read.
+	inode, err := tn.repo.loadINode("data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range tn.providers {
+		p.chaos.SetPolicy(&chaos.Policy{
+			Rules: []chaos.Rule{{Fault: chaos.Error, Method: chaos.GetBlock, BlockID: inode.Blocks[0].ID}},
+		})
+	}
+
+	tests := []struct {
+		offset int64
+		length int64
+	}{
+		{1024, 1024},
+		{1500, 2000},
+		{2047, 1},
+		{4000, -1},
+		{4000, 1 << 20},
+		{int64(len(data)), -1},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		err := tn.repo.GetRange(context.Background(), "data.bin", test.offset, test.length, &buf)
+		if err != nil {
+			t.Fatalf("offset %d length %d: %s", test.offset, test.length, err)
+		}
+		end := int64(len(data))
+		if test.length >= 0 && test.offset+test.length < end {
+			end = test.offset + test.length
+		}
+		if !bytes.Equal(buf.Bytes(), data[test.offset:end]) {
+			t.Fatalf("offset %d length %d: wrong data", test.offset, test.length)
+		}
+	}
+
+	var buf bytes.Buffer
+	err = tn.repo.GetRange(context.Background(), "data.bin", 0, 10, &buf)
+	if err == nil {
+		t.Fatal("expected error reading unavailable block")
+	}
+	err = tn.repo.GetRange(context.Background(), "data.bin", int64(len(data))+1, -1, &buf)
+	if err == nil {
+		t.Fatal("expected error reading past end of file")
+	}
+}
+
+func TestPutReader(t *testing.T) {
+	tn := newTestNet(t, 2)
+	tn.setConfig(func(config *Config) {
+		config.BlockSize = 1024
+	})
+
+	// Feed the data through a pipe so it can only be read once.
+	data := randomBytes(t, 5*1024+3)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write(data)
+		pw.Close()
+	}()
+	err := tn.repo.PutReader(context.Background(), "piped.bin", pr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finfo, err := tn.repo.Stat("piped.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finfo.Size != int64(len(data)) {
+		t.Fatalf("expected size %d, got %d", len(data), finfo.Size)
+	}
+	var buf bytes.Buffer
+	err = tn.repo.Get(context.Background(), "piped.bin", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("downloaded file does not match uploaded data")
+	}
+}
+
+func TestPutCompressed(t *testing.T) {
+	tn := newTestNet(t, 1)
+	tn.setConfig(func(config *Config) {
+		config.BlockSize = 4096
+	})
+
+	data := bytes.Repeat([]byte("2017-10-19 12:00:00 INFO request served\n"), 1000)
+	for _, algo := range []string{NoCompression, GzipCompression, ZstdCompression} {
+		opts := tn.repo.config.DefaultStorageOpts(algo + ".log")
+		opts.Compression = algo
+		err := tn.repo.Put(context.Background(), tn.writeFile(data), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		inode, err := tn.repo.loadINode(algo + ".log")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stored int64
+		for _, ref := range inode.Blocks {
+			stored += ref.Contracts[0].BlockSize
+		}
+		if algo == NoCompression && stored != int64(len(data)) {
+			t.Fatalf("uncompressed file stored in %d bytes", stored)
+		}
+		if algo != NoCompression && stored >= int64(len(data))/4 {
+			t.Fatalf("%s: file of %d bytes stored in %d bytes", algo, len(data), stored)
+		}
+
+		var buf bytes.Buffer
+		err = tn.repo.Get(context.Background(), algo+".log", &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Fatalf("%s: downloaded file does not match uploaded file", algo)
+		}
+
+		buf.Reset()
+		err = tn.repo.GetRange(context.Background(), algo+".log", 5000, 100, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), data[5000:5100]) {
+			t.Fatalf("%s: downloaded range does not match uploaded file", algo)
+		}
+	}
+}
+
+func TestValidateRelayedProviders(t *testing.T) {
+	err := validateProviders([]core.PeerInfo{
+		{ID: "direct", Addr: "127.0.0.1:8002"},
+		{ID: "relayed", Relay: "127.0.0.1:8002"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = validateProviders([]core.PeerInfo{{ID: "both", Addr: "127.0.0.1:8003", Relay: "127.0.0.1:8002"}})
+	if err == nil {
+		t.Fatal("expected error for provider with both an address and a relay")
+	}
+	err = validateProviders([]core.PeerInfo{{ID: "relayed", Relay: "nowhere"}})
+	if err == nil {
+		t.Fatal("expected error for invalid relay address")
+	}
+}
+
+func TestSaveConfigAppliesBandwidthLimits(t *testing.T) {
+	tn := newTestNet(t, 1)
+	tn.setConfig(func(config *Config) {
+		config.Redundancy = 1
+		config.RenterBandwidth.UploadRate = 64 * 1024
+	})
+
+	// The first 64KB pass in a burst and the rest at the limit.
+	put := func(name string) time.Duration {
+		start := time.Now()
+		opts := tn.repo.config.DefaultStorageOpts(name)
+		err := tn.repo.Put(context.Background(), tn.writeFile(randomBytes(t, 128*1024)), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Since(start)
+	}
+	if elapsed := put("limited.bin"); elapsed < 900*time.Millisecond {
+		t.Fatalf("upload limited to 64KB/s took only %s", elapsed)
+	}
+
+	tn.setConfig(func(config *Config) {
+		config.RenterBandwidth.UploadRate = 0
+	})
+	if elapsed := put("unlimited.bin"); elapsed > 900*time.Millisecond {
+		t.Fatalf("upload took %s after its limit was removed", elapsed)
+	}
+}
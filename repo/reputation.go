@@ -0,0 +1,312 @@
+package repo
+
+import (
+	"encoding/json"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"math"
+	"os"
+	core "skybin/core/proto"
+	provider "skybin/provider/remote"
+	"sort"
+	"sync"
+	"time"
+)
+
+// minObservations is the number of recorded outcomes needed before a
+// provider can be excluded for a low reliability score.
+const minObservations = 10
+
+// reputationHalfLife is how long it takes for a recorded outcome to count
+// half as much, so providers are judged by how they have done lately.
+const reputationHalfLife = 72 * time.Hour
+
+// reprobeInterval is how long a provider excluded for a low score goes
+// without being tried. After that it is ranked last until it fails again.
+const reprobeInterval = time.Hour
+
+// providerStats records the outcomes of past interactions with a provider.
+// The counts decay over time.
+type providerStats struct {
+	Successes         float64   `json:"successes"`
+	DialFailures      float64   `json:"dialFailures"`
+	NegotiateFailures float64   `json:"negotiateFailures"`
+	StoreFailures     float64   `json:"storeFailures"`
+	GetFailures       float64   `json:"getFailures"`
+	IntegrityFailures float64   `json:"integrityFailures"`
+	AvgLatencyMs      float64   `json:"avgLatencyMs"` // Moving average of successful requests
+	LastFailure       time.Time `json:"lastFailure"`
+	Updated           time.Time `json:"updated"` // When the counts were last decayed
+}
+
+func (s *providerStats) failures() float64 {
+	return s.DialFailures + s.NegotiateFailures + s.StoreFailures + s.GetFailures + s.IntegrityFailures
+}
+
+// score estimates the probability that a request to the provider succeeds.
+// Integrity failures are weighted heavily since they indicate a provider
+// serving bad data. Providers without history score 0.5.
+func (s *providerStats) score() float64 {
+	failures := s.failures() + 4*s.IntegrityFailures
+	return (s.Successes + 1) / (s.Successes + failures + 2)
+}
+
+// decay ages the counts to the given time. Stats saved before counts
+// decayed start aging from now.
+func (s *providerStats) decay(now time.Time) {
+	if !s.Updated.IsZero() && now.After(s.Updated) {
+		factor := math.Pow(0.5, float64(now.Sub(s.Updated))/float64(reputationHalfLife))
+		s.Successes *= factor
+		s.DialFailures *= factor
+		s.NegotiateFailures *= factor
+		s.StoreFailures *= factor
+		s.GetFailures *= factor
+		s.IntegrityFailures *= factor
+	}
+	s.Updated = now
+}
+
+// excluded reports whether a provider has done badly enough lately to be
+// left out of new operations.
+func (s *providerStats) excluded(minScore float64) bool {
+	return s.Successes+s.failures() >= minObservations && s.score() < minScore
+}
+
+type failureKind int
+
+const (
+	dialFailure failureKind = iota
+	negotiateFailure
+	storeFailure
+	getFailure
+	integrityFailure
+)
+
+// reputation tracks the reliability of providers across repo operations.
+type reputation struct {
+	mu       sync.Mutex
+	filename string
+	stats    map[string]*providerStats
+}
+
+func loadReputation(filename string) (*reputation, error) {
+	rep := &reputation{
+		filename: filename,
+		stats:    make(map[string]*providerStats),
+	}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return rep, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &rep.stats)
+	if err != nil {
+		return nil, err
+	}
+	return rep, nil
+}
+
+func (rep *reputation) save() error {
+	rep.mu.Lock()
+	data, err := json.MarshalIndent(rep.stats, "", "    ")
+	rep.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(rep.filename, data)
+}
+
+// get returns the provider's stats, decayed to the present.
+func (rep *reputation) get(providerID string) *providerStats {
+	stats, exists := rep.stats[providerID]
+	if !exists {
+		stats = &providerStats{}
+		rep.stats[providerID] = stats
+	}
+	stats.decay(time.Now())
+	return stats
+}
+
+func (rep *reputation) recordSuccess(providerID string, latency time.Duration) {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	stats := rep.get(providerID)
+	ms := float64(latency) / float64(time.Millisecond)
+	if stats.Successes == 0 {
+		stats.AvgLatencyMs = ms
+	} else {
+		stats.AvgLatencyMs = 0.8*stats.AvgLatencyMs + 0.2*ms
+	}
+	stats.Successes++
+}
+
+func (rep *reputation) recordFailure(providerID string, kind failureKind) {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	stats := rep.get(providerID)
+	switch kind {
+	case dialFailure:
+		stats.DialFailures++
+	case negotiateFailure:
+		stats.NegotiateFailures++
+	case storeFailure:
+		stats.StoreFailures++
+	case getFailure:
+		stats.GetFailures++
+	case integrityFailure:
+		stats.IntegrityFailures++
+	}
+	stats.LastFailure = time.Now()
+}
+
+// snapshot returns a copy of the provider's stats, decayed to the present.
+func (rep *reputation) snapshot(providerID string) providerStats {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	var stats providerStats
+	if s, exists := rep.stats[providerID]; exists {
+		stats = *s
+	}
+	stats.decay(time.Now())
+	return stats
+}
+
+// rankKey holds what a provider is ranked by. Keys are taken once per
+// provider before sorting, since taking one locks and decays the stats.
+type rankKey struct {
+	score     float64
+	latencyMs float64
+}
+
+// rankKeyOf rounds the score to a percent, so that providers with similar
+// records are ranked by latency rather than by how recently they were used.
+func rankKeyOf(stats providerStats) rankKey {
+	return rankKey{score: math.Round(stats.score()*100) / 100, latencyMs: stats.AvgLatencyMs}
+}
+
+// before reports whether a provider with key a should be preferred over one
+// with key b.
+func (a rankKey) before(b rankKey) bool {
+	if a.score != b.score {
+		return a.score > b.score
+	}
+	return a.latencyMs < b.latencyMs
+}
+
+// rankedPeer is a provider and its rank key.
+type rankedPeer struct {
+	pinfo core.PeerInfo
+	key   rankKey
+}
+
+func sortPeers(peers []rankedPeer) []core.PeerInfo {
+	sort.SliceStable(peers, func(i, j int) bool {
+		return peers[i].key.before(peers[j].key)
+	})
+	pinfos := make([]core.PeerInfo, len(peers))
+	for i, p := range peers {
+		pinfos[i] = p.pinfo
+	}
+	return pinfos
+}
+
+// rank orders providers from most to least reliable, dropping providers
+// with enough history whose score is below minScore. Dropped providers that
+// haven't failed for reprobeInterval are ranked last instead, so a provider
+// that has recovered gets the chance to show it.
+func (rep *reputation) rank(pinfos []core.PeerInfo, minScore float64) []core.PeerInfo {
+	var ranked []rankedPeer
+	var probation []rankedPeer
+	for _, pinfo := range pinfos {
+		stats := rep.snapshot(pinfo.ID)
+		peer := rankedPeer{pinfo: pinfo, key: rankKeyOf(stats)}
+		if stats.excluded(minScore) {
+			if time.Since(stats.LastFailure) >= reprobeInterval {
+				probation = append(probation, peer)
+			}
+			continue
+		}
+		ranked = append(ranked, peer)
+	}
+	return append(sortPeers(ranked), sortPeers(probation)...)
+}
+
+// rankContracts orders contracts from most to least reliable provider.
+func (rep *reputation) rankContracts(contracts []*core.Contract) []*core.Contract {
+	keys := make(map[string]rankKey)
+	for _, contract := range contracts {
+		if _, exists := keys[contract.ProviderID]; !exists {
+			keys[contract.ProviderID] = rankKeyOf(rep.snapshot(contract.ProviderID))
+		}
+	}
+	ranked := append([]*core.Contract{}, contracts...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return keys[ranked[i].ProviderID].before(keys[ranked[j].ProviderID])
+	})
+	return ranked
+}
+
+// monitoredProvider records the outcome of each request in the repo's
+// provider reputation.
+type monitoredProvider struct {
+	provider.RemoteProvider
+	id  string
+	rep *reputation
+}
+
+// record records the outcome of a request. Requests given up on by the
+// caller say nothing about the provider and are not recorded. Connections
+// are made when the first request needs them, so a provider that can't be
+// reached fails its request as unavailable, which counts as a dial failure.
+func (p *monitoredProvider) record(ctx context.Context, start time.Time, err error, kind failureKind) {
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		if status.Code(err) == codes.Unavailable {
+			kind = dialFailure
+		}
+		p.rep.recordFailure(p.id, kind)
+		return
+	}
+	p.rep.recordSuccess(p.id, time.Since(start))
+}
+
+func (p *monitoredProvider) Info(ctx context.Context) (*core.ProviderInfo, error) {
+	start := time.Now()
+	info, err := p.RemoteProvider.Info(ctx)
+	p.record(ctx, start, err, dialFailure)
+	return info, err
+}
+
+func (p *monitoredProvider) Negotiate(ctx context.Context, contract *core.Contract) (*core.Contract, error) {
+	start := time.Now()
+	c, err := p.RemoteProvider.Negotiate(ctx, contract)
+	p.record(ctx, start, err, negotiateFailure)
+	return c, err
+}
+
+func (p *monitoredProvider) StoreBlock(ctx context.Context, id string, block []byte) error {
+	start := time.Now()
+	err := p.RemoteProvider.StoreBlock(ctx, id, block)
+	p.record(ctx, start, err, storeFailure)
+	return err
+}
+
+func (p *monitoredProvider) GetBlock(ctx context.Context, id string) ([]byte, error) {
+	start := time.Now()
+	block, err := p.RemoteProvider.GetBlock(ctx, id)
+	p.record(ctx, start, err, getFailure)
+	return block, err
+}
+
+func (p *monitoredProvider) ProveBlock(ctx context.Context, id string, nonce []byte) ([]byte, error) {
+	start := time.Now()
+	proof, err := p.RemoteProvider.ProveBlock(ctx, id, nonce)
+	p.record(ctx, start, err, getFailure)
+	return proof, err
+}
@@ -0,0 +1,96 @@
+package repo
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math"
+	"path"
+	core "skybin/core/proto"
+	"testing"
+	"time"
+)
+
+func newTestReputation(t *testing.T) *reputation {
+	rep, err := loadReputation(path.Join(t.TempDir(), "reputation.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rep
+}
+
+func TestReputationDecays(t *testing.T) {
+	now := time.Now()
+	stats := providerStats{Successes: 8, GetFailures: 4, Updated: now.Add(-reputationHalfLife)}
+	stats.decay(now)
+	if math.Abs(stats.Successes-4) > 1e-9 || math.Abs(stats.GetFailures-2) > 1e-9 {
+		t.Fatalf("expected counts to halve after a half-life, got %+v", stats)
+	}
+	if !stats.Updated.Equal(now) {
+		t.Fatal("decay did not record when the counts were aged")
+	}
+}
+
+func TestExcludedProviderReturns(t *testing.T) {
+	rep := newTestReputation(t)
+	pinfos := []core.PeerInfo{{ID: "good"}, {ID: "bad"}}
+	rep.recordSuccess("good", 0)
+	for i := 0; i < 2*minObservations; i++ {
+		rep.recordFailure("bad", storeFailure)
+	}
+	ranked := rep.rank(pinfos, 0.5)
+	if len(ranked) != 1 || ranked[0].ID != "good" {
+		t.Fatalf("expected failing provider to be excluded, got %v", ranked)
+	}
+
+	// Once it hasn't failed for a while it is tried again, after the rest.
+	rep.stats["bad"].LastFailure = time.Now().Add(-reprobeInterval)
+	ranked = rep.rank(pinfos, 0.5)
+	if len(ranked) != 2 || ranked[1].ID != "bad" {
+		t.Fatalf("expected excluded provider to be ranked last, got %v", ranked)
+	}
+
+	// Old failures stop counting against it.
+	rep.stats["bad"].LastFailure = time.Time{}
+	rep.stats["bad"].Updated = time.Now().Add(-2 * reputationHalfLife)
+	stats := rep.snapshot("bad")
+	if stats.excluded(0.5) {
+		t.Fatalf("expected old failures to decay, got %+v", stats)
+	}
+}
+
+func TestRankOrdersByScoreThenLatency(t *testing.T) {
+	rep := newTestReputation(t)
+	rep.recordSuccess("slow", 200*time.Millisecond)
+	rep.recordSuccess("fast", 10*time.Millisecond)
+	rep.recordSuccess("flaky", time.Millisecond)
+	rep.recordFailure("flaky", getFailure)
+
+	pinfos := []core.PeerInfo{{ID: "flaky"}, {ID: "slow"}, {ID: "fast"}}
+	var ids []string
+	for _, pinfo := range rep.rank(pinfos, 0) {
+		ids = append(ids, pinfo.ID)
+	}
+	if len(ids) != 3 || ids[0] != "fast" || ids[1] != "slow" || ids[2] != "flaky" {
+		t.Fatalf("expected [fast slow flaky], got %v", ids)
+	}
+
+	contracts := []*core.Contract{{ProviderID: "flaky"}, {ProviderID: "slow"}, {ProviderID: "fast"}}
+	ranked := rep.rankContracts(contracts)
+	if ranked[0].ProviderID != "fast" || ranked[1].ProviderID != "slow" || ranked[2].ProviderID != "flaky" {
+		t.Fatalf("expected contracts ranked fast, slow, flaky, got %v", ranked)
+	}
+}
+
+func TestUnavailableCountsAsDialFailure(t *testing.T) {
+	rep := newTestReputation(t)
+	p := &monitoredProvider{id: "provider", rep: rep}
+	ctx := context.Background()
+	p.record(ctx, time.Now(), status.Error(codes.Unavailable, "connection refused"), storeFailure)
+	p.record(ctx, time.Now(), errors.New("disk full"), storeFailure)
+	stats := rep.snapshot("provider")
+	if math.Round(stats.DialFailures) != 1 || math.Round(stats.StoreFailures) != 1 {
+		t.Fatalf("expected 1 dial failure and 1 store failure, got %+v", stats)
+	}
+}
@@ -0,0 +1,161 @@
+package repo
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+	"io/ioutil"
+	"log"
+	"net"
+	"path"
+	core "skybin/core/proto"
+	"skybin/provider/chaos"
+	local "skybin/provider/local"
+	"skybin/provider/server"
+	"testing"
+)
+
+// Terms of test providers.
+const (
+	testCurrency    = "USD"
+	testStorageRate = 2000000  // 2 USD per GB-month
+	testEgressRate  = 10000000 // 10 USD per GB
+	testMinDuration = 7 * secondsPerDay
+)
+
+// testProvider is a provider in a testNet.
+type testProvider struct {
+	info     core.PeerInfo
+	chaos    *chaos.Provider // Injects faults into requests to the provider
+	store    local.BlockStore
+	listener *bufconn.Listener
+	server   *grpc.Server
+}
+
+// stop shuts down the provider's server. Later dials to it fail.
+func (p *testProvider) stop() {
+	p.server.Stop()
+}
+
+// testNet is a network of in-memory providers serving a temporary repo.
+type testNet struct {
+	t         *testing.T
+	providers []*testProvider
+	repo      *repo
+}
+
+// newTestNet starts n providers, each a local provider behind the gRPC server
+// listening on an in-memory connection, and creates a repo that knows about
+// them. Everything is torn down when the test finishes.
+func newTestNet(t *testing.T, n int) *testNet {
+	tn := &testNet{t: t}
+
+	for i := 0; i < n; i++ {
+		tn.providers = append(tn.providers, tn.startProvider(i))
+	}
+
+	homedir := path.Join(t.TempDir(), "repo")
+	Init(homedir)
+	r, err := OpenAt(homedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tn.repo = r.(*repo)
+	tn.repo.dial = tn.dial
+	t.Cleanup(func() { tn.repo.Close() })
+
+	var pinfos []core.PeerInfo
+	for _, p := range tn.providers {
+		pinfos = append(pinfos, p.info)
+	}
+	err = tn.repo.saveProviders(pinfos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tn
+}
+
+func (tn *testNet) startProvider(i int) *testProvider {
+	store, err := local.OpenBlockStore(local.ShardedStore, tn.t.TempDir())
+	if err != nil {
+		tn.t.Fatal(err)
+	}
+	tn.t.Cleanup(func() { store.Close() })
+
+	info := core.PeerInfo{
+		ID:   fmt.Sprintf("provider%d", i),
+		Addr: fmt.Sprintf("provider%d:8002", i),
+	}
+	pvdr, err := local.New(local.Options{
+		ProviderInfo: core.ProviderInfo{
+			ID:           info.ID,
+			MaxBlockSize: 1 << 30,
+			Currency:     testCurrency,
+			StorageRate:  testStorageRate,
+			EgressRate:   testEgressRate,
+			MinDuration:  testMinDuration,
+		},
+		Store: store,
+	})
+	if err != nil {
+		tn.t.Fatal(err)
+	}
+
+	faulty := chaos.New(pvdr, nil)
+
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer()
+	core.RegisterProviderServer(grpcServer, server.New(faulty, log.New(ioutil.Discard, "", 0)))
+	go grpcServer.Serve(listener)
+	tn.t.Cleanup(grpcServer.Stop)
+
+	return &testProvider{
+		info:     info,
+		chaos:    faulty,
+		store:    store,
+		listener: listener,
+		server:   grpcServer,
+	}
+}
+
+// provider returns the provider with the given ID.
+func (tn *testNet) provider(id string) *testProvider {
+	for _, p := range tn.providers {
+		if p.info.ID == id {
+			return p
+		}
+	}
+	tn.t.Fatalf("no test provider with ID %s", id)
+	return nil
+}
+
+// dial connects to a provider in the network by address.
+func (tn *testNet) dial(ctx context.Context, addr string) (net.Conn, error) {
+	for _, p := range tn.providers {
+		if p.info.Addr == addr {
+			return p.listener.Dial()
+		}
+	}
+	return nil, fmt.Errorf("no test provider at %s", addr)
+}
+
+// setConfig updates the repo's config.
+func (tn *testNet) setConfig(update func(config *Config)) {
+	config := *tn.repo.config
+	update(&config)
+	err := tn.repo.SaveConfig(&config)
+	if err != nil {
+		tn.t.Fatal(err)
+	}
+}
+
+// writeFile creates a temporary file with the given contents.
+func (tn *testNet) writeFile(data []byte) string {
+	filename := path.Join(tn.t.TempDir(), "file")
+	err := ioutil.WriteFile(filename, data, 0600)
+	if err != nil {
+		tn.t.Fatal(err)
+	}
+	return filename
+}
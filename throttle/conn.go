@@ -0,0 +1,110 @@
+package throttle
+
+import (
+	"golang.org/x/net/context"
+	"net"
+)
+
+// chunkSize is the most data a throttled connection reads or writes at a
+// time, so that a transfer is held to its limit as it streams rather than
+// after it completes.
+const chunkSize = 16 * 1024
+
+// Listen returns a listener whose connections are limited by upload as they
+// are written to and by download as they are read from, each connection's
+// remote host being the peer.
+func Listen(l net.Listener, upload *Group, download *Group) net.Listener {
+	return &listener{Listener: l, upload: upload, download: download}
+}
+
+type listener struct {
+	net.Listener
+	upload   *Group
+	download *Group
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(c, remoteHost(c), l.upload, l.download), nil
+}
+
+func remoteHost(c net.Conn) string {
+	addr := c.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// Conn is a connection limited in chunks by the upload group as it is
+// written to and by the download group as it is read from.
+type Conn struct {
+	net.Conn
+	peer     string
+	upload   *Group
+	download *Group
+	ctx      context.Context // Canceled when the connection is closed
+	cancel   context.CancelFunc
+}
+
+// NewConn limits c as a connection to peer. Either group may be nil to leave
+// that direction unlimited.
+func NewConn(c net.Conn, peer string, upload *Group, download *Group) *Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Conn{
+		Conn:     c,
+		peer:     peer,
+		upload:   upload,
+		download: download,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Read reads at most a chunk, then waits until the data read is within the
+// download limit. Data not yet read is held back by the transport's flow
+// control.
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(p) > chunkSize {
+		p = p[:chunkSize]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		if werr := c.download.Wait(c.ctx, c.peer, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// Write writes p a chunk at a time, waiting for the upload limit before
+// each.
+func (c *Conn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > chunkSize {
+			n = chunkSize
+		}
+		err := c.upload.Wait(c.ctx, c.peer, n)
+		if err != nil {
+			return written, err
+		}
+		n, err = c.Conn.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (c *Conn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
@@ -0,0 +1,140 @@
+package throttle
+
+import (
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+	"sync"
+	"time"
+)
+
+// minBurst is the smallest burst size given to a limiter. Transfers larger
+// than a limiter's burst are waited for in burst-sized chunks.
+const minBurst = 64 * 1024
+
+// peerIdleTime is how long a group keeps the limiter of a peer that has
+// transferred nothing.
+const peerIdleTime = 10 * time.Minute
+
+// Limiter limits the rate at which bytes are transferred. A rate of zero
+// means unlimited. Limiters are safe for concurrent use and their rate may be
+// changed while transfers are in progress.
+type Limiter struct {
+	lim *rate.Limiter
+}
+
+func NewLimiter(bytesPerSec int64) *Limiter {
+	l := &Limiter{lim: rate.NewLimiter(rate.Inf, minBurst)}
+	l.SetRate(bytesPerSec)
+	return l
+}
+
+// SetRate changes the limiter's rate in bytes per second.
+func (l *Limiter) SetRate(bytesPerSec int64) {
+	if bytesPerSec <= 0 {
+		l.lim.SetLimit(rate.Inf)
+		return
+	}
+	burst := int(bytesPerSec)
+	if burst < minBurst {
+		burst = minBurst
+	}
+	l.lim.SetBurst(burst)
+	l.lim.SetLimit(rate.Limit(bytesPerSec))
+}
+
+// Wait blocks until n bytes may be transferred or ctx is done.
+func (l *Limiter) Wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	for n > 0 {
+		if l.lim.Limit() == rate.Inf {
+			return nil
+		}
+		chunk := n
+		if burst := l.lim.Burst(); chunk > burst {
+			chunk = burst
+		}
+		err := l.lim.WaitN(ctx, chunk)
+		if err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// Group limits transfers both in aggregate and per peer. Peers are forgotten
+// once idle, and start again with a full burst.
+type Group struct {
+	mu       sync.Mutex
+	global   *Limiter
+	peerRate int64
+	peers    map[string]*peerLimiter
+}
+
+type peerLimiter struct {
+	*Limiter
+	active   int       // Transfers waiting on the limiter
+	lastUsed time.Time // When a transfer last finished waiting
+}
+
+// NewGroup creates a group with the given aggregate and per-peer rates in
+// bytes per second. A rate of zero means unlimited.
+func NewGroup(globalRate int64, peerRate int64) *Group {
+	return &Group{
+		global:   NewLimiter(globalRate),
+		peerRate: peerRate,
+		peers:    make(map[string]*peerLimiter),
+	}
+}
+
+// SetRates changes the group's aggregate and per-peer rates.
+func (g *Group) SetRates(globalRate int64, peerRate int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.global.SetRate(globalRate)
+	g.peerRate = peerRate
+	for _, lim := range g.peers {
+		lim.SetRate(peerRate)
+	}
+}
+
+// Wait blocks until n bytes may be transferred to or from the given peer, or
+// ctx is done.
+func (g *Group) Wait(ctx context.Context, peer string, n int) error {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	lim, exists := g.peers[peer]
+	if !exists {
+		g.evictIdle()
+		lim = &peerLimiter{Limiter: NewLimiter(g.peerRate)}
+		g.peers[peer] = lim
+	}
+	lim.active++
+	g.mu.Unlock()
+
+	err := lim.Wait(ctx, n)
+	g.mu.Lock()
+	lim.active--
+	lim.lastUsed = time.Now()
+	g.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return g.global.Wait(ctx, n)
+}
+
+// evictIdle forgets the peers idle for longer than peerIdleTime. It is
+// called as peers are added, so the group's size is bounded by the peers
+// seen recently.
+func (g *Group) evictIdle() {
+	now := time.Now()
+	for peer, lim := range g.peers {
+		if lim.active == 0 && now.Sub(lim.lastUsed) > peerIdleTime {
+			delete(g.peers, peer)
+		}
+	}
+}
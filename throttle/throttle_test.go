@@ -0,0 +1,155 @@
+package throttle
+
+import (
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testRate = 64 * 1024
+
+// timeWaits returns how long it takes for each of the given peers to wait
+// for n bytes at once.
+func timeWaits(t *testing.T, g *Group, n int, peers ...string) time.Duration {
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			err := g.Wait(context.Background(), peer, n)
+			if err != nil {
+				t.Error(err)
+			}
+		}(peer)
+	}
+	wg.Wait()
+	return time.Since(start)
+}
+
+func checkElapsed(t *testing.T, elapsed time.Duration, min time.Duration, max time.Duration) {
+	if elapsed < min || elapsed > max {
+		t.Fatalf("took %s, expected between %s and %s", elapsed, min, max)
+	}
+}
+
+func TestLimiterRate(t *testing.T) {
+	l := NewLimiter(testRate)
+
+	// The first burst passes at once; the rest waits for the limit.
+	start := time.Now()
+	err := l.Wait(context.Background(), 3*testRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkElapsed(t, time.Since(start), 1800*time.Millisecond, 3*time.Second)
+}
+
+func TestLimiterUnlimited(t *testing.T) {
+	l := NewLimiter(0)
+	start := time.Now()
+	err := l.Wait(context.Background(), 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkElapsed(t, time.Since(start), 0, 100*time.Millisecond)
+}
+
+func TestLimiterWaitCanceled(t *testing.T) {
+	l := NewLimiter(testRate)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := l.Wait(ctx, 10*testRate)
+	if err == nil {
+		t.Fatal("expected wait past the deadline to fail")
+	}
+}
+
+func TestGroupPeerLimit(t *testing.T) {
+	g := NewGroup(0, testRate)
+
+	// Each peer has its own limit, so two peers take as long as one.
+	elapsed := timeWaits(t, g, 2*testRate, "peer1", "peer2")
+	checkElapsed(t, elapsed, 800*time.Millisecond, 1800*time.Millisecond)
+
+	// A peer's transfers share its limit.
+	elapsed = timeWaits(t, g, testRate, "peer1", "peer1")
+	checkElapsed(t, elapsed, 1800*time.Millisecond, 3*time.Second)
+}
+
+func TestGroupGlobalLimit(t *testing.T) {
+	g := NewGroup(testRate, 0)
+
+	// The peers share the group's limit.
+	elapsed := timeWaits(t, g, testRate, "peer1", "peer2", "peer3")
+	checkElapsed(t, elapsed, 1800*time.Millisecond, 3*time.Second)
+}
+
+func TestGroupSetRates(t *testing.T) {
+	g := NewGroup(0, testRate)
+	timeWaits(t, g, testRate, "peer1")
+	g.SetRates(0, 0)
+	elapsed := timeWaits(t, g, 10*testRate, "peer1")
+	checkElapsed(t, elapsed, 0, 100*time.Millisecond)
+}
+
+func TestGroupEvictsIdlePeers(t *testing.T) {
+	g := NewGroup(0, testRate)
+	timeWaits(t, g, 1, "idle", "recent")
+	g.peers["idle"].lastUsed = time.Now().Add(-2 * peerIdleTime)
+
+	timeWaits(t, g, 1, "new")
+	if _, exists := g.peers["idle"]; exists {
+		t.Fatal("expected idle peer to be evicted")
+	}
+	if len(g.peers) != 2 {
+		t.Fatalf("expected recent and new peers to be kept, have %d peers", len(g.peers))
+	}
+}
+
+func TestListenerThrottlesInChunks(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	download := NewGroup(testRate, 0)
+	l = Listen(l, nil, download)
+
+	const size = 3 * testRate
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		conn.Write(make([]byte, size))
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The data is held to the limit as it arrives, not after all of it
+	// has been read.
+	start := time.Now()
+	_, err = io.ReadFull(conn, make([]byte, testRate+chunkSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkElapsed(t, time.Since(start), 0, 800*time.Millisecond)
+	n, err := io.Copy(ioutil.Discard, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != size-testRate-chunkSize {
+		t.Fatalf("read %d bytes, expected %d", n, size-testRate-chunkSize)
+	}
+	checkElapsed(t, time.Since(start), 1800*time.Millisecond, 3*time.Second)
+}